@@ -0,0 +1,205 @@
+package main
+
+import (
+	"flag"
+	"log"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/vmihailenco/msgpack/v4"
+)
+
+// Packets sent back to back come out of the slowest link on the way spaced
+// by how long it takes to send one on it. So a train of them, timed as they
+// come in, gives the capacity of the bottleneck, in each direction on its own
+// as each end times what the other sends. Cross traffic squeezes trains up
+// or spreads them out, so an estimate is the median of a lot of pairs.
+
+var capacityInterval = flag.Duration("capacity.interval", 10*time.Second, "How often sping peers with capacity set send a train of packets to estimate capacity")
+var capacityTrain = flag.Int("capacity.train", 10, "How many packets are in each capacity estimation train")
+var capacitySize = flag.Int("capacity.size", 1200, "How big (as IP packets) the packets in a capacity estimation train are")
+
+// capacityWindow is how many pair estimates the capacity is the median of
+const capacityWindow = 100
+
+// capacityMinSamples is how many pairs it takes before there is an estimate
+const capacityMinSamples = 10
+
+// trainStruct is a packet in a capacity estimation train, the tags can't be ones pingStruct uses for something else
+type trainStruct struct {
+	Type    uint8  `msgpack:"Y"` // MUST be 'p' for a train packet
+	Magic   uint16 `msgpack:"M"`
+	Session uint32 `msgpack:"S"`
+	Train   uint16 `msgpack:"R"`
+	Index   uint8  `msgpack:"Z"`
+	Count   uint8  `msgpack:"C"`
+	Padding []byte `msgpack:"P"`
+}
+
+type trainArrival struct {
+	index int
+	at    time.Time
+	size  int
+}
+
+// capacityEstimator is the state of capacity estimation for a session
+type capacityEstimator struct {
+	mu sync.Mutex
+
+	train uint16 // The last train we sent
+
+	rxTrain    uint16
+	rxCount    int
+	rxDone     bool
+	rxArrivals []trainArrival
+	samples    []float64 // In bits per second
+
+	RX float64 // bits per second, 0 if not known yet
+	TX float64 // As the peer has worked it out
+}
+
+func newCapacityEstimator(enabled bool) *capacityEstimator {
+	if !enabled {
+		return nil
+	}
+	return &capacityEstimator{}
+}
+
+// runCapacityTrains sends a train every -capacity.interval, for as long as the session lasts
+func (s *session) runCapacityTrains() {
+	for {
+		clock.Sleep(*capacityInterval)
+		if clock.Since(s.LastRX) > time.Minute {
+			return
+		}
+		if err := s.sendTrain(); err != nil {
+			log.Printf("[%s] Capacity train failed: %v", s.PeerAddress, err)
+		}
+	}
+}
+
+// sendTrain sends a train of packets to the peer, back to back
+func (s *session) sendTrain() error {
+	if s.ReplyTo == nil {
+		return nil
+	}
+	c := s.capacity
+	c.mu.Lock()
+	c.train++
+	train := c.train
+	c.mu.Unlock()
+
+	count := *capacityTrain
+	if count < 2 || count > 255 {
+		count = 10
+	}
+	packets := make([][]byte, count)
+	for i := range packets {
+		pkt := trainStruct{Type: 'p', Magic: 11181, Session: s.SessionID, Train: train, Index: uint8(i), Count: uint8(count)}
+		b, err := marshalPadded(func(pad []byte) interface{} {
+			pkt.Padding = pad
+			return pkt
+		}, *capacitySize-headerLen(s.ReplyTo.IP))
+		if err != nil {
+			return err
+		}
+		packets[i] = b
+	}
+	// Made up front, so nothing but the writes comes between them
+	for _, b := range packets {
+		if _, err := writeToFrom(s.ReplyWith, b, s.ReplyTo, s.Class.TOS, s.ReplyFrom); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// receiveTrainPacket records a packet of a train from the peer, that came in at at
+func (s *session) receiveTrainPacket(buf []byte, at time.Time, size int) {
+	if s.capacity == nil {
+		return
+	}
+	pkt := trainStruct{}
+	if err := msgpack.Unmarshal(buf, &pkt); err != nil {
+		return
+	}
+	c := s.capacity
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if pkt.Train != c.rxTrain {
+		c.finishTrain()
+		c.rxTrain, c.rxCount, c.rxDone, c.rxArrivals = pkt.Train, int(pkt.Count), false, nil
+	}
+	if c.rxDone {
+		return
+	}
+	c.rxArrivals = append(c.rxArrivals, trainArrival{index: int(pkt.Index), at: at, size: size})
+	if int(pkt.Index) == c.rxCount-1 {
+		c.finishTrain()
+	}
+}
+
+// finishTrain takes the pairs from the train that has come in, mu must be held
+func (c *capacityEstimator) finishTrain() {
+	if c.rxDone || len(c.rxArrivals) < 2 {
+		c.rxDone = true
+		return
+	}
+	c.rxDone = true
+
+	a := c.rxArrivals
+	sort.Slice(a, func(i, j int) bool { return a[i].index < a[j].index })
+	for i := 1; i < len(a); i++ {
+		if a[i].index != a[i-1].index+1 {
+			continue // One went missing between them
+		}
+		gap := a[i].at.Sub(a[i-1].at)
+		if gap < time.Microsecond {
+			continue // Reordered, or too close together to tell
+		}
+		c.samples = append(c.samples, float64(a[i].size*8)/gap.Seconds())
+	}
+	if len(c.samples) > capacityWindow {
+		c.samples = c.samples[len(c.samples)-capacityWindow:]
+	}
+	if len(c.samples) >= capacityMinSamples {
+		c.RX = medianFloat(c.samples)
+	}
+}
+
+func medianFloat(f []float64) float64 {
+	s := make([]float64, len(f))
+	copy(s, f)
+	sort.Float64s(s)
+	return s[len(s)/2]
+}
+
+// capacityReport fills in what a ping tells the peer about its trains
+func (s *session) capacityReport(p *pingStruct) {
+	c := s.capacity
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	p.Capacity = uint64(c.RX)
+}
+
+// observeCapacityReport takes in what the peer has worked out from our trains
+func (s *session) observeCapacityReport(p pingStruct) {
+	c := s.capacity
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.TX = float64(p.Capacity)
+}
+
+// export sets the capacity metrics for a session
+func (c *capacityEstimator) export(host, class, flow, transport, listener string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.RX != 0 {
+		promCapacity.WithLabelValues("rx", host, class, flow, transport, listener).Set(c.RX)
+	}
+	if c.TX != 0 {
+		promCapacity.WithLabelValues("tx", host, class, flow, transport, listener).Set(c.TX)
+	}
+}
@@ -0,0 +1,56 @@
+package main
+
+import (
+	"math"
+	"testing"
+	"time"
+)
+
+func TestSimCapacity(t *testing.T) {
+	// Like ADSL, much faster down than up
+	p, done := newSimPair(&simLink{Delay: 20 * time.Millisecond, Rate: 1e6}, &simLink{Delay: 20 * time.Millisecond, Rate: 20e6})
+	defer done()
+	p.local.capacity = &capacityEstimator{}
+	p.remote.capacity = &capacityEstimator{}
+
+	p.run(2)
+	for i := 0; i < 4; i++ {
+		if err := p.local.sendTrain(); err != nil {
+			t.Fatal(err)
+		}
+		if err := p.remote.sendTrain(); err != nil {
+			t.Fatal(err)
+		}
+		p.run(2)
+	}
+
+	c := p.local.capacity
+	if math.Abs(c.TX-1e6)/1e6 > 0.01 {
+		t.Fatalf("tx capacity came out as %.0f, want 1Mbit/s", c.TX)
+	}
+	if math.Abs(c.RX-20e6)/20e6 > 0.01 {
+		t.Fatalf("rx capacity came out as %.0f, want 20Mbit/s", c.RX)
+	}
+}
+
+func TestCapacityLostPackets(t *testing.T) {
+	c := &capacityEstimator{}
+	start := time.Unix(1600000000, 0)
+	// 1000 byte packets 1ms apart is 8Mbit/s, with the 3rd lost
+	for train := uint16(1); train <= 3; train++ {
+		c.rxTrain, c.rxCount, c.rxDone, c.rxArrivals = train, 8, false, nil
+		for i := 0; i < 8; i++ {
+			if i == 2 {
+				continue
+			}
+			c.rxArrivals = append(c.rxArrivals, trainArrival{index: i, at: start.Add(time.Duration(i) * time.Millisecond), size: 1000})
+		}
+		c.finishTrain()
+	}
+	if len(c.samples) != 15 {
+		t.Fatalf("got %d pairs, want 15 (5 from each train)", len(c.samples))
+	}
+	if c.RX != 8e6 {
+		t.Fatalf("capacity came out as %.0f, want 8Mbit/s", c.RX)
+	}
+}
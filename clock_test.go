@@ -0,0 +1,83 @@
+package main
+
+import (
+	"sort"
+	"sync"
+	"time"
+)
+
+// fakeClock is a Clock that only moves when told to. Anything sleeping on it
+// wakes up once Set or Advance moves the time past when it was due.
+type fakeClock struct {
+	mu      sync.Mutex
+	now     time.Time
+	waiters []fakeWaiter
+}
+
+type fakeWaiter struct {
+	until time.Time
+	ch    chan time.Time
+}
+
+func newFakeClock(start time.Time) *fakeClock {
+	return &fakeClock{now: start}
+}
+
+func (f *fakeClock) Now() time.Time {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.now
+}
+
+func (f *fakeClock) Since(t time.Time) time.Duration { return f.Now().Sub(t) }
+func (f *fakeClock) Until(t time.Time) time.Duration { return t.Sub(f.Now()) }
+func (f *fakeClock) Sleep(d time.Duration)           { <-f.After(d) }
+
+func (f *fakeClock) After(d time.Duration) <-chan time.Time {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	ch := make(chan time.Time, 1)
+	if d <= 0 {
+		ch <- f.now
+		return ch
+	}
+	f.waiters = append(f.waiters, fakeWaiter{until: f.now.Add(d), ch: ch})
+	return ch
+}
+
+// Advance moves the clock forward by d
+func (f *fakeClock) Advance(d time.Duration) {
+	f.Set(f.Now().Add(d))
+}
+
+// Set moves the clock to t, waking anything that was due by then. The clock
+// never goes backwards through Set, use Step for that.
+func (f *fakeClock) Set(t time.Time) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if t.Before(f.now) {
+		return
+	}
+	f.now = t
+
+	sort.SliceStable(f.waiters, func(i, j int) bool { return f.waiters[i].until.Before(f.waiters[j].until) })
+	n := 0
+	for _, w := range f.waiters {
+		if w.until.After(t) {
+			f.waiters[n] = w
+			n++
+			continue
+		}
+		w.ch <- t
+	}
+	f.waiters = f.waiters[:n]
+}
+
+// Step jumps the clock by d (which may be negative) without waking anything,
+// like ntpd stepping the system clock would
+func (f *fakeClock) Step(d time.Duration) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.now = f.now.Add(d)
+}
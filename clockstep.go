@@ -0,0 +1,196 @@
+package main
+
+import (
+	"flag"
+	"log"
+	"sort"
+	"sync"
+	"time"
+)
+
+var clockStepThreshold = flag.Duration("clockstep.threshold", 20*time.Millisecond, "How big a jump in a clock counts as a step")
+var clockStepQuarantine = flag.Duration("clockstep.quarantine", 40*time.Second, "How long to hold back samples after a clock step (should cover the 32 ack window)")
+var leapSmearWindow = flag.Duration("leap.smear-window", 24*time.Hour, "How long leap second smearing by a peer may last, centered on the leap second")
+
+// Local clock steps are detected by comparing how far the wall clock has
+// moved vs how far the monotonic clock has moved. The two only disagree if
+// something (ntpd, date, a leap second) has stepped the wall clock.
+
+var localQuarantinedUntil time.Time
+var localQuarantineLock sync.RWMutex
+
+// This has to use the real clock rather than the sping Clock, since it is the
+// real clock's monotonic reading we are comparing against.
+func watchLocalClockSteps() {
+	last := time.Now()
+	for {
+		time.Sleep(time.Second)
+		now := time.Now()
+
+		step := localClockStep(last, now)
+		if step > *clockStepThreshold || step < -*clockStepThreshold {
+			log.Printf("Local clock stepped by %s, quarantining samples for %s", step, *clockStepQuarantine)
+			promClockSteps.WithLabelValues("local-step", "").Inc()
+
+			localQuarantineLock.Lock()
+			localQuarantinedUntil = now.Add(*clockStepQuarantine)
+			localQuarantineLock.Unlock()
+		}
+
+		checkLeapSecond(now)
+		last = now
+	}
+}
+
+// localClockStep returns how much the wall clock moved beyond the monotonic clock between two readings
+func localClockStep(before, after time.Time) time.Duration {
+	monotonic := after.Sub(before)
+	wall := after.Round(0).Sub(before.Round(0))
+	return wall - monotonic
+}
+
+func localClockQuarantined(now time.Time) bool {
+	localQuarantineLock.RLock()
+	defer localQuarantineLock.RUnlock()
+	return now.Before(localQuarantinedUntil)
+}
+
+// Leap second handling. A peer that smears the leap second will drift away
+// from us by up to a second over the smear window, which would look like a
+// very slow (or, with a short smear, fast) peer clock step. When we know a
+// leap second is close, sessions drifting like that are quarantined and
+// logged as smearing instead.
+
+var leapSecondAt time.Time
+var leapSecondLock sync.RWMutex
+
+// checkLeapSecond asks the kernel if a leap second is scheduled (or just happened), and remembers when
+func checkLeapSecond(now time.Time) {
+	pending, inProgress := kernelLeapStatus()
+	if !pending && !inProgress {
+		return
+	}
+
+	// Leap seconds are always applied at the end of the UTC day
+	at := now.UTC().Truncate(24 * time.Hour)
+	if pending {
+		at = at.Add(24 * time.Hour)
+	}
+
+	leapSecondLock.Lock()
+	if !leapSecondAt.Equal(at) {
+		log.Printf("Leap second scheduled for %s, tolerating peer clock smearing around it", at)
+		promLeapSecond.Set(float64(at.Unix()))
+	}
+	leapSecondAt = at
+	leapSecondLock.Unlock()
+}
+
+// inLeapSmearWindow returns true if a peer could be smearing a leap second at now
+func inLeapSmearWindow(now time.Time) bool {
+	leapSecondLock.RLock()
+	at := leapSecondAt
+	leapSecondLock.RUnlock()
+
+	if at.IsZero() {
+		return false
+	}
+	d := now.Sub(at)
+	return d > -*leapSmearWindow/2 && d < *leapSmearWindow/2
+}
+
+// Peer clock steps show up as a sudden shift in the implied clock offset
+// ((forward - reverse) / 2) while the round trip time stays the same, since
+// one direction gets longer by exactly as much as the other gets shorter.
+
+const peerStepHistory = 16 // How many samples make up the baseline
+const peerStepConfirm = 3  // How many shifted samples in a row are needed to call a step
+
+type clockStepDetector struct {
+	offsets []time.Duration
+	rtts    []time.Duration
+	shifted int
+
+	// The offset from before the leap smear window, to compare drift against
+	anchor   time.Duration
+	anchored bool
+
+	quarantinedUntil time.Time
+	smearing         bool
+}
+
+// observe feeds a new forward / reverse delay pair in, and returns true if the
+// sample should be quarantined. event is set to "peer-step" or "leap-smear"
+// when one has just been detected, with shift being the change in offset
+func (c *clockStepDetector) observe(now time.Time, forward, reverse time.Duration) (quarantine bool, event string, shift time.Duration) {
+	offset := (forward - reverse) / 2
+	rtt := forward + reverse
+
+	inSmear := inLeapSmearWindow(now)
+	if !inSmear {
+		c.smearing = false
+		if len(c.offsets) != 0 {
+			c.anchor = medianDuration(c.offsets)
+			c.anchored = true
+		}
+	}
+
+	if len(c.offsets) >= peerStepConfirm {
+		offsetChange := offset - medianDuration(c.offsets)
+		rttChange := rtt - medianDuration(c.rtts)
+
+		if absDuration(offsetChange) > *clockStepThreshold && absDuration(rttChange) < absDuration(offsetChange)/2 {
+			c.shifted++
+			if c.shifted < peerStepConfirm {
+				// Could be a one off, don't let it into the baseline until we know
+				return true, "", 0
+			}
+
+			// Start the baseline again from the new offset
+			event = "peer-step"
+			shift = offsetChange
+			c.offsets = c.offsets[:0]
+			c.rtts = c.rtts[:0]
+			c.shifted = 0
+			c.quarantinedUntil = now.Add(*clockStepQuarantine)
+		} else {
+			c.shifted = 0
+		}
+	}
+
+	c.offsets = append(c.offsets, offset)
+	c.rtts = append(c.rtts, rtt)
+	if len(c.offsets) > peerStepHistory {
+		c.offsets = c.offsets[1:]
+		c.rtts = c.rtts[1:]
+	}
+
+	if inSmear && c.anchored && absDuration(offset-c.anchor) > *clockStepThreshold {
+		if !c.smearing && event == "" {
+			event = "leap-smear"
+			shift = offset - c.anchor
+		}
+		c.smearing = true
+	}
+
+	return c.smearing || now.Before(c.quarantinedUntil), event, shift
+}
+
+// quarantined returns true if samples from this session should be held back at now
+func (c *clockStepDetector) quarantined(now time.Time) bool {
+	return c.smearing || now.Before(c.quarantinedUntil) || localClockQuarantined(now)
+}
+
+func medianDuration(d []time.Duration) time.Duration {
+	s := make([]time.Duration, len(d))
+	copy(s, d)
+	sort.Slice(s, func(i, j int) bool { return s[i] < s[j] })
+	return s[len(s)/2]
+}
+
+func absDuration(d time.Duration) time.Duration {
+	if d < 0 {
+		return -d
+	}
+	return d
+}
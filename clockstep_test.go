@@ -0,0 +1,102 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestPeerClockStep(t *testing.T) {
+	c := clockStepDetector{}
+	now := time.Unix(1600000000, 0)
+	fwd, rev := 10*time.Millisecond, 12*time.Millisecond
+
+	for i := 0; i < 10; i++ {
+		now = now.Add(time.Second)
+		if q, event, _ := c.observe(now, fwd, rev); q || event != "" {
+			t.Fatalf("steady sample %d was quarantined (%s)", i, event)
+		}
+	}
+
+	// The peer clock jumps 100ms, so one direction looks longer and the other shorter
+	events := 0
+	for i := 0; i < 5; i++ {
+		now = now.Add(time.Second)
+		q, event, shift := c.observe(now, fwd+100*time.Millisecond, rev-100*time.Millisecond)
+		if !q {
+			t.Fatalf("sample %d after the step was not quarantined", i)
+		}
+		if event != "" {
+			events++
+			if event != "peer-step" || shift != 100*time.Millisecond {
+				t.Fatalf("got event %s with shift %s, want peer-step with 100ms", event, shift)
+			}
+		}
+	}
+	if events != 1 {
+		t.Fatalf("got %d step events, want 1", events)
+	}
+
+	if !c.quarantined(now.Add(*clockStepQuarantine - 3*time.Second)) {
+		t.Fatalf("quarantine ended too early")
+	}
+	if c.quarantined(now.Add(*clockStepQuarantine + time.Second)) {
+		t.Fatalf("quarantine did not end")
+	}
+}
+
+func TestPeerClockStepIgnoresDelaySpikes(t *testing.T) {
+	c := clockStepDetector{}
+	now := time.Unix(1600000000, 0)
+
+	for i := 0; i < 10; i++ {
+		now = now.Add(time.Second)
+		c.observe(now, 10*time.Millisecond, 10*time.Millisecond)
+	}
+
+	// Queueing in one direction moves the RTT too, so is not a clock step
+	for i := 0; i < 10; i++ {
+		now = now.Add(time.Second)
+		if q, event, _ := c.observe(now, 200*time.Millisecond, 10*time.Millisecond); q || event != "" {
+			t.Fatalf("delay spike %d was treated as a clock step (%s)", i, event)
+		}
+	}
+}
+
+func TestLeapSmear(t *testing.T) {
+	leap := time.Unix(1483228800, 0) // 2017-01-01, the last leap second
+	leapSecondLock.Lock()
+	leapSecondAt = leap
+	leapSecondLock.Unlock()
+	defer func() {
+		leapSecondLock.Lock()
+		leapSecondAt = time.Time{}
+		leapSecondLock.Unlock()
+	}()
+
+	c := clockStepDetector{}
+	now := leap.Add(-*leapSmearWindow)
+	for i := 0; i < 10; i++ {
+		now = now.Add(time.Second)
+		c.observe(now, 10*time.Millisecond, 10*time.Millisecond)
+	}
+
+	// Inside the window, a smearing peer slowly drifts away from us
+	now = leap.Add(-*leapSmearWindow / 2)
+	drift := time.Duration(0)
+	var events []string
+	for i := 0; i < 600; i++ {
+		now = now.Add(time.Second)
+		drift += 100 * time.Microsecond
+		_, event, _ := c.observe(now, 10*time.Millisecond+drift, 10*time.Millisecond-drift)
+		if event != "" {
+			events = append(events, event)
+		}
+	}
+
+	if len(events) != 1 || events[0] != "leap-smear" {
+		t.Fatalf("got events %v, want a single leap-smear", events)
+	}
+	if !c.quarantined(now) {
+		t.Fatalf("smearing peer is not quarantined")
+	}
+}
@@ -0,0 +1,164 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"net"
+	"strconv"
+	"strings"
+)
+
+// sping sessions can be marked with a DSCP and ECN codepoint, both ends mark
+// their pings the same way, and tell each other what TOS (or IPv6 traffic
+// class) they arrived with. That shows if a marking is being rewritten (or
+// bleached back to 0) and in which direction it happens.
+
+var dscpNames = map[string]int{
+	"cs0": 0, "cs1": 8, "cs2": 16, "cs3": 24, "cs4": 32, "cs5": 40, "cs6": 48, "cs7": 56,
+	"af11": 10, "af12": 12, "af13": 14,
+	"af21": 18, "af22": 20, "af23": 22,
+	"af31": 26, "af32": 28, "af33": 30,
+	"af41": 34, "af42": 36, "af43": 38,
+	"ef": 46, "va": 44, "le": 1,
+}
+
+var ecnNames = []string{"not-ect", "ect1", "ect0", "ce"}
+
+// trafficClass is how a session marks its pings
+type trafficClass struct {
+	Marked bool // false for a plain session, which leaves the TOS alone
+	TOS    int  // DSCP in the top 6 bits, ECN in the bottom 2
+}
+
+// String gives the class as used in the metrics, "" for a plain session
+func (c trafficClass) String() string {
+	if !c.Marked {
+		return ""
+	}
+	return tosName(c.TOS)
+}
+
+// tosName writes a TOS byte out as its DSCP name, and the ECN codepoint if it has one, like "af41/ect0"
+func tosName(tos int) string {
+	dscp := strconv.Itoa(tos >> 2)
+	for name, v := range dscpNames {
+		if v == tos>>2 {
+			dscp = name
+			break
+		}
+	}
+	if tos&3 == 0 {
+		return dscp
+	}
+	return dscp + "/" + ecnNames[tos&3]
+}
+
+func parseDSCP(s string) (int, error) {
+	if v, ok := dscpNames[strings.ToLower(s)]; ok {
+		return v, nil
+	}
+	v, err := strconv.Atoi(s)
+	if err != nil || v < 0 || v > 63 {
+		return 0, fmt.Errorf("unknown DSCP %q", s)
+	}
+	return v, nil
+}
+
+func parseECN(s string) (int, error) {
+	for v, name := range ecnNames {
+		if strings.EqualFold(s, name) {
+			return v, nil
+		}
+	}
+	return 0, fmt.Errorf("unknown ECN codepoint %q", s)
+}
+
+// trafficClasses gives the classes a sping peer should be probed with, from
+// its dscp= and ecn= options. Each is a comma separated list, and there is a
+// session for every DSCP and ECN pair. With neither there is one plain session.
+func (p peerSpec) trafficClasses() ([]trafficClass, error) {
+	dscps, ecns := []int{0}, []int{0}
+	var err error
+	if v := p.Options.Get("dscp"); v != "" {
+		if dscps, err = parseCodepoints(v, parseDSCP); err != nil {
+			return nil, err
+		}
+	}
+	if v := p.Options.Get("ecn"); v != "" {
+		if ecns, err = parseCodepoints(v, parseECN); err != nil {
+			return nil, err
+		}
+	}
+	if p.Options.Get("dscp") == "" && p.Options.Get("ecn") == "" {
+		return []trafficClass{{}}, nil
+	}
+
+	var classes []trafficClass
+	for _, d := range dscps {
+		for _, e := range ecns {
+			classes = append(classes, trafficClass{Marked: true, TOS: d<<2 | e})
+		}
+	}
+	return classes, nil
+}
+
+func parseCodepoints(s string, parse func(string) (int, error)) ([]int, error) {
+	var out []int
+	for _, v := range strings.Split(s, ",") {
+		n, err := parse(strings.TrimSpace(v))
+		if err != nil {
+			return nil, err
+		}
+		out = append(out, n)
+	}
+	return out, nil
+}
+
+// arrivedAs is what a packet sent with a TOS arrived as, ignoring congestion
+// experienced marks on ECN capable packets, since that is what ECN is for
+func arrivedAs(sent, received int) int {
+	if received&3 == 3 && sent&3 != 0 {
+		return received&^3 | sent&3
+	}
+	return received
+}
+
+// tosTracker follows the TOS a session's pings arrive with in one direction
+type tosTracker struct {
+	Known bool
+	TOS   int
+}
+
+// observeTOS feeds the TOS a ping arrived with in one direction of a marked session in, logging when it is remarked
+func (ses *session) observeTOS(direction string, tos int) {
+	t := &ses.rxTOS
+	if direction == "tx" {
+		t = &ses.txTOS
+	}
+	tos = arrivedAs(ses.Class.TOS, tos)
+	if t.Known && t.TOS == tos {
+		return
+	}
+	was := *t
+	t.Known, t.TOS = true, tos
+
+	host, class := ses.PeerAddress.String(), ses.Class.String()
+	if was.Known {
+		promRemarked.DeleteLabelValues(direction, host, class, ses.flowName(), ses.transportName(), ses.Listener, tosName(was.TOS))
+	}
+	if tos != ses.Class.TOS {
+		log.Printf("[%s] %s packets marked %s are arriving as %s", ses.PeerAddress, direction, class, tosName(tos))
+	} else if was.Known {
+		log.Printf("[%s] %s packets marked %s are arriving unchanged again", ses.PeerAddress, direction, class)
+	}
+}
+
+// tosWriter is a net.PacketConn that can send packets with a TOS (or traffic class)
+type tosWriter interface {
+	WriteToWithTOS(b []byte, addr *net.UDPAddr, tos int) (int, error)
+}
+
+// writeToWithTOS sends b to addr marked with tos, if c can do that
+func writeToWithTOS(c net.PacketConn, b []byte, addr *net.UDPAddr, tos int) (int, error) {
+	return writeToFrom(c, b, addr, tos, nil)
+}
@@ -0,0 +1,158 @@
+package main
+
+import (
+	"net"
+	"testing"
+	"time"
+)
+
+func TestTrafficClasses(t *testing.T) {
+	for _, tt := range []struct {
+		peer  string
+		names []string
+	}{
+		{"192.0.2.1", []string{""}},
+		{"sping://192.0.2.1?dscp=ef", []string{"ef"}},
+		{"sping://192.0.2.1?dscp=ef,AF41&ecn=ect0", []string{"ef/ect0", "af41/ect0"}},
+		{"sping://192.0.2.1?ecn=ect1", []string{"cs0/ect1"}},
+		{"sping://192.0.2.1?dscp=5", []string{"5"}},
+	} {
+		spec, err := parsePeerSpec(tt.peer)
+		if err != nil {
+			t.Fatal(err)
+		}
+		classes, err := spec.trafficClasses()
+		if err != nil {
+			t.Fatalf("%s: %v", tt.peer, err)
+		}
+		var names []string
+		for _, c := range classes {
+			names = append(names, c.String())
+		}
+		if len(names) != len(tt.names) {
+			t.Fatalf("%s: got classes %q, want %q", tt.peer, names, tt.names)
+		}
+		for i := range names {
+			if names[i] != tt.names[i] {
+				t.Fatalf("%s: got classes %q, want %q", tt.peer, names, tt.names)
+			}
+		}
+	}
+
+	for _, bad := range []string{"sping://192.0.2.1?dscp=64", "sping://192.0.2.1?dscp=gold", "sping://192.0.2.1?ecn=yes"} {
+		spec, _ := parsePeerSpec(bad)
+		if _, err := spec.trafficClasses(); err == nil {
+			t.Fatalf("%s was accepted", bad)
+		}
+	}
+}
+
+func TestParseInvite(t *testing.T) {
+	if o, ok := parseInvite("INVITE\r\n"); !ok || o.Class.Marked || o.Flow != 0 {
+		t.Fatalf("plain invite read as %+v (%t)", o, ok)
+	}
+	want := inviteOptions{Class: trafficClass{Marked: true, TOS: 184}, Flow: 3}
+	if o, ok := parseInvite(want.String()); !ok || o != want || o.Class.String() != "ef" {
+		t.Fatalf("%q read as %+v (%t)", want, o, ok)
+	}
+	if o, ok := parseInvite("INVITE flow=2 shiny=yes\r\n"); !ok || o.Flow != 2 {
+		t.Fatalf("invite with an unknown option read as %+v (%t)", o, ok)
+	}
+	for _, bad := range []string{"INVITE tos=300\r\n", "INVITE 184\r\n", "INVITED\r\n", "INVITE"} {
+		if _, ok := parseInvite(bad); ok {
+			t.Fatalf("%q was read", bad)
+		}
+	}
+}
+
+func TestArrivedAs(t *testing.T) {
+	ef := 46 << 2
+	for _, tt := range []struct {
+		sent, received, want int
+	}{
+		{ef, ef, ef},
+		{ef | 2, ef | 3, ef | 2}, // Congestion experienced is not a remark
+		{ef, ef | 3, ef | 3},     // But turning up on something not ECN capable is
+		{ef | 2, 0, 0},
+	} {
+		if got := arrivedAs(tt.sent, tt.received); got != tt.want {
+			t.Fatalf("%s arriving as %s came out as %s", tosName(tt.sent), tosName(tt.received), tosName(got))
+		}
+	}
+}
+
+func TestSimRemarking(t *testing.T) {
+	// The forward path bleaches the DSCP, but leaves ECN alone
+	p, done := newSimPair(
+		&simLink{Delay: 20 * time.Millisecond, Remark: func(tos int) int { return tos & 3 }},
+		&simLink{Delay: 20 * time.Millisecond},
+	)
+	defer done()
+	class := trafficClass{Marked: true, TOS: 46<<2 | 2}
+	p.local.Class, p.remote.Class = class, class
+
+	p.run(3)
+	if !p.local.txTOS.Known || p.local.txTOS.TOS != 2 {
+		t.Fatalf("tx arrived as %+v, want cs0/ect0", p.local.txTOS)
+	}
+	if !p.local.rxTOS.Known || p.local.rxTOS.TOS != class.TOS {
+		t.Fatalf("rx arrived as %+v, want it unchanged", p.local.rxTOS)
+	}
+
+	p.ab.Remark = nil
+	p.run(2)
+	if p.local.txTOS.TOS != class.TOS {
+		t.Fatalf("tx still arriving as %s after the remarking stopped", tosName(p.local.txTOS.TOS))
+	}
+}
+
+func TestTOSConn(t *testing.T) {
+	for _, addr := range []string{"127.0.0.1:0", "[::1]:0"} {
+		la, _ := net.ResolveUDPAddr("udp", addr)
+		c, err := net.ListenUDP("udp", la)
+		if err != nil {
+			t.Logf("skipping %s: %v", addr, err)
+			continue
+		}
+		rc := newRXInfoConn(c)
+
+		out, err := net.ListenUDP("udp", &net.UDPAddr{IP: la.IP})
+		if err != nil {
+			t.Fatal(err)
+		}
+		writeToWithTOS(out, []byte("hello"), c.LocalAddr().(*net.UDPAddr), 46<<2|2)
+
+		c.SetReadDeadline(time.Now().Add(time.Second))
+		buf := make([]byte, 100)
+		n, _, info, err := rc.ReadFromWithInfo(buf)
+		if err != nil || string(buf[:n]) != "hello" {
+			t.Fatalf("%s: read %q (%v)", addr, buf[:n], err)
+		}
+		if !info.TOSKnown {
+			t.Logf("%s: TOS can't be read here", addr)
+		} else if info.TOS != 46<<2|2 {
+			t.Fatalf("%s: arrived as %s, want ef/ect0", addr, tosName(info.TOS))
+		}
+		out.Close()
+		c.Close()
+	}
+}
+
+func TestRemarkedPerListener(t *testing.T) {
+	// Two sessions to the same peer with the same class, one on each uplink
+	class := trafficClass{Marked: true, TOS: 46 << 2}
+	up1 := &session{PeerAddress: net.ParseIP("192.0.2.7"), Class: class, Listener: "up1"}
+	up2 := &session{PeerAddress: net.ParseIP("192.0.2.7"), Class: class, Listener: "up2"}
+	up1.observeTOS("tx", 0)
+	up2.observeTOS("tx", 0)
+	promRemarked.WithLabelValues("tx", "192.0.2.7", "ef", "", "udp", "up1", "cs0").Set(1)
+	promRemarked.WithLabelValues("tx", "192.0.2.7", "ef", "", "udp", "up2", "cs0").Set(1)
+
+	up1.observeTOS("tx", class.TOS)
+	if promRemarked.DeleteLabelValues("tx", "192.0.2.7", "ef", "", "udp", "up1", "cs0") {
+		t.Fatalf("up1's old series is still there")
+	}
+	if !promRemarked.DeleteLabelValues("tx", "192.0.2.7", "ef", "", "udp", "up2", "cs0") {
+		t.Fatalf("up2's series went with up1's")
+	}
+}
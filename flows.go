@@ -0,0 +1,58 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"strconv"
+)
+
+// On ECMP and LAG networks each 5-tuple is hashed onto one of many paths, so
+// a single session only ever measures one of them in each direction. Giving a
+// sping peer flows=N runs N sessions, each from its own source port, which
+// the peer replies to, so both directions get spread over the paths. On Linux
+// the IPv6 flow label is hashed from the ports by default, so that differs
+// between the flows too.
+
+// maxFlows is the most flows a peer can be probed with
+const maxFlows = 64
+
+// flowCount is how many flows the peer should be probed with, from its flows= option, 0 if not given
+func (p peerSpec) flowCount() (int, error) {
+	v := p.Options.Get("flows")
+	if v == "" {
+		return 0, nil
+	}
+	n, err := strconv.Atoi(v)
+	if err != nil || n < 1 || n > maxFlows {
+		return 0, fmt.Errorf("flows must be between 1 and %d", maxFlows)
+	}
+	return n, nil
+}
+
+// listenFlow makes a socket on a new source port for a flow (or a pinned
+// session), routing what comes back to it like the main socket
+func listenFlow(bind localBinding) (*net.UDPConn, error) {
+	host, _, err := net.SplitHostPort(*bindAddr)
+	if err != nil {
+		host = "" // There is no -listenAddr listener
+	}
+	if bind.Source != nil {
+		host = bind.Source.String()
+	}
+	lc := net.ListenConfig{Control: bind.control}
+	conn, err := lc.ListenPacket(context.Background(), "udp", net.JoinHostPort(host, "0"))
+	if err != nil {
+		return nil, err
+	}
+	go routePackets(conn.(*net.UDPConn))
+	return conn.(*net.UDPConn), nil
+}
+
+// flowName is the flow label for the session's metrics, "" if it is the only flow
+func (s *session) flowName() string {
+	if s.Flow == 0 {
+		return ""
+	}
+	return strconv.Itoa(s.Flow)
+}
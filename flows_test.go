@@ -0,0 +1,81 @@
+package main
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/vmihailenco/msgpack/v4"
+)
+
+func TestFlowCount(t *testing.T) {
+	for peer, want := range map[string]int{
+		"192.0.2.1":                   0,
+		"sping://192.0.2.1?flows=8":   8,
+		"sping://192.0.2.1?flows=0":   -1,
+		"sping://192.0.2.1?flows=65":  -1,
+		"sping://192.0.2.1?flows=two": -1,
+	} {
+		spec, err := parsePeerSpec(peer)
+		if err != nil {
+			t.Fatal(err)
+		}
+		n, err := spec.flowCount()
+		if want == -1 {
+			if err == nil {
+				t.Fatalf("%s was accepted", peer)
+			}
+			continue
+		}
+		if err != nil || n != want {
+			t.Fatalf("%s gave %d flows (%v), want %d", peer, n, err, want)
+		}
+	}
+}
+
+func TestFlowHandshake(t *testing.T) {
+	oldBind := *bindAddr
+	*bindAddr = "127.0.0.1:6924"
+	defer func() { *bindAddr = oldBind }()
+
+	conn, err := listenFlow(localBinding{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	ses := &session{
+		SessionID:    7,
+		TCPActivated: true,
+		MadeByMe:     true,
+		SessionMade:  clock.Now(),
+		UDPHandshake: make(chan bool, 1),
+		ReplyWith:    conn,
+	}
+	sessionMap = map[uint32]*session{7: ses}
+
+	peer, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.ParseIP("127.0.0.1")})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer peer.Close()
+	b, _ := msgpack.Marshal(handshakeStruct{Type: 'h', Magic: 11181, Version: 3, Session: 7})
+	peer.WriteTo(b, conn.LocalAddr())
+
+	select {
+	case <-ses.UDPHandshake:
+	case <-time.After(2 * time.Second):
+		t.Fatalf("handshake never got to the session")
+	}
+	if ses.ReplyWith != conn {
+		t.Fatalf("session replies with %v, not its flow socket", ses.ReplyWith.LocalAddr())
+	}
+
+	// The peer sees the flow's port, not the main one
+	peer.SetReadDeadline(time.Now().Add(2 * time.Second))
+	_, from, err := peer.ReadFromUDP(make([]byte, 100))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if from.Port != conn.LocalAddr().(*net.UDPAddr).Port {
+		t.Fatalf("reply came from port %d, want the flow's %d", from.Port, conn.LocalAddr().(*net.UDPAddr).Port)
+	}
+}
@@ -0,0 +1,151 @@
+package main
+
+import (
+	"log"
+	"net"
+	"time"
+
+	"golang.org/x/net/ipv4"
+	"golang.org/x/net/ipv6"
+)
+
+// The TTL (or hop limit) a packet turns up with says how many hops it took to
+// get here, as long as we can guess what it started at. Peers tell each other
+// what they saw, so both directions are known, and a change in only one of
+// them is very often the reason a path has gone asymmetric.
+
+// rxInfo is what the kernel tells us about how a packet arrived
+type rxInfo struct {
+	TTL      int // 0 if not known
+	TOS      int // The TOS (or IPv6 traffic class) byte, DSCP and ECN
+	TOSKnown bool
+	Stamp    time.Time // When the kernel says it came in, zero if it doesn't
+	Dst      net.IP    // The local address it was sent to, nil if not known
+}
+
+// rxInfoConn reads packets along with the TTL and TOS they arrived with, and when
+type rxInfoConn struct {
+	*net.UDPConn
+	oob []byte
+}
+
+// newRXInfoConn asks for the TTL, TOS and destination address of received
+// packets to be given with them. On a dual stack socket both the IPv4 and IPv6
+// versions are asked for, either may not be supported, in which case they
+// just read as not known.
+func newRXInfoConn(c *net.UDPConn) *rxInfoConn {
+	ipv4.NewPacketConn(c).SetControlMessage(ipv4.FlagTTL|ipv4.FlagDst, true)
+	ipv6.NewPacketConn(c).SetControlMessage(ipv6.FlagHopLimit|ipv6.FlagDst, true)
+	enableRecvTOS(c)
+	enableRXStamps(c)
+	oob := append(ipv4.NewControlMessage(ipv4.FlagTTL|ipv4.FlagDst), ipv6.NewControlMessage(ipv6.FlagHopLimit|ipv6.FlagDst)...)
+	oob = append(oob, make([]byte, 128)...) // Room for the TOS or traffic class, and the timestamp
+	return &rxInfoConn{UDPConn: c, oob: oob}
+}
+
+// ReadFromWithInfo is ReadFrom, also giving what is known about how the packet arrived
+func (c *rxInfoConn) ReadFromWithInfo(b []byte) (n int, addr *net.UDPAddr, info rxInfo, err error) {
+	n, oobn, _, addr, err := c.ReadMsgUDP(b, c.oob)
+	if err != nil {
+		return n, addr, info, err
+	}
+	return n, addr, rxInfoFromControlMessage(c.oob[:oobn]), nil
+}
+
+// ReadFromWithTTL is ReadFrom, also giving the TTL the packet arrived with (0 if not known)
+func (c *rxInfoConn) ReadFromWithTTL(b []byte) (n int, addr *net.UDPAddr, ttl int, err error) {
+	n, addr, info, err := c.ReadFromWithInfo(b)
+	return n, addr, info.TTL, err
+}
+
+func rxInfoFromControlMessage(oob []byte) (info rxInfo) {
+	if len(oob) == 0 {
+		return info
+	}
+	var cm4 ipv4.ControlMessage
+	if cm4.Parse(oob) == nil {
+		info.TTL, info.Dst = cm4.TTL, cm4.Dst
+	}
+	var cm6 ipv6.ControlMessage
+	if cm6.Parse(oob) == nil {
+		if info.TTL == 0 {
+			info.TTL = cm6.HopLimit
+		}
+		if info.Dst == nil {
+			info.Dst = cm6.Dst
+		}
+	}
+	info.TOS, info.TOSKnown = tosFromControlMessage(oob)
+	info.Stamp, _ = stampFromControlMessage(oob)
+	return info
+}
+
+// senderTTL is the TTL to put in a STAMP/TWAMP/OWAMP reply, 255 if we don't know it
+func senderTTL(ttl int) uint8 {
+	if ttl <= 0 || ttl > 255 {
+		return 255
+	}
+	return uint8(ttl)
+}
+
+// inferHops guesses how many hops a packet took, from the TTL it arrived with.
+// Hosts start packets at 64 (Linux, BSD, macOS), 128 (Windows) or 255 (most
+// routers), so the nearest of those at or above it is taken as the start.
+func inferHops(ttl int) int {
+	if ttl <= 0 {
+		return -1
+	}
+	for _, start := range []int{32, 64, 128, 255} {
+		if ttl <= start {
+			return start - ttl
+		}
+	}
+	return -1
+}
+
+// hopTracker follows the hop count in one direction
+type hopTracker struct {
+	Hops  int
+	Known bool
+
+	candidate int
+	seen      int
+}
+
+// observe takes a new hop count, and returns true (with the old count) once a
+// different count has been seen enough times in a row to not be a one off
+func (h *hopTracker) observe(hops int) (from int, changed bool) {
+	if hops < 0 {
+		return 0, false
+	}
+	if !h.Known {
+		h.Hops, h.Known = hops, true
+		return 0, false
+	}
+	if hops == h.Hops {
+		h.seen = 0
+		return 0, false
+	}
+	if hops != h.candidate {
+		h.candidate, h.seen = hops, 0
+	}
+	h.seen++
+	if h.seen < peerStepConfirm {
+		return 0, false
+	}
+	from = h.Hops
+	h.Hops, h.seen = hops, 0
+	return from, true
+}
+
+// observeHops feeds a hop count for one direction of a sping session in, logging route changes
+func (ses *session) observeHops(direction string, hops int) {
+	h := &ses.rxHops
+	if direction == "tx" {
+		h = &ses.txHops
+	}
+	if from, changed := h.observe(hops); changed {
+		log.Printf("[%s] Route change: %s hop count went from %d to %d", ses.PeerAddress, direction, from, hops)
+		promRouteChanges.WithLabelValues(direction, ses.PeerAddress.String(), ses.Class.String(), ses.flowName(), ses.transportName(), ses.Listener).Inc()
+	}
+}
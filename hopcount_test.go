@@ -0,0 +1,88 @@
+package main
+
+import (
+	"net"
+	"testing"
+	"time"
+)
+
+func TestInferHops(t *testing.T) {
+	for _, tt := range []struct {
+		ttl, hops int
+	}{
+		{64, 0},
+		{52, 12},
+		{120, 8},
+		{241, 14},
+		{30, 2},
+		{0, -1},
+	} {
+		if got := inferHops(tt.ttl); got != tt.hops {
+			t.Fatalf("TTL %d gave %d hops, want %d", tt.ttl, got, tt.hops)
+		}
+	}
+}
+
+func TestSimHopCount(t *testing.T) {
+	p, done := newSimPair(&simLink{Delay: 20 * time.Millisecond, TTL: 52}, &simLink{Delay: 20 * time.Millisecond, TTL: 50})
+	defer done()
+
+	p.run(5)
+	if !p.local.rxHops.Known || p.local.rxHops.Hops != 14 {
+		t.Fatalf("rx hops %+v, want 14", p.local.rxHops)
+	}
+	if !p.local.txHops.Known || p.local.txHops.Hops != 12 {
+		t.Fatalf("tx hops %+v, want 12 (from what the peer saw)", p.local.txHops)
+	}
+
+	// A one off is not a route change
+	p.ab.TTL = 51
+	p.run(1)
+	p.ab.TTL = 52
+	p.run(2)
+	if p.local.txHops.Hops != 12 {
+		t.Fatalf("tx hops moved to %d on a one off", p.local.txHops.Hops)
+	}
+
+	// The forward path gets longer and stays that way
+	p.ab.TTL = 48
+	p.run(5)
+	if p.local.txHops.Hops != 16 || p.local.rxHops.Hops != 14 {
+		t.Fatalf("after the route change tx/rx hops are %d/%d, want 16/14", p.local.txHops.Hops, p.local.rxHops.Hops)
+	}
+}
+
+func TestTTLConn(t *testing.T) {
+	for _, addr := range []string{"127.0.0.1:0", "[::1]:0"} {
+		la, _ := net.ResolveUDPAddr("udp", addr)
+		c, err := net.ListenUDP("udp", la)
+		if err != nil {
+			t.Logf("skipping %s: %v", addr, err)
+			continue
+		}
+		tc := newRXInfoConn(c)
+
+		out, err := net.DialUDP("udp", nil, c.LocalAddr().(*net.UDPAddr))
+		if err != nil {
+			t.Fatal(err)
+		}
+		out.Write([]byte("hello"))
+
+		c.SetReadDeadline(time.Now().Add(time.Second))
+		buf := make([]byte, 100)
+		n, _, info, err := tc.ReadFromWithInfo(buf)
+		if err != nil || string(buf[:n]) != "hello" {
+			t.Fatalf("%s: read %q (%v)", addr, buf[:n], err)
+		}
+		ttl := info.TTL
+		if !info.Stamp.IsZero() && time.Since(info.Stamp) > time.Second {
+			t.Fatalf("%s: kernel says it came in at %s", addr, info.Stamp)
+		}
+		// Nothing routes on loopback, so it arrives with whatever it was sent with
+		if ttl == 0 || inferHops(ttl) != 0 {
+			t.Fatalf("%s: arrived with TTL %d", addr, ttl)
+		}
+		out.Close()
+		c.Close()
+	}
+}
@@ -84,6 +84,9 @@ func Ping(addr string, seq int) (_ *net.IPAddr, _ time.Duration, _ *icmp.Timesta
 }
 
 func main() {
+	optMode := flag.String("opt", "", "Send with IPv4 options, rr (Record Route), ts, tsaddr or tsprespec=ip,ip (Timestamp)")
+	echo := flag.Bool("echo", false, "With -opt, send echo requests rather than timestamp requests")
+
 	p := func(addr string) {
 		dst, dur, ts, err := Ping(addr, 1)
 		if err != nil {
@@ -96,11 +99,27 @@ func main() {
 
 		}
 	}
+	po := func(addr string, opts []byte) {
+		dst, dur, rm, h, err := OptionPing(addr, 1, *echo, opts)
+		if err != nil {
+			log.Printf("Ping %s (%s): %s\n", addr, dst, err)
+			return
+		}
+		fmt.Printf("%s (%s): RTT(%dms)\n", addr, dst, dur.Milliseconds())
+		if ts, ok := rm.Body.(*icmp.Timestamp); ok {
+			fmt.Printf("  Forward: %dms Back: %dms\n", ts.Transmit-ts.Originate, int(dur.Milliseconds())-(ts.Transmit-ts.Originate))
+		}
+		printOptions(h)
+	}
 	flag.Usage = func() {
-		fmt.Print(`icmp-timestap-pinger <hosts>
+		fmt.Print(`icmp-timestap-pinger [-opt mode [-echo]] <hosts>
 
-No flags, Will send a ICMP Timestamp request to hosts and estimate forward and back latency,
+Will send a ICMP Timestamp request to hosts and estimate forward and back latency,
 Can only work correctly if both the host and client have near perfectly syncd clocks.
+
+With -opt the requests carry IPv4 options that routers on the path write into,
+and those are printed from the reply: rr (Record Route), ts (Timestamp),
+tsaddr (Timestamp with addresses) or tsprespec=ip,ip (only those addresses stamp).
 `)
 		os.Exit(1)
 	}
@@ -110,8 +129,21 @@ Can only work correctly if both the host and client have near perfectly syncd cl
 		flag.Usage()
 	}
 
+	var opts []byte
+	if *optMode != "" {
+		var err error
+		opts, err = parseOptionMode(*optMode)
+		if err != nil {
+			log.Fatalf("Bad -opt: %v", err)
+		}
+	}
+
 	for _, v := range hosts {
-		p(v)
+		if opts != nil {
+			po(v, opts)
+		} else {
+			p(v)
+		}
 	}
 
 	// p("reddit.com")
@@ -0,0 +1,155 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/benjojo/sping/icmp"
+	"golang.org/x/net/ipv4"
+)
+
+// Sending with IPv4 options (RFC 791) makes the routers along the path write
+// into the packet, so they can be seen without any TTL games. Not every
+// router will, and plenty of networks drop packets with options at the edge.
+
+// parseOptionMode turns the -opt flag into the options to send
+func parseOptionMode(mode string) ([]byte, error) {
+	var opt icmp.IPv4Option
+	switch {
+	case mode == "rr":
+		opt = &icmp.IPv4RecordRouteOption{}
+	case mode == "ts":
+		opt = &icmp.IPv4TimestampOption{Flags: icmp.IPv4TimestampOnly}
+	case mode == "tsaddr":
+		opt = &icmp.IPv4TimestampOption{Flags: icmp.IPv4TimestampAndAddress}
+	case strings.HasPrefix(mode, "tsprespec="):
+		o := &icmp.IPv4TimestampOption{Flags: icmp.IPv4TimestampPrespecified}
+		for _, v := range strings.Split(strings.TrimPrefix(mode, "tsprespec="), ",") {
+			ip := net.ParseIP(v).To4()
+			if ip == nil {
+				return nil, fmt.Errorf("%q is not an IPv4 address", v)
+			}
+			o.Prespecified = append(o.Prespecified, ip)
+		}
+		opt = o
+	default:
+		return nil, fmt.Errorf("unknown option mode %q (rr, ts, tsaddr or tsprespec=ip,ip)", mode)
+	}
+	return icmp.MarshalIPv4Options(opt)
+}
+
+// OptionPing sends an echo or timestamp request carrying IPv4 options, and
+// gives back the reply with the IPv4 header it came in
+func OptionPing(addr string, seq int, echo bool, opts []byte) (_ *net.IPAddr, _ time.Duration, _ *icmp.Message, _ *ipv4.Header, _ error) {
+	c, err := icmp.ListenPacket("ip4:icmp", ListenAddr)
+	if err != nil {
+		return nil, 0, nil, nil, err
+	}
+	defer c.Close()
+
+	dst, err := net.ResolveIPAddr("ip4", addr)
+	if err != nil {
+		return nil, 0, nil, nil, err
+	}
+	p := c.IPv4PacketConn()
+	if err := icmp.SetIPv4Options(p, opts); err != nil {
+		return dst, 0, nil, nil, err
+	}
+
+	id := os.Getpid() & 0xffff
+	m := icmp.Message{Type: ipv4.ICMPTypeEcho, Body: &icmp.Echo{ID: id, Seq: seq, Data: []byte("sping")}}
+	want := ipv4.ICMPTypeEchoReply
+	if !echo {
+		now := time.Now().UTC()
+		midnight := time.Date(now.Year(), now.Month(), now.Day(), 0, 0, 0, 0, time.UTC)
+		m = icmp.Message{Type: ipv4.ICMPTypeTimestamp, Body: &icmp.Timestamp{
+			ID: id, Seq: seq,
+			Originate: int(now.Sub(midnight) / time.Millisecond),
+		}}
+		want = ipv4.ICMPTypeTimestampReply
+	}
+	b, err := m.Marshal(nil)
+	if err != nil {
+		return dst, 0, nil, nil, err
+	}
+
+	start := time.Now()
+	if _, err := c.WriteTo(b, dst); err != nil {
+		return dst, 0, nil, nil, err
+	}
+
+	// Wait for our reply, the socket sees every ICMP packet coming in
+	reply := make([]byte, 1500)
+	if err := c.SetReadDeadline(time.Now().Add(10 * time.Second)); err != nil {
+		return dst, 0, nil, nil, err
+	}
+	for {
+		h, payload, _, err := icmp.ReadIPv4(p, reply)
+		if err != nil {
+			return dst, 0, nil, nil, err
+		}
+		duration := time.Since(start)
+		rm, err := icmp.ParseMessage(1, payload)
+		if err != nil || rm.Type != want || !h.Src.Equal(dst.IP) {
+			continue
+		}
+		switch body := rm.Body.(type) {
+		case *icmp.Echo:
+			if body.ID != id || body.Seq != seq {
+				continue
+			}
+		case *icmp.Timestamp:
+			if body.ID != id || body.Seq != seq {
+				continue
+			}
+		}
+		return dst, duration, rm, h, nil
+	}
+}
+
+// printOptions shows what the routers on the path wrote into the reply
+func printOptions(h *ipv4.Header) {
+	opts, err := icmp.ParseIPv4Options(h.Options)
+	if err != nil {
+		fmt.Printf("  Bad options in reply: %v\n", err)
+		return
+	}
+	if len(opts) == 0 {
+		fmt.Printf("  No options in reply, they were dropped or ignored along the way\n")
+		return
+	}
+	for _, o := range opts {
+		switch o := o.(type) {
+		case *icmp.IPv4RecordRouteOption:
+			fmt.Printf("  Record Route (%d slots left):\n", o.Slots)
+			for i, addr := range o.Addrs {
+				fmt.Printf("  %2d. %s\n", i+1, addr)
+			}
+		case *icmp.IPv4TimestampOption:
+			fmt.Printf("  Timestamp (%d slots left, overflow %d):\n", o.Slots, o.Overflow)
+			for i, e := range o.Entries {
+				if e.Addr != nil {
+					fmt.Printf("  %2d. %-15s %s\n", i+1, e.Addr, fmtOptionStamp(e.Time))
+				} else {
+					fmt.Printf("  %2d. %s\n", i+1, fmtOptionStamp(e.Time))
+				}
+			}
+			for _, addr := range o.Prespecified {
+				fmt.Printf("      %-15s did not stamp\n", addr)
+			}
+		case *icmp.RawIPv4Option:
+			fmt.Printf("  Option %d: %x\n", o.Type, o.Data)
+		}
+	}
+}
+
+func fmtOptionStamp(ms int) string {
+	if ms&0x80000000 != 0 || ms >= 24*60*60*1000 {
+		return fmt.Sprintf("non-standard (%#x)", ms)
+	}
+	t := time.Date(2000, 1, 1, 0, 0, 0, 0, time.UTC).Add(time.Duration(ms) * time.Millisecond)
+	return fmt.Sprintf("%s UT (%dms)", t.Format("15:04:05.000"), ms)
+}
@@ -0,0 +1,289 @@
+package icmp
+
+import (
+	"encoding/binary"
+	"errors"
+	"net"
+
+	"golang.org/x/net/ipv4"
+)
+
+// IPv4 option types, see RFC 791.
+const (
+	IPv4OptionEOL         = 0  // end of option list
+	IPv4OptionNOP         = 1  // no operation
+	IPv4OptionRecordRoute = 7  // record route
+	IPv4OptionTimestamp   = 68 // internet timestamp
+)
+
+// Flags of an IPv4 Timestamp option.
+const (
+	IPv4TimestampOnly         = 0 // routers record a timestamp
+	IPv4TimestampAndAddress   = 1 // routers record their address, then a timestamp
+	IPv4TimestampPrespecified = 3 // only the listed addresses record a timestamp
+)
+
+// MaxIPv4OptionsLen is the most room an IPv4 header has for options.
+const MaxIPv4OptionsLen = 40
+
+var (
+	errOptionsTooLong   = errors.New("IPv4 options too long")
+	errOptionMalformed  = errors.New("malformed IPv4 option")
+	errNotIPv4          = errors.New("not an IPv4 address")
+	errNotRawIPv4Socket = errors.New("not a raw IPv4 socket")
+)
+
+// An IPv4Option is an option that can be carried in an IPv4 header.
+type IPv4Option interface {
+	// Marshal returns the binary encoding of the option.
+	Marshal() ([]byte, error)
+}
+
+// An IPv4TimestampEntry is one slot in an IPv4 Timestamp option. Addr
+// is nil when the option only records timestamps. Time is in
+// milliseconds since midnight UT, unless the high bit is set.
+type IPv4TimestampEntry struct {
+	Addr net.IP
+	Time int
+}
+
+// An IPv4TimestampOption represents an IPv4 Timestamp option.
+//
+// Entries are the slots that have been filled in. Slots is how many
+// empty slots follow them, when marshaling an option with no entries a
+// Slots of 0 leaves as many as will fit. For IPv4TimestampPrespecified,
+// Prespecified lists the addresses of the empty slots instead.
+type IPv4TimestampOption struct {
+	Flags        int
+	Overflow     int // number of routers that could not record for lack of room
+	Entries      []IPv4TimestampEntry
+	Slots        int
+	Prespecified []net.IP
+}
+
+func (o *IPv4TimestampOption) entryLen() int {
+	if o.Flags == IPv4TimestampOnly {
+		return 4
+	}
+	return 8
+}
+
+// Marshal implements the Marshal method of IPv4Option interface.
+func (o *IPv4TimestampOption) Marshal() ([]byte, error) {
+	el := o.entryLen()
+	free := o.Slots
+	if o.Flags == IPv4TimestampPrespecified {
+		free = len(o.Prespecified)
+	} else if free == 0 && len(o.Entries) == 0 {
+		free = (MaxIPv4OptionsLen - 4) / el
+	}
+	l := 4 + (len(o.Entries)+free)*el
+	if l > MaxIPv4OptionsLen {
+		return nil, errOptionsTooLong
+	}
+	b := make([]byte, l)
+	b[0] = IPv4OptionTimestamp
+	b[1] = byte(l)
+	b[2] = byte(5 + len(o.Entries)*el)
+	b[3] = byte(o.Overflow&0x0f)<<4 | byte(o.Flags&0x0f)
+	off := 4
+	put := func(addr net.IP, t int) error {
+		if el == 8 {
+			ip := addr.To4()
+			if addr != nil && ip == nil {
+				return errNotIPv4
+			}
+			copy(b[off:off+4], ip)
+			off += 4
+		}
+		binary.BigEndian.PutUint32(b[off:off+4], uint32(t))
+		off += 4
+		return nil
+	}
+	for _, e := range o.Entries {
+		if err := put(e.Addr, e.Time); err != nil {
+			return nil, err
+		}
+	}
+	for _, addr := range o.Prespecified {
+		if err := put(addr, 0); err != nil {
+			return nil, err
+		}
+	}
+	return b, nil
+}
+
+func parseIPv4TimestampOption(b []byte) (*IPv4TimestampOption, error) {
+	if len(b) < 4 || b[2] < 5 {
+		return nil, errOptionMalformed
+	}
+	o := &IPv4TimestampOption{Flags: int(b[3] & 0x0f), Overflow: int(b[3] >> 4)}
+	el := o.entryLen()
+	if (len(b)-4)%el != 0 {
+		return nil, errOptionMalformed
+	}
+	used := (int(b[2]) - 5) / el
+	total := (len(b) - 4) / el
+	if used > total {
+		used = total
+	}
+	for i := 0; i < total; i++ {
+		s := b[4+i*el : 4+(i+1)*el]
+		var addr net.IP
+		if el == 8 {
+			addr = net.IPv4(s[0], s[1], s[2], s[3])
+			s = s[4:]
+		}
+		if i < used {
+			o.Entries = append(o.Entries, IPv4TimestampEntry{Addr: addr, Time: int(binary.BigEndian.Uint32(s))})
+		} else if o.Flags == IPv4TimestampPrespecified {
+			o.Prespecified = append(o.Prespecified, addr)
+		} else {
+			o.Slots++
+		}
+	}
+	return o, nil
+}
+
+// An IPv4RecordRouteOption represents an IPv4 Record Route option.
+//
+// Addrs are the addresses recorded so far, and Slots is how many empty
+// slots follow them. When marshaling an option with no addresses a
+// Slots of 0 leaves as many as will fit.
+type IPv4RecordRouteOption struct {
+	Addrs []net.IP
+	Slots int
+}
+
+// Marshal implements the Marshal method of IPv4Option interface.
+func (o *IPv4RecordRouteOption) Marshal() ([]byte, error) {
+	free := o.Slots
+	if free == 0 && len(o.Addrs) == 0 {
+		free = (MaxIPv4OptionsLen - 3) / net.IPv4len
+	}
+	l := 3 + (len(o.Addrs)+free)*net.IPv4len
+	if l > MaxIPv4OptionsLen {
+		return nil, errOptionsTooLong
+	}
+	b := make([]byte, l)
+	b[0] = IPv4OptionRecordRoute
+	b[1] = byte(l)
+	b[2] = byte(4 + len(o.Addrs)*net.IPv4len)
+	for i, addr := range o.Addrs {
+		ip := addr.To4()
+		if ip == nil {
+			return nil, errNotIPv4
+		}
+		copy(b[3+i*net.IPv4len:], ip)
+	}
+	return b, nil
+}
+
+func parseIPv4RecordRouteOption(b []byte) (*IPv4RecordRouteOption, error) {
+	if len(b) < 3 || b[2] < 4 || (len(b)-3)%net.IPv4len != 0 {
+		return nil, errOptionMalformed
+	}
+	used := (int(b[2]) - 4) / net.IPv4len
+	total := (len(b) - 3) / net.IPv4len
+	if used > total {
+		used = total
+	}
+	o := &IPv4RecordRouteOption{Slots: total - used}
+	for i := 0; i < used; i++ {
+		s := b[3+i*net.IPv4len:]
+		o.Addrs = append(o.Addrs, net.IPv4(s[0], s[1], s[2], s[3]))
+	}
+	return o, nil
+}
+
+// A RawIPv4Option represents an IPv4 option this package does not
+// otherwise know about.
+type RawIPv4Option struct {
+	Type int
+	Data []byte // option data, after the type and length
+}
+
+// Marshal implements the Marshal method of IPv4Option interface.
+func (o *RawIPv4Option) Marshal() ([]byte, error) {
+	if 2+len(o.Data) > MaxIPv4OptionsLen {
+		return nil, errOptionsTooLong
+	}
+	b := []byte{byte(o.Type), byte(2 + len(o.Data))}
+	return append(b, o.Data...), nil
+}
+
+// MarshalIPv4Options returns the options ready to go in an IPv4
+// header, padded out to a multiple of 4 bytes.
+func MarshalIPv4Options(opts ...IPv4Option) ([]byte, error) {
+	var b []byte
+	for _, o := range opts {
+		ob, err := o.Marshal()
+		if err != nil {
+			return nil, err
+		}
+		b = append(b, ob...)
+	}
+	for len(b)%4 != 0 {
+		b = append(b, IPv4OptionEOL)
+	}
+	if len(b) > MaxIPv4OptionsLen {
+		return nil, errOptionsTooLong
+	}
+	return b, nil
+}
+
+// ParseIPv4Options parses the options of an IPv4 header, such as the
+// Options field of an ipv4.Header.
+func ParseIPv4Options(b []byte) ([]IPv4Option, error) {
+	var opts []IPv4Option
+	for len(b) > 0 {
+		switch b[0] {
+		case IPv4OptionEOL:
+			return opts, nil
+		case IPv4OptionNOP:
+			b = b[1:]
+			continue
+		}
+		if len(b) < 2 || b[1] < 2 || int(b[1]) > len(b) {
+			return nil, errOptionMalformed
+		}
+		ob := b[:b[1]]
+		b = b[b[1]:]
+
+		var o IPv4Option
+		var err error
+		switch ob[0] {
+		case IPv4OptionTimestamp:
+			o, err = parseIPv4TimestampOption(ob)
+		case IPv4OptionRecordRoute:
+			o, err = parseIPv4RecordRouteOption(ob)
+		default:
+			o = &RawIPv4Option{Type: int(ob[0]), Data: append([]byte(nil), ob[2:]...)}
+		}
+		if err != nil {
+			return nil, err
+		}
+		opts = append(opts, o)
+	}
+	return opts, nil
+}
+
+// ReadIPv4 reads a packet from c, which must be the IPv4PacketConn of
+// a raw ICMPv4 endpoint ("ip4:icmp"). Unlike ReadFrom it keeps the
+// IPv4 header, so options added along the path can be seen. It returns
+// the header and the ICMP message that followed it.
+func ReadIPv4(c *ipv4.PacketConn, b []byte) (*ipv4.Header, []byte, net.Addr, error) {
+	conn, ok := c.PacketConn.(*net.IPConn)
+	if !ok {
+		return nil, nil, nil, errNotRawIPv4Socket
+	}
+	n, _, _, peer, err := conn.ReadMsgIP(b, nil)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	h, err := ParseIPv4Header(b[:n])
+	if err != nil {
+		return nil, nil, peer, err
+	}
+	return h, b[h.Len:n], peer, nil
+}
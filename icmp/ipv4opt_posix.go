@@ -0,0 +1,30 @@
+// +build aix darwin dragonfly freebsd linux netbsd openbsd solaris
+
+package icmp
+
+import (
+	"syscall"
+
+	"golang.org/x/net/ipv4"
+)
+
+// SetIPv4Options sets the options, from MarshalIPv4Options, carried by
+// every packet c sends from now on. Empty options turn them off again.
+func SetIPv4Options(c *ipv4.PacketConn, opts []byte) error {
+	sc, ok := c.PacketConn.(syscall.Conn)
+	if !ok {
+		return errNotRawIPv4Socket
+	}
+	rc, err := sc.SyscallConn()
+	if err != nil {
+		return err
+	}
+	var serr error
+	err = rc.Control(func(fd uintptr) {
+		serr = syscall.SetsockoptString(int(fd), syscall.IPPROTO_IP, syscall.IP_OPTIONS, string(opts))
+	})
+	if err != nil {
+		return err
+	}
+	return serr
+}
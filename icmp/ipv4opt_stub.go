@@ -0,0 +1,11 @@
+// +build !aix,!darwin,!dragonfly,!freebsd,!linux,!netbsd,!openbsd,!solaris
+
+package icmp
+
+import "golang.org/x/net/ipv4"
+
+// SetIPv4Options sets the options, from MarshalIPv4Options, carried by
+// every packet c sends from now on. Empty options turn them off again.
+func SetIPv4Options(c *ipv4.PacketConn, opts []byte) error {
+	return errNotImplemented
+}
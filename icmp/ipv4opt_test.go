@@ -0,0 +1,113 @@
+package icmp
+
+import (
+	"net"
+	"reflect"
+	"testing"
+)
+
+func TestMarshalAndParseIPv4Options(t *testing.T) {
+	for i, tt := range []struct {
+		opt  IPv4Option
+		wire []byte // padded, as MarshalIPv4Options gives it
+	}{
+		{
+			&IPv4TimestampOption{Flags: IPv4TimestampOnly, Overflow: 2,
+				Entries: []IPv4TimestampEntry{{Time: 43200123}}, Slots: 1},
+			[]byte{
+				68, 12, 9, 0x20,
+				0x02, 0x93, 0x2e, 0x7b,
+				0, 0, 0, 0,
+			},
+		},
+		{
+			&IPv4TimestampOption{Flags: IPv4TimestampAndAddress,
+				Entries: []IPv4TimestampEntry{{Addr: net.IPv4(192, 0, 2, 1), Time: 0x80000001}}, Slots: 1},
+			[]byte{
+				68, 20, 13, 0x01,
+				192, 0, 2, 1, 0x80, 0, 0, 1,
+				0, 0, 0, 0, 0, 0, 0, 0,
+			},
+		},
+		{
+			&IPv4TimestampOption{Flags: IPv4TimestampPrespecified,
+				Entries:      []IPv4TimestampEntry{{Addr: net.IPv4(192, 0, 2, 1), Time: 5}},
+				Prespecified: []net.IP{net.IPv4(198, 51, 100, 1)}},
+			[]byte{
+				68, 20, 13, 0x03,
+				192, 0, 2, 1, 0, 0, 0, 5,
+				198, 51, 100, 1, 0, 0, 0, 0,
+			},
+		},
+		{
+			&IPv4RecordRouteOption{Addrs: []net.IP{net.IPv4(192, 0, 2, 1)}, Slots: 1},
+			[]byte{
+				7, 11, 8,
+				192, 0, 2, 1,
+				0, 0, 0, 0,
+				IPv4OptionEOL,
+			},
+		},
+	} {
+		b, err := MarshalIPv4Options(tt.opt)
+		if err != nil {
+			t.Fatalf("#%d: %v", i, err)
+		}
+		if !reflect.DeepEqual(b, tt.wire) {
+			t.Fatalf("#%d: got %v; want %v", i, b, tt.wire)
+		}
+		opts, err := ParseIPv4Options(b)
+		if err != nil {
+			t.Fatalf("#%d: %v", i, err)
+		}
+		if !reflect.DeepEqual(opts, []IPv4Option{tt.opt}) {
+			t.Fatalf("#%d: got %#v; want %#v", i, opts[0], tt.opt)
+		}
+	}
+}
+
+func TestIPv4OptionsDefaultSlots(t *testing.T) {
+	for i, tt := range []struct {
+		opt IPv4Option
+		len int
+	}{
+		{&IPv4TimestampOption{Flags: IPv4TimestampOnly}, 40},
+		{&IPv4TimestampOption{Flags: IPv4TimestampAndAddress}, 36},
+		{&IPv4RecordRouteOption{}, 40},
+	} {
+		b, err := MarshalIPv4Options(tt.opt)
+		if err != nil {
+			t.Fatalf("#%d: %v", i, err)
+		}
+		if len(b) != tt.len {
+			t.Fatalf("#%d: got %d bytes; want %d", i, len(b), tt.len)
+		}
+	}
+
+	if _, err := MarshalIPv4Options(&IPv4RecordRouteOption{}, &IPv4TimestampOption{}); err != errOptionsTooLong {
+		t.Fatalf("got %v; want %v", err, errOptionsTooLong)
+	}
+}
+
+func TestParseIPv4OptionsMalformed(t *testing.T) {
+	for i, b := range [][]byte{
+		{68},
+		{68, 12, 9},
+		{68, 9, 5, 0x01, 0, 0, 0, 0, 0},
+		{7, 40, 4},
+		{7, 1},
+	} {
+		if _, err := ParseIPv4Options(b); err != errOptionMalformed {
+			t.Fatalf("#%d: got %v; want %v", i, err, errOptionMalformed)
+		}
+	}
+
+	// NOPs are skipped, unknown options are kept as they are
+	opts, err := ParseIPv4Options([]byte{IPv4OptionNOP, 130, 4, 1, 2, IPv4OptionEOL, 0, 0})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []IPv4Option{&RawIPv4Option{Type: 130, Data: []byte{1, 2}}}; !reflect.DeepEqual(opts, want) {
+		t.Fatalf("got %#v; want %#v", opts, want)
+	}
+}
@@ -7,6 +7,7 @@
 package icmp
 
 import (
+	"context"
 	"net"
 	"os"
 	"runtime"
@@ -41,6 +42,12 @@ const sysIP_STRIPHDR = 0x17 // for now only darwin supports this option
 //	ListenPacket("ip6:ipv6-icmp", "fe80::1%en0")
 //	ListenPacket("ip6:58", "::")
 func ListenPacket(network, address string) (*PacketConn, error) {
+	return ListenPacketConfig(&net.ListenConfig{}, network, address)
+}
+
+// ListenPacketConfig is ListenPacket, with lc's Control function run on
+// the socket before it is bound, to bind it to a device for example.
+func ListenPacketConfig(lc *net.ListenConfig, network, address string) (*PacketConn, error) {
 	var family, proto int
 	switch network {
 	case "udp4":
@@ -73,20 +80,30 @@ func ListenPacket(network, address string) (*PacketConn, error) {
 				return nil, os.NewSyscallError("setsockopt", err)
 			}
 		}
+		f := os.NewFile(uintptr(s), "datagram-oriented icmp")
+		if lc.Control != nil {
+			rc, err := f.SyscallConn()
+			if err == nil {
+				err = lc.Control(network, address, rc)
+			}
+			if err != nil {
+				f.Close()
+				return nil, err
+			}
+		}
 		sa, err := sockaddr(family, address)
 		if err != nil {
-			syscall.Close(s)
+			f.Close()
 			return nil, err
 		}
 		if err := syscall.Bind(s, sa); err != nil {
-			syscall.Close(s)
+			f.Close()
 			return nil, os.NewSyscallError("bind", err)
 		}
-		f := os.NewFile(uintptr(s), "datagram-oriented icmp")
 		c, cerr = net.FilePacketConn(f)
 		f.Close()
 	default:
-		c, cerr = net.ListenPacket(network, address)
+		c, cerr = lc.ListenPacket(context.Background(), network, address)
 	}
 	if cerr != nil {
 		return nil, cerr
@@ -6,6 +6,8 @@
 
 package icmp
 
+import "net"
+
 // ListenPacket listens for incoming ICMP packets addressed to
 // address. See net.Dial for the syntax of address.
 //
@@ -31,3 +33,9 @@ package icmp
 func ListenPacket(network, address string) (*PacketConn, error) {
 	return nil, errNotImplemented
 }
+
+// ListenPacketConfig is ListenPacket, with lc's Control function run on
+// the socket before it is bound, to bind it to a device for example.
+func ListenPacketConfig(lc *net.ListenConfig, network, address string) (*PacketConn, error) {
+	return nil, errNotImplemented
+}
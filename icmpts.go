@@ -0,0 +1,238 @@
+package main
+
+import (
+	"log"
+	"net"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/benjojo/sping/icmp"
+	"golang.org/x/net/ipv4"
+)
+
+// ICMP Timestamp (RFC 792) targets. Any router or host that answers timestamp
+// requests gives us its receive and transmit times, so with a good local clock
+// the path can be split like a sping peer, just to the millisecond.
+//
+// All targets share one raw ICMP socket (so this needs root or CAP_NET_RAW),
+// replies are matched to targets by their source address.
+
+const msPerDay = 24 * 60 * 60 * 1000
+
+// icmpNonStandard is set by hosts that can't give the time in ms since midnight UT
+const icmpNonStandard = 0x80000000
+
+// msSinceMidnight is t as an ICMP timestamp
+func msSinceMidnight(t time.Time) int {
+	t = t.UTC()
+	midnight := time.Date(t.Year(), t.Month(), t.Day(), 0, 0, 0, 0, time.UTC)
+	return int(t.Sub(midnight) / time.Millisecond)
+}
+
+// icmpStampTime turns a timestamp from the far end into a time near ref. Hosts
+// truncate to the millisecond, so the middle of the millisecond is the best
+// guess. The stamp can be from the other side of midnight to ref.
+func icmpStampTime(ms int, ref time.Time) time.Time {
+	ref = ref.UTC()
+	midnight := time.Date(ref.Year(), ref.Month(), ref.Day(), 0, 0, 0, 0, time.UTC)
+	t := midnight.Add(time.Duration(ms)*time.Millisecond + time.Millisecond/2)
+	if d := t.Sub(ref); d > 12*time.Hour {
+		t = t.Add(-24 * time.Hour)
+	} else if d < -12*time.Hour {
+		t = t.Add(24 * time.Hour)
+	}
+	return t
+}
+
+// icmpTimestampStandard is false if the reply has stamps that are not ms since midnight UT
+func icmpTimestampStandard(ts *icmp.Timestamp) bool {
+	for _, v := range []int{ts.Receive, ts.Transmit} {
+		if v&icmpNonStandard != 0 || v >= msPerDay {
+			return false
+		}
+	}
+	return true
+}
+
+// icmpTimestampSplit works out the forward and reverse delay of a timestamp
+// reply to a request sent at t1 and received back at t4
+func icmpTimestampSplit(t1 time.Time, ts *icmp.Timestamp, t4 time.Time) (forward, reverse time.Duration, ok bool) {
+	if !icmpTimestampStandard(ts) {
+		return 0, 0, false
+	}
+	t2 := icmpStampTime(ts.Receive, t1)
+	t3 := icmpStampTime(ts.Transmit, t4)
+	return t2.Sub(t1), t4.Sub(t3), true
+}
+
+// icmpTimestampSynced is false if a split can't be right, with either way
+// being negative by more than the stamps resolution could explain
+func icmpTimestampSynced(forward, reverse time.Duration) bool {
+	return forward > -time.Millisecond && reverse > -time.Millisecond
+}
+
+func newICMPTimestampRequest(id, seq int, t1 time.Time) ([]byte, error) {
+	m := icmp.Message{
+		Type: ipv4.ICMPTypeTimestamp, Code: 0,
+		Body: &icmp.Timestamp{
+			ID: id, Seq: seq,
+			Originate: msSinceMidnight(t1),
+		},
+	}
+	return m.Marshal(nil)
+}
+
+// icmpTimestampListener is the raw socket all ICMP Timestamp targets share
+type icmpTimestampListener struct {
+	conn *icmp.PacketConn
+	id   int
+
+	mu      sync.Mutex
+	targets map[string]*icmpTimestampTarget
+}
+
+var icmpTSListener *icmpTimestampListener
+var icmpTSListenerErr error
+var icmpTSListenerOnce sync.Once
+
+func getICMPTimestampListener() (*icmpTimestampListener, error) {
+	icmpTSListenerOnce.Do(func() {
+		conn, err := icmp.ListenPacket("ip4:icmp", "0.0.0.0")
+		if err != nil {
+			icmpTSListenerErr = err
+			return
+		}
+		icmpTSListener = &icmpTimestampListener{
+			conn:    conn,
+			id:      os.Getpid() & 0xffff,
+			targets: make(map[string]*icmpTimestampTarget),
+		}
+		go icmpTSListener.readReplies()
+	})
+	return icmpTSListener, icmpTSListenerErr
+}
+
+func (l *icmpTimestampListener) readReplies() {
+	buf := make([]byte, 1500)
+	for {
+		n, peer, err := l.conn.ReadFrom(buf)
+		if err != nil {
+			log.Printf("Failed to rx ICMP packet, %v", err)
+			clock.Sleep(time.Millisecond * 777)
+			continue
+		}
+		t4 := timeNowDisciplined()
+
+		m, err := icmp.ParseMessage(1, buf[:n])
+		if err != nil || m.Type != ipv4.ICMPTypeTimestampReply {
+			continue
+		}
+		ts, ok := m.Body.(*icmp.Timestamp)
+		if !ok || ts.ID != l.id {
+			continue
+		}
+
+		l.mu.Lock()
+		t := l.targets[peer.String()]
+		l.mu.Unlock()
+		if t != nil {
+			t.handleReply(ts, t4)
+		}
+	}
+}
+
+// add takes replies from t's host for it, unless another target already
+// has that host (replies only say which host they came from), which is
+// returned instead
+func (l *icmpTimestampListener) add(t *icmpTimestampTarget) *icmpTimestampTarget {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if other := l.targets[t.addr.String()]; other != nil {
+		return other
+	}
+	l.targets[t.addr.String()] = t
+	return nil
+}
+
+// icmpTimestampTarget probes one host with ICMP Timestamp requests
+type icmpTimestampTarget struct {
+	spec   peerSpec
+	addr   *net.IPAddr
+	l      *icmpTimestampListener
+	window probeWindow
+	seq    uint16
+
+	warnOnce sync.Once
+}
+
+func (t *icmpTimestampTarget) Protocol() string { return "icmp-timestamp" }
+func (t *icmpTimestampTarget) Host() string     { return t.spec.Host }
+
+func (t *icmpTimestampTarget) Stats() proberStats {
+	return t.window.stats(clock.Now(), 2*time.Second)
+}
+
+// runICMPTimestampTarget probes a host once a second, forever
+func runICMPTimestampTarget(spec peerSpec) {
+	addr, err := net.ResolveIPAddr("ip4", spec.Host)
+	if err != nil {
+		log.Printf("Cannot start ICMP Timestamp probes to %s: %v", spec, err)
+		return
+	}
+	l, err := getICMPTimestampListener()
+	if err != nil {
+		log.Printf("Cannot start ICMP Timestamp probes to %s (this needs a raw socket): %v", spec, err)
+		return
+	}
+
+	t := &icmpTimestampTarget{spec: spec, addr: addr, l: l}
+	if other := l.add(t); other != nil {
+		log.Printf("Ignoring peer %s: %s is already being probed as %s", spec, addr, other.spec)
+		return
+	}
+	registerProber(t)
+
+	for {
+		clock.Sleep(clock.Until(nextSecondBoundary()))
+		t.send()
+	}
+}
+
+func (t *icmpTimestampTarget) send() {
+	seq := t.seq
+	t.seq++
+
+	t1 := timeNowDisciplined()
+	b, err := newICMPTimestampRequest(t.l.id, int(seq), t1)
+	if err != nil {
+		log.Printf("[%s] Failed to build ICMP Timestamp request: %v", t.spec, err)
+		return
+	}
+	t.window.sent(uint32(seq), t1)
+	if _, err := t.l.conn.WriteTo(b, t.addr); err != nil && *debugShowLiveStats {
+		log.Printf("[%s] Failed to send ICMP Timestamp request: %v", t.spec, err)
+	}
+}
+
+func (t *icmpTimestampTarget) handleReply(ts *icmp.Timestamp, t4 time.Time) {
+	seq := uint32(uint16(ts.Seq))
+	t1, ok := t.window.sentAt(seq)
+	if !ok {
+		return
+	}
+
+	forward, reverse, ok := icmpTimestampSplit(t1, ts, t4)
+	if !ok {
+		t.warnOnce.Do(func() {
+			log.Printf("[%s] Host gives non-standard ICMP timestamps, only loss can be measured", t.spec)
+		})
+		t.window.repliedNoDelay(seq)
+		return
+	}
+	t.window.replied(seq, forward, reverse)
+
+	if *debugShowLiveStats {
+		log.Printf("[%s] ICMP Timestamp seq %d Forward: %s Reverse: %s", t.spec, seq, forward, reverse)
+	}
+}
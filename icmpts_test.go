@@ -0,0 +1,114 @@
+package main
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/benjojo/sping/icmp"
+)
+
+func TestICMPStampTime(t *testing.T) {
+	ref := time.Date(2020, 9, 13, 12, 0, 0, 0, time.UTC)
+	got := icmpStampTime(msSinceMidnight(ref.Add(1234*time.Microsecond)), ref)
+	if want := ref.Add(1500 * time.Microsecond); !got.Equal(want) {
+		t.Fatalf("got %s, want the middle of the ms %s", got, want)
+	}
+
+	// Just before midnight, with a stamp from just after it
+	ref = time.Date(2020, 9, 13, 23, 59, 59, 999000000, time.UTC)
+	got = icmpStampTime(2, ref)
+	if want := time.Date(2020, 9, 14, 0, 0, 0, 2500000, time.UTC); !got.Equal(want) {
+		t.Fatalf("over midnight got %s, want %s", got, want)
+	}
+
+	// And the other way
+	ref = time.Date(2020, 9, 14, 0, 0, 0, 1000000, time.UTC)
+	got = icmpStampTime(msPerDay-1, ref)
+	if want := time.Date(2020, 9, 13, 23, 59, 59, 999500000, time.UTC); !got.Equal(want) {
+		t.Fatalf("back over midnight got %s, want %s", got, want)
+	}
+}
+
+func TestICMPTimestampSplit(t *testing.T) {
+	t1 := time.Date(2020, 9, 13, 12, 0, 0, 100000, time.UTC)
+	t2 := t1.Add(30 * time.Millisecond)
+	t3 := t2.Add(time.Millisecond)
+	t4 := t3.Add(10 * time.Millisecond)
+	ts := &icmp.Timestamp{
+		Originate: msSinceMidnight(t1),
+		Receive:   msSinceMidnight(t2),
+		Transmit:  msSinceMidnight(t3),
+	}
+
+	fwd, rev, ok := icmpTimestampSplit(t1, ts, t4)
+	if !ok {
+		t.Fatalf("standard timestamps not split")
+	}
+	if d := fwd - 30*time.Millisecond; d > time.Millisecond/2 || d < -time.Millisecond/2 {
+		t.Fatalf("forward %s, want 30ms give or take half a ms", fwd)
+	}
+	if d := rev - 10*time.Millisecond; d > time.Millisecond/2 || d < -time.Millisecond/2 {
+		t.Fatalf("reverse %s, want 10ms give or take half a ms", rev)
+	}
+	if !icmpTimestampSynced(fwd, rev) {
+		t.Fatalf("in sync split flagged as unsynchronised")
+	}
+	if icmpTimestampSynced(-5*time.Millisecond, 45*time.Millisecond) {
+		t.Fatalf("negative forward delay not flagged")
+	}
+
+	ts.Receive |= icmpNonStandard
+	if _, _, ok := icmpTimestampSplit(t1, ts, t4); ok {
+		t.Fatalf("non-standard timestamp was split")
+	}
+}
+
+func TestICMPTimestampTargetReplies(t *testing.T) {
+	target := &icmpTimestampTarget{spec: peerSpec{Proto: "icmp-timestamp", Host: "192.0.2.1"}}
+	t1 := clock.Now().Add(-time.Minute)
+
+	for seq := 0; seq < 32; seq++ {
+		sent := t1.Add(time.Duration(seq) * time.Second)
+		target.window.sent(uint32(seq), sent)
+		if seq%4 == 0 {
+			continue
+		}
+		ts := &icmp.Timestamp{
+			Seq:      seq,
+			Receive:  msSinceMidnight(sent.Add(20 * time.Millisecond)),
+			Transmit: msSinceMidnight(sent.Add(20 * time.Millisecond)),
+		}
+		if seq == 31 {
+			// Replies that can't be split still count against loss
+			ts.Receive |= icmpNonStandard
+		}
+		target.handleReply(ts, sent.Add(25*time.Millisecond))
+	}
+
+	st := target.Stats()
+	if st.Exchanges != 32 || st.RTTLoss != 8 {
+		t.Fatalf("loss is wrong: %+v", st)
+	}
+	if st.TXLatency < 19*time.Millisecond || st.TXLatency > 21*time.Millisecond ||
+		st.RXLatency < 4*time.Millisecond || st.RXLatency > 6*time.Millisecond {
+		t.Fatalf("latency is wrong: %+v", st)
+	}
+}
+
+func TestICMPTimestampDuplicateTarget(t *testing.T) {
+	l := &icmpTimestampListener{targets: make(map[string]*icmpTimestampTarget)}
+	addr := &net.IPAddr{IP: net.ParseIP("192.0.2.1")}
+	first := &icmpTimestampTarget{spec: peerSpec{Proto: "icmp-timestamp", Host: "192.0.2.1"}, addr: addr}
+	second := &icmpTimestampTarget{spec: peerSpec{Proto: "icmp-timestamp", Host: "host.example"}, addr: addr}
+
+	if other := l.add(first); other != nil {
+		t.Fatalf("first target clashed with %s", other.spec)
+	}
+	if other := l.add(second); other != first {
+		t.Fatalf("second target to the same host was taken")
+	}
+	if l.targets["192.0.2.1"] != first {
+		t.Fatalf("replies go to the second target")
+	}
+}
@@ -0,0 +1,202 @@
+package impair
+
+import (
+	"bufio"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+// These tests run two real sping daemons on loopback with a Relay between
+// them, and check that both report what the relay is doing to the traffic.
+//
+//	sping A (127.0.0.1) --> relay (127.0.0.3) --> sping B (127.0.0.2)
+//
+// A is told to peer with the relay address, so everything A sends goes
+// through the Forward direction and everything B sends back through Reverse.
+
+const (
+	addrA     = "127.0.0.1"
+	addrB     = "127.0.0.2"
+	addrRelay = "127.0.0.3"
+)
+
+func buildSping(t *testing.T) string {
+	dir, err := ioutil.TempDir("", "sping-e2e")
+	if err != nil {
+		t.Fatal(err)
+	}
+	bin := filepath.Join(dir, "sping")
+	out, err := exec.Command("go", "build", "-o", bin, "github.com/benjojo/sping").CombinedOutput()
+	if err != nil {
+		t.Fatalf("failed to build sping: %v\n%s", err, out)
+	}
+	return bin
+}
+
+func startSping(t *testing.T, bin string, addr string, args ...string) *exec.Cmd {
+	args = append([]string{
+		"-listenAddr", net.JoinHostPort(addr, "6924"),
+		"-web.listen-address", net.JoinHostPort(addr, "19523"),
+	}, args...)
+	cmd := exec.Command(bin, args...)
+	if testing.Verbose() {
+		cmd.Stdout = os.Stdout
+		cmd.Stderr = os.Stderr
+	}
+	if err := cmd.Start(); err != nil {
+		t.Fatalf("failed to start sping: %v", err)
+	}
+	return cmd
+}
+
+// runPair starts the two daemons and relays, and returns a func to stop it all
+func runPair(t *testing.T, cfg Config) func() {
+	if testing.Short() {
+		t.Skip("skipping end to end test in short mode")
+	}
+	if l, err := net.Listen("tcp", net.JoinHostPort(addrB, "0")); err != nil {
+		t.Skipf("loopback addresses other than 127.0.0.1 are not usable here: %v", err)
+	} else {
+		l.Close()
+	}
+
+	bin := buildSping(t)
+	relayTo := net.JoinHostPort(addrB, "6924")
+	udp, err := NewUDPRelay(net.JoinHostPort(addrRelay, "6924"), relayTo, cfg)
+	if err != nil {
+		t.Fatalf("failed to start UDP relay: %v", err)
+	}
+	tcp, err := NewTCPRelay(net.JoinHostPort(addrRelay, "6924"), relayTo, cfg)
+	if err != nil {
+		t.Fatalf("failed to start TCP relay: %v", err)
+	}
+
+	b := startSping(t, bin, addrB)
+	time.Sleep(500 * time.Millisecond)
+	a := startSping(t, bin, addrA, "-peers", addrRelay)
+
+	return func() {
+		a.Process.Kill()
+		b.Process.Kill()
+		a.Wait()
+		b.Wait()
+		udp.Close()
+		tcp.Close()
+		os.RemoveAll(filepath.Dir(bin))
+	}
+}
+
+// scrape returns the splitping_latency and splitping_loss values of an instance by direction
+func scrape(addr string) (latency map[string]float64, loss map[string]float64, err error) {
+	resp, err := http.Get("http://" + net.JoinHostPort(addr, "19523") + "/metrics")
+	if err != nil {
+		return nil, nil, err
+	}
+	defer resp.Body.Close()
+
+	latency = make(map[string]float64)
+	loss = make(map[string]float64)
+	s := bufio.NewScanner(resp.Body)
+	for s.Scan() {
+		line := s.Text()
+		var m map[string]float64
+		switch {
+		case strings.HasPrefix(line, "splitping_latency{"):
+			m = latency
+		case strings.HasPrefix(line, "splitping_loss{"):
+			m = loss
+		default:
+			continue
+		}
+
+		fields := strings.Fields(line)
+		v, err := strconv.ParseFloat(fields[len(fields)-1], 64)
+		if err != nil {
+			continue
+		}
+		for _, dir := range []string{"rx", "tx"} {
+			if strings.Contains(line, fmt.Sprintf("direction=%q", dir)) {
+				m[dir] = v
+			}
+		}
+	}
+	return latency, loss, s.Err()
+}
+
+// waitFor scrapes an instance until check passes, or fails the test after timeout
+func waitFor(t *testing.T, addr string, timeout time.Duration, check func(latency, loss map[string]float64) error) {
+	deadline := time.Now().Add(timeout)
+	var lastErr error
+	for time.Now().Before(deadline) {
+		time.Sleep(time.Second)
+		latency, loss, err := scrape(addr)
+		if err != nil {
+			lastErr = err
+			continue
+		}
+		if lastErr = check(latency, loss); lastErr == nil {
+			return
+		}
+	}
+	t.Fatalf("%s never reported the injected impairment: %v", addr, lastErr)
+}
+
+func near(got, want, tolerance float64) bool {
+	return got > want-tolerance && got < want+tolerance
+}
+
+func TestEndToEndDelay(t *testing.T) {
+	stop := runPair(t, Config{
+		Forward: Direction{Delay: 40 * time.Millisecond, Jitter: 2 * time.Millisecond},
+		Reverse: Direction{Delay: 10 * time.Millisecond, Jitter: 2 * time.Millisecond},
+		Seed:    1,
+	})
+	defer stop()
+
+	check := func(tx, rx float64) func(latency, loss map[string]float64) error {
+		return func(latency, loss map[string]float64) error {
+			if !near(latency["tx"], tx, 0.005) || !near(latency["rx"], rx, 0.005) {
+				return fmt.Errorf("latency is tx %f rx %f, want tx %f rx %f", latency["tx"], latency["rx"], tx, rx)
+			}
+			return nil
+		}
+	}
+
+	// A sends through the forward direction, B through the reverse
+	waitFor(t, addrA, 20*time.Second, check(0.041, 0.011))
+	waitFor(t, addrB, 5*time.Second, check(0.011, 0.041))
+}
+
+func TestEndToEndLoss(t *testing.T) {
+	stop := runPair(t, Config{
+		Forward: Direction{Delay: 5 * time.Millisecond, Loss: Burst(0.25, 2)},
+		Reverse: Direction{Delay: 5 * time.Millisecond},
+		Seed:    3,
+	})
+	defer stop()
+
+	// The loss is measured over 32 seconds, so it takes a while to show up
+	check := func(tx, rx string) func(latency, loss map[string]float64) error {
+		return func(latency, loss map[string]float64) error {
+			if _, ok := loss[tx]; !ok {
+				return fmt.Errorf("no loss reported yet")
+			}
+			if loss[tx] < 0.05 || loss[tx] > 0.5 || loss[rx] != 0 {
+				return fmt.Errorf("loss is %s %f %s %f, want %s ~0.25 and no %s loss", tx, loss[tx], rx, loss[rx], tx, rx)
+			}
+			return nil
+		}
+	}
+
+	waitFor(t, addrA, 90*time.Second, check("tx", "rx"))
+	waitFor(t, addrB, 10*time.Second, check("rx", "tx"))
+}
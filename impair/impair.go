@@ -0,0 +1,158 @@
+// Package impair is a userspace network impairment relay, for testing sping
+// (or anything else) against a bad network without netem or root.
+//
+// A Relay listens on one address and forwards everything to a target,
+// applying delay, jitter, loss, reordering and duplication independently in
+// each direction. UDP relays apply all of them per datagram. TCP relays can
+// only delay (and jitter, without reordering) the stream, since loss and
+// reordering are hidden by TCP itself.
+package impair
+
+import (
+	"math/rand"
+	"sync"
+	"time"
+)
+
+// Direction is how one way through the relay behaves
+type Direction struct {
+	Delay        time.Duration
+	Jitter       time.Duration // Random extra delay of up to this much
+	Loss         GilbertElliott
+	Reorder      float64       // Chance of a packet being held back by ReorderDelay
+	ReorderDelay time.Duration // How long reordered packets are held for, defaults to 50ms
+	Duplicate    float64       // Chance of a packet being sent twice
+}
+
+// Config is the impairment for both directions. Forward is from whoever
+// talks to the relay towards the target, Reverse is the way back.
+type Config struct {
+	Forward Direction
+	Reverse Direction
+	Seed    int64 // Seed for the randomness, so runs can be repeated
+}
+
+// GilbertElliott is a two state loss model, that can do both random loss and
+// bursts of loss. In the Good state packets are lost with LossGood chance, in
+// the Bad state with LossBad. P is the chance of going from Good to Bad after
+// each packet, R the chance of going back.
+//
+// The zero value never loses anything. Bernoulli returns a model for plain
+// random loss.
+type GilbertElliott struct {
+	P, R     float64
+	LossGood float64
+	LossBad  float64
+}
+
+// Bernoulli returns a model that loses packets independently with chance loss
+func Bernoulli(loss float64) GilbertElliott {
+	return GilbertElliott{LossGood: loss}
+}
+
+// Burst returns a model with an average loss of rate, in bursts of burstLen packets on average
+func Burst(rate float64, burstLen float64) GilbertElliott {
+	if burstLen < 1 {
+		burstLen = 1
+	}
+	r := 1 / burstLen
+	// In the steady state the Bad state is occupied P/(P+R) of the time
+	return GilbertElliott{P: rate * r / (1 - rate), R: r, LossBad: 1}
+}
+
+// Stats counts what a Direction has done to packets
+type Stats struct {
+	Packets    int
+	Dropped    int
+	Duplicated int
+	Reordered  int
+}
+
+// impairer applies a Direction to a stream of packets
+type impairer struct {
+	d Direction
+
+	mu    sync.Mutex
+	rng   *rand.Rand
+	bad   bool
+	stats Stats
+	// The latest time anything has been scheduled, used by ordered streams
+	last time.Time
+}
+
+func newImpairer(d Direction, seed int64) *impairer {
+	return &impairer{
+		d:   d,
+		rng: rand.New(rand.NewSource(seed)),
+	}
+}
+
+// plan decides what happens to a packet, it returns the delay for each copy
+// of the packet to be delivered (none if it is lost).
+func (im *impairer) plan() []time.Duration {
+	im.mu.Lock()
+	defer im.mu.Unlock()
+	im.stats.Packets++
+
+	loss := im.d.Loss.LossGood
+	if im.bad {
+		loss = im.d.Loss.LossBad
+	}
+	lost := loss > 0 && im.rng.Float64() < loss
+	if im.bad {
+		if im.rng.Float64() < im.d.Loss.R {
+			im.bad = false
+		}
+	} else if im.d.Loss.P > 0 && im.rng.Float64() < im.d.Loss.P {
+		im.bad = true
+	}
+	if lost {
+		im.stats.Dropped++
+		return nil
+	}
+
+	delay := im.d.Delay
+	if im.d.Jitter > 0 {
+		delay += time.Duration(im.rng.Int63n(int64(im.d.Jitter)))
+	}
+	if im.d.Reorder > 0 && im.rng.Float64() < im.d.Reorder {
+		im.stats.Reordered++
+		if im.d.ReorderDelay == 0 {
+			delay += 50 * time.Millisecond
+		} else {
+			delay += im.d.ReorderDelay
+		}
+	}
+
+	delays := []time.Duration{delay}
+	if im.d.Duplicate > 0 && im.rng.Float64() < im.d.Duplicate {
+		im.stats.Duplicated++
+		delays = append(delays, delay)
+	}
+	return delays
+}
+
+// ordered returns when a chunk of a stream sent now should be delivered, with
+// delay and jitter applied but never before anything sent earlier
+func (im *impairer) ordered(now time.Time) time.Time {
+	im.mu.Lock()
+	defer im.mu.Unlock()
+	im.stats.Packets++
+
+	delay := im.d.Delay
+	if im.d.Jitter > 0 {
+		delay += time.Duration(im.rng.Int63n(int64(im.d.Jitter)))
+	}
+	at := now.Add(delay)
+	if at.Before(im.last) {
+		at = im.last
+	}
+	im.last = at
+	return at
+}
+
+func (im *impairer) Stats() Stats {
+	im.mu.Lock()
+	defer im.mu.Unlock()
+	return im.stats
+}
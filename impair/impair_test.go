@@ -0,0 +1,85 @@
+package impair
+
+import (
+	"math"
+	"testing"
+	"time"
+)
+
+func lossRate(d Direction, n int) (rate float64, meanBurst float64) {
+	im := newImpairer(d, 1)
+	bursts, inBurst := 0, false
+	for i := 0; i < n; i++ {
+		lost := im.plan() == nil
+		if lost && !inBurst {
+			bursts++
+		}
+		inBurst = lost
+	}
+	s := im.Stats()
+	if bursts == 0 {
+		return 0, 0
+	}
+	return float64(s.Dropped) / float64(s.Packets), float64(s.Dropped) / float64(bursts)
+}
+
+func TestBernoulliLoss(t *testing.T) {
+	rate, burst := lossRate(Direction{Loss: Bernoulli(0.1)}, 100000)
+	if math.Abs(rate-0.1) > 0.01 {
+		t.Fatalf("loss rate is %f, want 0.1", rate)
+	}
+	if burst > 1.3 {
+		t.Fatalf("random loss has bursts of %f on average", burst)
+	}
+}
+
+func TestBurstLoss(t *testing.T) {
+	rate, burst := lossRate(Direction{Loss: Burst(0.05, 4)}, 200000)
+	if math.Abs(rate-0.05) > 0.01 {
+		t.Fatalf("loss rate is %f, want 0.05", rate)
+	}
+	if math.Abs(burst-4) > 0.5 {
+		t.Fatalf("average burst is %f, want 4", burst)
+	}
+}
+
+func TestNoImpairment(t *testing.T) {
+	im := newImpairer(Direction{Delay: 10 * time.Millisecond}, 1)
+	for i := 0; i < 1000; i++ {
+		d := im.plan()
+		if len(d) != 1 || d[0] != 10*time.Millisecond {
+			t.Fatalf("packet %d got %v, want a single 10ms delivery", i, d)
+		}
+	}
+}
+
+func TestDuplicateAndReorder(t *testing.T) {
+	im := newImpairer(Direction{Delay: 10 * time.Millisecond, Duplicate: 0.1, Reorder: 0.2, ReorderDelay: 30 * time.Millisecond}, 1)
+	for i := 0; i < 10000; i++ {
+		im.plan()
+	}
+	s := im.Stats()
+	if math.Abs(float64(s.Duplicated)/10000-0.1) > 0.02 {
+		t.Fatalf("duplicated %d of 10000, want ~1000", s.Duplicated)
+	}
+	if math.Abs(float64(s.Reordered)/10000-0.2) > 0.02 {
+		t.Fatalf("reordered %d of 10000, want ~2000", s.Reordered)
+	}
+}
+
+func TestOrderedStreamNeverReorders(t *testing.T) {
+	im := newImpairer(Direction{Delay: 10 * time.Millisecond, Jitter: 20 * time.Millisecond}, 1)
+	now := time.Unix(1600000000, 0)
+	last := time.Time{}
+	for i := 0; i < 1000; i++ {
+		now = now.Add(time.Millisecond)
+		at := im.ordered(now)
+		if at.Before(last) {
+			t.Fatalf("chunk %d delivered at %s, before the previous one at %s", i, at, last)
+		}
+		if at.Before(now.Add(10 * time.Millisecond)) {
+			t.Fatalf("chunk %d delivered with less than the base delay", i)
+		}
+		last = at
+	}
+}
@@ -0,0 +1,265 @@
+package impair
+
+import (
+	"io"
+	"log"
+	"net"
+	"sync"
+	"time"
+)
+
+// udpIdleTimeout is how long a UDP flow through the relay lives without traffic
+const udpIdleTimeout = 2 * time.Minute
+
+// A Relay forwards traffic from a listening address to a target, impairing it on the way
+type Relay struct {
+	cfg     Config
+	target  string
+	forward *impairer
+	reverse *impairer
+
+	udp *net.UDPConn
+	tcp net.Listener
+
+	mu    sync.Mutex
+	flows map[string]*udpFlow
+	done  chan struct{}
+}
+
+type udpFlow struct {
+	client   *net.UDPAddr
+	upstream *net.UDPConn
+	lastSeen time.Time
+}
+
+func newRelay(target string, cfg Config) *Relay {
+	return &Relay{
+		cfg:     cfg,
+		target:  target,
+		forward: newImpairer(cfg.Forward, cfg.Seed),
+		reverse: newImpairer(cfg.Reverse, cfg.Seed+1),
+		flows:   make(map[string]*udpFlow),
+		done:    make(chan struct{}),
+	}
+}
+
+// NewUDPRelay relays UDP datagrams sent to listen on to target. Every client
+// address gets its own socket towards the target, so replies find their way back.
+func NewUDPRelay(listen, target string, cfg Config) (*Relay, error) {
+	laddr, err := net.ResolveUDPAddr("udp", listen)
+	if err != nil {
+		return nil, err
+	}
+	c, err := net.ListenUDP("udp", laddr)
+	if err != nil {
+		return nil, err
+	}
+
+	r := newRelay(target, cfg)
+	r.udp = c
+	go r.serveUDP()
+	go r.expireFlows()
+	return r, nil
+}
+
+// NewTCPRelay relays TCP connections made to listen on to target
+func NewTCPRelay(listen, target string, cfg Config) (*Relay, error) {
+	l, err := net.Listen("tcp", listen)
+	if err != nil {
+		return nil, err
+	}
+
+	r := newRelay(target, cfg)
+	r.tcp = l
+	go r.serveTCP()
+	return r, nil
+}
+
+// Addr returns the address the relay is listening on
+func (r *Relay) Addr() net.Addr {
+	if r.udp != nil {
+		return r.udp.LocalAddr()
+	}
+	return r.tcp.Addr()
+}
+
+// Stats returns what has been done to the traffic going each way
+func (r *Relay) Stats() (forward Stats, reverse Stats) {
+	return r.forward.Stats(), r.reverse.Stats()
+}
+
+// Close stops the relay
+func (r *Relay) Close() error {
+	close(r.done)
+	r.mu.Lock()
+	for k, f := range r.flows {
+		f.upstream.Close()
+		delete(r.flows, k)
+	}
+	r.mu.Unlock()
+
+	if r.udp != nil {
+		return r.udp.Close()
+	}
+	return r.tcp.Close()
+}
+
+func (r *Relay) serveUDP() {
+	buf := make([]byte, 65536)
+	for {
+		n, client, err := r.udp.ReadFromUDP(buf)
+		if err != nil {
+			select {
+			case <-r.done:
+				return
+			default:
+			}
+			log.Printf("impair: failed to read from UDP: %v", err)
+			continue
+		}
+
+		f, err := r.flow(client)
+		if err != nil {
+			log.Printf("impair: cannot relay for %s: %v", client, err)
+			continue
+		}
+
+		pkt := append([]byte(nil), buf[:n]...)
+		for _, d := range r.forward.plan() {
+			time.AfterFunc(d, func() {
+				f.upstream.Write(pkt)
+			})
+		}
+	}
+}
+
+// flow returns the upstream socket for a client, making one if needed
+func (r *Relay) flow(client *net.UDPAddr) (*udpFlow, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if f := r.flows[client.String()]; f != nil {
+		f.lastSeen = time.Now()
+		return f, nil
+	}
+
+	raddr, err := net.ResolveUDPAddr("udp", r.target)
+	if err != nil {
+		return nil, err
+	}
+	up, err := net.DialUDP("udp", nil, raddr)
+	if err != nil {
+		return nil, err
+	}
+
+	f := &udpFlow{client: client, upstream: up, lastSeen: time.Now()}
+	r.flows[client.String()] = f
+	go r.serveUpstream(f)
+	return f, nil
+}
+
+func (r *Relay) serveUpstream(f *udpFlow) {
+	buf := make([]byte, 65536)
+	for {
+		n, err := f.upstream.Read(buf)
+		if err != nil {
+			return
+		}
+
+		pkt := append([]byte(nil), buf[:n]...)
+		for _, d := range r.reverse.plan() {
+			time.AfterFunc(d, func() {
+				r.udp.WriteToUDP(pkt, f.client)
+			})
+		}
+	}
+}
+
+func (r *Relay) expireFlows() {
+	ticker := time.NewTicker(udpIdleTimeout / 4)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-r.done:
+			return
+		case <-ticker.C:
+		}
+
+		r.mu.Lock()
+		for k, f := range r.flows {
+			if time.Since(f.lastSeen) > udpIdleTimeout {
+				f.upstream.Close()
+				delete(r.flows, k)
+			}
+		}
+		r.mu.Unlock()
+	}
+}
+
+func (r *Relay) serveTCP() {
+	for {
+		conn, err := r.tcp.Accept()
+		if err != nil {
+			select {
+			case <-r.done:
+				return
+			default:
+			}
+			log.Printf("impair: failed to accept TCP: %v", err)
+			continue
+		}
+		go r.handleTCP(conn)
+	}
+}
+
+func (r *Relay) handleTCP(client net.Conn) {
+	up, err := net.DialTimeout("tcp", r.target, 10*time.Second)
+	if err != nil {
+		log.Printf("impair: cannot relay for %s: %v", client.RemoteAddr(), err)
+		client.Close()
+		return
+	}
+
+	go delayedCopy(up, client, r.forward)
+	go delayedCopy(client, up, r.reverse)
+}
+
+type delayedChunk struct {
+	at   time.Time
+	data []byte
+	eof  bool
+}
+
+// delayedCopy copies src to dst, holding every chunk back as the impairer says
+func delayedCopy(dst net.Conn, src net.Conn, im *impairer) {
+	queue := make(chan delayedChunk, 1024)
+
+	go func() {
+		defer dst.Close()
+		for c := range queue {
+			time.Sleep(time.Until(c.at))
+			if c.eof {
+				return
+			}
+			if _, err := dst.Write(c.data); err != nil {
+				return
+			}
+		}
+	}()
+
+	buf := make([]byte, 32*1024)
+	for {
+		n, err := src.Read(buf)
+		if n > 0 {
+			queue <- delayedChunk{at: im.ordered(time.Now()), data: append([]byte(nil), buf[:n]...)}
+		}
+		if err != nil {
+			if err != io.EOF {
+				src.Close()
+			}
+			queue <- delayedChunk{at: im.ordered(time.Now()), eof: true}
+			close(queue)
+			return
+		}
+	}
+}
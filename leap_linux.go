@@ -0,0 +1,25 @@
+// +build linux
+
+package main
+
+import "golang.org/x/sys/unix"
+
+const (
+	kernelStaINS   = 0x0010 // STA_INS, insert a leap second at the end of the day
+	kernelStaDEL   = 0x0020 // STA_DEL, delete a leap second at the end of the day
+	kernelTimeOOP  = 3      // TIME_OOP, the leap second is happening right now
+	kernelTimeWAIT = 4      // TIME_WAIT, the leap second has just happened
+)
+
+// kernelLeapStatus asks the kernel (via adjtimex) if a leap second is scheduled or in progress
+func kernelLeapStatus() (pending bool, inProgress bool) {
+	tx := unix.Timex{}
+	state, err := unix.Adjtimex(&tx)
+	if err != nil {
+		return false, false
+	}
+
+	pending = tx.Status&(kernelStaINS|kernelStaDEL) != 0
+	inProgress = state == kernelTimeOOP || state == kernelTimeWAIT
+	return pending && !inProgress, inProgress
+}
@@ -0,0 +1,8 @@
+// +build !linux
+
+package main
+
+// kernelLeapStatus is not available on this platform, so leap seconds are never expected
+func kernelLeapStatus() (pending bool, inProgress bool) {
+	return false, false
+}
@@ -0,0 +1,140 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"log"
+	"net"
+	"net/url"
+	"strings"
+)
+
+// On a router with several uplinks, the same peer can be measured over each
+// by having sping listen on an address (or interface, or VRF) for each, and
+// pointing peers at the one to use with listener=. Sessions on a listener
+// send and take in packets on its socket, and its name is in the metrics.
+
+var listenersFlag = flag.String("listeners", "", "More addresses to listen on, as a comma separated list of name=host:port, each optionally with ?interface=dev or ?vrf=dev")
+
+// listener is somewhere sping takes sessions on, the one from -listenAddr has no name
+type listener struct {
+	Name string
+	Addr string
+	bind localBinding // The device it is bound to, and its address if it is not a wildcard
+
+	udp *net.UDPConn
+}
+
+// listeners are the listeners sping has open, by name
+var listeners = map[string]*listener{}
+
+// parseListener reads a listener, like uplink1=192.0.2.1:6924?interface=eth1
+func parseListener(s string) (*listener, error) {
+	s = strings.TrimSpace(s)
+	kv := strings.SplitN(s, "=", 2)
+	if len(kv) != 2 || kv[0] == "" {
+		return nil, fmt.Errorf("listener %q is not name=host:port", s)
+	}
+	l := &listener{Name: kv[0], Addr: kv[1]}
+	var opts url.Values
+	if i := strings.Index(l.Addr, "?"); i != -1 {
+		var err error
+		if opts, err = url.ParseQuery(l.Addr[i+1:]); err != nil {
+			return nil, fmt.Errorf("listener %s: %v", l.Name, err)
+		}
+		l.Addr = l.Addr[:i]
+	}
+
+	host, _, err := net.SplitHostPort(l.Addr)
+	if err != nil {
+		return nil, fmt.Errorf("listener %s: %v", l.Name, err)
+	}
+	if host != "" {
+		ip := net.ParseIP(host)
+		if ip == nil {
+			return nil, fmt.Errorf("listener %s: %q is not an IP", l.Name, host)
+		}
+		if !ip.IsUnspecified() {
+			l.bind.Source = ip
+		}
+	}
+	if opts.Get("interface") != "" && opts.Get("vrf") != "" {
+		return nil, fmt.Errorf("listener %s: only one of interface and vrf can be given", l.Name)
+	}
+	l.bind.Device = opts.Get("interface") + opts.Get("vrf")
+	return l, nil
+}
+
+// parseListeners reads the -listeners flag
+func parseListeners(s string) ([]*listener, error) {
+	if s == "" {
+		return nil, nil
+	}
+	seen := map[string]bool{}
+	var out []*listener
+	for _, v := range strings.Split(s, ",") {
+		l, err := parseListener(v)
+		if err != nil {
+			return nil, err
+		}
+		if seen[l.Name] {
+			return nil, fmt.Errorf("listener %s is given twice", l.Name)
+		}
+		seen[l.Name] = true
+		out = append(out, l)
+	}
+	return out, nil
+}
+
+// startListeners opens the listener from -listenAddr (unless it is set to ""), and any from -listeners
+func startListeners() {
+	ls, err := parseListeners(*listenersFlag)
+	if err != nil {
+		log.Fatalf("Bad -listeners: %v", err)
+	}
+	if *bindAddr != "" {
+		ls = append([]*listener{{Addr: *bindAddr}}, ls...)
+	}
+	if len(ls) == 0 {
+		log.Fatalf("Nothing to listen on, -listenAddr or -listeners has to be given")
+	}
+	for _, l := range ls {
+		if err := l.listen(); err != nil {
+			log.Fatalf("Failed to listen on %s: %v", l.Addr, err)
+		}
+		listeners[l.Name] = l
+	}
+}
+
+// listen opens the UDP socket and TCP listener, and starts taking packets and sessions on them
+func (l *listener) listen() error {
+	lc := net.ListenConfig{Control: l.bind.control}
+	u, err := lc.ListenPacket(context.Background(), "udp", l.Addr)
+	if err != nil {
+		return err
+	}
+	t, err := lc.Listen(context.Background(), "tcp", l.Addr)
+	if err != nil {
+		u.Close()
+		return err
+	}
+	l.udp = u.(*net.UDPConn)
+	go routePackets(l.udp)
+	go listenOnTCP(t, l)
+	return nil
+}
+
+// on fills in the source address and device of the listener, where b does not give its own
+func (b localBinding) on(l *listener) localBinding {
+	if l == nil {
+		return b
+	}
+	if b.Source == nil {
+		b.Source = l.bind.Source
+	}
+	if b.Device == "" {
+		b.Device = l.bind.Device
+	}
+	return b
+}
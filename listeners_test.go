@@ -0,0 +1,51 @@
+package main
+
+import (
+	"net"
+	"testing"
+)
+
+func TestParseListeners(t *testing.T) {
+	ls, err := parseListeners("up1=192.0.2.1:6924?interface=eth1, up2=[::]:7000?vrf=blue,any=:6925")
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []listener{
+		{Name: "up1", Addr: "192.0.2.1:6924", bind: localBinding{Source: net.ParseIP("192.0.2.1"), Device: "eth1"}},
+		{Name: "up2", Addr: "[::]:7000", bind: localBinding{Device: "blue"}},
+		{Name: "any", Addr: ":6925"},
+	}
+	if len(ls) != len(want) {
+		t.Fatalf("got %d listeners, want %d", len(ls), len(want))
+	}
+	for i, l := range ls {
+		w := want[i]
+		if l.Name != w.Name || l.Addr != w.Addr || !l.bind.Source.Equal(w.bind.Source) || l.bind.Device != w.bind.Device {
+			t.Fatalf("listener %d is %+v, want %+v", i, *l, w)
+		}
+	}
+
+	for _, bad := range []string{
+		"192.0.2.1:6924",
+		"=192.0.2.1:6924",
+		"up1=192.0.2.1",
+		"up1=router.example:6924",
+		"up1=192.0.2.1:6924?interface=eth1&vrf=blue",
+		"up1=192.0.2.1:6924,up1=192.0.2.2:6924",
+	} {
+		if _, err := parseListeners(bad); err == nil {
+			t.Fatalf("%q was accepted", bad)
+		}
+	}
+}
+
+func TestBindingOnListener(t *testing.T) {
+	l := &listener{bind: localBinding{Source: net.ParseIP("192.0.2.1"), Device: "eth1"}}
+	if b := (localBinding{Listener: "up1"}).on(l); !b.Source.Equal(l.bind.Source) || b.Device != "eth1" || b.Listener != "up1" {
+		t.Fatalf("got %+v, want the listener's source and device", b)
+	}
+	// What the peer gives wins
+	if b := (localBinding{Source: net.ParseIP("192.0.2.9")}).on(l); !b.Source.Equal(net.ParseIP("192.0.2.9")) || b.Device != "eth1" {
+		t.Fatalf("got %+v, want the peer's source on the listener's device", b)
+	}
+}
@@ -0,0 +1,530 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"text/tabwriter"
+	"time"
+)
+
+// sping load-test <peer> shows how a link behaves when it is busy. A normal
+// session runs the whole time, while the peer is asked (over the TCP control
+// port) to fill up one direction at a time, and then both. How much the delay
+// in each direction goes up under load is the bufferbloat. That is taken as a
+// difference, so it doesn't matter if the clocks at each end don't agree.
+
+var loadDuration = flag.Duration("load.duration", 10*time.Second, "How long each phase of sping load-test runs for (at most 25s)")
+var loadProto = flag.String("load.proto", "tcp", "How sping load-test fills the link, tcp (bulk transfer) or udp (paced at -load.rate-mbit)")
+var loadRateMbit = flag.Int("load.rate-mbit", 100, "How fast sping load-test sends with -load.proto udp, in Mbit/s")
+var loadServe = flag.Bool("load.serve", false, "Fill the link when a peer running sping load-test asks")
+
+// loadMaxDuration keeps a phase (and the wait after it) inside the 32 ack window
+const loadMaxDuration = 25 * time.Second
+
+// loadMaxRateMbit is the fastest a peer can ask for UDP load to be sent
+const loadMaxRateMbit = 10000
+
+// loadPacketSize is how big (as IP packets) UDP load is sent as
+const loadPacketSize = 1200
+
+// Only one load test is served at a time
+var loadRunning int32
+
+// Each peer can have each direction of load once in loadServeInterval, so one
+// load test at a time, not a link kept full
+const loadServeInterval = 5 * time.Minute
+
+var loadServed holdoff
+
+// loadRequest is sent after LOAD on the TCP control port, as key=value pairs
+type loadRequest struct {
+	Direction string // up is towards the peer being asked, down is from it, or both
+	Proto     string // tcp or udp
+	Duration  time.Duration
+	RateMbit  int // For udp
+	Port      int // Where down udp load should be sent
+}
+
+func (r loadRequest) String() string {
+	return fmt.Sprintf("LOAD dir=%s proto=%s ms=%d rate=%d port=%d\r\n", r.Direction, r.Proto, r.Duration/time.Millisecond, r.RateMbit, r.Port)
+}
+
+func parseLoadRequest(s string) (r loadRequest, err error) {
+	fields := strings.Fields(s)
+	if len(fields) == 0 || fields[0] != "LOAD" {
+		return r, fmt.Errorf("not a load request")
+	}
+	for _, f := range fields[1:] {
+		kv := strings.SplitN(f, "=", 2)
+		if len(kv) != 2 {
+			return r, fmt.Errorf("bad option %q", f)
+		}
+		switch kv[0] {
+		case "dir":
+			r.Direction = kv[1]
+		case "proto":
+			r.Proto = kv[1]
+		case "ms", "rate", "port":
+			n, err := strconv.Atoi(kv[1])
+			if err != nil {
+				return r, fmt.Errorf("bad option %q", f)
+			}
+			switch kv[0] {
+			case "ms":
+				r.Duration = time.Duration(n) * time.Millisecond
+			case "rate":
+				r.RateMbit = n
+			case "port":
+				r.Port = n
+			}
+		}
+	}
+
+	if r.Direction != "up" && r.Direction != "down" && r.Direction != "both" {
+		return r, fmt.Errorf("bad direction %q", r.Direction)
+	}
+	if r.Proto != "tcp" && r.Proto != "udp" {
+		return r, fmt.Errorf("bad protocol %q", r.Proto)
+	}
+	if r.Duration <= 0 || r.Duration > loadMaxDuration {
+		return r, fmt.Errorf("load can last at most %s", loadMaxDuration)
+	}
+	if r.Proto == "udp" {
+		if r.RateMbit < 1 || r.RateMbit > loadMaxRateMbit {
+			return r, fmt.Errorf("bad rate %d", r.RateMbit)
+		}
+		if r.Direction != "up" && (r.Port < 1 || r.Port > 65535) {
+			return r, fmt.Errorf("bad port %d", r.Port)
+		}
+	}
+	return r, nil
+}
+
+// errLoadUnsupported is when the peer runs a sping from before load tests
+var errLoadUnsupported = errors.New("peer does not support load tests, it needs a newer sping")
+
+// handleLoadRequest is the peer end of a load test on l, filling the link with (or taking in) what was asked for
+func handleLoadRequest(conn net.Conn, line string, l *listener) {
+	req, err := parseLoadRequest(line)
+	if err != nil {
+		conn.Write([]byte("I_DONT_UNDERSTAND"))
+		return
+	}
+	if !*loadServe {
+		conn.Write([]byte("REFUSED\r\n"))
+		return
+	}
+	peerIP := conn.RemoteAddr().(*net.TCPAddr).IP
+	if !loadServed.allow(peerIP.String()+" "+req.Direction, clock.Now(), loadServeInterval) {
+		conn.Write([]byte("TOO_SOON\r\n"))
+		return
+	}
+	if !atomic.CompareAndSwapInt32(&loadRunning, 0, 1) {
+		conn.Write([]byte("BUSY\r\n"))
+		return
+	}
+	defer atomic.StoreInt32(&loadRunning, 0)
+
+	log.Printf("Load test from %s: %s %s for %s", peerIP, req.Proto, req.Direction, req.Duration)
+
+	// UDP load gets a socket of its own, so it doesn't crowd pings out
+	bind := localBinding{}.on(l)
+	var sink *loadSink
+	port := 0
+	if req.Proto == "udp" && req.Direction != "down" {
+		if sink, err = newLoadSink(bind); err != nil {
+			conn.Write([]byte("BUSY\r\n"))
+			return
+		}
+		defer sink.Close()
+		port = sink.Port()
+	}
+	if _, err := fmt.Fprintf(conn, "OK port=%d\r\n", port); err != nil {
+		return
+	}
+	runLoad(conn, conn, bind, peerIP, req.Port, req, req.Direction != "up", req.Direction != "down", sink)
+}
+
+// requestLoad asks the peer at addr for load, and runs our end of it from
+// where bind pins it to. It returns once the load is over, with how much we
+// sent and got.
+func requestLoad(addr string, bind localBinding, req loadRequest) (sent, received int64, err error) {
+	d := bind.dialer("tcp")
+	d.Timeout = 5 * time.Second
+	conn, err := d.Dial("tcp", addr)
+	if err != nil {
+		return 0, 0, err
+	}
+	defer conn.Close()
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	br := bufio.NewReader(conn)
+	banner, err := br.ReadString('\n')
+	if err != nil {
+		return 0, 0, fmt.Errorf("host banner not sping")
+	}
+	if err := checkBanner(banner); err != nil {
+		return 0, 0, err
+	}
+
+	var sink *loadSink
+	if req.Proto == "udp" && req.Direction != "up" {
+		if sink, err = newLoadSink(bind); err != nil {
+			return 0, 0, err
+		}
+		defer sink.Close()
+		req.Port = sink.Port()
+	}
+	if _, err := conn.Write([]byte(req.String())); err != nil {
+		return 0, 0, err
+	}
+	reply, err := br.ReadString('\n')
+	if strings.HasPrefix(reply, "I_DONT_UNDERSTAND") {
+		return 0, 0, errLoadUnsupported
+	}
+	if !strings.HasPrefix(reply, "OK ") {
+		if err != nil && reply == "" {
+			return 0, 0, err
+		}
+		return 0, 0, fmt.Errorf("peer turned the load test down (%q)", strings.TrimSpace(reply))
+	}
+	port, _ := strconv.Atoi(strings.TrimPrefix(strings.TrimSpace(reply), "OK port="))
+	peerIP := conn.RemoteAddr().(*net.TCPAddr).IP
+
+	sent, received = runLoad(conn, br, bind, peerIP, port, req, req.Direction != "down", req.Direction != "up", sink)
+	return sent, received, nil
+}
+
+// runLoad sends and/or takes in load for as long as req says. TCP load goes
+// over the control connection, UDP load goes to port on the peer (from where
+// bind pins it to) and comes in on the sink.
+func runLoad(conn net.Conn, r io.Reader, bind localBinding, peerIP net.IP, port int, req loadRequest, send, recv bool, sink *loadSink) (sent, received int64) {
+	until := time.Now().Add(req.Duration)
+	var wg sync.WaitGroup
+	if req.Proto == "tcp" {
+		conn.SetDeadline(until)
+		if send {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				buf := make([]byte, 64*1024)
+				for {
+					n, err := conn.Write(buf)
+					sent += int64(n)
+					if err != nil {
+						return
+					}
+				}
+			}()
+		}
+		if recv {
+			received, _ = io.Copy(ioutil.Discard, r)
+		}
+		wg.Wait()
+		return sent, received
+	}
+
+	if send {
+		sent = paceUDP(bind, &net.UDPAddr{IP: peerIP, Port: port}, req.RateMbit, until)
+	}
+	time.Sleep(time.Until(until))
+	if recv && sink != nil {
+		received = sink.Bytes()
+	}
+	return sent, received
+}
+
+// paceUDP sends UDP load to to at rateMbit until until, returning how many bytes went
+func paceUDP(bind localBinding, to *net.UDPAddr, rateMbit int, until time.Time) (sent int64) {
+	c, err := bind.dialer("udp").Dial("udp", to.String())
+	if err != nil {
+		return 0
+	}
+	defer c.Close()
+	buf := make([]byte, loadPacketSize-headerLen(to.IP))
+	interval := time.Duration(float64(loadPacketSize*8) / (float64(rateMbit) * 1e6) * float64(time.Second))
+	next := time.Now()
+	for time.Now().Before(until) {
+		if _, err := c.Write(buf); err == nil {
+			sent += loadPacketSize
+		}
+		// Sleeps are not that fine grained, so at high rates this catches up in bursts
+		next = next.Add(interval)
+		if d := time.Until(next); d > 0 {
+			time.Sleep(d)
+		}
+	}
+	return sent
+}
+
+// loadSink takes in UDP load, counting it
+type loadSink struct {
+	conn  *net.UDPConn
+	bytes int64
+}
+
+// newLoadSink opens a sink on the source address and device bind gives
+func newLoadSink(bind localBinding) (*loadSink, error) {
+	addr := ":0"
+	if bind.Source != nil {
+		addr = net.JoinHostPort(bind.Source.String(), "0")
+	}
+	lc := net.ListenConfig{Control: bind.control}
+	c, err := lc.ListenPacket(context.Background(), "udp", addr)
+	if err != nil {
+		return nil, err
+	}
+	s := &loadSink{conn: c.(*net.UDPConn)}
+	go func() {
+		buf := make([]byte, 2048)
+		for {
+			n, _, err := c.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+			atomic.AddInt64(&s.bytes, int64(n+headerLen(net.IPv4zero)))
+		}
+	}()
+	return s, nil
+}
+
+func (s *loadSink) Port() int    { return s.conn.LocalAddr().(*net.UDPAddr).Port }
+func (s *loadSink) Bytes() int64 { return atomic.LoadInt64(&s.bytes) }
+func (s *loadSink) Close() error { return s.conn.Close() }
+
+// loadPhase is the delay and loss seen while one kind of load was running
+type loadPhase struct {
+	Name      string // idle, up, down or both
+	RX, TX    []time.Duration
+	RXLost    int
+	TXLost    int
+	Seconds   int // How many seconds of pings the loss is out of
+	Duration  time.Duration
+	Sent      int64
+	Received  int64
+	LoadError error
+}
+
+func (p loadPhase) rxDelay() time.Duration { return medianOrZero(p.RX) }
+func (p loadPhase) txDelay() time.Duration { return medianOrZero(p.TX) }
+
+func medianOrZero(d []time.Duration) time.Duration {
+	if len(d) == 0 {
+		return 0
+	}
+	return medianDuration(d)
+}
+
+// bufferbloatGrade grades how much the delay goes up under load, in the same bands as the common web tests
+func bufferbloatGrade(increase time.Duration) string {
+	switch {
+	case increase < 5*time.Millisecond:
+		return "A+"
+	case increase < 30*time.Millisecond:
+		return "A"
+	case increase < 60*time.Millisecond:
+		return "B"
+	case increase < 200*time.Millisecond:
+		return "C"
+	case increase < 400*time.Millisecond:
+		return "D"
+	}
+	return "F"
+}
+
+// loadTestPeer reads the peer given to sping load-test, a host, a host:port,
+// or a sping:// URL as in -peers
+func loadTestPeer(s string) (spec peerSpec, bind localBinding, err error) {
+	switch host, port, herr := net.SplitHostPort(s); {
+	case strings.Contains(s, "://"):
+		if spec, err = parsePeerSpec(s); err != nil {
+			return spec, bind, err
+		}
+		if spec.Proto != "sping" {
+			return spec, bind, fmt.Errorf("only sping peers can be load tested")
+		}
+	case herr == nil:
+		spec = peerSpec{Proto: "sping", Host: host, Options: url.Values{}}
+		if spec.Port, err = strconv.Atoi(port); err != nil || spec.Port < 1 || spec.Port > 65535 {
+			return spec, bind, fmt.Errorf("bad port %s", port)
+		}
+	default:
+		spec = peerSpec{Proto: "sping", Host: s, Options: url.Values{}}
+	}
+	if bind, err = spec.localBinding(); err != nil {
+		return spec, bind, err
+	}
+	if bind.Listener != "" {
+		return spec, bind, fmt.Errorf("load-test has a listener of its own, listener= can't be given")
+	}
+	return spec, bind, nil
+}
+
+func runLoadTest(peer string) {
+	spec, bind, err := loadTestPeer(peer)
+	if err != nil {
+		log.Fatalf("Cannot load test %s: %v", peer, err)
+	}
+	addr, err := net.ResolveIPAddr("ip", spec.Host)
+	if err != nil {
+		log.Fatalf("Cannot load test %s: %v", peer, err)
+	}
+	ip := addr.IP
+	d := *loadDuration
+	if d > loadMaxDuration {
+		d = loadMaxDuration
+	}
+
+	// A socket of our own for the session, so this works next to a running sping
+	uListener, err := net.ListenPacket("udp", ":0")
+	if err != nil {
+		log.Fatalf("Failed to listen on UDP %v", err)
+	}
+	listeners[""] = &listener{udp: uListener.(*net.UDPConn)}
+	go routePackets(uListener.(*net.UDPConn))
+	port := spec.Port
+	if port == 0 {
+		port = defaultPorts["sping"]
+	}
+	go startSession(&net.UDPAddr{IP: ip, Port: port}, inviteOptions{}, bind, "tcp")
+
+	var ses *session
+	for start := clock.Now(); ses == nil; {
+		if clock.Since(start) > 30*time.Second {
+			log.Fatalf("Could not start a session with %s", ip)
+		}
+		clock.Sleep(time.Second)
+		sessionLock.Lock()
+		for _, v := range sessionMap {
+			if v.PeerAddress.Equal(ip) && v.UDPActivated {
+				ses = v
+			}
+		}
+		sessionLock.Unlock()
+	}
+	sessionLock.Lock()
+	loadable, local := ses.can(featureLoad), ses.bind
+	sessionLock.Unlock()
+	if !loadable {
+		log.Fatalf("Cannot load test %s: %v", ip, errLoadUnsupported)
+	}
+	// Let the ack window fill up before starting
+	clock.Sleep(5 * time.Second)
+
+	fmt.Printf("Load testing %s with %s, %s a phase\n", ip, *loadProto, d)
+	control := net.JoinHostPort(ip.String(), strconv.Itoa(port))
+	var phases []loadPhase
+	for _, name := range []string{"idle", "up", "down", "both"} {
+		var load func() (int64, int64, error)
+		if name != "idle" {
+			req := loadRequest{Direction: name, Proto: *loadProto, Duration: d, RateMbit: *loadRateMbit}
+			load = func() (int64, int64, error) { return requestLoad(control, local, req) }
+		}
+		p := measurePhase(ses, name, d, load)
+		if p.LoadError != nil {
+			log.Printf("Load test %s phase failed: %v", name, p.LoadError)
+		}
+		phases = append(phases, p)
+	}
+	printLoadTest(os.Stdout, phases)
+}
+
+// measurePhase runs load (nothing if nil) for d, collecting the delay and loss of the session while it does
+func measurePhase(ses *session, name string, d time.Duration, load func() (int64, int64, error)) loadPhase {
+	p := loadPhase{Name: name}
+	done := make(chan bool, 1)
+	go func() {
+		if load != nil {
+			p.Sent, p.Received, p.LoadError = load()
+		} else {
+			clock.Sleep(d)
+		}
+		done <- true
+	}()
+
+	start := clock.Now()
+	var lastID uint8
+	for clock.Since(start) < d {
+		clock.Sleep(time.Second)
+		sessionLock.Lock()
+		if ses.LastRXPing.ID != lastID && !ses.LastRX.Before(start) {
+			lastID = ses.LastRXPing.ID
+			RXL, TXL, _, _, _ := getStats(ses.LastRX, ses.LastRXPing, ses)
+			p.RX = append(p.RX, RXL)
+			if TXL != 0 {
+				p.TX = append(p.TX, TXL)
+			}
+		}
+		sessionLock.Unlock()
+	}
+	<-done
+	end := clock.Now()
+	p.Duration = end.Sub(start)
+
+	// Give the last pings, and the acks for them, time to come back
+	clock.Sleep(2 * time.Second)
+	sessionLock.Lock()
+	for sec := start.Unix() + 1; sec < end.Unix(); sec++ {
+		id := uint8(sec%255) + 1
+		p.Seconds++
+		if !dumbLastAckSearchForID(id, ses.LastAcks) {
+			p.RXLost++
+		}
+		if !dumbLastAckSearchForID(id, ses.LastRXPing.LastAcks) {
+			p.TXLost++
+		}
+	}
+	sessionLock.Unlock()
+	return p
+}
+
+func printLoadTest(w io.Writer, phases []loadPhase) {
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(tw, "Phase\tRX delay\tTX delay\tRX loss\tTX loss\tLoad sent\tLoad got")
+	for _, p := range phases {
+		fmt.Fprintf(tw, "%s\t%s\t%s\t%s\t%s\t%s\t%s\n", p.Name,
+			fmtTraceDuration(p.rxDelay()), fmtTraceDuration(p.txDelay()),
+			fmtLoss(p.RXLost, p.Seconds), fmtLoss(p.TXLost, p.Seconds),
+			fmtRate(p.Sent, p.Duration), fmtRate(p.Received, p.Duration))
+	}
+	tw.Flush()
+
+	idle := phases[0]
+	var rxBloat, txBloat time.Duration
+	for _, p := range phases[1:] {
+		if p.Name != "down" && p.txDelay()-idle.txDelay() > txBloat {
+			txBloat = p.txDelay() - idle.txDelay()
+		}
+		if p.Name != "up" && p.rxDelay()-idle.rxDelay() > rxBloat {
+			rxBloat = p.rxDelay() - idle.rxDelay()
+		}
+	}
+	fmt.Fprintf(w, "\nBufferbloat: tx (up) +%s, grade %s. rx (down) +%s, grade %s\n",
+		fmtTraceDuration(txBloat), bufferbloatGrade(txBloat), fmtTraceDuration(rxBloat), bufferbloatGrade(rxBloat))
+}
+
+func fmtLoss(lost, of int) string {
+	if of == 0 {
+		return "-"
+	}
+	return fmt.Sprintf("%.0f%%", float64(lost)*100/float64(of))
+}
+
+func fmtRate(bytes int64, d time.Duration) string {
+	if bytes == 0 || d <= 0 {
+		return "-"
+	}
+	return fmt.Sprintf("%.1f Mbit/s", float64(bytes*8)/d.Seconds()/1e6)
+}
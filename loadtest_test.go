@@ -0,0 +1,145 @@
+package main
+
+import (
+	"bytes"
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestLoadRequest(t *testing.T) {
+	want := loadRequest{Direction: "both", Proto: "udp", Duration: 10 * time.Second, RateMbit: 50, Port: 4000}
+	got, err := parseLoadRequest(want.String())
+	if err != nil || got != want {
+		t.Fatalf("%q read as %+v (%v)", want, got, err)
+	}
+	for _, bad := range []string{
+		"LOAD dir=sideways proto=tcp ms=1000\r\n",
+		"LOAD dir=up proto=tcp ms=600000\r\n",
+		"LOAD dir=down proto=udp ms=1000 rate=50\r\n", // Nowhere to send it
+		"LOAD dir=up proto=udp ms=1000 rate=0\r\n",
+	} {
+		if _, err := parseLoadRequest(bad); err == nil {
+			t.Fatalf("%q was accepted", bad)
+		}
+	}
+}
+
+func TestLoadExchange(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go handleTCPconnection(conn, &listener{})
+		}
+	}()
+
+	req := loadRequest{Direction: "up", Proto: "tcp", Duration: 300 * time.Millisecond}
+	if _, _, err := requestLoad(ln.Addr().String(), localBinding{}, req); err == nil {
+		t.Fatalf("load served without -load.serve")
+	}
+	*loadServe = true
+	loadServed = holdoff{}
+	defer func() { *loadServe = false }()
+
+	for _, req := range []loadRequest{
+		{Direction: "up", Proto: "tcp"},
+		{Direction: "down", Proto: "tcp"},
+		{Direction: "both", Proto: "udp", RateMbit: 10},
+	} {
+		req.Duration = 300 * time.Millisecond
+		sent, received, err := requestLoad(ln.Addr().String(), localBinding{}, req)
+		if err != nil {
+			t.Fatalf("%s %s: %v", req.Proto, req.Direction, err)
+		}
+		if (req.Direction != "down") != (sent > 0) || (req.Direction != "up") != (received > 0) {
+			t.Fatalf("%s %s: sent %d and got %d bytes", req.Proto, req.Direction, sent, received)
+		}
+	}
+
+	// Asking for the same again straight away is turned down
+	if _, _, err := requestLoad(ln.Addr().String(), localBinding{}, req); err == nil || !strings.Contains(err.Error(), "TOO_SOON") {
+		t.Fatalf("load served again inside the holdoff: %v", err)
+	}
+}
+
+func TestLoadUnsupported(t *testing.T) {
+	// A sping from before load tests answers LOAD like any other line it doesn't know
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	go func() {
+		conn, err := ln.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		conn.Write([]byte("sping-0.3-https://github.com/benjojo/sping\n"))
+		conn.Read(make([]byte, 1000))
+		conn.Write([]byte("I_DONT_UNDERSTAND"))
+	}()
+
+	req := loadRequest{Direction: "up", Proto: "tcp", Duration: 300 * time.Millisecond}
+	if _, _, err := requestLoad(ln.Addr().String(), localBinding{}, req); err != errLoadUnsupported {
+		t.Fatalf("old peer gave %v", err)
+	}
+}
+
+func TestLoadTestPeer(t *testing.T) {
+	for _, tt := range []struct {
+		in, host string
+		port     int
+		source   string
+		ok       bool
+	}{
+		{"192.0.2.1", "192.0.2.1", 0, "<nil>", true},
+		{"192.0.2.1:7000", "192.0.2.1", 7000, "<nil>", true},
+		{"[2001:db8::1]:7000", "2001:db8::1", 7000, "<nil>", true},
+		{"2001:db8::1", "2001:db8::1", 0, "<nil>", true},
+		{"example.com", "example.com", 0, "<nil>", true},
+		{"sping://192.0.2.1:7000?source=198.51.100.2", "192.0.2.1", 7000, "198.51.100.2", true},
+		{"192.0.2.1:99999", "", 0, "", false},
+		{"twamp://192.0.2.1", "", 0, "", false},
+		{"sping://192.0.2.1?listener=up1", "", 0, "", false},
+	} {
+		spec, bind, err := loadTestPeer(tt.in)
+		if (err == nil) != tt.ok {
+			t.Errorf("%s: %v", tt.in, err)
+			continue
+		}
+		if tt.ok && (spec.Host != tt.host || spec.Port != tt.port || bind.Source.String() != tt.source) {
+			t.Errorf("%s: read as %s port %d from %s", tt.in, spec.Host, spec.Port, bind.Source)
+		}
+	}
+}
+
+func TestLoadTestReport(t *testing.T) {
+	ms := func(n ...int) []time.Duration {
+		var d []time.Duration
+		for _, v := range n {
+			d = append(d, time.Duration(v)*time.Millisecond)
+		}
+		return d
+	}
+	phases := []loadPhase{
+		{Name: "idle", RX: ms(10, 11, 10), TX: ms(20, 20, 21), Seconds: 9},
+		{Name: "up", RX: ms(10, 10, 10), TX: ms(100, 120, 110), Seconds: 9},
+		{Name: "down", RX: ms(12, 13, 12), TX: ms(20, 20, 20), Seconds: 9, RXLost: 1},
+		{Name: "both", RX: ms(13, 14, 13), TX: ms(90, 95, 100), Seconds: 9},
+	}
+	var buf bytes.Buffer
+	printLoadTest(&buf, phases)
+	if !strings.Contains(buf.String(), "tx (up) +90.0ms, grade C. rx (down) +3.0ms, grade A+") {
+		t.Fatalf("report came out as:\n%s", buf.String())
+	}
+}
@@ -5,7 +5,6 @@ import (
 	"fmt"
 	"log"
 	"net"
-	"strings"
 	"sync"
 	"time"
 
@@ -17,10 +16,10 @@ var packetLimiter = rate.NewLimiter(100, 300)
 
 var debugFlagSlotShow = flag.Bool("debug.showslots", false, "Show incoming packet latency slots")
 var debugShowLiveStats = flag.Bool("debug.showstats", false, "Show per ping info, and timestamps")
+var peers = flag.String("peers", "", "List of IPs that are peers, or proto://host[:port] for other kinds of peer (stamp, owamp, twamp, ntp, icmp-timestamp)")
 
 func main() {
 	udpPPSin := flag.Int("udp.pps", 100, "max inbound PPS that can be processed at once")
-	peers := flag.String("peers", "", "List of IPs that are peers")
 	flag.Parse()
 
 	if *usePPS && !*flagClockIsPerfect {
@@ -33,21 +32,55 @@ func main() {
 	packetLimiter = rate.NewLimiter(rate.Limit(*udpPPSin), (*udpPPSin)*3)
 	getTimeOffset()
 
-	go listenOnTCP()
-	go listenAndRoute()
+	if flag.Arg(0) == "trace" {
+		if flag.NArg() != 2 {
+			log.Fatalf("Usage: sping [flags] trace <host>")
+		}
+		if *usePPS {
+			go ppsClockTicker()
+		}
+		runTrace(flag.Arg(1))
+		return
+	}
+	if flag.Arg(0) == "load-test" {
+		if flag.NArg() != 2 {
+			log.Fatalf("Usage: sping [flags] load-test <peer>")
+		}
+		if *usePPS {
+			go ppsClockTicker()
+		} else {
+			go sysClockTicker()
+		}
+		runLoadTest(flag.Arg(1))
+		return
+	}
+
+	startListeners()
+
+	if *stampListen != "" {
+		go listenSTAMPReflector()
+	}
+	if *owampListen != "" {
+		go listenOWAMP()
+	}
+	if *twampListen != "" {
+		go listenTWAMP()
+	}
 
 	if len(*peers) != 0 {
-		peerList := strings.Split(*peers, ",")
+		peerList := splitPeers(*peers)
 		for _, v := range peerList {
-			ip := net.ParseIP(v)
-			if ip != nil {
-				// Start a session with this host
-				go startSession(ip)
+			spec, err := parsePeerSpec(v)
+			if err != nil {
+				log.Printf("Ignoring peer: %v", err)
+				continue
 			}
+			startPeer(spec)
 		}
 	}
 
 	go sessionGC()
+	go watchLocalClockSteps()
 
 	if *usePPS {
 		go ppsClockTicker()
@@ -58,25 +91,107 @@ func main() {
 	go handlePrometheus()
 	for {
 
-		a := timeNowCorrected().Unix()
-		u := time.Until(time.Unix(a+1, 0).Add(timeOffset * -1))
-		time.Sleep(u)
+		clock.Sleep(clock.Until(nextSecondBoundary()))
 		if *debugShowLiveStats {
-			fmt.Printf("it is now: %s\n", time.Now())
+			fmt.Printf("it is now: %s\n", clock.Now())
 		}
 	}
 }
 
+// startPeer kicks off measurements towards a peer from the -peers flag
+func startPeer(spec peerSpec) {
+	switch spec.Proto {
+	case "sping":
+		ip := net.ParseIP(spec.Host)
+		if ip == nil {
+			log.Printf("Ignoring peer %s: sping peers must be an IP", spec)
+			return
+		}
+		classes, err := spec.trafficClasses()
+		if err != nil {
+			log.Printf("Ignoring peer %s: %v", spec, err)
+			return
+		}
+		flows, err := spec.flowCount()
+		if err != nil {
+			log.Printf("Ignoring peer %s: %v", spec, err)
+			return
+		}
+		size, sweep, err := spec.sizeOptions()
+		if err != nil {
+			log.Printf("Ignoring peer %s: %v", spec, err)
+			return
+		}
+		transports, err := spec.transports()
+		if err != nil {
+			log.Printf("Ignoring peer %s: %v", spec, err)
+			return
+		}
+		bind, err := spec.localBinding()
+		if err != nil {
+			log.Printf("Ignoring peer %s: %v", spec, err)
+			return
+		}
+		handshake, err := spec.handshakeMode()
+		if err != nil {
+			log.Printf("Ignoring peer %s: %v", spec, err)
+			return
+		}
+		if listeners[bind.Listener] == nil {
+			log.Printf("Ignoring peer %s: there is no listener called %q", spec, bind.Listener)
+			return
+		}
+		peer := &net.UDPAddr{IP: ip, Port: 6924}
+		if spec.Port != 0 {
+			peer.Port = spec.Port
+		}
+		// Start a session with this host, one for each class, transport and flow it should be probed with
+		for _, class := range classes {
+			for _, transport := range transports {
+				opts := inviteOptions{Class: class, Transport: transport, Size: size}
+				if transport == "" {
+					// Sweeps and trains only mean something over UDP
+					opts.Sweep, opts.Capacity = sweep, spec.boolOption("capacity")
+				}
+				opts.Lock = spec.boolOption("lock")
+				if flows == 0 {
+					go startSession(peer, opts, bind, handshake)
+					continue
+				}
+				for flow := 1; flow <= flows; flow++ {
+					opts.Flow = flow
+					go startSession(peer, opts, bind, handshake)
+				}
+			}
+		}
+	case "stamp":
+		go runSTAMPSender(spec)
+	case "owamp":
+		go runOWAMPClient(spec)
+	case "twamp":
+		go runTWAMPClient(spec)
+	case "ntp":
+		go runNTPTarget(spec)
+	case "icmp-timestamp":
+		go runICMPTimestampTarget(spec)
+	}
+}
+
 func ppsClockTicker() {
 	sessionList := make([]*session, 0)
-	setupPPS()
+	src := newTimeSource()
 
 	for {
-		waitForPPSPulse()
+		tick, err := src.Next()
+		if err != nil {
+			log.Printf("PPS pulse failed! %v", err)
+			continue
+		}
 
+		recordTick(tick)
 		for _, v := range sessionList {
 			select {
-			case v.pulse <- true:
+			case v.pulse <- tick:
 			default:
 				// Well /shrug I guess
 			}
@@ -95,13 +210,11 @@ func sysClockTicker() {
 	sessionList := make([]*session, 0)
 
 	for {
-		a := timeNowCorrected().Unix()
-		u := time.Until(time.Unix(a+1, 0).Add(timeOffset * -1))
-		time.Sleep(u)
+		tick, _ := systemClockSource{}.Next()
 
 		for _, v := range sessionList {
 			select {
-			case v.pulse <- true:
+			case v.pulse <- tick:
 			default:
 				// Well /shrug I guess
 			}
@@ -118,23 +231,34 @@ func sysClockTicker() {
 
 func sessionGC() {
 	for {
-		time.Sleep(time.Minute)
+		clock.Sleep(time.Minute)
 		sessionLock.Lock()
-		for ID, ses := range sessionMap {
-			if time.Since(ses.LastRX) > time.Minute {
-				log.Printf("GC - Session with %s for inactivity", ses.PeerAddress)
+		gcSessions()
+		sessionLock.Unlock()
+	}
+}
+
+// gcSessions removes dead sessions from the sessionMap, sessionLock must be held
+func gcSessions() {
+	for ID, ses := range sessionMap {
+		lastHeard := ses.LastRX
+		if lastHeard.Before(ses.SessionMade) {
+			lastHeard = ses.SessionMade
+		}
+		if clock.Since(lastHeard) > time.Minute {
+			log.Printf("GC - Session with %s for inactivity", ses.PeerAddress)
+			delete(sessionMap, ID)
+			ses.forgetPeerInfo()
+			continue
+		}
+		if !ses.UDPActivated {
+			if clock.Since(ses.SessionMade) > time.Second*20 {
+				log.Printf("GC - Session with %s for lack of handshake", ses.PeerAddress)
 				delete(sessionMap, ID)
+				ses.forgetPeerInfo()
 				continue
 			}
-			if !ses.UDPActivated {
-				if time.Since(ses.SessionMade) > time.Second*20 {
-					log.Printf("GC - Session with %s for lack of handshake", ses.PeerAddress)
-					delete(sessionMap, ID)
-					continue
-				}
-			}
 		}
-		sessionLock.Unlock()
 	}
 }
 
@@ -144,26 +268,66 @@ type session struct {
 	MadeByMe     bool      // If I made the session, aka if I should send the UDP Handshake
 	UDPHandshake chan bool // Used to confirm a UDP handshake
 	PeerAddress  net.IP    // Used only to start a session
+	PeerPort     int       // Where the peer takes handshakes, for sessions we made
+	Listener     string    // The name of the listener the session is on
 	SessionMade  time.Time // Used to eventually give up on a session
 
 	// Network Mobility data
 	ReplyWith net.PacketConn
 	ReplyTo   *net.UDPAddr
+	ReplyFrom net.IP       // The local address the peer's packets arrive at, nil if not known
+	bind      localBinding // Where a session we made is pinned to send from
+	inviteKey string       // Who asked for the session over UDP, so asking again gets the same one
+
+	// Where the peer's pings come from, and where ours come from as it sees them
+	Locked       bool // Packets from anywhere but where the session was set up from are dropped
+	peerAddr     addrTracker
+	localAddr    addrTracker
+	lastRejected string
+	BehindNAT    bool // If the peer sees our pings come from some other address than they leave from
+	natKnown     bool
+
+	// What the peer runs, and what the session can do, from its handshake
+	PeerSoftware string
+	WireVersion  uint8
+	Features     uint32
+	peerKnown    bool
+	peerInfo     [4]string // The splitping_peer_info labels last exported
+
+	Flow      int    // Which of the flows to the peer this is, 0 if there is just the one
+	Transport string // "icmp" or "tcp" if packets go over that, "" for UDP
+
+	// How pings are marked, and the TOS they turn up with
+	Class  trafficClass
+	RXTOS  uint8 // The TOS the peer's last packet came in with, sent back to them
+	SawTOS bool
+	rxTOS  tosTracker
+	txTOS  tosTracker
+
+	PadTo int        // Pings are padded out to this size (as IP packets), 0 to leave them be
+	sweep *sizeSweep // nil if not sweeping sizes
+
+	capacity *capacityEstimator // nil if not sending trains
 
 	// Time keeping data
-	LastAcks    [32]pingInfo
-	LastRX      time.Time
-	CurrentID   uint8
-	SessionID   uint32
-	nextAckSlot int
-	LastRXPing  pingStruct
-
-	// Time pulse channel
-	pulse chan bool
+	LastAcks      [32]pingInfo
+	LastRX        time.Time
+	CurrentID     uint8
+	SessionID     uint32
+	nextAckSlot   int
+	LastRXPing    pingStruct
+	RXTTL         uint8 // The TTL the peer's last packet came in with, sent back to them
+	rxHops        hopTracker
+	txHops        hopTracker
+	clockSteps    clockStepDetector
+	latencyShifts latencyShiftDetector
+
+	// Time pulse channel, and the last pulse seen on it
+	pulse     chan secondTick
+	lastPulse secondTick
+	sendLag   time.Duration // How long it takes from stamping TXTime to the packet leaving
 }
 
-var globalReplyWith *net.PacketConn
-
 func (s *session) getNextAckSlot() int {
 	if s.nextAckSlot != 31 {
 		s.nextAckSlot = s.nextAckSlot + 1
@@ -174,60 +338,97 @@ func (s *session) getNextAckSlot() int {
 }
 
 func (s *session) sendPackets() {
-	timeStarted := time.Now()
+	timeStarted := clock.Now()
+	if s.sweep != nil {
+		go s.runSweep()
+	}
+	if s.capacity != nil {
+		go s.runCapacityTrains()
+	}
 	for {
 		if *usePPS {
-			waitForPPSPulse()
+			s.lastPulse = <-s.pulse
 		} else {
-			a := timeNowCorrected().Unix()
-			u := time.Until(time.Unix(a+1, 0).Add(timeOffset * -1))
-			time.Sleep(u)
+			clock.Sleep(clock.Until(nextSecondBoundary()))
 		}
 
-		if (time.Since(s.LastRX) > time.Second*60) && (time.Since(timeStarted) > time.Second*10) {
+		if (clock.Since(s.LastRX) > time.Second*60) && (clock.Since(timeStarted) > time.Second*10) {
 			return
 		}
 
-		// Send pings
-		s.CurrentID = uint8(time.Now().Unix()%255) + 1
-		packet := pingStruct{
-			Type:     't',
-			Magic:    11181,
-			Session:  s.SessionID,
-			ID:       s.CurrentID,
-			TXTime:   timeNowCorrected(),
-			LastAcks: s.LastAcks,
-		}
+		s.sendPing()
+	}
+}
 
-		b, err := msgpack.Marshal(packet)
-		if err != nil {
-			log.Fatalf("Failed to marshal packet %v / %#v", err, packet)
-		}
+// sendPing sends a single time packet to the peer
+func (s *session) sendPing() {
+	var txTime time.Time
+	if *usePPS && s.lastPulse.FromPPS {
+		// Stamp against the pulse rather than the system clock, the send lag
+		// covers the marshal and write that happen after the stamp is taken
+		txTime = ppsTXTime(s.lastPulse, clock.Now(), s.sendLag)
+	} else {
+		txTime = timeNowCorrected()
+	}
+	s.CurrentID = uint8(clock.Now().Unix()%255) + 1
+	packet := pingStruct{
+		Type:     't',
+		Magic:    11181,
+		Session:  s.SessionID,
+		ID:       s.CurrentID,
+		TXTime:   txTime,
+		LastAcks: s.LastAcks,
 
-		if s.ReplyTo != nil {
-			s.ReplyWith.WriteTo(b, s.ReplyTo)
-		} else {
-			log.Printf("s.ReplyTo is nil")
-		}
+		ReceivedTTL: s.RXTTL,
+	}
+	if s.can(featureTOS) {
+		packet.ReceivedTOS, packet.SawTOS = s.RXTOS, s.SawTOS
+	}
+	if s.can(featureSeenFrom) {
+		packet.SeenFrom = s.peerAddr.Addr
+	}
+	if s.sweep != nil {
+		s.sweepReport(&packet)
+	}
+	if s.capacity != nil {
+		s.capacityReport(&packet)
+	}
+
+	sendStarted := clock.Now()
+	var b []byte
+	var err error
+	if s.PadTo != 0 && s.ReplyTo != nil {
+		b, err = marshalPadded(func(pad []byte) interface{} {
+			packet.Padding = pad
+			return packet
+		}, s.PadTo-headerLen(s.ReplyTo.IP))
+	} else {
+		b, err = msgpack.Marshal(packet)
+	}
+	if err != nil {
+		log.Fatalf("Failed to marshal packet %v / %#v", err, packet)
+	}
+
+	if s.ReplyTo != nil {
+		writeToFrom(s.ReplyWith, b, s.ReplyTo, s.Class.TOS, s.ReplyFrom)
+		s.sendLag = updateSendLag(s.sendLag, clock.Since(sendStarted))
+	} else {
+		log.Printf("s.ReplyTo is nil")
 	}
 }
 
 var sessionMap map[uint32]*session
 var sessionLock sync.RWMutex
 
-var bindAddr = flag.String("listenAddr", "[::]:6924", "Listening address")
+var bindAddr = flag.String("listenAddr", "[::]:6924", "Listening address, \"\" to only listen on -listeners")
 
-func listenAndRoute() {
-	uListener, err := net.ListenPacket("udp", *bindAddr)
-	if err != nil {
-		log.Fatalf("Failed to listen on UDP port %v", err)
-	}
-
-	globalReplyWith = &uListener
+// routePackets reads sping packets from c, replies go back out of it
+func routePackets(c *net.UDPConn) {
+	tListener := newRXInfoConn(c)
 
 	for {
 		buf := make([]byte, 10000)
-		n, rxAddr, err := uListener.ReadFrom(buf)
+		n, rxAddr, info, err := tListener.ReadFromWithInfo(buf)
 
 		if err != nil {
 			log.Fatalf("Failed to rx from UDP, %v", err)
@@ -238,12 +439,12 @@ func listenAndRoute() {
 			continue
 		}
 
-		go handlePacket(buf[:n], rxAddr.(*net.UDPAddr), uListener)
+		go handlePacket(buf[:n], rxAddr, info, c)
 	}
 }
 
-func handlePacket(buf []byte, rxAddr *net.UDPAddr, lSocket net.PacketConn) {
-	timeRX := timeNowCorrected()
+func handlePacket(buf []byte, rxAddr *net.UDPAddr, info rxInfo, lSocket net.PacketConn) {
+	timeRX := timeNowDisciplined()
 
 	rx := pingStruct{}
 	err := msgpack.Unmarshal(buf, &rx)
@@ -259,7 +460,31 @@ func handlePacket(buf []byte, rxAddr *net.UDPAddr, lSocket net.PacketConn) {
 
 	if rx.Type == 'h' {
 		// Differnet handler for handshakes
-		handleInboundHandshake(buf, rxAddr, lSocket)
+		handleInboundHandshake(buf, rxAddr, info, lSocket)
+		return
+	}
+	if rx.Type == 'i' {
+		handleUDPInvite(buf, rxAddr, lSocket)
+		return
+	}
+	if rx.Type == 'c' || rx.Type == 'a' {
+		handleUDPInviteAnswer(buf, rxAddr)
+		return
+	}
+	if rx.Type == 's' {
+		if ses := sessionMap[rx.Session]; ses != nil && ses.UDPActivated && ses.sideFromPeer(rxAddr) {
+			ses.receiveSweepProbe(buf)
+		}
+		return
+	}
+	if rx.Type == 'p' {
+		if ses := sessionMap[rx.Session]; ses != nil && ses.UDPActivated && ses.sideFromPeer(rxAddr) {
+			at := timeRX
+			if !info.Stamp.IsZero() {
+				at = info.Stamp
+			}
+			ses.receiveTrainPacket(buf, at, len(buf)+headerLen(rxAddr.IP))
+		}
 		return
 	}
 	if rx.Type != 't' {
@@ -278,18 +503,78 @@ func handlePacket(buf []byte, rxAddr *net.UDPAddr, lSocket net.PacketConn) {
 		log.Printf("Ping packet sent but session is not double activated %s", rxAddr)
 		return
 	}
+	if !ses.fromPeer(rxAddr) {
+		return
+	}
 
+	ses.receivePing(rx, timeRX, info, rxAddr, lSocket)
+}
+
+// receivePing records a time packet from the peer against the session, info is how it arrived
+func (ses *session) receivePing(rx pingStruct, timeRX time.Time, info rxInfo, rxAddr *net.UDPAddr, lSocket net.PacketConn) {
 	pI := pingInfo{
 		ID: rx.ID,
 		TX: rx.TXTime,
 		RX: timeRX,
 	}
+	for _, v := range ses.LastAcks {
+		if v.ID == pI.ID && v.TX.Equal(pI.TX) {
+			// A duplicate, acking it again would push a real packet out of the window
+			return
+		}
+	}
 	ses.LastAcks[ses.getNextAckSlot()] = pI
 	ses.ReplyWith = lSocket
 	ses.ReplyTo = rxAddr
+	ses.ReplyFrom = info.Dst
+	if !ses.LastRXPing.TXTime.IsZero() && rx.TXTime.Before(ses.LastRXPing.TXTime) {
+		// Reordered, so it has older acks than what we already have
+		return
+	}
 	ses.LastRX = timeRX
 	ses.LastRXPing = rx
 
+	if info.TTL != 0 {
+		ses.RXTTL = uint8(info.TTL)
+		ses.observeHops("rx", inferHops(info.TTL))
+	}
+	if rx.ReceivedTTL != 0 {
+		ses.observeHops("tx", inferHops(int(rx.ReceivedTTL)))
+	}
+	if info.TOSKnown {
+		ses.RXTOS, ses.SawTOS = uint8(info.TOS), true
+		if ses.Class.Marked {
+			ses.observeTOS("rx", info.TOS)
+		}
+	}
+	if rx.SawTOS && ses.Class.Marked && ses.can(featureTOS) {
+		ses.observeTOS("tx", int(rx.ReceivedTOS))
+	}
+	if rx.SeenFrom != "" {
+		ses.observeSeenFrom(rx.SeenFrom)
+	}
+	if ses.sweep != nil {
+		ses.observeSweepReport(rx)
+	}
+	if ses.capacity != nil {
+		ses.observeCapacityReport(rx)
+	}
+
+	if RXL, TXL, _, _, _ := getStats(timeRX, rx, ses); TXL != 0 {
+		quarantine, event, shift := ses.clockSteps.observe(clock.Now(), TXL, RXL)
+		if event != "" {
+			log.Printf("[%s] Peer clock event %s, offset moved by %s, quarantining samples", ses.PeerAddress, event, shift)
+			promClockSteps.WithLabelValues(event, ses.PeerAddress.String()).Inc()
+		}
+		if quarantine || localClockQuarantined(clock.Now()) {
+			promQuarantined.WithLabelValues(ses.PeerAddress.String()).Inc()
+		} else if *pathTraceShift != 0 {
+			if direction, shift := ses.latencyShifts.observe(TXL, RXL, *pathTraceShift); direction != "" {
+				pathShifted(ses, direction, shift)
+			}
+		}
+	}
+
 	if *debugFlagSlotShow {
 		for n, v := range ses.LastAcks {
 			fmt.Printf("\t[Slot %d] ID: %d - TX: %s\n", n, v.ID, v.TX.Sub(v.RX))
@@ -303,7 +588,7 @@ func handlePacket(buf []byte, rxAddr *net.UDPAddr, lSocket net.PacketConn) {
 
 }
 
-func handleInboundHandshake(buf []byte, rxAddr *net.UDPAddr, lSocket net.PacketConn) {
+func handleInboundHandshake(buf []byte, rxAddr *net.UDPAddr, info rxInfo, lSocket net.PacketConn) {
 
 	rx := handshakeStruct{}
 	err := msgpack.Unmarshal(buf, &rx)
@@ -317,11 +602,6 @@ func handleInboundHandshake(buf []byte, rxAddr *net.UDPAddr, lSocket net.PacketC
 		return
 	}
 
-	if rx.Version != 3 {
-		log.Printf("Invalid UDP handshake version from %v", rxAddr.String())
-		return
-	}
-
 	ses := sessionMap[rx.Session]
 	if ses == nil {
 		log.Printf("Handshake packet sent without an active session by %s", rxAddr)
@@ -333,10 +613,18 @@ func handleInboundHandshake(buf []byte, rxAddr *net.UDPAddr, lSocket net.PacketC
 		return
 	}
 	wasAlreadyActivated := ses.UDPActivated
+	if !ses.fromPeer(rxAddr) {
+		return
+	}
+	if !ses.agree(rx) {
+		log.Printf("UDP handshake from %v speaks none of our wire versions (%d %v)", rxAddr, rx.Version, rx.Versions)
+		return
+	}
 
 	// Well cool, Looks good, let's activate our end and send the same thing back to them
 	ses.ReplyTo = rxAddr
-	ses.ReplyWith = *globalReplyWith
+	ses.ReplyWith = lSocket
+	ses.ReplyFrom = info.Dst
 	ses.UDPActivated = true
 	if ses.PeerAddress == nil {
 		ses.PeerAddress = rxAddr.IP
@@ -349,7 +637,11 @@ func handleInboundHandshake(buf []byte, rxAddr *net.UDPAddr, lSocket net.PacketC
 	}
 
 	if !wasAlreadyActivated {
-		ses.ReplyWith.WriteTo(buf, ses.ReplyTo)
+		b, err := msgpack.Marshal(ses.handshake(true))
+		if err != nil {
+			log.Fatalf("Failed to marshal handshake %v", err)
+		}
+		writeToFrom(ses.ReplyWith, b, ses.ReplyTo, 0, ses.ReplyFrom)
 	}
 
 }
@@ -363,9 +655,9 @@ func getStats(timeRX time.Time, rx pingStruct, ses *session) (RXLatency time.Dur
 			continue
 		}
 
-		if time.Since(v.TX) < latest {
+		if clock.Since(v.TX) < latest {
 			TXLatency = v.RX.Sub(v.TX)
-			latest = time.Since(v.TX)
+			latest = clock.Since(v.TX)
 		}
 	}
 
@@ -376,7 +668,7 @@ func getStats(timeRX time.Time, rx pingStruct, ses *session) (RXLatency time.Dur
 
 func getLoss(rx pingStruct, ses *session) (RXLoss int, TXLoss int, TotalSent int) {
 
-	TipID := uint8(time.Now().Unix()%255) + 1
+	TipID := uint8(clock.Now().Unix()%255) + 1
 
 	// Don't send loss stats when we don't have enough info to operate with
 	if dumbLastAckSearchForID(0, ses.LastAcks) {
@@ -423,6 +715,15 @@ type pingStruct struct {
 	TXTime       time.Time    `msgpack:"T"`
 	SendersError uint16       `msgpack:"E"`
 	LastAcks     [32]pingInfo `msgpack:"A"`
+	ReceivedTTL  uint8        `msgpack:"L"` // The TTL our last packet from the peer had, 0 if not known
+	ReceivedTOS  uint8        `msgpack:"Q"` // The TOS (or traffic class) our last packet from the peer had
+	SawTOS       bool         `msgpack:"K"` // If ReceivedTOS is known
+	SweepRound   uint16       `msgpack:"N"` // The last round of size sweep probes from the peer
+	SweepGot     []uint16     `msgpack:"G"` // And the sizes of them that got here
+	SweepMTU     uint16       `msgpack:"H"` // The path MTU to the peer, as our kernel sees it
+	Capacity     uint64       `msgpack:"B"` // What the peer's trains to us say the capacity is, in bits per second
+	SeenFrom     string       `msgpack:"J"` // Where the peer's pings come from as we see them, host:port
+	Padding      []byte       `msgpack:"P"`
 }
 
 type pingInfo struct {
@@ -0,0 +1,101 @@
+package main
+
+import (
+	"log"
+	"net"
+	"strconv"
+)
+
+// Peers move: a NAT rebinds its mapping, or a mobile host changes network,
+// and its pings start turning up from a new address. Replies follow the last
+// ping, but each move is logged and counted, and a peer given lock=1 is held
+// to the address it set the session up from instead. Pings also carry where
+// the peer's pings came from as we saw them, so each end can tell if it is
+// behind NAT, and when its own mapping moves.
+
+// addrTracker follows an address, noting when it changes
+type addrTracker struct {
+	Addr  string
+	Known bool
+}
+
+// observe records addr, returning the address it had before if it changed
+func (t *addrTracker) observe(addr string) (was string, changed bool) {
+	if t.Known && t.Addr == addr {
+		return "", false
+	}
+	was, changed = t.Addr, t.Known
+	t.Addr, t.Known = addr, true
+	return was, changed
+}
+
+// fromPeer checks a packet from rxAddr can be taken for the session, noting it if the peer has moved
+func (s *session) fromPeer(rxAddr *net.UDPAddr) bool {
+	host, addr := s.PeerAddress.String(), rxAddr.String()
+	if s.Locked && s.peerAddr.Known && addr != s.peerAddr.Addr {
+		if addr != s.lastRejected {
+			log.Printf("[%s] Dropping packets from %s, the session is locked to %s", host, addr, s.peerAddr.Addr)
+			s.lastRejected = addr
+		}
+		promAddressRejected.WithLabelValues(host).Inc()
+		return false
+	}
+	if was, moved := s.peerAddr.observe(addr); moved {
+		log.Printf("[%s] Peer moved from %s to %s", host, was, addr)
+		promAddressChanges.WithLabelValues("peer", host).Inc()
+	}
+	return true
+}
+
+// sideFromPeer checks a sweep probe or train packet from rxAddr can be taken
+// for the session. Only pings move the peer: spings from before sweeps went
+// out on the session's socket send them from a port of their own, so these
+// only have to come from the IP a locked session is held to.
+func (s *session) sideFromPeer(rxAddr *net.UDPAddr) bool {
+	if !s.Locked || !s.peerAddr.Known {
+		return true
+	}
+	host, _, err := net.SplitHostPort(s.peerAddr.Addr)
+	return err == nil && rxAddr.IP.Equal(net.ParseIP(host))
+}
+
+// observeSeenFrom notes where the peer says our pings come from
+func (s *session) observeSeenFrom(seen string) {
+	host := s.PeerAddress.String()
+	if was, moved := s.localAddr.observe(seen); moved {
+		log.Printf("[%s] The peer now sees us at %s rather than %s, our NAT mapping has moved", host, seen, was)
+		promAddressChanges.WithLabelValues("local", host).Inc()
+	}
+	if local := s.localUDPAddr(); local != nil {
+		s.BehindNAT, s.natKnown = !sameUDPAddr(local, seen), true
+	}
+}
+
+// localUDPAddr is the address the session's pings leave from, nil if that can't be known
+func (s *session) localUDPAddr() *net.UDPAddr {
+	c, ok := s.ReplyWith.(*net.UDPConn)
+	if !ok {
+		return nil
+	}
+	la, ok := c.LocalAddr().(*net.UDPAddr)
+	if !ok {
+		return nil
+	}
+	if la.IP == nil || la.IP.IsUnspecified() {
+		if s.ReplyFrom == nil {
+			return nil
+		}
+		return &net.UDPAddr{IP: s.ReplyFrom, Port: la.Port}
+	}
+	return la
+}
+
+// sameUDPAddr is true if a and the host:port s are the same address
+func sameUDPAddr(a *net.UDPAddr, s string) bool {
+	host, port, err := net.SplitHostPort(s)
+	if err != nil {
+		return false
+	}
+	p, err := strconv.Atoi(port)
+	return err == nil && p == a.Port && a.IP.Equal(net.ParseIP(host))
+}
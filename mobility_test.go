@@ -0,0 +1,127 @@
+package main
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+func TestPeerMoves(t *testing.T) {
+	first := &net.UDPAddr{IP: net.ParseIP("192.0.2.1"), Port: 6924}
+	moved := &net.UDPAddr{IP: net.ParseIP("192.0.2.1"), Port: 40123}
+
+	ses := &session{PeerAddress: first.IP}
+	for _, addr := range []*net.UDPAddr{first, first, moved} {
+		if !ses.fromPeer(addr) {
+			t.Fatalf("packet from %s was dropped", addr)
+		}
+	}
+	if ses.peerAddr.Addr != moved.String() {
+		t.Fatalf("peer is at %s, want %s", ses.peerAddr.Addr, moved)
+	}
+
+	locked := &session{PeerAddress: first.IP, Locked: true}
+	if !locked.fromPeer(first) {
+		t.Fatalf("packet from %s was dropped", first)
+	}
+	if locked.fromPeer(moved) {
+		t.Fatalf("locked session took a packet from %s", moved)
+	}
+	if !locked.fromPeer(first) || locked.peerAddr.Addr != first.String() {
+		t.Fatalf("locked session moved to %s", locked.peerAddr.Addr)
+	}
+
+	o := inviteOptions{Lock: true}
+	if got, ok := parseInvite(o.String()); !ok || got != o {
+		t.Fatalf("%q read as %+v (%t)", o, got, ok)
+	}
+}
+
+func TestBehindNAT(t *testing.T) {
+	c, err := net.ListenUDP("udp4", &net.UDPAddr{IP: net.ParseIP("127.0.0.1")})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	ses := &session{PeerAddress: net.ParseIP("192.0.2.1"), ReplyWith: c}
+
+	ses.observeSeenFrom(c.LocalAddr().String())
+	if !ses.natKnown || ses.BehindNAT {
+		t.Fatalf("seen from our own address, but taken as NAT (%t, %t)", ses.natKnown, ses.BehindNAT)
+	}
+	ses.observeSeenFrom("198.51.100.7:31337")
+	if !ses.BehindNAT {
+		t.Fatalf("seen from some other address, but not taken as NAT")
+	}
+	if ses.localAddr.Addr != "198.51.100.7:31337" {
+		t.Fatalf("the peer sees us at %s, want 198.51.100.7:31337", ses.localAddr.Addr)
+	}
+
+	// With a wildcard socket, only where the pings arrived says what we are
+	w, err := net.ListenUDP("udp4", &net.UDPAddr{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer w.Close()
+	ses = &session{PeerAddress: net.ParseIP("192.0.2.1"), ReplyWith: w}
+	ses.observeSeenFrom("198.51.100.7:31337")
+	if ses.natKnown {
+		t.Fatalf("took a guess at NAT without knowing our address")
+	}
+}
+
+func TestSimSweepLockedAndMoving(t *testing.T) {
+	reg := prometheus.NewRegistry()
+	reg.MustRegister(promAddressChanges)
+	peerMoves := func() float64 {
+		mfs, _ := reg.Gather()
+		for _, mf := range mfs {
+			for _, m := range mf.GetMetric() {
+				for _, l := range m.GetLabel() {
+					if l.GetName() == "host" && l.GetValue() == "192.0.2.2" {
+						return m.GetCounter().GetValue()
+					}
+				}
+			}
+		}
+		return 0
+	}
+
+	for _, locked := range []bool{false, true} {
+		p, done := newSimPair(&simLink{Delay: 20 * time.Millisecond}, &simLink{Delay: 20 * time.Millisecond})
+		sizes := []int{576, 1280, 1500}
+		p.local.Locked = locked
+		p.local.sweep = &sizeSweep{sizes: sizes}
+		p.remote.sweep = &sizeSweep{sizes: sizes}
+
+		// The remote end is an older sping, sending its sweeps from a port of their own
+		pings := p.remote.ReplyWith.(*simEndpoint)
+		side := &simEndpoint{net: p.net, addr: &net.UDPAddr{IP: pings.addr.IP, Port: 40123}, peer: pings.peer, out: pings.out}
+
+		p.run(2)
+		before := peerMoves()
+		for i := 0; i < 4; i++ {
+			p.local.sweepRound()
+			p.remote.ReplyWith = side
+			p.remote.sweepRound()
+			p.remote.ReplyWith = pings
+			p.run(3)
+		}
+		done()
+
+		if moves := peerMoves() - before; moves != 0 {
+			t.Fatalf("locked %t: sweeps moved the peer %v times", locked, moves)
+		}
+		if p.local.lastRejected != "" {
+			t.Fatalf("locked %t: dropped packets from %s", locked, p.local.lastRejected)
+		}
+		if rx := p.local.sweep.rx; !rx.Known || rx.MaxDelivered != 1500 {
+			t.Fatalf("locked %t: rx max size %+v, want 1500", locked, rx)
+		}
+		if tx := p.local.sweep.tx; !tx.Known || tx.MaxDelivered != 1500 {
+			t.Fatalf("locked %t: tx max size %+v, want 1500", locked, tx)
+		}
+	}
+}
@@ -0,0 +1,173 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"sort"
+	"strings"
+)
+
+// So that spings of different versions can be meshed together, the UDP
+// handshake says which wire versions and features each end has, and the
+// session goes with the newest version and the features both have. An old
+// sping only speaks version 3, and sends our handshake back as it came
+// rather than answering it, so it is taken to only do what sping did then.
+
+// spingVersion is the version of this sping, as given to peers in handshakes
+const spingVersion = "0.4"
+
+// The wire versions: 3 is the handshake on its own, 4 adds what each end can
+// do to it
+var handshakeVersions = []uint8{3, 4}
+
+// Features a sping can have, one bit each
+const (
+	featureAcks     uint32 = 1 << iota // Pings ack the last 32 pings from the peer, every sping does
+	featurePadding                     // Pings can be padded out with size=
+	featureTOS                         // Pings say what TOS the peer's last one came with
+	featureSweep                       // Size sweeps, with sweep=
+	featureCapacity                    // Capacity trains, with capacity=
+	featureSeenFrom                    // Pings say where the peer's last one came from
+	featureLock                        // Sessions can be locked to an address, with lock=
+	featureLoad                        // Takes LOAD on the TCP port, for sping load-test
+)
+
+var featureNames = map[uint32]string{
+	featureAcks:     "acks",
+	featurePadding:  "padding",
+	featureTOS:      "tos",
+	featureSweep:    "sweep",
+	featureCapacity: "capacity",
+	featureSeenFrom: "seen-from",
+	featureLock:     "lock",
+	featureLoad:     "load",
+}
+
+// ourFeatures are what this sping can do, and oldFeatures what a sping from
+// before the handshake said so could
+const (
+	ourFeatures = featureAcks | featurePadding | featureTOS | featureSweep | featureCapacity | featureSeenFrom | featureLock | featureLoad
+	oldFeatures = featureAcks
+)
+
+// featureString lists the features in f by name, like acks,padding
+func featureString(f uint32) string {
+	var names []string
+	for bit, name := range featureNames {
+		if f&bit != 0 {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+	return strings.Join(names, ",")
+}
+
+// pickVersion is the newest wire version in theirs that we speak too
+func pickVersion(theirs []uint8) (uint8, bool) {
+	for i := len(handshakeVersions) - 1; i >= 0; i-- {
+		for _, v := range theirs {
+			if v == handshakeVersions[i] {
+				return v, true
+			}
+		}
+	}
+	return 0, false
+}
+
+// banner is what a sping sends first on its TCP port
+const banner = "sping-" + spingVersion + "-https://github.com/benjojo/sping\n"
+
+// bannerVersion reads the version from the banner a sping sends on its TCP
+// port, like sping-0.3-https://github.com/benjojo/sping
+func bannerVersion(banner string) (major, minor int, ok bool) {
+	if !strings.HasPrefix(banner, "sping-") {
+		return 0, 0, false
+	}
+	v := strings.SplitN(strings.TrimPrefix(banner, "sping-"), "-", 2)[0]
+	if _, err := fmt.Sscanf(v, "%d.%d", &major, &minor); err != nil {
+		return 0, 0, false
+	}
+	return major, minor, true
+}
+
+// checkBanner makes sure the banner is from a sping new enough to take
+// INVITE (and TRACE and LOAD), which came in with 0.3
+func checkBanner(banner string) error {
+	major, minor, ok := bannerVersion(banner)
+	if !ok {
+		return fmt.Errorf("Host banner not sping")
+	}
+	if major == 0 && minor < 3 {
+		return fmt.Errorf("Host runs sping %d.%d, which is too old", major, minor)
+	}
+	return nil
+}
+
+// handshake is the UDP handshake for the session, answer is set when it is
+// the reply to the peer's
+func (s *session) handshake(answer bool) handshakeStruct {
+	return handshakeStruct{
+		Type:     'h',
+		Magic:    11181,
+		Session:  s.SessionID,
+		Version:  3,
+		Versions: handshakeVersions,
+		Features: ourFeatures,
+		Software: spingVersion,
+		Answer:   answer,
+	}
+}
+
+// agree works out the wire version and features of the session from the
+// peer's handshake, false if the two ends have no version in common
+func (s *session) agree(rx handshakeStruct) bool {
+	theirs, features, software := rx.Versions, rx.Features, rx.Software
+	if len(theirs) == 0 || (s.MadeByMe && !rx.Answer) {
+		theirs, features, software = []uint8{uint8(rx.Version)}, oldFeatures, ""
+	}
+	v, ok := pickVersion(theirs)
+	if !ok {
+		return false
+	}
+	s.WireVersion, s.Features, s.PeerSoftware, s.peerKnown = v, ourFeatures&features, software, true
+
+	// Both of these need the peer to report back what it saw
+	if s.sweep != nil && !s.can(featureSweep) {
+		log.Printf("[%s] Peer can't do size sweeps, not sweeping", s.PeerAddress)
+		s.sweep = nil
+	}
+	if s.capacity != nil && !s.can(featureCapacity) {
+		log.Printf("[%s] Peer can't do capacity trains, not sending them", s.PeerAddress)
+		s.capacity = nil
+	}
+	if s.PadTo != 0 && !s.can(featurePadding) {
+		log.Printf("[%s] Peer can't take padded pings, not padding them", s.PeerAddress)
+		s.PadTo = 0
+	}
+	if s.Locked && !s.can(featureLock) {
+		log.Printf("[%s] Peer can't do locked sessions, not locking it", s.PeerAddress)
+		s.Locked = false
+	}
+	return true
+}
+
+// can is true if both ends of the session have the feature
+func (s *session) can(feature uint32) bool {
+	return s.Features&feature != 0
+}
+
+// forgetPeerInfo drops the splitping_peer_info series last exported for the session
+func (s *session) forgetPeerInfo() {
+	if s.peerInfo != [4]string{} {
+		promPeerInfo.DeleteLabelValues(s.peerInfo[:]...)
+		s.peerInfo = [4]string{}
+	}
+}
+
+// softwareName is the peer's version of sping for metrics, "old" for one from before it was given
+func (s *session) softwareName() string {
+	if s.PeerSoftware == "" {
+		return "old"
+	}
+	return s.PeerSoftware
+}
@@ -0,0 +1,71 @@
+package main
+
+import "testing"
+
+func TestCheckBanner(t *testing.T) {
+	for banner, ok := range map[string]bool{
+		"sping-0.3-https://github.com/benjojo/sping\n": true,
+		"sping-0.9-https://example.com\n":              true,
+		"sping-1.0-\n":                                 true,
+		"sping-0.2-https://github.com/benjojo/sping\n": false,
+		"SSH-2.0-OpenSSH_9.6\r\n":                      false,
+		"sping-x.y-\n":                                 false,
+		banner:                                         true,
+	} {
+		if err := checkBanner(banner); (err == nil) != ok {
+			t.Fatalf("%q gave %v", banner, err)
+		}
+	}
+}
+
+func TestAgree(t *testing.T) {
+	ours := (&session{SessionID: 7}).handshake(false)
+
+	// An old sping sends our own handshake back
+	ses := &session{MadeByMe: true, sweep: newSizeSweep("auto"), capacity: newCapacityEstimator(true)}
+	if !ses.agree(ours) {
+		t.Fatalf("did not agree with an old sping")
+	}
+	if ses.WireVersion != 3 || ses.Features != oldFeatures || ses.softwareName() != "old" {
+		t.Fatalf("old sping taken as %d %s %s", ses.WireVersion, featureString(ses.Features), ses.softwareName())
+	}
+	if ses.sweep != nil || ses.capacity != nil {
+		t.Fatalf("still sweeping or sending trains to an old sping")
+	}
+
+	// Nor padded or locked
+	ses = &session{MadeByMe: true, PadTo: 1400, Locked: true}
+	if !ses.agree(ours) || ses.PadTo != 0 || ses.Locked {
+		t.Fatalf("still padding to %d or locked (%t) with an old sping", ses.PadTo, ses.Locked)
+	}
+
+	// And an old sping asking for a session only says it speaks 3
+	ses = &session{}
+	if !ses.agree(handshakeStruct{Type: 'h', Magic: 11181, Version: 3, Session: 7}) || ses.WireVersion != 3 || ses.Features != oldFeatures {
+		t.Fatalf("old sping taken as %d %s", ses.WireVersion, featureString(ses.Features))
+	}
+
+	// A newer sping that can do more, and less, than us
+	newer := handshakeStruct{
+		Type: 'h', Magic: 11181, Version: 3, Session: 7,
+		Versions: []uint8{3, 4, 5},
+		Features: featureAcks | featureSweep | 1<<20,
+		Software: "0.9",
+		Answer:   true,
+	}
+	ses = &session{MadeByMe: true, sweep: newSizeSweep("auto"), capacity: newCapacityEstimator(true)}
+	if !ses.agree(newer) {
+		t.Fatalf("did not agree with a newer sping")
+	}
+	if ses.WireVersion != 4 || featureString(ses.Features) != "acks,sweep" || ses.softwareName() != "0.9" {
+		t.Fatalf("newer sping taken as %d %s %s", ses.WireVersion, featureString(ses.Features), ses.softwareName())
+	}
+	if ses.sweep == nil || ses.capacity != nil {
+		t.Fatalf("sweeps should carry on and trains stop, with a peer that can only do sweeps")
+	}
+
+	newer.Versions = []uint8{5}
+	if (&session{}).agree(newer) {
+		t.Fatalf("agreed with a sping that only speaks 5")
+	}
+}
@@ -117,7 +117,7 @@ var flagClockIsPerfect = flag.Bool("clock-is-perfect", true, "Enable userspace c
 // Returns out offset against apple's NTP (+ GPS) servers
 func calibrateAgainstApple() int {
 	if *flagClockIsPerfect {
-		lastSync = time.Now()
+		lastSync = clock.Now()
 		return 1
 	}
 
@@ -171,7 +171,7 @@ func calibrateAgainstApple() int {
 		}
 	}
 
-	lastSync = time.Now()
+	lastSync = clock.Now()
 	return int(considerableNTPresponces[2].Offset)
 }
 
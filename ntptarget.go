@@ -0,0 +1,103 @@
+package main
+
+import (
+	"log"
+	"time"
+
+	"github.com/beevik/ntp"
+)
+
+// NTP targets split the path to any NTP server, without needing sping on the
+// other end. A reply carries T2 (server receive) and T3 (server transmit), so
+// with a good local clock the forward delay is T2-T1 and reverse is T4-T3.
+//
+// The ntp package works those out against the system clock and hands back
+// RTT = (T2-T1)+(T4-T3) and offset = ((T2-T1)-(T4-T3))/2, so the two one
+// way delays come back out of those, then get moved onto our clock.
+
+// ntpTarget polls one NTP server
+type ntpTarget struct {
+	spec     peerSpec
+	interval time.Duration
+	window   probeWindow
+	seq      uint32
+
+	query func(host string, opt ntp.QueryOptions) (*ntp.Response, error)
+}
+
+func (t *ntpTarget) Protocol() string { return "ntp" }
+func (t *ntpTarget) Host() string     { return t.spec.Host }
+
+func (t *ntpTarget) Stats() proberStats {
+	return t.window.stats(clock.Now(), 2*time.Second)
+}
+
+func newNTPTarget(spec peerSpec) *ntpTarget {
+	t := &ntpTarget{
+		spec:     spec,
+		interval: time.Second,
+		query:    ntp.QueryWithOptions,
+	}
+	// Public servers will rate limit a poll every second, so this can be slowed down
+	if d, err := time.ParseDuration(spec.Options.Get("interval")); err == nil && d > 0 {
+		t.interval = d
+	}
+	return t
+}
+
+// runNTPTarget polls an NTP server at the probe interval, forever
+func runNTPTarget(spec peerSpec) {
+	t := newNTPTarget(spec)
+	registerProber(t)
+
+	for {
+		if t.interval == time.Second {
+			clock.Sleep(clock.Until(nextSecondBoundary()))
+		} else {
+			clock.Sleep(t.interval)
+		}
+		seq := t.seq
+		t.seq++
+		t.window.sent(seq, clock.Now())
+		go t.poll(seq)
+	}
+}
+
+func (t *ntpTarget) poll(seq uint32) {
+	// How far our clock is from the system clock the ntp package uses
+	sys := time.Now()
+	correction := timeNowDisciplined().Sub(sys)
+
+	resp, err := t.query(t.spec.Host, ntp.QueryOptions{
+		Timeout: time.Second,
+		Port:    t.spec.Port,
+	})
+	if err != nil {
+		if *debugShowLiveStats {
+			log.Printf("[%s] NTP query failed: %v", t.spec, err)
+		}
+		return
+	}
+	if err := resp.Validate(); err != nil {
+		// This includes being told to go away (a kiss of death), which counts as loss
+		if *debugShowLiveStats {
+			log.Printf("[%s] Bad NTP response: %v", t.spec, err)
+		}
+		return
+	}
+
+	forward, reverse := ntpOneWayDelays(resp, correction)
+	t.window.replied(seq, forward, reverse)
+
+	if *debugShowLiveStats {
+		log.Printf("[%s] NTP seq %d Forward: %s Reverse: %s", t.spec, seq, forward, reverse)
+	}
+}
+
+// ntpOneWayDelays gives T2-T1 and T4-T3 for a response, where our clock is
+// correction ahead of the system clock the query was timed with
+func ntpOneWayDelays(resp *ntp.Response, correction time.Duration) (forward, reverse time.Duration) {
+	forward = resp.RTT/2 + resp.ClockOffset - correction
+	reverse = resp.RTT/2 - resp.ClockOffset + correction
+	return forward, reverse
+}
@@ -0,0 +1,66 @@
+package main
+
+import (
+	"errors"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/beevik/ntp"
+)
+
+func TestNTPOneWayDelays(t *testing.T) {
+	// T1=0, T2=30ms, T3=31ms, T4=41ms on a server 5ms ahead of our system clock:
+	// 25ms there, 15ms back
+	resp := &ntp.Response{
+		RTT:         40 * time.Millisecond,
+		ClockOffset: 5 * time.Millisecond,
+	}
+	fwd, rev := ntpOneWayDelays(resp, 0)
+	if fwd != 25*time.Millisecond || rev != 15*time.Millisecond {
+		t.Fatalf("got forward %s reverse %s", fwd, rev)
+	}
+
+	// If our clock is 5ms ahead of the system clock too, the paths are even
+	fwd, rev = ntpOneWayDelays(resp, 5*time.Millisecond)
+	if fwd != 20*time.Millisecond || rev != 20*time.Millisecond {
+		t.Fatalf("with correction got forward %s reverse %s", fwd, rev)
+	}
+}
+
+func TestNTPTargetPoll(t *testing.T) {
+	target := newNTPTarget(peerSpec{Proto: "ntp", Host: "192.0.2.1", Options: url.Values{}})
+	fail := false
+	target.query = func(host string, opt ntp.QueryOptions) (*ntp.Response, error) {
+		if fail {
+			return nil, errors.New("timeout")
+		}
+		now := time.Now()
+		return &ntp.Response{
+			Time:          now,
+			ReferenceTime: now.Add(-time.Minute),
+			Stratum:       1,
+			RTT:           20 * time.Millisecond,
+			ClockOffset:   2 * time.Millisecond,
+		}, nil
+	}
+
+	for i := 0; i < 32; i++ {
+		fail = i%8 == 0
+		seq := target.seq
+		target.seq++
+		target.window.sent(seq, clock.Now().Add(-time.Minute))
+		target.poll(seq)
+	}
+
+	st := target.Stats()
+	if st.Exchanges != 32 || st.RTTLoss != 4 || st.TXLoss != 0 || st.RXLoss != 0 {
+		t.Fatalf("loss is wrong: %+v", st)
+	}
+	if d := st.TXLatency - 12*time.Millisecond; d > time.Millisecond || d < -time.Millisecond {
+		t.Fatalf("forward delay %s, want about 12ms", st.TXLatency)
+	}
+	if d := st.RXLatency - 8*time.Millisecond; d > time.Millisecond || d < -time.Millisecond {
+		t.Fatalf("reverse delay %s, want about 8ms", st.RXLatency)
+	}
+}
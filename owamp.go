@@ -0,0 +1,1050 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"flag"
+	"fmt"
+	"log"
+	"net"
+	"sort"
+	"sync"
+	"time"
+)
+
+// OWAMP (RFC 4656) support, so sping can sit in a perfSONAR mesh.
+//
+// As a client, sping asks the server for two test sessions: one where we
+// send and the server receives (we fetch its receive timestamps back over
+// the control connection to get forward delay and loss), and one where the
+// server sends to us (giving reverse delay and loss directly). Sessions run
+// for a while and are then renewed.
+//
+// As a server, sping will send or receive test sessions for anyone, and
+// hand back results with Fetch-Session, like owampd does.
+
+var owampListen = flag.String("owamp.listen", "", "Address to run an OWAMP server on, for example [::]:861 (disabled if empty)")
+var owampOpen = flag.Bool("owamp.open", true, "Allow unauthenticated OWAMP/TWAMP control connections")
+
+const (
+	owampRequestSession = 1
+	owampStartSessions  = 2
+	owampStopSessions   = 3
+	owampFetchSession   = 4
+)
+
+// Accept values in replies
+const (
+	acceptOK          = 0
+	acceptFailure     = 1
+	acceptInternal    = 2
+	acceptUnsupported = 3
+	acceptPermanent   = 4
+	acceptTemporary   = 5
+)
+
+const (
+	requestSessionLen = 112
+	owampRecordLen    = 25
+	owampMaxPackets   = 1 << 20
+)
+
+// Limits on what a client can ask the server for
+const (
+	owampMaxPadding  = 65000                 // So test packets still fit in a UDP packet
+	owampMinInterval = 10 * time.Millisecond // The fastest the server will send test packets
+	owampMaxSessions = 16                    // Test sessions one client can have at once
+)
+
+var errOWAMPRejected = errors.New("OWAMP request rejected")
+
+// Schedule slot types
+const (
+	slotExponential = 0
+	slotFixed       = 1
+)
+
+type scheduleSlot struct {
+	Type     byte
+	Interval time.Duration
+}
+
+// requestSession is the Request-Session message, also the base of TWAMPs Request-TW-Session
+type requestSession struct {
+	Type         byte
+	ConfSender   bool // The server should send
+	ConfReceiver bool // The server should receive
+	NumPackets   uint32
+	SenderPort   uint16
+	ReceiverPort uint16
+	SenderAddr   net.IP
+	ReceiverAddr net.IP
+	SID          [16]byte
+	Padding      uint32
+	StartTime    time.Time
+	Timeout      time.Duration
+	TypeP        uint32
+	Slots        []scheduleSlot
+}
+
+func putAddr(b []byte, ip net.IP) {
+	if ip4 := ip.To4(); ip4 != nil {
+		copy(b, ip4)
+		return
+	}
+	copy(b, ip.To16())
+}
+
+func getAddr(b []byte, ipvn byte) net.IP {
+	if ipvn == 4 {
+		return net.IP(append([]byte(nil), b[:4]...))
+	}
+	return net.IP(append([]byte(nil), b[:16]...))
+}
+
+func boolByte(v bool) byte {
+	if v {
+		return 1
+	}
+	return 0
+}
+
+// Marshal gives the first part of the message, and the schedule slots part
+func (r requestSession) Marshal() ([]byte, []byte) {
+	b := make([]byte, requestSessionLen)
+	b[0] = r.Type
+	b[1] = 6
+	if r.SenderAddr.To4() != nil {
+		b[1] = 4
+	}
+	b[2] = boolByte(r.ConfSender)
+	b[3] = boolByte(r.ConfReceiver)
+	binary.BigEndian.PutUint32(b[4:8], uint32(len(r.Slots)))
+	binary.BigEndian.PutUint32(b[8:12], r.NumPackets)
+	binary.BigEndian.PutUint16(b[12:14], r.SenderPort)
+	binary.BigEndian.PutUint16(b[14:16], r.ReceiverPort)
+	putAddr(b[16:32], r.SenderAddr)
+	putAddr(b[32:48], r.ReceiverAddr)
+	copy(b[48:64], r.SID[:])
+	binary.BigEndian.PutUint32(b[64:68], r.Padding)
+	putNTPTime(b[68:76], r.StartTime)
+	binary.BigEndian.PutUint64(b[76:84], ntpDuration(r.Timeout))
+	binary.BigEndian.PutUint32(b[84:88], r.TypeP)
+
+	slots := make([]byte, 16*len(r.Slots)+hmacLen)
+	for i, s := range r.Slots {
+		slots[16*i] = s.Type
+		binary.BigEndian.PutUint64(slots[16*i+8:16*i+16], ntpDuration(s.Interval))
+	}
+	return b, slots
+}
+
+func parseRequestSession(b []byte) requestSession {
+	r := requestSession{
+		Type:         b[0],
+		ConfSender:   b[2] != 0,
+		ConfReceiver: b[3] != 0,
+		NumPackets:   binary.BigEndian.Uint32(b[8:12]),
+		SenderPort:   binary.BigEndian.Uint16(b[12:14]),
+		ReceiverPort: binary.BigEndian.Uint16(b[14:16]),
+		SenderAddr:   getAddr(b[16:32], b[1]&0xf),
+		ReceiverAddr: getAddr(b[32:48], b[1]&0xf),
+		Padding:      binary.BigEndian.Uint32(b[64:68]),
+		StartTime:    getNTPTime(b[68:76]),
+		Timeout:      fromNTPDuration(binary.BigEndian.Uint64(b[76:84])),
+		TypeP:        binary.BigEndian.Uint32(b[84:88]),
+	}
+	copy(r.SID[:], b[48:64])
+	return r
+}
+
+func parseScheduleSlots(b []byte, n int) []scheduleSlot {
+	slots := make([]scheduleSlot, n)
+	for i := range slots {
+		slots[i].Type = b[16*i]
+		slots[i].Interval = fromNTPDuration(binary.BigEndian.Uint64(b[16*i+8 : 16*i+16]))
+	}
+	return slots
+}
+
+// readRequestSession reads the rest of a Request-Session whose first block is first
+func readRequestSession(c *controlConn, first []byte) (requestSession, error) {
+	rest, err := c.readBlocks(requestSessionLen - 16)
+	if err != nil {
+		return requestSession{}, err
+	}
+	msg := append(first, rest...)
+	if err := c.checkMAC(msg); err != nil {
+		return requestSession{}, err
+	}
+	r := parseRequestSession(msg)
+
+	nSlots := int(binary.BigEndian.Uint32(msg[4:8]))
+	if nSlots > 1024 {
+		return requestSession{}, fmt.Errorf("too many schedule slots (%d)", nSlots)
+	}
+	if nSlots > 0 || r.Type == owampRequestSession {
+		sb, err := c.readMsg(16*nSlots + hmacLen)
+		if err != nil {
+			return requestSession{}, err
+		}
+		r.Slots = parseScheduleSlots(sb, nSlots)
+	}
+	return r, nil
+}
+
+func acceptSessionMsg(accept byte, port uint16, sid [16]byte) []byte {
+	b := make([]byte, 48)
+	b[0] = accept
+	binary.BigEndian.PutUint16(b[2:4], port)
+	copy(b[4:20], sid[:])
+	return b
+}
+
+// owampRecord is a test packet as seen by the receiver, as sent back by Fetch-Session
+type owampRecord struct {
+	Seq       uint32
+	SendError uint16
+	SendTime  time.Time
+	RecvError uint16
+	RecvTime  time.Time // Zero if the packet was lost
+	TTL       uint8
+}
+
+func (r owampRecord) Marshal(b []byte) {
+	binary.BigEndian.PutUint32(b[0:4], r.Seq)
+	binary.BigEndian.PutUint16(b[4:6], r.SendError)
+	putNTPTime(b[6:14], r.SendTime)
+	binary.BigEndian.PutUint16(b[14:16], r.RecvError)
+	binary.BigEndian.PutUint64(b[16:24], 0)
+	if !r.RecvTime.IsZero() {
+		putNTPTime(b[16:24], r.RecvTime)
+	}
+	b[24] = r.TTL
+}
+
+func parseOWAMPRecord(b []byte) owampRecord {
+	r := owampRecord{
+		Seq:       binary.BigEndian.Uint32(b[0:4]),
+		SendError: binary.BigEndian.Uint16(b[4:6]),
+		SendTime:  getNTPTime(b[6:14]),
+		RecvError: binary.BigEndian.Uint16(b[14:16]),
+		TTL:       b[24],
+	}
+	if binary.BigEndian.Uint64(b[16:24]) != 0 {
+		r.RecvTime = getNTPTime(b[16:24])
+	}
+	return r
+}
+
+// Test packets are Seq, Timestamp, Error Estimate then padding. In the
+// authenticated and encrypted modes the fields are spread out to line up
+// with the AES blocks.
+
+func owampTestPacketLen(mode uint32, padding uint32) int {
+	if mode == modeAuthenticated || mode == modeEncrypted {
+		return 32 + int(padding)
+	}
+	return 14 + int(padding)
+}
+
+func marshalOWAMPTestPacket(seq uint32, ts time.Time, errEst uint16, mode uint32, key []byte, padding uint32) []byte {
+	b := make([]byte, owampTestPacketLen(mode, padding))
+	binary.BigEndian.PutUint32(b[0:4], seq)
+	if mode == modeAuthenticated || mode == modeEncrypted {
+		putNTPTime(b[16:24], ts)
+		binary.BigEndian.PutUint16(b[24:26], errEst)
+		encryptTestHeader(b, mode, key, 32)
+	} else {
+		putNTPTime(b[4:12], ts)
+		binary.BigEndian.PutUint16(b[12:14], errEst)
+	}
+	return b
+}
+
+func parseOWAMPTestPacket(b []byte, mode uint32, key []byte) (seq uint32, ts time.Time, errEst uint16, err error) {
+	if len(b) < owampTestPacketLen(mode, 0) {
+		return 0, time.Time{}, 0, fmt.Errorf("OWAMP test packet too short (%d bytes)", len(b))
+	}
+	if mode == modeAuthenticated || mode == modeEncrypted {
+		decryptTestHeader(b, mode, key, 32)
+		return binary.BigEndian.Uint32(b[0:4]), getNTPTime(b[16:24]), binary.BigEndian.Uint16(b[24:26]), nil
+	}
+	return binary.BigEndian.Uint32(b[0:4]), getNTPTime(b[4:12]), binary.BigEndian.Uint16(b[12:14]), nil
+}
+
+// newSID makes a session ID the way RFC 4656 suggests: receiver address, time, then random
+func newSID(receiver net.IP) [16]byte {
+	var sid [16]byte
+	ip4 := receiver.To4()
+	if ip4 == nil && len(receiver) == 16 {
+		// No room for a v6 address, so use the end of it
+		ip4 = receiver[12:16]
+	}
+	copy(sid[0:4], ip4)
+	putNTPTime(sid[4:12], timeNowCorrected())
+	rand.Read(sid[12:16])
+	return sid
+}
+
+// testUDPAddr is the address to use for test packets, the same IP the control connection is on
+func testUDPAddr(a net.Addr) *net.UDPAddr {
+	if t, ok := a.(*net.TCPAddr); ok {
+		return &net.UDPAddr{IP: t.IP, Zone: t.Zone}
+	}
+	return &net.UDPAddr{}
+}
+
+// checkTestAddr gives the address to use for the client's end of a test
+// session, which has to be the address the control connection came from
+// (or be left unspecified)
+func checkTestAddr(ip, remote net.IP) (net.IP, bool) {
+	if ip == nil || ip.IsUnspecified() {
+		return remote, true
+	}
+	return ip, ip.Equal(remote)
+}
+
+// testSessions is how many test sessions each client (by IP) has, over all of
+// its control connections
+var testSessions = map[string]int{}
+var testSessionsLock sync.Mutex
+
+// takeTestSession counts a new test session for client, false if it already has too many
+func takeTestSession(client string) bool {
+	testSessionsLock.Lock()
+	defer testSessionsLock.Unlock()
+	if testSessions[client] >= owampMaxSessions {
+		return false
+	}
+	testSessions[client]++
+	return true
+}
+
+func releaseTestSession(client string) {
+	testSessionsLock.Lock()
+	defer testSessionsLock.Unlock()
+	if testSessions[client]--; testSessions[client] <= 0 {
+		delete(testSessions, client)
+	}
+}
+
+// sendSchedule sends count test packets starting at start, one per interval. OWAMPs
+// exponential schedules are sent at their mean interval.
+func sendSchedule(conn *net.UDPConn, to *net.UDPAddr, start time.Time, count uint32, slots []scheduleSlot, done chan struct{}, packet func(seq uint32) []byte) {
+	t := start
+	for seq := uint32(0); seq < count; seq++ {
+		select {
+		case <-done:
+			return
+		case <-clock.After(t.Sub(timeNowCorrected())):
+		}
+		if _, err := conn.WriteToUDP(packet(seq), to); err != nil && *debugShowLiveStats {
+			log.Printf("Failed to send test packet to %s: %v", to, err)
+		}
+		interval := time.Second
+		if len(slots) > 0 {
+			interval = slots[int(seq)%len(slots)].Interval
+		}
+		t = t.Add(interval)
+	}
+}
+
+// owampServer handles one OWAMP control connection
+type owampServer struct {
+	c        *controlConn
+	sessions []*owampTestSession
+}
+
+// owampTestSession is a test session on the server side
+type owampTestSession struct {
+	req     requestSession
+	request requestSession // As the client sent it, which Fetch-Session gives back
+	client  string
+	sid     [16]byte
+	mode    uint32
+	key     []byte
+	conn    *net.UDPConn
+	done    chan struct{}
+	peer    *net.UDPAddr
+	start   time.Time
+
+	mu       sync.Mutex
+	records  map[uint32]owampRecord
+	highest  uint32
+	seen     bool
+	started  bool
+	finished bool
+	nextSeq  uint32
+}
+
+func listenOWAMP() {
+	ln, err := net.Listen("tcp", *owampListen)
+	if err != nil {
+		log.Fatalf("Failed to listen for OWAMP on %s: %v", *owampListen, err)
+	}
+	keys, err := loadKeyring(*owampKeyFile)
+	if err != nil {
+		log.Fatalf("Failed to load OWAMP keys: %v", err)
+	}
+	serveOWAMP(ln, keys)
+}
+
+// controlModes is the modes we offer to OWAMP and TWAMP clients
+func controlModes(keys keyring) uint32 {
+	modes := uint32(0)
+	if *owampOpen {
+		modes |= modeUnauthenticated
+	}
+	if len(keys) > 0 {
+		modes |= modeAuthenticated | modeEncrypted
+	}
+	return modes
+}
+
+func serveOWAMP(ln net.Listener, keys keyring) {
+	for {
+		conn, err := ln.Accept()
+		if errors.Is(err, net.ErrClosed) {
+			return
+		}
+		if err != nil {
+			log.Printf("Failed to accept OWAMP connection: %v", err)
+			clock.Sleep(time.Second)
+			continue
+		}
+		go func() {
+			defer conn.Close()
+			c, err := serverHandshake(conn, controlModes(keys), keys)
+			if err != nil {
+				log.Printf("OWAMP control connection from %s failed: %v", conn.RemoteAddr(), err)
+				return
+			}
+			s := &owampServer{c: c}
+			defer s.stopAll()
+			if err := s.serve(); err != nil && *debugShowLiveStats {
+				log.Printf("OWAMP control connection from %s ended: %v", conn.RemoteAddr(), err)
+			}
+		}()
+	}
+}
+
+func (s *owampServer) serve() error {
+	for {
+		first, err := s.c.readBlocks(16)
+		if err != nil {
+			return err
+		}
+		switch first[0] {
+		case owampRequestSession:
+			req, err := readRequestSession(s.c, first)
+			if err != nil {
+				return err
+			}
+			if err := s.c.writeMsg(s.requestSession(req)); err != nil {
+				return err
+			}
+		case owampStartSessions:
+			if err := readRestOfMsg(s.c, first, 32); err != nil {
+				return err
+			}
+			s.startAll()
+			if err := s.c.writeMsg(make([]byte, 32)); err != nil {
+				return err
+			}
+		case owampStopSessions:
+			if err := readStopSessions(s.c, first, s.sessions); err != nil {
+				return err
+			}
+			s.stopAll()
+		case owampFetchSession:
+			msg, err := s.c.readBlocks(32)
+			if err != nil {
+				return err
+			}
+			msg = append(first, msg...)
+			if err := s.c.checkMAC(msg); err != nil {
+				return err
+			}
+			if err := s.fetch(msg); err != nil {
+				return err
+			}
+		default:
+			return fmt.Errorf("unknown OWAMP control message %d", first[0])
+		}
+	}
+}
+
+// readRestOfMsg reads the rest of an n byte control message, and checks its HMAC
+func readRestOfMsg(c *controlConn, first []byte, n int) error {
+	rest, err := c.readBlocks(n - len(first))
+	if err != nil {
+		return err
+	}
+	return c.checkMAC(append(first, rest...))
+}
+
+// requestSession sets up a test session and gives the Accept-Session reply
+func (s *owampServer) requestSession(req requestSession) []byte {
+	var zero [16]byte
+	request := req
+	if req.ConfSender == req.ConfReceiver || req.NumPackets > owampMaxPackets || req.Padding > owampMaxPadding {
+		return acceptSessionMsg(acceptUnsupported, 0, zero)
+	}
+	for _, slot := range req.Slots {
+		if slot.Interval < owampMinInterval {
+			return acceptSessionMsg(acceptUnsupported, 0, zero)
+		}
+	}
+	remote := testUDPAddr(s.c.conn.RemoteAddr()).IP
+	var ok bool
+	if req.SenderAddr, ok = checkTestAddr(req.SenderAddr, remote); !ok {
+		return acceptSessionMsg(acceptPermanent, 0, zero)
+	}
+	if req.ReceiverAddr, ok = checkTestAddr(req.ReceiverAddr, remote); !ok {
+		return acceptSessionMsg(acceptPermanent, 0, zero)
+	}
+	client := remote.String()
+	if !takeTestSession(client) {
+		log.Printf("OWAMP client %s has too many test sessions", client)
+		return acceptSessionMsg(acceptTemporary, 0, zero)
+	}
+
+	local := testUDPAddr(s.c.conn.LocalAddr())
+	conn, err := net.ListenUDP("udp", local)
+	if err != nil {
+		releaseTestSession(client)
+		log.Printf("Failed to open OWAMP test socket: %v", err)
+		return acceptSessionMsg(acceptTemporary, 0, zero)
+	}
+
+	ts := &owampTestSession{
+		req:     req,
+		client:  client,
+		mode:    s.c.Mode,
+		conn:    conn,
+		done:    make(chan struct{}),
+		records: make(map[uint32]owampRecord),
+	}
+	if req.ConfReceiver {
+		ts.sid = newSID(local.IP)
+	} else {
+		ts.sid = req.SID
+		ts.peer = &net.UDPAddr{IP: req.ReceiverAddr, Port: int(req.ReceiverPort)}
+	}
+	ts.key = s.c.testKey(ts.sid)
+	ts.request = request
+	ts.request.SID = ts.sid
+	s.sessions = append(s.sessions, ts)
+
+	return acceptSessionMsg(acceptOK, uint16(conn.LocalAddr().(*net.UDPAddr).Port), ts.sid)
+}
+
+func (s *owampServer) startAll() {
+	for _, ts := range s.sessions {
+		// Each Start-Sessions starts whatever has been asked for since the last one
+		ts.mu.Lock()
+		started := ts.started || ts.finished
+		ts.started = true
+		ts.mu.Unlock()
+		if started {
+			continue
+		}
+		if ts.req.ConfReceiver {
+			go ts.receive()
+		} else {
+			go sendSchedule(ts.conn, ts.peer, ts.req.StartTime, ts.req.NumPackets, ts.req.Slots, ts.done, func(seq uint32) []byte {
+				return marshalOWAMPTestPacket(seq, timeNowDisciplined(), localErrorEstimate(), ts.mode, ts.key, ts.req.Padding)
+			})
+		}
+	}
+}
+
+func (s *owampServer) stopAll() {
+	for _, ts := range s.sessions {
+		ts.stop()
+	}
+}
+
+func (ts *owampTestSession) stop() {
+	ts.mu.Lock()
+	defer ts.mu.Unlock()
+	if ts.finished {
+		return
+	}
+	ts.finished = true
+	close(ts.done)
+	ts.conn.Close()
+	releaseTestSession(ts.client)
+}
+
+func (ts *owampTestSession) receive() {
+	buf := make([]byte, 65536)
+	conn := newRXInfoConn(ts.conn)
+	for {
+		n, _, ttl, err := conn.ReadFromWithTTL(buf)
+		if err != nil {
+			return
+		}
+		rx := timeNowDisciplined()
+		seq, sent, errEst, err := parseOWAMPTestPacket(buf[:n], ts.mode, ts.key)
+		if err != nil || seq >= ts.req.NumPackets {
+			continue
+		}
+
+		ts.mu.Lock()
+		ts.records[seq] = owampRecord{
+			Seq:       seq,
+			SendError: errEst,
+			SendTime:  sent,
+			RecvError: localErrorEstimate(),
+			RecvTime:  rx,
+			TTL:       senderTTL(ttl),
+		}
+		if !ts.seen || seq > ts.highest {
+			ts.highest = seq
+			ts.seen = true
+		}
+		ts.mu.Unlock()
+	}
+}
+
+// results gives the records from begin to end, with packets we know were lost
+// (ones before the latest we have seen, or all of them once the session is over)
+// given a zero receive time.
+func (ts *owampTestSession) results(begin, end uint32) ([]owampRecord, bool) {
+	ts.mu.Lock()
+	defer ts.mu.Unlock()
+
+	limit := ts.highest
+	if ts.finished {
+		limit = ts.req.NumPackets - 1
+		if ts.nextSeq != 0 && ts.nextSeq-1 < limit {
+			limit = ts.nextSeq - 1
+		}
+	} else if !ts.seen {
+		return nil, false
+	}
+	if end > limit {
+		end = limit
+	}
+
+	out := make([]owampRecord, 0)
+	for seq := begin; seq <= end && ts.req.NumPackets > 0; seq++ {
+		r, ok := ts.records[seq]
+		if !ok {
+			r = owampRecord{Seq: seq}
+		}
+		out = append(out, r)
+		if seq == 0xffffffff {
+			break
+		}
+	}
+	return out, ts.finished
+}
+
+func (s *owampServer) fetch(msg []byte) error {
+	begin := binary.BigEndian.Uint32(msg[8:12])
+	end := binary.BigEndian.Uint32(msg[12:16])
+	var sid [16]byte
+	copy(sid[:], msg[16:32])
+
+	var ts *owampTestSession
+	for _, v := range s.sessions {
+		if v.sid == sid && v.req.ConfReceiver {
+			ts = v
+		}
+	}
+
+	ack := make([]byte, 32)
+	if ts == nil {
+		ack[0] = acceptFailure
+		return s.c.writeMsg(ack)
+	}
+
+	records, finished := ts.results(begin, end)
+	ack[1] = boolByte(finished)
+	binary.BigEndian.PutUint32(ack[4:8], ts.nextSeq)
+	binary.BigEndian.PutUint32(ack[12:16], uint32(len(records)))
+	if err := s.c.writeMsg(ack); err != nil {
+		return err
+	}
+
+	// Then the Request-Session the session came from, with its SID filled in
+	head, slots := ts.request.Marshal()
+	if err := s.c.writeMsg(head); err != nil {
+		return err
+	}
+	if err := s.c.writeMsg(slots); err != nil {
+		return err
+	}
+
+	// No skip ranges, so just the HMAC for them
+	if err := s.c.writeMsg(make([]byte, hmacLen)); err != nil {
+		return err
+	}
+
+	data := make([]byte, (len(records)*owampRecordLen+15)/16*16+hmacLen)
+	for i, r := range records {
+		r.Marshal(data[i*owampRecordLen:])
+	}
+	return s.c.writeMsg(data)
+}
+
+// readStopSessions reads a Stop-Sessions, noting how far the senders got
+func readStopSessions(c *controlConn, first []byte, sessions []*owampTestSession) error {
+	all := append([]byte(nil), first...)
+	buf := []byte{}
+	next := func(n int) ([]byte, error) {
+		for len(buf) < n {
+			b, err := c.readBlocks(16)
+			if err != nil {
+				return nil, err
+			}
+			buf = append(buf, b...)
+			all = append(all, b...)
+		}
+		out := buf[:n]
+		buf = buf[n:]
+		return out, nil
+	}
+
+	n := binary.BigEndian.Uint32(first[4:8])
+	if n > 1024 {
+		return fmt.Errorf("too many sessions in Stop-Sessions (%d)", n)
+	}
+	for i := uint32(0); i < n; i++ {
+		d, err := next(24)
+		if err != nil {
+			return err
+		}
+		var sid [16]byte
+		copy(sid[:], d[0:16])
+		nextSeq := binary.BigEndian.Uint32(d[16:20])
+		if _, err := next(8 * int(binary.BigEndian.Uint32(d[20:24]))); err != nil {
+			return err
+		}
+		for _, ts := range sessions {
+			if ts.sid == sid {
+				ts.mu.Lock()
+				ts.nextSeq = nextSeq
+				ts.mu.Unlock()
+			}
+		}
+	}
+
+	mac, err := c.readBlocks(hmacLen)
+	if err != nil {
+		return err
+	}
+	return c.checkMAC(append(all, mac...))
+}
+
+// stopSessionsMsg builds a Stop-Sessions, describing sessions we were the sender of
+func stopSessionsMsg(sids [][16]byte, nextSeqs []uint32) []byte {
+	b := make([]byte, 16, 16+24*len(sids)+32)
+	b[0] = owampStopSessions
+	binary.BigEndian.PutUint32(b[4:8], uint32(len(sids)))
+	for i, sid := range sids {
+		d := make([]byte, 24)
+		copy(d[0:16], sid[:])
+		binary.BigEndian.PutUint32(d[16:20], nextSeqs[i])
+		b = append(b, d...)
+	}
+	for len(b)%16 != 0 {
+		b = append(b, 0)
+	}
+	return append(b, make([]byte, hmacLen)...)
+}
+
+// owampClient measures towards an OWAMP server
+type owampClient struct {
+	spec       peerSpec
+	mode       uint32
+	keyID      string
+	keys       keyring
+	interval   time.Duration
+	count      uint32        // Packets per session, before they are renewed
+	startDelay time.Duration // How far ahead to schedule the sessions
+	timeout    time.Duration // How long before a packet that has not turned up is lost
+	fetchEvery uint32
+
+	fwd, rev oneWayWindow
+}
+
+func (o *owampClient) Protocol() string { return "owamp" }
+func (o *owampClient) Host() string     { return o.spec.Host }
+
+func (o *owampClient) Stats() proberStats {
+	st := proberStats{}
+	var fwdFull, revFull bool
+	st.TXLatency, st.TXLoss, fwdFull = o.fwd.stats()
+	st.RXLatency, st.RXLoss, revFull = o.rev.stats()
+	if fwdFull && revFull {
+		st.Exchanges = len(o.fwd.samples)
+	}
+	return st
+}
+
+func newOWAMPClient(spec peerSpec) (*owampClient, error) {
+	mode, err := parseModeOption(spec.Options.Get("mode"))
+	if err != nil {
+		return nil, err
+	}
+	keys, err := loadKeyring(*owampKeyFile)
+	if err != nil {
+		return nil, err
+	}
+	return &owampClient{
+		spec:       spec,
+		mode:       mode,
+		keyID:      spec.Options.Get("keyid"),
+		keys:       keys,
+		interval:   time.Second,
+		count:      3600,
+		startDelay: 2 * time.Second,
+		timeout:    2 * time.Second,
+		fetchEvery: 10,
+	}, nil
+}
+
+// runOWAMPClient keeps OWAMP sessions going to a server, forever
+func runOWAMPClient(spec peerSpec) {
+	o, err := newOWAMPClient(spec)
+	if err != nil {
+		log.Printf("Cannot start OWAMP sessions to %s: %v", spec, err)
+		return
+	}
+	registerProber(o)
+
+	for {
+		if err := o.runOnce(); err != nil {
+			log.Printf("[%s] OWAMP sessions failed: %v", spec, err)
+			clock.Sleep(10 * time.Second)
+		}
+	}
+}
+
+// runOnce does one pair of test sessions, returning when they are over
+func (o *owampClient) runOnce() error {
+	conn, err := net.DialTimeout("tcp", o.spec.Addr(), 10*time.Second)
+	if err != nil {
+		return err
+	}
+	c, err := clientHandshake(conn, o.mode, o.keyID, o.keys)
+	if err != nil {
+		conn.Close()
+		return err
+	}
+	defer c.Close()
+
+	udp, err := net.ListenUDP("udp", testUDPAddr(conn.LocalAddr()))
+	if err != nil {
+		return err
+	}
+	defer udp.Close()
+
+	local := udp.LocalAddr().(*net.UDPAddr)
+	remote := conn.RemoteAddr().(*net.TCPAddr)
+	start := timeNowCorrected().Add(o.startDelay)
+	slots := []scheduleSlot{{Type: slotFixed, Interval: o.interval}}
+	timeout := o.timeout
+
+	// Us to them, the server picks the SID
+	fwdSID, fwdPort, err := o.request(c, requestSession{
+		Type:         owampRequestSession,
+		ConfReceiver: true,
+		NumPackets:   o.count,
+		SenderPort:   uint16(local.Port),
+		SenderAddr:   local.IP,
+		ReceiverAddr: remote.IP,
+		StartTime:    start,
+		Timeout:      timeout,
+		Slots:        slots,
+	})
+	if err != nil {
+		return err
+	}
+
+	// Them to us, we pick the SID
+	revSID := newSID(local.IP)
+	if _, _, err := o.request(c, requestSession{
+		Type:         owampRequestSession,
+		ConfSender:   true,
+		NumPackets:   o.count,
+		ReceiverPort: uint16(local.Port),
+		SenderAddr:   remote.IP,
+		ReceiverAddr: local.IP,
+		SID:          revSID,
+		StartTime:    start,
+		Timeout:      timeout,
+		Slots:        slots,
+	}); err != nil {
+		return err
+	}
+
+	startMsg := make([]byte, 32)
+	startMsg[0] = owampStartSessions
+	if err := c.writeMsg(startMsg); err != nil {
+		return err
+	}
+	ack, err := c.readMsg(32)
+	if err != nil {
+		return err
+	}
+	if ack[0] != acceptOK {
+		return fmt.Errorf("%w: Start-Sessions (accept code %d)", errOWAMPRejected, ack[0])
+	}
+
+	o.fwd.reset()
+	o.rev.reset()
+	go o.receive(udp, c.Mode, c.testKey(revSID))
+
+	to := &net.UDPAddr{IP: remote.IP, Port: int(fwdPort), Zone: remote.Zone}
+	fwdKey := c.testKey(fwdSID)
+	fetched := uint32(0)
+	t := start
+	for seq := uint32(0); seq < o.count; seq++ {
+		clock.Sleep(t.Sub(timeNowCorrected()))
+		pkt := marshalOWAMPTestPacket(seq, timeNowDisciplined(), localErrorEstimate(), c.Mode, fwdKey, 0)
+		if _, err := udp.WriteToUDP(pkt, to); err != nil && *debugShowLiveStats {
+			log.Printf("[%s] Failed to send OWAMP packet: %v", o.spec, err)
+		}
+		t = t.Add(o.interval)
+
+		// Fetch what the server has seen, leaving the packets that could still be on the way
+		inFlight := uint32(timeout/o.interval) + 1
+		if seq%o.fetchEvery == 0 && seq >= inFlight && seq-inFlight >= fetched {
+			if err := o.fetch(c, fwdSID, fetched, seq-inFlight); err != nil {
+				return err
+			}
+			fetched = seq - inFlight + 1
+		}
+	}
+
+	clock.Sleep(timeout)
+	if fetched < o.count {
+		if err := o.fetch(c, fwdSID, fetched, o.count-1); err != nil {
+			return err
+		}
+	}
+	return c.writeMsg(stopSessionsMsg([][16]byte{fwdSID}, []uint32{o.count}))
+}
+
+func (o *owampClient) request(c *controlConn, req requestSession) ([16]byte, uint16, error) {
+	head, slots := req.Marshal()
+	if err := c.writeMsg(head); err != nil {
+		return [16]byte{}, 0, err
+	}
+	if err := c.writeMsg(slots); err != nil {
+		return [16]byte{}, 0, err
+	}
+
+	b, err := c.readMsg(48)
+	if err != nil {
+		return [16]byte{}, 0, err
+	}
+	if b[0] != acceptOK {
+		return [16]byte{}, 0, fmt.Errorf("%w: Request-Session (accept code %d)", errOWAMPRejected, b[0])
+	}
+	var sid [16]byte
+	copy(sid[:], b[4:20])
+	return sid, binary.BigEndian.Uint16(b[2:4]), nil
+}
+
+// fetch gets the servers records for our packets begin to end, and feeds the forward window
+func (o *owampClient) fetch(c *controlConn, sid [16]byte, begin, end uint32) error {
+	records, err := fetchSession(c, sid, begin, end)
+	if err != nil {
+		return err
+	}
+
+	bySeq := make(map[uint32]owampRecord, len(records))
+	for _, r := range records {
+		bySeq[r.Seq] = r
+	}
+	for seq := begin; seq <= end; seq++ {
+		r, ok := bySeq[seq]
+		if ok && !r.RecvTime.IsZero() {
+			delay := r.RecvTime.Sub(r.SendTime)
+			o.fwd.record(seq, true, delay)
+			if *debugShowLiveStats {
+				log.Printf("[%s] OWAMP seq %d Forward: %s", o.spec, seq, delay)
+			}
+		} else {
+			o.fwd.record(seq, false, 0)
+		}
+	}
+	return nil
+}
+
+// fetchSession does a Fetch-Session, and returns the records sorted by sequence number
+func fetchSession(c *controlConn, sid [16]byte, begin, end uint32) ([]owampRecord, error) {
+	msg := make([]byte, 48)
+	msg[0] = owampFetchSession
+	binary.BigEndian.PutUint32(msg[8:12], begin)
+	binary.BigEndian.PutUint32(msg[12:16], end)
+	copy(msg[16:32], sid[:])
+	if err := c.writeMsg(msg); err != nil {
+		return nil, err
+	}
+
+	ack, err := c.readMsg(32)
+	if err != nil {
+		return nil, err
+	}
+	if ack[0] != acceptOK {
+		return nil, fmt.Errorf("%w: Fetch-Session (accept code %d)", errOWAMPRejected, ack[0])
+	}
+	nSkip := int(binary.BigEndian.Uint32(ack[8:12]))
+	nRecords := int(binary.BigEndian.Uint32(ack[12:16]))
+	if nSkip > owampMaxPackets || nRecords > owampMaxPackets {
+		return nil, fmt.Errorf("Fetch-Ack too big (%d skip ranges, %d records)", nSkip, nRecords)
+	}
+
+	// The session's Request-Session comes back first, which we already know
+	first, err := c.readBlocks(16)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := readRequestSession(c, first); err != nil {
+		return nil, err
+	}
+
+	if _, err := c.readMsg((8*nSkip+15)/16*16 + hmacLen); err != nil {
+		return nil, err
+	}
+	data, err := c.readMsg((nRecords*owampRecordLen+15)/16*16 + hmacLen)
+	if err != nil {
+		return nil, err
+	}
+
+	records := make([]owampRecord, nRecords)
+	for i := range records {
+		records[i] = parseOWAMPRecord(data[i*owampRecordLen:])
+	}
+	sort.Slice(records, func(i, j int) bool { return records[i].Seq < records[j].Seq })
+	return records, nil
+}
+
+// receive reads the servers test packets to us, for the reverse direction
+func (o *owampClient) receive(conn *net.UDPConn, mode uint32, key []byte) {
+	buf := make([]byte, 65536)
+	for {
+		n, _, err := conn.ReadFromUDP(buf)
+		if err != nil {
+			return
+		}
+		rx := timeNowDisciplined()
+		seq, sent, _, err := parseOWAMPTestPacket(buf[:n], mode, key)
+		if err != nil {
+			continue
+		}
+		delay := rx.Sub(sent)
+		o.rev.record(seq, true, delay)
+		if *debugShowLiveStats {
+			log.Printf("[%s] OWAMP seq %d Reverse: %s", o.spec, seq, delay)
+		}
+	}
+}
@@ -0,0 +1,316 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/hex"
+	"io"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestPBKDF2(t *testing.T) {
+	// RFC 6070 test vectors
+	got := hex.EncodeToString(pbkdf2([]byte("password"), []byte("salt"), 1, 20))
+	if got != "0c60c80f961f0e71f3a9b524af6012062fe037a6" {
+		t.Fatalf("1 iteration: got %s", got)
+	}
+	got = hex.EncodeToString(pbkdf2([]byte("password"), []byte("salt"), 4096, 20))
+	if got != "4b007901b765489abead49d926f721d065a429c1" {
+		t.Fatalf("4096 iterations: got %s", got)
+	}
+}
+
+// controlPair runs the control handshake over a pipe
+func controlPair(t *testing.T, offer, want uint32, clientKeys, serverKeys keyring) (*controlConn, *controlConn, error, error) {
+	a, b := net.Pipe()
+	type result struct {
+		c   *controlConn
+		err error
+	}
+	done := make(chan result)
+	go func() {
+		c, err := serverHandshake(b, offer, serverKeys)
+		done <- result{c, err}
+	}()
+	cc, cerr := clientHandshake(a, want, "test", clientKeys)
+	if cerr != nil {
+		a.Close()
+	}
+	sr := <-done
+	return cc, sr.c, cerr, sr.err
+}
+
+func TestControlHandshake(t *testing.T) {
+	keys := keyring{"test": []byte("hunter2")}
+	all := uint32(modeUnauthenticated | modeAuthenticated | modeEncrypted)
+
+	for _, mode := range []uint32{modeUnauthenticated, modeAuthenticated, modeEncrypted} {
+		cc, sc, cerr, serr := controlPair(t, all, mode, keys, keys)
+		if cerr != nil || serr != nil {
+			t.Fatalf("mode %d: client %v, server %v", mode, cerr, serr)
+		}
+		if cc.Mode != mode || sc.Mode != mode {
+			t.Fatalf("mode %d: client picked %d, server has %d", mode, cc.Mode, sc.Mode)
+		}
+
+		// A message each way, to check both sides agree on keys and IVs
+		for i := 0; i < 2; i++ {
+			msg := make([]byte, 48)
+			msg[0] = byte(i + 1)
+			go cc.writeMsg(msg)
+			got, err := sc.readMsg(48)
+			if err != nil || got[0] != byte(i+1) {
+				t.Fatalf("mode %d: client to server message %d: %v %x", mode, i, err, got)
+			}
+			go sc.writeMsg(msg)
+			got, err = cc.readMsg(48)
+			if err != nil || got[0] != byte(i+1) {
+				t.Fatalf("mode %d: server to client message %d: %v %x", mode, i, err, got)
+			}
+		}
+		cc.Close()
+	}
+
+	// Wrong secret
+	_, _, cerr, serr := controlPair(t, all, modeAuthenticated, keyring{"test": []byte("hunter3")}, keys)
+	if cerr == nil || serr != errBadToken {
+		t.Fatalf("wrong secret: client %v, server %v", cerr, serr)
+	}
+
+	// No key, so only open mode is possible
+	cc, _, cerr, serr := controlPair(t, all, 0, keyring{}, keys)
+	if cerr != nil || serr != nil || cc.Mode != modeUnauthenticated {
+		t.Fatalf("no key: client %v, server %v", cerr, serr)
+	}
+	cc.Close()
+
+	// A server asking for far too many PBKDF2 rounds
+	a, b := net.Pipe()
+	defer a.Close()
+	go b.Write(serverGreeting{Modes: all, Count: 1 << 30}.Marshal())
+	if _, err := clientHandshake(a, modeAuthenticated, "test", keys); err != errBadCount {
+		t.Fatalf("huge count: %v", err)
+	}
+}
+
+func TestOWAMPTestPacket(t *testing.T) {
+	key := make([]byte, 16)
+	key[3] = 9
+	ts := time.Unix(1600000000, 500000000)
+	for _, mode := range []uint32{modeUnauthenticated, modeAuthenticated, modeEncrypted} {
+		b := marshalOWAMPTestPacket(42, ts, 0x8101, mode, key, 10)
+		if len(b) != owampTestPacketLen(mode, 10) {
+			t.Fatalf("mode %d: packet is %d bytes", mode, len(b))
+		}
+		seq, got, errEst, err := parseOWAMPTestPacket(b, mode, key)
+		if err != nil || seq != 42 || !got.Equal(ts) || errEst != 0x8101 {
+			t.Fatalf("mode %d: got seq %d time %s error %x (%v)", mode, seq, got, errEst, err)
+		}
+	}
+}
+
+func TestOWAMPRecordRoundTrip(t *testing.T) {
+	in := owampRecord{Seq: 3, SendError: 1, SendTime: time.Unix(1600000000, 0), RecvError: 2, RecvTime: time.Unix(1600000000, 2000), TTL: 60}
+	b := make([]byte, owampRecordLen)
+	in.Marshal(b)
+	if out := parseOWAMPRecord(b); out != in {
+		t.Fatalf("got %+v, want %+v", out, in)
+	}
+
+	lost := owampRecord{Seq: 4, SendTime: time.Unix(1600000000, 0)}
+	lost.Marshal(b)
+	if out := parseOWAMPRecord(b); !out.RecvTime.IsZero() {
+		t.Fatalf("lost packet came back with a receive time %s", out.RecvTime)
+	}
+}
+
+// loopbackControl is a control connection from 127.0.0.1, for the server end
+func loopbackControl(t *testing.T) *controlConn {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	client, err := net.Dial("tcp", ln.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { client.Close() })
+	conn, err := ln.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	return &controlConn{conn: conn, Mode: modeUnauthenticated}
+}
+
+func TestOWAMPRequestLimits(t *testing.T) {
+	s := &owampServer{c: loopbackControl(t)}
+	defer s.stopAll()
+
+	lo := net.IPv4(127, 0, 0, 1)
+	ok := requestSession{ConfReceiver: true, NumPackets: 10, SenderAddr: lo, ReceiverAddr: lo,
+		Slots: []scheduleSlot{{Type: slotFixed, Interval: time.Second}}}
+	for _, c := range []struct {
+		name   string
+		change func(r *requestSession)
+		accept byte
+	}{
+		{"fine", func(r *requestSession) {}, acceptOK},
+		{"unspecified addresses", func(r *requestSession) { r.SenderAddr, r.ReceiverAddr = net.IPv4zero, net.IPv4zero }, acceptOK},
+		{"huge padding", func(r *requestSession) { r.Padding = 1 << 20 }, acceptUnsupported},
+		{"too fast", func(r *requestSession) { r.Slots[0].Interval = time.Microsecond }, acceptUnsupported},
+		{"someone else", func(r *requestSession) { r.SenderAddr = net.IPv4(192, 0, 2, 1) }, acceptPermanent},
+		{"send to someone else", func(r *requestSession) {
+			r.ConfReceiver, r.ConfSender, r.ReceiverAddr = false, true, net.IPv4(192, 0, 2, 1)
+		}, acceptPermanent},
+	} {
+		r := ok
+		r.Slots = append([]scheduleSlot(nil), ok.Slots...)
+		c.change(&r)
+		if got := s.requestSession(r)[0]; got != c.accept {
+			t.Errorf("%s: accept %d, wanted %d", c.name, got, c.accept)
+		}
+	}
+
+	// Two are open already, and then it runs out
+	for i := 2; i < owampMaxSessions; i++ {
+		if got := s.requestSession(ok)[0]; got != acceptOK {
+			t.Fatalf("session %d: accept %d", i, got)
+		}
+	}
+	if got := s.requestSession(ok)[0]; got != acceptTemporary {
+		t.Fatalf("one too many: accept %d", got)
+	}
+	s.stopAll()
+	if got := s.requestSession(ok)[0]; got != acceptOK {
+		t.Fatalf("after stopping: accept %d", got)
+	}
+}
+
+func TestOWAMPSessions(t *testing.T) {
+	if testing.Short() {
+		t.Skip("runs real OWAMP sessions on loopback")
+	}
+
+	keys := keyring{"test": []byte("hunter2")}
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	go serveOWAMP(ln, keys)
+
+	for _, mode := range []string{"open", "authenticated", "encrypted"} {
+		spec, err := parsePeerSpec("owamp://" + ln.Addr().String() + "?keyid=test&mode=" + mode)
+		if err != nil {
+			t.Fatal(err)
+		}
+		o, err := newOWAMPClient(spec)
+		if err != nil {
+			t.Fatal(err)
+		}
+		o.keys = keys
+		o.interval = 10 * time.Millisecond
+		o.count = 40
+		o.startDelay = 50 * time.Millisecond
+		o.timeout = 100 * time.Millisecond
+		o.fetchEvery = 5
+
+		if err := o.runOnce(); err != nil {
+			t.Fatalf("%s: %v", mode, err)
+		}
+
+		st := o.Stats()
+		if st.Exchanges == 0 {
+			t.Fatalf("%s: windows did not fill", mode)
+		}
+		if st.TXLoss != 0 || st.RXLoss != 0 {
+			t.Fatalf("%s: loss on loopback: %+v", mode, st)
+		}
+		if st.TXLatency <= 0 || st.TXLatency > 100*time.Millisecond || st.RXLatency <= 0 || st.RXLatency > 100*time.Millisecond {
+			t.Fatalf("%s: odd latency: %+v", mode, st)
+		}
+	}
+}
+
+func TestOWAMPFetchReply(t *testing.T) {
+	a, b := net.Pipe()
+	defer a.Close()
+	defer b.Close()
+
+	sid := [16]byte{1, 2, 3}
+	lo := net.IPv4(127, 0, 0, 1)
+	ts := &owampTestSession{
+		sid: sid,
+		req: requestSession{ConfReceiver: true, NumPackets: 2},
+		request: requestSession{Type: owampRequestSession, ConfReceiver: true, NumPackets: 2, SenderAddr: lo, ReceiverAddr: lo, SID: sid,
+			Slots: []scheduleSlot{{Type: slotFixed, Interval: time.Second}}},
+		records: map[uint32]owampRecord{0: {Seq: 0}, 1: {Seq: 1}},
+		highest: 1,
+		seen:    true,
+	}
+	s := &owampServer{c: &controlConn{conn: b, Mode: modeUnauthenticated}, sessions: []*owampTestSession{ts}}
+
+	msg := make([]byte, 48)
+	msg[0] = owampFetchSession
+	binary.BigEndian.PutUint32(msg[12:16], 0xffffffff)
+	copy(msg[16:32], sid[:])
+	go s.fetch(msg)
+
+	// Fetch-Ack, Request-Session and its one slot, no skip ranges, then two records
+	want := 32 + requestSessionLen + 16 + hmacLen + hmacLen + 64 + hmacLen
+	reply := make([]byte, want)
+	if _, err := io.ReadFull(a, reply); err != nil {
+		t.Fatal(err)
+	}
+	if reply[0] != acceptOK || binary.BigEndian.Uint32(reply[12:16]) != 2 {
+		t.Fatalf("Fetch-Ack %x", reply[:32])
+	}
+	req := reply[32 : 32+requestSessionLen]
+	if req[0] != owampRequestSession || binary.BigEndian.Uint32(req[4:8]) != 1 || !bytes.Equal(req[48:64], sid[:]) {
+		t.Fatalf("Request-Session %x", req)
+	}
+	records := reply[32+requestSessionLen+16+2*hmacLen:]
+	if r := parseOWAMPRecord(records[owampRecordLen:]); r.Seq != 1 {
+		t.Fatalf("second record is seq %d", r.Seq)
+	}
+}
+
+func TestOWAMPStartTwice(t *testing.T) {
+	s := &owampServer{c: loopbackControl(t)}
+	defer s.stopAll()
+
+	rx, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rx.Close()
+	req := requestSession{ConfSender: true, NumPackets: 3, ReceiverAddr: rx.LocalAddr().(*net.UDPAddr).IP,
+		ReceiverPort: uint16(rx.LocalAddr().(*net.UDPAddr).Port), StartTime: timeNowCorrected(),
+		Slots: []scheduleSlot{{Type: slotFixed, Interval: 10 * time.Millisecond}}}
+	if got := s.requestSession(req)[0]; got != acceptOK {
+		t.Fatalf("accept %d", got)
+	}
+
+	// A second Start-Sessions shouldn't send the session again
+	s.startAll()
+	s.startAll()
+	seen := 0
+	buf := make([]byte, 1500)
+	for {
+		rx.SetReadDeadline(time.Now().Add(300 * time.Millisecond))
+		n, err := rx.Read(buf)
+		if err != nil {
+			break
+		}
+		if _, _, _, err := parseOWAMPTestPacket(buf[:n], modeUnauthenticated, nil); err == nil {
+			seen++
+		}
+	}
+	if seen != 3 {
+		t.Fatalf("got %d test packets, sent 3", seen)
+	}
+}
@@ -0,0 +1,434 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha1"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"flag"
+	"fmt"
+	"hash"
+	"io"
+	"net"
+	"os"
+	"strings"
+	"time"
+)
+
+// The control connection of OWAMP (RFC 4656) and TWAMP (RFC 5357) work the
+// same way up to the point of asking for test sessions: the server sends a
+// greeting with the modes it supports, the client picks one (proving it knows
+// a shared secret if it is not the unauthenticated mode), and the server says
+// if it is happy to go on. From then on, in authenticated and encrypted mode,
+// every message is encrypted with AES-CBC and ends with a HMAC.
+
+var owampKeyFile = flag.String("owamp.keyfile", "", "File of \"keyid secret\" lines, for authenticated OWAMP/TWAMP (secret in hex, like a perfSONAR pfs file)")
+
+const (
+	modeUnauthenticated = 1
+	modeAuthenticated   = 2
+	modeEncrypted       = 4
+)
+
+const (
+	greetingLen      = 64
+	setupResponseLen = 164
+	serverStartLen   = 48
+	hmacLen          = 16
+	pbkdf2Count      = 1024
+	pbkdf2MaxCount   = 32768 // A server asking for more than this is only making us burn CPU
+)
+
+var (
+	errControlRefused = errors.New("server refused the control connection")
+	errNoCommonMode   = errors.New("no mode in common with the server")
+	errBadHMAC        = errors.New("control message failed HMAC check")
+	errBadToken       = errors.New("client did not prove it knows the shared secret")
+	errBadCount       = errors.New("server asked for too many PBKDF2 rounds")
+)
+
+// keyring is the shared secrets for authenticated modes, by KeyID
+type keyring map[string][]byte
+
+func loadKeyring(path string) (keyring, error) {
+	k := keyring{}
+	if path == "" {
+		return k, nil
+	}
+
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	s := bufio.NewScanner(f)
+	for s.Scan() {
+		line := strings.TrimSpace(s.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		fields := strings.Fields(line)
+		if len(fields) != 2 {
+			return nil, fmt.Errorf("bad line in %s: %q", path, line)
+		}
+		secret, err := hex.DecodeString(fields[1])
+		if err != nil {
+			// Not hex, so use the passphrase as it is
+			secret = []byte(fields[1])
+		}
+		k[fields[0]] = secret
+	}
+	return k, s.Err()
+}
+
+// pbkdf2 is PBKDF2 (RFC 8018) with HMAC-SHA1, as used to turn the shared secret into a key
+func pbkdf2(password, salt []byte, iter, keyLen int) []byte {
+	prf := hmac.New(sha1.New, password)
+	out := make([]byte, 0, keyLen)
+	u := make([]byte, prf.Size())
+	t := make([]byte, prf.Size())
+	for block := uint32(1); len(out) < keyLen; block++ {
+		prf.Reset()
+		prf.Write(salt)
+		binary.Write(prf, binary.BigEndian, block)
+		u = prf.Sum(u[:0])
+		copy(t, u)
+		for i := 1; i < iter; i++ {
+			prf.Reset()
+			prf.Write(u)
+			u = prf.Sum(u[:0])
+			for j := range t {
+				t[j] ^= u[j]
+			}
+		}
+		out = append(out, t...)
+	}
+	return out[:keyLen]
+}
+
+type serverGreeting struct {
+	Modes     uint32
+	Challenge [16]byte
+	Salt      [16]byte
+	Count     uint32
+}
+
+func (g serverGreeting) Marshal() []byte {
+	b := make([]byte, greetingLen)
+	binary.BigEndian.PutUint32(b[12:16], g.Modes)
+	copy(b[16:32], g.Challenge[:])
+	copy(b[32:48], g.Salt[:])
+	binary.BigEndian.PutUint32(b[48:52], g.Count)
+	return b
+}
+
+func parseServerGreeting(b []byte) serverGreeting {
+	g := serverGreeting{
+		Modes: binary.BigEndian.Uint32(b[12:16]),
+		Count: binary.BigEndian.Uint32(b[48:52]),
+	}
+	copy(g.Challenge[:], b[16:32])
+	copy(g.Salt[:], b[32:48])
+	return g
+}
+
+// controlConn is an OWAMP/TWAMP control connection after the mode has been agreed
+type controlConn struct {
+	conn    net.Conn
+	Mode    uint32
+	KeyID   string
+	hmacKey []byte
+	aesKey  []byte
+	enc     cipher.BlockMode // For what we send
+	dec     cipher.BlockMode // For what we read
+}
+
+func (c *controlConn) secure() bool {
+	return c.Mode == modeAuthenticated || c.Mode == modeEncrypted
+}
+
+// writeMsg sends a control message, b must be a multiple of 16 bytes and end
+// with 16 bytes of space for the HMAC (which is left zero in open mode)
+func (c *controlConn) writeMsg(b []byte) error {
+	if c.secure() {
+		copy(b[len(b)-hmacLen:], c.mac(b[:len(b)-hmacLen]))
+		out := make([]byte, len(b))
+		c.enc.CryptBlocks(out, b)
+		b = out
+	}
+	_, err := c.conn.Write(b)
+	return err
+}
+
+// writeBlocks sends data that is not followed by a HMAC, like test result records
+func (c *controlConn) writeBlocks(b []byte) error {
+	if c.secure() {
+		out := make([]byte, len(b))
+		c.enc.CryptBlocks(out, b)
+		b = out
+	}
+	_, err := c.conn.Write(b)
+	return err
+}
+
+// readBlocks reads n bytes (a multiple of 16) and decrypts them if needed
+func (c *controlConn) readBlocks(n int) ([]byte, error) {
+	b := make([]byte, n)
+	if _, err := io.ReadFull(c.conn, b); err != nil {
+		return nil, err
+	}
+	if c.secure() {
+		c.dec.CryptBlocks(b, b)
+	}
+	return b, nil
+}
+
+// readMsg reads a whole control message of n bytes and checks its HMAC
+func (c *controlConn) readMsg(n int) ([]byte, error) {
+	b, err := c.readBlocks(n)
+	if err != nil {
+		return nil, err
+	}
+	return b, c.checkMAC(b)
+}
+
+// checkMAC checks the HMAC at the end of a message that has already been read
+func (c *controlConn) checkMAC(b []byte) error {
+	if !c.secure() {
+		return nil
+	}
+	if !hmac.Equal(b[len(b)-hmacLen:], c.mac(b[:len(b)-hmacLen])) {
+		return errBadHMAC
+	}
+	return nil
+}
+
+func (c *controlConn) mac(b []byte) []byte {
+	var h hash.Hash = hmac.New(sha1.New, c.hmacKey)
+	h.Write(b)
+	return h.Sum(nil)[:hmacLen]
+}
+
+// testKey is the key used for a test sessions packets, the SID encrypted with the session key
+func (c *controlConn) testKey(sid [16]byte) []byte {
+	if !c.secure() {
+		return nil
+	}
+	blk, _ := aes.NewCipher(c.aesKey)
+	k := make([]byte, 16)
+	blk.Encrypt(k, sid[:])
+	return k
+}
+
+// testHMACKey is the key for test packet HMACs (TWAMP only), the HMAC session key encrypted with the test key
+func (c *controlConn) testHMACKey(sid [16]byte) []byte {
+	if !c.secure() {
+		return nil
+	}
+	blk, _ := aes.NewCipher(c.testKey(sid))
+	k := make([]byte, len(c.hmacKey))
+	cipher.NewCBCEncrypter(blk, make([]byte, 16)).CryptBlocks(k, c.hmacKey)
+	return k
+}
+
+func (c *controlConn) Close() error {
+	return c.conn.Close()
+}
+
+// clientHandshake reads the greeting, picks the best mode we can do (or the
+// one asked for with want, if not 0) and waits for the server to start
+func clientHandshake(conn net.Conn, want uint32, keyID string, keys keyring) (*controlConn, error) {
+	conn.SetDeadline(clock.Now().Add(30 * time.Second))
+	defer conn.SetDeadline(time.Time{})
+
+	gb := make([]byte, greetingLen)
+	if _, err := io.ReadFull(conn, gb); err != nil {
+		return nil, err
+	}
+	g := parseServerGreeting(gb)
+	if g.Modes == 0 {
+		return nil, errControlRefused
+	}
+
+	secret := keys[keyID]
+	mode := uint32(0)
+	for _, m := range []uint32{modeEncrypted, modeAuthenticated, modeUnauthenticated} {
+		if g.Modes&m == 0 || (want != 0 && want != m) {
+			continue
+		}
+		if m != modeUnauthenticated && secret == nil {
+			continue
+		}
+		mode = m
+		break
+	}
+	if mode == 0 {
+		return nil, errNoCommonMode
+	}
+
+	c := &controlConn{conn: conn, Mode: mode, KeyID: keyID}
+	resp := make([]byte, setupResponseLen)
+	binary.BigEndian.PutUint32(resp[0:4], mode)
+	var clientIV [16]byte
+	if c.secure() {
+		if g.Count > pbkdf2MaxCount {
+			return nil, errBadCount
+		}
+		copy(resp[4:84], keyID)
+
+		c.aesKey = make([]byte, 16)
+		c.hmacKey = make([]byte, 32)
+		rand.Read(c.aesKey)
+		rand.Read(c.hmacKey)
+		rand.Read(clientIV[:])
+
+		// Token is Challenge | AES key | HMAC key, encrypted with the key from the secret
+		token := make([]byte, 64)
+		copy(token[0:16], g.Challenge[:])
+		copy(token[16:32], c.aesKey)
+		copy(token[32:64], c.hmacKey)
+		k := pbkdf2(secret, g.Salt[:], int(g.Count), 16)
+		blk, _ := aes.NewCipher(k)
+		cipher.NewCBCEncrypter(blk, make([]byte, 16)).CryptBlocks(resp[84:148], token)
+		copy(resp[148:164], clientIV[:])
+	}
+	if _, err := conn.Write(resp); err != nil {
+		return nil, err
+	}
+
+	sb := make([]byte, serverStartLen)
+	if _, err := io.ReadFull(conn, sb); err != nil {
+		return nil, err
+	}
+	if sb[15] != 0 {
+		return nil, fmt.Errorf("%w (accept code %d)", errControlRefused, sb[15])
+	}
+	if c.secure() {
+		blk, _ := aes.NewCipher(c.aesKey)
+		c.enc = cipher.NewCBCEncrypter(blk, clientIV[:])
+		c.dec = cipher.NewCBCDecrypter(blk, sb[16:32])
+	}
+	return c, nil
+}
+
+// serverHandshake sends the greeting offering modes, and checks what the client comes back with
+func serverHandshake(conn net.Conn, modes uint32, keys keyring) (*controlConn, error) {
+	conn.SetDeadline(clock.Now().Add(30 * time.Second))
+	defer conn.SetDeadline(time.Time{})
+
+	g := serverGreeting{Modes: modes, Count: pbkdf2Count}
+	rand.Read(g.Challenge[:])
+	rand.Read(g.Salt[:])
+	if _, err := conn.Write(g.Marshal()); err != nil {
+		return nil, err
+	}
+
+	resp := make([]byte, setupResponseLen)
+	if _, err := io.ReadFull(conn, resp); err != nil {
+		return nil, err
+	}
+	mode := binary.BigEndian.Uint32(resp[0:4])
+
+	start := make([]byte, serverStartLen)
+	putNTPTime(start[32:40], timeNowCorrected())
+	refuse := func(err error) (*controlConn, error) {
+		start[15] = 1
+		conn.Write(start)
+		return nil, err
+	}
+	if mode&modes == 0 || (mode != modeUnauthenticated && mode != modeAuthenticated && mode != modeEncrypted) {
+		return refuse(errNoCommonMode)
+	}
+
+	c := &controlConn{conn: conn, Mode: mode}
+	var serverIV [16]byte
+	if c.secure() {
+		c.KeyID = string(bytes.TrimRight(resp[4:84], "\x00"))
+		secret := keys[c.KeyID]
+		if secret == nil {
+			return refuse(fmt.Errorf("unknown KeyID %q", c.KeyID))
+		}
+
+		k := pbkdf2(secret, g.Salt[:], int(g.Count), 16)
+		blk, _ := aes.NewCipher(k)
+		token := make([]byte, 64)
+		cipher.NewCBCDecrypter(blk, make([]byte, 16)).CryptBlocks(token, resp[84:148])
+		if !bytes.Equal(token[0:16], g.Challenge[:]) {
+			return refuse(errBadToken)
+		}
+		c.aesKey = token[16:32]
+		c.hmacKey = token[32:64]
+
+		rand.Read(serverIV[:])
+		copy(start[16:32], serverIV[:])
+		sblk, _ := aes.NewCipher(c.aesKey)
+		c.enc = cipher.NewCBCEncrypter(sblk, serverIV[:])
+		c.dec = cipher.NewCBCDecrypter(sblk, resp[148:164])
+	}
+
+	if _, err := conn.Write(start); err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+// parseModeOption turns a peer mode option into the mode bits, 0 meaning the best available
+func parseModeOption(s string) (uint32, error) {
+	switch s {
+	case "":
+		return 0, nil
+	case "open", "unauthenticated":
+		return modeUnauthenticated, nil
+	case "auth", "authenticated":
+		return modeAuthenticated, nil
+	case "encrypted":
+		return modeEncrypted, nil
+	}
+	return 0, fmt.Errorf("unknown mode %q, must be open, authenticated or encrypted", s)
+}
+
+// ntpDuration encodes a duration in the timestamp format, for schedule slots and timeouts
+func ntpDuration(d time.Duration) uint64 {
+	secs := uint64(d / time.Second)
+	frac := (uint64(d%time.Second)<<32 + 5e8) / 1e9
+	return secs<<32 | frac
+}
+
+func fromNTPDuration(v uint64) time.Duration {
+	return time.Duration(v>>32)*time.Second + time.Duration(((v&0xffffffff)*1e9+1<<31)>>32)
+}
+
+// Test packets in authenticated and encrypted mode have the sequence number
+// encrypted with the test session key, and in encrypted mode the first n
+// bytes (all the timestamps) are.
+
+func encryptTestHeader(b []byte, mode uint32, key []byte, n int) {
+	if mode != modeAuthenticated && mode != modeEncrypted {
+		return
+	}
+	blk, _ := aes.NewCipher(key)
+	if mode == modeAuthenticated {
+		blk.Encrypt(b[0:16], b[0:16])
+		return
+	}
+	cipher.NewCBCEncrypter(blk, make([]byte, 16)).CryptBlocks(b[0:n], b[0:n])
+}
+
+func decryptTestHeader(b []byte, mode uint32, key []byte, n int) {
+	if mode != modeAuthenticated && mode != modeEncrypted {
+		return
+	}
+	blk, _ := aes.NewCipher(key)
+	if mode == modeAuthenticated {
+		blk.Decrypt(b[0:16], b[0:16])
+		return
+	}
+	cipher.NewCBCDecrypter(blk, make([]byte, 16)).CryptBlocks(b[0:n], b[0:n])
+}
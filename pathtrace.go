@@ -0,0 +1,529 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/benjojo/sping/icmp"
+	"github.com/vmihailenco/msgpack/v4"
+	"golang.org/x/net/ipv4"
+	"golang.org/x/net/ipv6"
+)
+
+// When the delay in one direction jumps, the path has usually changed, and
+// the path back can be entirely different to the path there. So both ends
+// traceroute towards each other at the same time, swap hop lists over the TCP
+// control port, and the pair is kept (and logged) for whoever looks later.
+
+var pathTraceShift = flag.Duration("pathtrace.shift", 0, "How big a jump in one direction's delay makes sping peers traceroute towards each other (0 disables)")
+var pathTraceHoldoff = flag.Duration("pathtrace.holdoff", 5*time.Minute, "How long to wait before tracing the path to the same peer again")
+
+// How many path pairs are kept for the API
+const pathPairsKept = 50
+
+// How often a peer may ask us to trace back to it
+const pathTraceServeInterval = 30 * time.Second
+
+// pathHop is one hop of a traceroute
+type pathHop struct {
+	TTL         int           `json:"ttl" msgpack:"T"`
+	Addr        string        `json:"addr,omitempty" msgpack:"A"` // Empty if nothing answered
+	RTT         time.Duration `json:"rtt_ns,omitempty" msgpack:"R"`
+	Unreachable int           `json:"unreachable,omitempty" msgpack:"U"` // Destination Unreachable code+1, if that ended the trace
+	Extensions  []string      `json:"extensions,omitempty" msgpack:"E"`
+}
+
+// pathTrace is a traceroute from one end to the other
+type pathTrace struct {
+	At      time.Time `json:"at" msgpack:"W"`
+	To      string    `json:"to" msgpack:"D"`
+	Hops    []pathHop `json:"hops" msgpack:"H"`
+	Reached bool      `json:"reached" msgpack:"F"`
+	Error   string    `json:"error,omitempty" msgpack:"X"`
+}
+
+// pathPair is both directions of the path to a peer, traced at the same time
+type pathPair struct {
+	At      time.Time `json:"at"`
+	Peer    string    `json:"peer"`
+	Reason  string    `json:"reason"`
+	Forward pathTrace `json:"forward"` // From us to the peer
+	Reverse pathTrace `json:"reverse"` // From the peer to us
+}
+
+var pathPairs []pathPair
+var pathPairsLock sync.Mutex
+
+// traceroutePath is swapped out in tests
+var traceroutePath = traceroute
+
+// holdoff rate limits something per peer
+type holdoff struct {
+	mu   sync.Mutex
+	last map[string]time.Time
+}
+
+// allow returns true, and starts a new holdoff, if key was last allowed more than d ago
+func (h *holdoff) allow(key string, now time.Time, d time.Duration) bool {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if h.last == nil {
+		h.last = make(map[string]time.Time)
+	}
+	if last, ok := h.last[key]; ok && now.Sub(last) < d {
+		return false
+	}
+	h.last[key] = now
+	return true
+}
+
+var pathTraceStarted holdoff
+var pathTraceServed holdoff
+
+// Latency shifts are a sustained change in one direction's delay, found the
+// same way as peer clock steps, just without the round trip staying put.
+
+type latencyShiftDetector struct {
+	tx, rx shiftHistory
+}
+
+type shiftHistory struct {
+	samples []time.Duration
+	shifted int
+}
+
+// observe feeds a new forward / reverse delay pair in, and returns the
+// direction ("tx" or "rx") that has just shifted, and by how much
+func (d *latencyShiftDetector) observe(forward, reverse, threshold time.Duration) (direction string, shift time.Duration) {
+	if shift, ok := d.tx.observe(forward, threshold); ok {
+		direction = "tx"
+		if rshift, ok := d.rx.observe(reverse, threshold); ok && absDuration(rshift) > absDuration(shift) {
+			return "rx", rshift
+		}
+		return direction, shift
+	}
+	if shift, ok := d.rx.observe(reverse, threshold); ok {
+		return "rx", shift
+	}
+	return "", 0
+}
+
+func (h *shiftHistory) observe(v, threshold time.Duration) (shift time.Duration, ok bool) {
+	if len(h.samples) >= peerStepConfirm {
+		change := v - medianDuration(h.samples)
+		if absDuration(change) > threshold {
+			h.shifted++
+			if h.shifted < peerStepConfirm {
+				return 0, false
+			}
+			// Start the baseline again from the new delay
+			h.samples = append(h.samples[:0], v)
+			h.shifted = 0
+			return change, true
+		}
+		h.shifted = 0
+	}
+
+	h.samples = append(h.samples, v)
+	if len(h.samples) > peerStepHistory {
+		h.samples = h.samples[1:]
+	}
+	return 0, false
+}
+
+// exchangePaths traces the path to a sping peer at addr (host:port of its TCP
+// control port) from where bind pins it to, while asking it to trace back to
+// us, and keeps the pair
+func exchangePaths(addr string, bind localBinding, reason string) {
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		log.Printf("Cannot exchange paths with %s: %v", addr, err)
+		return
+	}
+	peer := net.ParseIP(host)
+	if peer == nil {
+		log.Printf("Cannot exchange paths with %s: not an IP", addr)
+		return
+	}
+
+	forwardDone := make(chan pathTrace, 1)
+	var once sync.Once
+	startForward := func() {
+		once.Do(func() {
+			go func() { forwardDone <- traceroutePath(peer, bind) }()
+		})
+	}
+
+	pair := pathPair{At: clock.Now(), Peer: peer.String(), Reason: reason}
+	reverse, conn, err := requestPeerTrace(addr, bind, startForward)
+	if err != nil {
+		reverse = pathTrace{At: pair.At, Error: err.Error()}
+	}
+	pair.Reverse = reverse
+	startForward()
+	pair.Forward = <-forwardDone
+
+	if conn != nil {
+		// Let the peer have our side, so it can keep the pair too
+		conn.SetDeadline(time.Now().Add(10 * time.Second))
+		if err := msgpack.NewEncoder(conn).Encode(&pair.Forward); err != nil && *debugShowLiveStats {
+			log.Printf("Failed to send path to %s: %v", addr, err)
+		}
+		conn.Close()
+	}
+	storePathPair(pair)
+}
+
+// requestPeerTrace asks the peer to trace back to us, calling start once the
+// peer has been asked, so both traces run at the same time. On success conn
+// is left open so that our trace can be sent back.
+func requestPeerTrace(addr string, bind localBinding, start func()) (pathTrace, net.Conn, error) {
+	var tr pathTrace
+	d := bind.dialer("tcp")
+	d.Timeout = 10 * time.Second
+	conn, err := d.Dial("tcp", addr)
+	if err != nil {
+		return tr, nil, err
+	}
+	conn.SetDeadline(time.Now().Add(2 * time.Minute))
+
+	bannerBuf := make([]byte, 10000)
+	n, err := conn.Read(bannerBuf)
+	if err != nil {
+		conn.Close()
+		return tr, nil, fmt.Errorf("host banner not sping")
+	}
+	if err := checkBanner(string(bannerBuf[:n])); err != nil {
+		conn.Close()
+		return tr, nil, err
+	}
+	if _, err := conn.Write([]byte("TRACE\r\n")); err != nil {
+		conn.Close()
+		return tr, nil, err
+	}
+	start()
+
+	if err := msgpack.NewDecoder(conn).Decode(&tr); err != nil {
+		// Older peers just say I_DONT_UNDERSTAND
+		conn.Close()
+		return tr, nil, fmt.Errorf("peer did not send its path: %v", err)
+	}
+	return tr, conn, nil
+}
+
+// handlePathTraceRequest is the other end of requestPeerTrace, run on the
+// TCP control port of l after a TRACE
+func handlePathTraceRequest(conn net.Conn, l *listener) {
+	conn.SetDeadline(time.Now().Add(2 * time.Minute))
+	host, _, _ := net.SplitHostPort(conn.RemoteAddr().String())
+	peer := net.ParseIP(host)
+	if peer == nil {
+		return
+	}
+
+	var pair pathPair
+	pair.At = clock.Now()
+	pair.Peer = peer.String()
+	pair.Reason = "peer-request"
+	if !pathTraceServed.allow(pair.Peer, pair.At, pathTraceServeInterval) {
+		pair.Forward = pathTrace{At: pair.At, To: pair.Peer, Error: "asked to trace too often"}
+		msgpack.NewEncoder(conn).Encode(&pair.Forward)
+		return
+	}
+
+	pair.Forward = traceroutePath(peer, localBinding{}.on(l))
+	if err := msgpack.NewEncoder(conn).Encode(&pair.Forward); err != nil {
+		log.Printf("Failed to send path to %s: %v", pair.Peer, err)
+		return
+	}
+	if err := msgpack.NewDecoder(conn).Decode(&pair.Reverse); err != nil {
+		pair.Reverse = pathTrace{At: pair.At, Error: fmt.Sprintf("peer did not send its path: %v", err)}
+	}
+	storePathPair(pair)
+}
+
+// pathShifted is called when a sping session sees the delay in one direction shift
+func pathShifted(ses *session, direction string, shift time.Duration) {
+	log.Printf("[%s] %s delay shifted by %s", ses.PeerAddress, direction, shift)
+	if !ses.MadeByMe {
+		// Both ends see it, only the end that started the session traces
+		return
+	}
+	if !pathTraceStarted.allow(ses.PeerAddress.String(), clock.Now(), *pathTraceHoldoff) {
+		return
+	}
+	addr, bind := ses.controlAddr()
+	go exchangePaths(addr, bind, fmt.Sprintf("%s-shift %s", direction, shift))
+}
+
+func storePathPair(p pathPair) {
+	log.Printf("[%s] Path pair (%s) forward: %s", p.Peer, p.Reason, p.Forward)
+	log.Printf("[%s] Path pair (%s) reverse: %s", p.Peer, p.Reason, p.Reverse)
+
+	pathPairsLock.Lock()
+	pathPairs = append(pathPairs, p)
+	if len(pathPairs) > pathPairsKept {
+		pathPairs = pathPairs[len(pathPairs)-pathPairsKept:]
+	}
+	pathPairsLock.Unlock()
+}
+
+func (t pathTrace) String() string {
+	if t.Error != "" && len(t.Hops) == 0 {
+		return "error: " + t.Error
+	}
+	hops := make([]string, 0, len(t.Hops))
+	for _, h := range t.Hops {
+		switch {
+		case h.Addr == "":
+			hops = append(hops, "*")
+		case h.Unreachable != 0:
+			hops = append(hops, fmt.Sprintf("%s!%d", h.Addr, h.Unreachable-1))
+		default:
+			hops = append(hops, h.Addr)
+		}
+	}
+	s := strings.Join(hops, " ")
+	if !t.Reached {
+		s += " (did not reach " + t.To + ")"
+	}
+	return s
+}
+
+// handlePathsAPI lists the path pairs with GET, or traces to a peer with POST ?peer=ip
+func handlePathsAPI(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+		pathPairsLock.Lock()
+		b, err := json.MarshalIndent(pathPairs, "", "  ")
+		pathPairsLock.Unlock()
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.Write(b)
+	case http.MethodPost:
+		peer := net.ParseIP(r.FormValue("peer"))
+		if peer == nil {
+			http.Error(w, "peer must be the IP of a sping peer", http.StatusBadRequest)
+			return
+		}
+		addr, bind, ok := spingPeerControl(peer)
+		if !ok {
+			http.Error(w, "peer must be in -peers or have a session with us", http.StatusForbidden)
+			return
+		}
+		if !pathTraceStarted.allow(peer.String(), clock.Now(), *pathTraceHoldoff) {
+			http.Error(w, "traced that peer too recently, try again later", http.StatusTooManyRequests)
+			return
+		}
+		go exchangePaths(addr, bind, "api")
+		w.WriteHeader(http.StatusAccepted)
+		fmt.Fprintf(w, "Tracing the path to and from %s, GET this URL in a minute or so to see it\n", peer)
+	default:
+		http.Error(w, "GET or POST only", http.StatusMethodNotAllowed)
+	}
+}
+
+// spingPeerControl finds the TCP control port of ip, and where to reach it
+// from, if it has a session with us or is a sping peer from -peers
+func spingPeerControl(ip net.IP) (addr string, bind localBinding, ok bool) {
+	sessionLock.Lock()
+	for _, ses := range sessionMap {
+		if ip.Equal(ses.PeerAddress) {
+			addr, bind = ses.controlAddr()
+			sessionLock.Unlock()
+			return addr, bind, true
+		}
+	}
+	sessionLock.Unlock()
+	for _, v := range splitPeers(*peers) {
+		spec, err := parsePeerSpec(v)
+		if err != nil || spec.Proto != "sping" || !ip.Equal(net.ParseIP(spec.Host)) {
+			continue
+		}
+		if bind, err = spec.localBinding(); err != nil {
+			continue
+		}
+		return spec.Addr(), bind.on(listeners[bind.Listener]), true
+	}
+	return "", localBinding{}, false
+}
+
+// controlAddr is the host:port of the peer's TCP control port, and where to reach it from
+func (s *session) controlAddr() (string, localBinding) {
+	port := s.PeerPort
+	if port == 0 {
+		// The peer made the session, so all that is known is that it runs sping
+		port = defaultPorts["sping"]
+	}
+	return net.JoinHostPort(s.PeerAddress.String(), strconv.Itoa(port)), s.bind.on(listeners[s.Listener])
+}
+
+// traceroute finds the path to dst with TTL limited ICMP echo requests, sent
+// from the source address and device bind gives
+func traceroute(dst net.IP, bind localBinding) pathTrace {
+	tr := pathTrace{At: clock.Now(), To: dst.String()}
+
+	network, listen, proto := "ip4:icmp", "0.0.0.0", 1
+	var echoType, replyType icmp.Type = ipv4.ICMPTypeEcho, ipv4.ICMPTypeEchoReply
+	if dst.To4() == nil {
+		network, listen, proto = "ip6:ipv6-icmp", "::", 58
+		echoType, replyType = ipv6.ICMPTypeEchoRequest, ipv6.ICMPTypeEchoReply
+	}
+	if bind.Source != nil && (bind.Source.To4() == nil) == (dst.To4() == nil) {
+		listen = bind.Source.String()
+	}
+	conn, err := icmp.ListenPacketConfig(&net.ListenConfig{Control: bind.control}, network, listen)
+	if err != nil {
+		tr.Error = fmt.Sprintf("cannot open a raw socket: %v", err)
+		return tr
+	}
+	defer conn.Close()
+
+	id := int(newSessionID() & 0xffff)
+	hops := make([]pathHop, *traceMaxHops)
+	sentAt := make([]time.Time, *traceMaxHops)
+	reached := 0
+	var mu sync.Mutex
+
+	// Read replies in the background while probes go out
+	readDone := make(chan bool)
+	go func() {
+		defer close(readDone)
+		buf := make([]byte, 1500)
+		for {
+			n, peer, err := conn.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+			rx := clock.Now()
+			m, err := icmp.ParseMessage(proto, buf[:n])
+			if err != nil {
+				continue
+			}
+
+			var ttl int
+			unreachable := 0
+			var exts []icmp.Extension
+			switch body := m.Body.(type) {
+			case *icmp.TimeExceeded:
+				typ, qid, seq, ok := quotedICMPRequest(proto, body.Data)
+				if !ok || typ != echoTypeNumber(echoType) || qid != id {
+					continue
+				}
+				ttl, exts = int(seq), body.Extensions
+			case *icmp.DstUnreach:
+				typ, qid, seq, ok := quotedICMPRequest(proto, body.Data)
+				if !ok || typ != echoTypeNumber(echoType) || qid != id {
+					continue
+				}
+				ttl, exts, unreachable = int(seq), body.Extensions, m.Code+1
+			case *icmp.Echo:
+				if m.Type != replyType || body.ID != id {
+					continue
+				}
+				ttl = body.Seq
+			default:
+				continue
+			}
+			if ttl < 1 || ttl > len(hops) {
+				continue
+			}
+
+			mu.Lock()
+			if hops[ttl-1].Addr == "" {
+				hops[ttl-1] = pathHop{
+					TTL:         ttl,
+					Addr:        peer.(*net.IPAddr).IP.String(),
+					RTT:         rx.Sub(sentAt[ttl-1]),
+					Unreachable: unreachable,
+					Extensions:  describeExtensions(exts),
+				}
+			}
+			if (unreachable != 0 || m.Type == replyType) && (reached == 0 || ttl < reached) {
+				reached = ttl
+			}
+			mu.Unlock()
+		}
+	}()
+
+	// A couple of passes, to fill in hops that rate limit their replies
+	for pass := 0; pass < 2; pass++ {
+		mu.Lock()
+		complete := reached != 0
+		for i := 0; i < reached; i++ {
+			if hops[i].Addr == "" {
+				complete = false
+			}
+		}
+		mu.Unlock()
+		if complete {
+			break
+		}
+
+		for ttl := 1; ttl <= len(hops); ttl++ {
+			mu.Lock()
+			done := hops[ttl-1].Addr != "" || (reached != 0 && ttl > reached)
+			if !done {
+				sentAt[ttl-1] = clock.Now()
+			}
+			mu.Unlock()
+			if done {
+				continue
+			}
+			if p := conn.IPv4PacketConn(); p != nil {
+				p.SetTTL(ttl)
+			} else if p := conn.IPv6PacketConn(); p != nil {
+				p.SetHopLimit(ttl)
+			}
+			m := icmp.Message{Type: echoType, Body: &icmp.Echo{ID: id, Seq: ttl, Data: []byte("sping-trace")}}
+			b, err := m.Marshal(nil)
+			if err != nil {
+				continue
+			}
+			conn.WriteTo(b, &net.IPAddr{IP: dst})
+			clock.Sleep(20 * time.Millisecond)
+		}
+		clock.Sleep(3 * time.Second)
+	}
+	conn.Close()
+	<-readDone
+
+	last := len(hops)
+	if reached != 0 {
+		last = reached
+		tr.Reached = hops[reached-1].Unreachable == 0 || hops[reached-1].Addr == dst.String()
+	} else {
+		// Don't list the run of silence after the last hop that answered
+		for last > 0 && hops[last-1].Addr == "" {
+			last--
+		}
+	}
+	for i := 0; i < last; i++ {
+		if hops[i].Addr == "" {
+			hops[i].TTL = i + 1
+		}
+		tr.Hops = append(tr.Hops, hops[i])
+	}
+	return tr
+}
+
+func echoTypeNumber(t icmp.Type) int {
+	switch t := t.(type) {
+	case ipv4.ICMPType:
+		return int(t)
+	case ipv6.ICMPType:
+		return int(t)
+	}
+	return -1
+}
@@ -0,0 +1,193 @@
+package main
+
+import (
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"golang.org/x/net/ipv6"
+)
+
+func TestLatencyShift(t *testing.T) {
+	d := latencyShiftDetector{}
+	threshold := 10 * time.Millisecond
+
+	for i := 0; i < 10; i++ {
+		if dir, _ := d.observe(20*time.Millisecond, 20*time.Millisecond, threshold); dir != "" {
+			t.Fatalf("steady sample %d shifted %s", i, dir)
+		}
+	}
+
+	// A one off spike is not a shift
+	if dir, _ := d.observe(80*time.Millisecond, 20*time.Millisecond, threshold); dir != "" {
+		t.Fatalf("spike shifted %s", dir)
+	}
+	d.observe(20*time.Millisecond, 20*time.Millisecond, threshold)
+
+	// The path back gets 50ms longer, and stays that way
+	events := 0
+	for i := 0; i < 10; i++ {
+		dir, shift := d.observe(20*time.Millisecond, 70*time.Millisecond, threshold)
+		if dir != "" {
+			events++
+			if dir != "rx" || shift != 50*time.Millisecond {
+				t.Fatalf("got %s shift of %s, want rx 50ms", dir, shift)
+			}
+		}
+	}
+	if events != 1 {
+		t.Fatalf("got %d shifts, want 1", events)
+	}
+}
+
+func TestQuotedICMPv6Request(t *testing.T) {
+	quoted := make([]byte, ipv6.HeaderLen+8)
+	quoted[0] = 0x60
+	quoted[ipv6.HeaderLen] = byte(ipv6.ICMPTypeEchoRequest)
+	quoted[ipv6.HeaderLen+5] = 42
+	quoted[ipv6.HeaderLen+7] = 7
+
+	typ, id, seq, ok := quotedICMPRequest(58, quoted)
+	if !ok || typ != int(ipv6.ICMPTypeEchoRequest) || id != 42 || seq != 7 {
+		t.Fatalf("quoted request read as type %d id %d seq %d (%t)", typ, id, seq, ok)
+	}
+	if _, _, _, ok := quotedICMPRequest(58, quoted[:ipv6.HeaderLen+4]); ok {
+		t.Fatalf("short quote was read")
+	}
+}
+
+func TestPathExchange(t *testing.T) {
+	var sources []string
+	var mu sync.Mutex
+	traceroutePath = func(dst net.IP, bind localBinding) pathTrace {
+		mu.Lock()
+		sources = append(sources, bind.Source.String())
+		mu.Unlock()
+		return pathTrace{
+			At:      clock.Now(),
+			To:      dst.String(),
+			Hops:    []pathHop{{TTL: 1, Addr: "192.0.2.1"}, {TTL: 2}, {TTL: 3, Addr: dst.String()}},
+			Reached: true,
+		}
+	}
+	defer func() {
+		traceroutePath = traceroute
+		pathPairsLock.Lock()
+		pathPairs = nil
+		pathPairsLock.Unlock()
+	}()
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go handleTCPconnection(conn, &listener{})
+		}
+	}()
+
+	exchangePaths(ln.Addr().String(), localBinding{Source: net.IPv4(127, 0, 0, 1)}, "test")
+
+	// Both ends keep the pair, the peer end once it has our half
+	deadline := time.Now().Add(5 * time.Second)
+	var pairs []pathPair
+	for time.Now().Before(deadline) {
+		pathPairsLock.Lock()
+		pairs = append(pairs[:0], pathPairs...)
+		pathPairsLock.Unlock()
+		if len(pairs) == 2 {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if len(pairs) != 2 {
+		t.Fatalf("got %d path pairs, want 2", len(pairs))
+	}
+	for _, p := range pairs {
+		if p.Forward.Error != "" || p.Reverse.Error != "" || len(p.Forward.Hops) != 3 || len(p.Reverse.Hops) != 3 {
+			t.Fatalf("pair %+v", p)
+		}
+		if got := p.Forward.String(); got != "192.0.2.1 * 127.0.0.1" {
+			t.Fatalf("path came out as %q", got)
+		}
+	}
+
+	// We trace from the source we were given, the peer from anywhere
+	mu.Lock()
+	if len(sources) != 2 || sources[0] == sources[1] || (sources[0] != "127.0.0.1" && sources[1] != "127.0.0.1") {
+		t.Fatalf("traced from %v", sources)
+	}
+	mu.Unlock()
+
+	// Asking again straight away is turned down by the peer
+	exchangePaths(ln.Addr().String(), localBinding{}, "test")
+	pathPairsLock.Lock()
+	last := pathPairs[len(pathPairs)-1]
+	pathPairsLock.Unlock()
+	if last.Reverse.Error == "" {
+		t.Fatalf("peer traced again inside its holdoff")
+	}
+}
+
+func TestPathsAPIPost(t *testing.T) {
+	old := *peers
+	*peers = "192.0.2.7"
+	defer func() { *peers = old }()
+
+	post := func(peer string) int {
+		w := httptest.NewRecorder()
+		handlePathsAPI(w, httptest.NewRequest(http.MethodPost, "/paths?peer="+peer, nil))
+		return w.Code
+	}
+	if code := post("198.51.100.1"); code != http.StatusForbidden {
+		t.Fatalf("stranger got %d", code)
+	}
+
+	// A peer that was just traced has to wait out the holdoff
+	pathTraceStarted.allow("192.0.2.7", clock.Now(), *pathTraceHoldoff)
+	if code := post("192.0.2.7"); code != http.StatusTooManyRequests {
+		t.Fatalf("peer in its holdoff got %d", code)
+	}
+}
+
+func TestSpingPeerControl(t *testing.T) {
+	old := *peers
+	*peers = "sping://192.0.2.8:7001?source=192.0.2.10"
+	defer func() { *peers = old }()
+
+	sessionLock.Lock()
+	sessionMap = map[uint32]*session{
+		1: {PeerAddress: net.ParseIP("192.0.2.7"), PeerPort: 7000, bind: localBinding{Source: net.ParseIP("192.0.2.9")}},
+		2: {PeerAddress: net.ParseIP("192.0.2.6")}, // The peer made this one
+	}
+	sessionLock.Unlock()
+	defer func() {
+		sessionLock.Lock()
+		sessionMap = map[uint32]*session{}
+		sessionLock.Unlock()
+	}()
+
+	for _, tt := range []struct {
+		ip, addr, source string
+		ok               bool
+	}{
+		{"192.0.2.7", "192.0.2.7:7000", "192.0.2.9", true},
+		{"192.0.2.6", "192.0.2.6:6924", "<nil>", true},
+		{"192.0.2.8", "192.0.2.8:7001", "192.0.2.10", true},
+		{"198.51.100.1", "", "<nil>", false},
+	} {
+		addr, bind, ok := spingPeerControl(net.ParseIP(tt.ip))
+		if addr != tt.addr || bind.Source.String() != tt.source || ok != tt.ok {
+			t.Errorf("%s: got %s from %s (%t), want %s from %s (%t)", tt.ip, addr, bind.Source, ok, tt.addr, tt.source, tt.ok)
+		}
+	}
+}
@@ -0,0 +1,107 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"net/url"
+	"strconv"
+	"strings"
+)
+
+// peerSpec is one entry of the -peers flag. A plain IP is a sping peer,
+// anything else is written as proto://host[:port][?option=value&...], for
+// example stamp://192.0.2.1:862?stateful=1
+type peerSpec struct {
+	Proto   string
+	Host    string
+	Port    int // 0 if not given, the protocol default should be used
+	Options url.Values
+}
+
+// defaultPorts for each kind of peer
+var defaultPorts = map[string]int{
+	"sping": 6924,
+	"stamp": 862,
+	"owamp": 861,
+	"twamp": 862,
+	"ntp":   123,
+
+	"icmp-timestamp": 0, // No ports for ICMP
+}
+
+// splitPeers splits the -peers flag up. Options can be comma separated lists
+// too, so a piece that is not an IP or a URL is put back on the one before.
+func splitPeers(s string) []string {
+	var out []string
+	for _, v := range strings.Split(s, ",") {
+		t := strings.TrimSpace(v)
+		if len(out) != 0 && net.ParseIP(t) == nil && !strings.Contains(t, "://") {
+			out[len(out)-1] += "," + v
+			continue
+		}
+		out = append(out, v)
+	}
+	return out
+}
+
+func parsePeerSpec(s string) (peerSpec, error) {
+	s = strings.TrimSpace(s)
+	if ip := net.ParseIP(s); ip != nil {
+		return peerSpec{Proto: "sping", Host: ip.String(), Options: url.Values{}}, nil
+	}
+	if !strings.Contains(s, "://") {
+		return peerSpec{}, fmt.Errorf("peer %q is not an IP or a proto://host URL", s)
+	}
+
+	u, err := url.Parse(s)
+	if err != nil {
+		return peerSpec{}, fmt.Errorf("peer %q: %v", s, err)
+	}
+	if _, ok := defaultPorts[u.Scheme]; !ok {
+		return peerSpec{}, fmt.Errorf("peer %q: unknown peer type %s", s, u.Scheme)
+	}
+	if u.Hostname() == "" {
+		return peerSpec{}, fmt.Errorf("peer %q: no host given", s)
+	}
+
+	p := peerSpec{
+		Proto:   u.Scheme,
+		Host:    u.Hostname(),
+		Options: u.Query(),
+	}
+	if u.Port() != "" {
+		p.Port, err = strconv.Atoi(u.Port())
+		if err != nil || p.Port < 1 || p.Port > 65535 {
+			return peerSpec{}, fmt.Errorf("peer %q: bad port %s", s, u.Port())
+		}
+	}
+	return p, nil
+}
+
+// Addr returns host:port for the peer, using the default port if none was given
+func (p peerSpec) Addr() string {
+	port := p.Port
+	if port == 0 {
+		port = defaultPorts[p.Proto]
+	}
+	return net.JoinHostPort(p.Host, strconv.Itoa(port))
+}
+
+// boolOption returns true if the option is set to something truthy
+func (p peerSpec) boolOption(name string) bool {
+	v, err := strconv.ParseBool(p.Options.Get(name))
+	return err == nil && v
+}
+
+func (p peerSpec) String() string {
+	if p.Proto == "sping" && p.Port == 0 && len(p.Options) == 0 {
+		return p.Host
+	}
+	u := url.URL{Scheme: p.Proto, Host: p.Host, RawQuery: p.Options.Encode()}
+	if p.Port != 0 {
+		u.Host = net.JoinHostPort(p.Host, strconv.Itoa(p.Port))
+	} else if strings.Contains(p.Host, ":") {
+		u.Host = "[" + p.Host + "]"
+	}
+	return u.String()
+}
@@ -0,0 +1,49 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestParsePeerSpec(t *testing.T) {
+	tests := []struct {
+		in    string
+		proto string
+		addr  string
+	}{
+		{"192.0.2.1", "sping", "192.0.2.1:6924"},
+		{"2001:db8::1", "sping", "[2001:db8::1]:6924"},
+		{"stamp://192.0.2.1", "stamp", "192.0.2.1:862"},
+		{"stamp://[2001:db8::1]:4000?stateful=1", "stamp", "[2001:db8::1]:4000"},
+		{"stamp://router.example", "stamp", "router.example:862"},
+		{"ntp://time.example?interval=16s", "ntp", "time.example:123"},
+	}
+	for _, tt := range tests {
+		p, err := parsePeerSpec(tt.in)
+		if err != nil {
+			t.Fatalf("%s: %v", tt.in, err)
+		}
+		if p.Proto != tt.proto || p.Addr() != tt.addr {
+			t.Fatalf("%s: got %s %s, want %s %s", tt.in, p.Proto, p.Addr(), tt.proto, tt.addr)
+		}
+	}
+
+	for _, bad := range []string{"router.example", "bogus://192.0.2.1", "stamp://", "stamp://192.0.2.1:99999"} {
+		if _, err := parsePeerSpec(bad); err == nil {
+			t.Fatalf("%s: parsed without an error", bad)
+		}
+	}
+
+	p, _ := parsePeerSpec("stamp://192.0.2.1?stateful=1")
+	if !p.boolOption("stateful") || p.boolOption("other") {
+		t.Fatalf("options not parsed: %v", p.Options)
+	}
+}
+
+func TestSplitPeers(t *testing.T) {
+	got := splitPeers("192.0.2.1,sping://192.0.2.2?dscp=ef,af41&sweep=576,1500,2001:db8::1,stamp://192.0.2.3")
+	want := []string{"192.0.2.1", "sping://192.0.2.2?dscp=ef,af41&sweep=576,1500", "2001:db8::1", "stamp://192.0.2.3"}
+	if strings.Join(got, " ") != strings.Join(want, " ") {
+		t.Fatalf("split into %q, want %q", got, want)
+	}
+}
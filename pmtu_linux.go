@@ -0,0 +1,67 @@
+// +build linux
+
+package main
+
+import (
+	"errors"
+	"net"
+	"syscall"
+
+	"golang.org/x/sys/unix"
+)
+
+// withDontFragment runs send with DF set on what c sends to IPv4 (or IPv6 if
+// v6) peers, so the kernel fails sends bigger than the path MTU it knows of,
+// and puts c back how it was after
+func withDontFragment(c net.PacketConn, v6 bool, send func()) error {
+	sc, ok := c.(syscall.Conn)
+	if !ok {
+		send()
+		return errors.New("not a socket DF can be set on")
+	}
+	rc, err := sc.SyscallConn()
+	if err != nil {
+		send()
+		return err
+	}
+	level, opt, do := unix.IPPROTO_IP, unix.IP_MTU_DISCOVER, unix.IP_PMTUDISC_DO
+	if v6 {
+		level, opt, do = unix.IPPROTO_IPV6, unix.IPV6_MTU_DISCOVER, unix.IPV6_PMTUDISC_DO
+	}
+	var was int
+	var serr error
+	err = rc.Control(func(fd uintptr) {
+		if was, serr = unix.GetsockoptInt(int(fd), level, opt); serr == nil {
+			serr = unix.SetsockoptInt(int(fd), level, opt, do)
+		}
+	})
+	send()
+	if err != nil {
+		return err
+	}
+	if serr != nil {
+		return serr
+	}
+	rc.Control(func(fd uintptr) {
+		unix.SetsockoptInt(int(fd), level, opt, was)
+	})
+	return nil
+}
+
+// pathMTU is the path MTU the kernel has for where c is connected to, 0 if not known
+func pathMTU(c *net.UDPConn) int {
+	rc, err := c.SyscallConn()
+	if err != nil {
+		return 0
+	}
+	v6 := c.RemoteAddr().(*net.UDPAddr).IP.To4() == nil
+	mtu := 0
+	rc.Control(func(fd uintptr) {
+		if v6 {
+			mtu, _ = unix.GetsockoptInt(int(fd), unix.IPPROTO_IPV6, unix.IPV6_MTU)
+		} else {
+			mtu, _ = unix.GetsockoptInt(int(fd), unix.IPPROTO_IP, unix.IP_MTU)
+		}
+	})
+	return mtu
+}
@@ -0,0 +1,17 @@
+// +build !linux
+
+package main
+
+import (
+	"errors"
+	"net"
+)
+
+func withDontFragment(c net.PacketConn, v6 bool, send func()) error {
+	send()
+	return errors.New("setting DF is not supported on this platform")
+}
+
+func pathMTU(c *net.UDPConn) int {
+	return 0
+}
@@ -1,8 +1,245 @@
 package main
 
 import (
+	"errors"
 	"flag"
+	"log"
+	"math"
+	"strings"
+	"sync"
+	"time"
 )
 
-var ppsPath = flag.String("pps.path", "/dev/pps0", "what PPS device to use")
+var ppsPath = flag.String("pps.path", "/dev/pps0", "what PPS device to use (or \"simulated\" for a fake pulse generator)")
 var usePPS = flag.Bool("use.pps", false, "If to use a PPS device instead of system clock")
+var ppsEdgeFlag = flag.String("pps.edge", "assert", "What PPS edge marks the top of the second (assert or clear)")
+var ppsDebug = flag.Bool("pps.debug", false, "Enable debug output for PPS inputs")
+var ppsFallbackAfter = flag.Int("pps.fallback-after", 3, "Fall back to the system clock after this many missed pulses in a row")
+
+var errPPSTimeout = errors.New("timed out waiting for PPS pulse")
+
+// A TimeSource ticks at the start of every second.
+type TimeSource interface {
+	// Next blocks until the next second boundary and returns it
+	Next() (secondTick, error)
+	Name() string
+}
+
+// secondTick is the start of a second, as seen by a TimeSource
+type secondTick struct {
+	Time    time.Time     // The start of the second, as timestamped by the source
+	Offset  time.Duration // How far the system clock was from the source at that edge
+	FromPPS bool          // false when the tick came from the system clock
+}
+
+// ppsEdge is a single pulse as captured by a ppsDevice
+type ppsEdge struct {
+	Time     time.Time // System clock time the edge was captured at
+	Sequence uint32    // Pulse counter, 0 if the device does not keep one
+}
+
+// ppsDevice is something that can produce PPS edges, like /dev/pps0
+type ppsDevice interface {
+	Fetch(timeout time.Duration) (ppsEdge, error)
+	Close() error
+}
+
+// newTimeSource picks the TimeSource to use based on the flags
+func newTimeSource() TimeSource {
+	if !*usePPS {
+		return systemClockSource{}
+	}
+
+	var dev ppsDevice
+	var err error
+	if *ppsPath == "simulated" {
+		dev = newSimulatedPPS(clock.Now(), 0, 0)
+		dev.(*simulatedPPS).Paced = true
+	} else {
+		dev, err = openKernelPPS(*ppsPath, *ppsEdgeFlag)
+		if err != nil {
+			log.Fatalf("Unable to setup PPS device %s: %v", *ppsPath, err)
+		}
+	}
+
+	return newPPSSource(dev, *ppsFallbackAfter)
+}
+
+// systemClockSource ticks on the (corrected) system clock second boundaries
+type systemClockSource struct{}
+
+func (systemClockSource) Name() string { return "system" }
+
+func (systemClockSource) Next() (secondTick, error) {
+	b := nextSecondBoundary()
+	clock.Sleep(clock.Until(b))
+	return secondTick{Time: b}, nil
+}
+
+// nextSecondBoundary returns when (in system clock time) the next corrected second starts
+func nextSecondBoundary() time.Time {
+	a := timeNowCorrected().Unix()
+	return time.Unix(a+1, 0).Add(timeOffset * -1)
+}
+
+// ppsSource is a TimeSource backed by a ppsDevice, that keeps track of the
+// health of the pulses and falls back to the system clock when they stop.
+type ppsSource struct {
+	dev           ppsDevice
+	fallbackAfter int
+
+	mu           sync.Mutex
+	lastEdge     ppsEdge
+	lastOffset   time.Duration
+	jitter       time.Duration
+	missed       uint64
+	missedInARow int
+	fallingBack  bool
+}
+
+func newPPSSource(dev ppsDevice, fallbackAfter int) *ppsSource {
+	if fallbackAfter < 1 {
+		fallbackAfter = 1
+	}
+	return &ppsSource{
+		dev:           dev,
+		fallbackAfter: fallbackAfter,
+	}
+}
+
+func (p *ppsSource) Name() string {
+	if p.FallingBack() {
+		return "pps-fallback"
+	}
+	return "pps"
+}
+
+func (p *ppsSource) Next() (secondTick, error) {
+	timeout := 1500 * time.Millisecond
+	var boundary time.Time
+	if p.FallingBack() {
+		// Don't wait around longer than the system clock second, so we still
+		// tick on time while the pulses are gone.
+		boundary = nextSecondBoundary()
+		timeout = clock.Until(boundary) + 200*time.Millisecond
+	}
+
+	edge, err := p.dev.Fetch(timeout)
+	if err != nil {
+		p.mu.Lock()
+		p.missed++
+		p.missedInARow++
+		startFallback := !p.fallingBack && p.missedInARow >= p.fallbackAfter
+		if startFallback {
+			p.fallingBack = true
+		}
+		fallingBack := p.fallingBack
+		p.mu.Unlock()
+		p.export()
+
+		if startFallback {
+			log.Printf("PPS pulses lost (%v), falling back to the system clock", err)
+		}
+		if !fallingBack {
+			return secondTick{}, err
+		}
+		if boundary.IsZero() {
+			boundary = nextSecondBoundary()
+			clock.Sleep(clock.Until(boundary))
+		}
+		return secondTick{Time: boundary}, nil
+	}
+
+	tick := p.observe(edge)
+	p.export()
+	if *ppsDebug {
+		log.Printf("PPS edge %#v, offset %s", edge, tick.Offset)
+	}
+	return tick, nil
+}
+
+// observe updates the health data with a new edge
+func (p *ppsSource) observe(edge ppsEdge) secondTick {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	// Pulses are on the top of the second, so anything else is the system clock being off
+	offset := edge.Time.Sub(edge.Time.Round(time.Second))
+
+	if !p.lastEdge.Time.IsZero() {
+		// Timeouts since the last edge have already been counted
+		gapMissed := missedBetween(p.lastEdge, edge)
+		if gapMissed > uint64(p.missedInARow) {
+			p.missed += gapMissed - uint64(p.missedInARow)
+		}
+
+		// RFC 5905 style jitter, an exponential average of the offset differences
+		diff := float64(offset - p.lastOffset)
+		p.jitter = time.Duration(math.Sqrt(
+			float64(p.jitter)*float64(p.jitter)*0.75 + diff*diff*0.25))
+	}
+
+	if p.fallingBack {
+		log.Printf("PPS pulses are back, no longer using the system clock")
+		p.fallingBack = false
+	}
+	p.missedInARow = 0
+	p.lastEdge = edge
+	p.lastOffset = offset
+
+	return secondTick{
+		Time:    edge.Time,
+		Offset:  offset,
+		FromPPS: true,
+	}
+}
+
+// missedBetween works out how many pulses should have happened between two edges
+func missedBetween(last, this ppsEdge) uint64 {
+	if last.Sequence != 0 && this.Sequence > last.Sequence {
+		return uint64(this.Sequence - last.Sequence - 1)
+	}
+
+	gap := this.Time.Sub(last.Time).Round(time.Second)
+	if gap <= time.Second {
+		return 0
+	}
+	return uint64(gap/time.Second) - 1
+}
+
+// FallingBack returns true if the pulses have stopped and the system clock is in use
+func (p *ppsSource) FallingBack() bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.fallingBack
+}
+
+// Health returns the offset, jitter and missed pulse count of the source
+func (p *ppsSource) Health() (offset time.Duration, jitter time.Duration, missed uint64) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.lastOffset, p.jitter, p.missed
+}
+
+func (p *ppsSource) export() {
+	offset, jitter, missed := p.Health()
+	promPPSOffset.Set(offset.Seconds())
+	promPPSJitter.Set(jitter.Seconds())
+	promPPSMissed.Set(float64(missed))
+	if p.FallingBack() {
+		promPPSLocked.Set(0)
+	} else {
+		promPPSLocked.Set(1)
+	}
+}
+
+// parsePPSEdge turns the -pps.edge flag into true for assert, false for clear
+func parsePPSEdge(s string) (assert bool, err error) {
+	switch strings.ToLower(s) {
+	case "assert", "":
+		return true, nil
+	case "clear":
+		return false, nil
+	}
+	return false, errors.New("PPS edge must be assert or clear")
+}
@@ -3,7 +3,7 @@
 package main
 
 import (
-	"flag"
+	"fmt"
 	"log"
 	"os"
 	"time"
@@ -12,52 +12,96 @@ import (
 	"golang.org/x/sys/unix"
 )
 
-func setupPPS() {
-	f, err := os.OpenFile(*ppsPath, os.O_RDWR, 0)
+const (
+	ppsCaptureAssert = 0x01
+	ppsCaptureClear  = 0x02
+	ppsOffsetAssert  = 0x10
+	ppsOffsetClear   = 0x20
+)
+
+// kernelPPS is a ppsDevice backed by the linux PPS API (/dev/ppsN)
+type kernelPPS struct {
+	f      *os.File // Kept around to stop the GC closing the FD
+	fd     uintptr
+	assert bool
+}
+
+func openKernelPPS(path string, edge string) (*kernelPPS, error) {
+	assert, err := parsePPSEdge(edge)
+	if err != nil {
+		return nil, err
+	}
+
+	f, err := os.OpenFile(path, os.O_RDWR, 0)
 	if err != nil {
-		log.Fatalf("Unable to open pps device %#v", err)
+		return nil, err
 	}
 
-	FD := f.Fd()
-	a := int(FD)
-	ppsFD = &a
-	ppsFile = f
+	k := &kernelPPS{
+		f:      f,
+		fd:     f.Fd(),
+		assert: assert,
+	}
 
 	PP := unix.PPSKParams{}
-	unix.Syscall(unix.SYS_IOCTL, uintptr(*ppsFD), uintptr(unix.PPS_GETPARAMS), uintptr(unsafe.Pointer(&PP)))
+	_, _, errno := unix.Syscall(unix.SYS_IOCTL, k.fd, uintptr(unix.PPS_GETPARAMS), uintptr(unsafe.Pointer(&PP)))
+	if errno != 0 {
+		f.Close()
+		return nil, fmt.Errorf("PPS_GETPARAMS failed: %v", errno)
+	}
 	if *ppsDebug {
 		log.Printf("PPS Cap: %#v", PP)
 	}
-	PP.Mode = 0x01  // PPS_CAPTUREASSERT
-	PP.Mode |= 0x10 // PPS_OFFSETASSERT
-	PP.Assert_off_tu.Nsec = 0
-	PP.Assert_off_tu.Sec = 0
-	_, _, err2 := unix.Syscall(unix.SYS_IOCTL, uintptr(*ppsFD), uintptr(unix.PPS_SETPARAMS), uintptr(unsafe.Pointer(&PP)))
+
+	if assert {
+		PP.Mode = ppsCaptureAssert | ppsOffsetAssert
+		PP.Assert_off_tu.Nsec = 0
+		PP.Assert_off_tu.Sec = 0
+	} else {
+		PP.Mode = ppsCaptureClear | ppsOffsetClear
+		PP.Clear_off_tu.Nsec = 0
+		PP.Clear_off_tu.Sec = 0
+	}
+	_, _, errno = unix.Syscall(unix.SYS_IOCTL, k.fd, uintptr(unix.PPS_SETPARAMS), uintptr(unsafe.Pointer(&PP)))
 	if *ppsDebug {
 		log.Printf("PPS Set Cap: %#v", PP)
 	}
-	if err2 != 0 {
-		log.Fatalf("Failed to setup pps device %v", err)
+	if errno != 0 {
+		f.Close()
+		return nil, fmt.Errorf("PPS_SETPARAMS failed: %v", errno)
 	}
-}
-
-var ppsFD *int
-var ppsFile *os.File // To stop GC
-var ppsDebug = flag.Bool("pps.debug", false, "Enable debug output for PPS inputs")
 
-func waitForPPSPulse() time.Time {
-	if ppsFD == nil {
-		setupPPS()
-	}
+	return k, nil
+}
 
+// Fetch waits for the next pulse on the selected edge
+func (k *kernelPPS) Fetch(timeout time.Duration) (ppsEdge, error) {
 	a := unix.PPSFData{}
-	a.Timeout.Sec = 3
-	_, _, err := unix.Syscall(unix.SYS_IOCTL, uintptr(*ppsFD), uintptr(unix.PPS_FETCH), uintptr(unsafe.Pointer(&a)))
-	if err != 0 {
-		log.Printf("PPS Pulse failed! %v / FD %v", err, *ppsFD)
+	a.Timeout.Sec = int64(timeout / time.Second)
+	a.Timeout.Nsec = int32(timeout % time.Second)
+	_, _, errno := unix.Syscall(unix.SYS_IOCTL, k.fd, uintptr(unix.PPS_FETCH), uintptr(unsafe.Pointer(&a)))
+	if errno == unix.ETIMEDOUT || errno == unix.EINTR {
+		return ppsEdge{}, errPPSTimeout
+	}
+	if errno != 0 {
+		return ppsEdge{}, fmt.Errorf("PPS_FETCH failed: %v", errno)
 	}
 	if *ppsDebug {
 		log.Printf("%#v", a)
 	}
-	return time.Unix(a.Info.Assert_tu.Sec, int64(a.Info.Assert_tu.Nsec))
+
+	if k.assert {
+		return ppsEdge{
+			Time:     time.Unix(a.Info.Assert_tu.Sec, int64(a.Info.Assert_tu.Nsec)),
+			Sequence: a.Info.Assert_sequence,
+		}, nil
+	}
+	return ppsEdge{
+		Time:     time.Unix(a.Info.Clear_tu.Sec, int64(a.Info.Clear_tu.Nsec)),
+		Sequence: a.Info.Clear_sequence,
+	}, nil
+}
+
+func (k *kernelPPS) Close() error {
+	return k.f.Close()
 }
@@ -2,12 +2,21 @@
 
 package main
 
-import "log"
+import (
+	"errors"
+	"time"
+)
 
-func setupPPS() {
-	log.Fatalf("PPS input is not supported on this platform.")
+type kernelPPS struct{}
+
+func openKernelPPS(path string, edge string) (*kernelPPS, error) {
+	return nil, errors.New("PPS input is not supported on this platform")
+}
+
+func (k *kernelPPS) Fetch(timeout time.Duration) (ppsEdge, error) {
+	return ppsEdge{}, errors.New("PPS input is not supported on this platform")
 }
 
-func waitForPPSPulse() {
-	log.Fatalf("PPS input is not supported on this platform.")
+func (k *kernelPPS) Close() error {
+	return nil
 }
@@ -0,0 +1,77 @@
+package main
+
+import (
+	"math/rand"
+	"sync"
+	"time"
+)
+
+// simulatedPPS is a ppsDevice that makes up pulses, so the PPS code path can
+// be exercised without a GPS receiver attached.
+//
+// Pulses are generated on every whole second after start, with the (fake)
+// system clock being Offset away from the true second plus up to Jitter of
+// random noise. Pulses listed in Drop are not delivered.
+type simulatedPPS struct {
+	Offset time.Duration
+	Jitter time.Duration
+	// If set, Fetch sleeps until the pulse is due, otherwise it returns instantly
+	Paced bool
+
+	mu       sync.Mutex
+	next     time.Time
+	sequence uint32
+	drop     map[uint32]bool
+	rng      *rand.Rand
+}
+
+func newSimulatedPPS(start time.Time, offset, jitter time.Duration) *simulatedPPS {
+	return &simulatedPPS{
+		Offset: offset,
+		Jitter: jitter,
+		next:   start.Truncate(time.Second).Add(time.Second),
+		drop:   make(map[uint32]bool),
+		rng:    rand.New(rand.NewSource(1)),
+	}
+}
+
+// Drop stops pulse number seq (the first pulse is 1) from being delivered
+func (s *simulatedPPS) Drop(seq ...uint32) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, v := range seq {
+		s.drop[v] = true
+	}
+}
+
+func (s *simulatedPPS) Fetch(timeout time.Duration) (ppsEdge, error) {
+	s.mu.Lock()
+	edge := s.next.Add(s.Offset)
+	if s.Jitter > 0 {
+		edge = edge.Add(time.Duration(s.rng.Int63n(int64(s.Jitter)*2)) - s.Jitter)
+	}
+	if s.Paced && clock.Until(edge) > timeout {
+		// The pulse is not due yet
+		s.mu.Unlock()
+		clock.Sleep(timeout)
+		return ppsEdge{}, errPPSTimeout
+	}
+	s.sequence++
+	seq := s.sequence
+	s.next = s.next.Add(time.Second)
+	dropped := s.drop[seq]
+	s.mu.Unlock()
+
+	if s.Paced {
+		clock.Sleep(clock.Until(edge))
+	}
+	if dropped {
+		return ppsEdge{}, errPPSTimeout
+	}
+
+	return ppsEdge{Time: edge, Sequence: seq}, nil
+}
+
+func (s *simulatedPPS) Close() error {
+	return nil
+}
@@ -0,0 +1,139 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestPPSSourceOffset(t *testing.T) {
+	sim := newSimulatedPPS(time.Unix(1600000000, 0), 250*time.Microsecond, 0)
+	src := newPPSSource(sim, 3)
+
+	for i := 0; i < 5; i++ {
+		tick, err := src.Next()
+		if err != nil {
+			t.Fatalf("pulse %d failed: %v", i, err)
+		}
+		if !tick.FromPPS {
+			t.Fatalf("pulse %d did not come from PPS", i)
+		}
+		if tick.Offset != 250*time.Microsecond {
+			t.Fatalf("pulse %d offset is %s, want 250µs", i, tick.Offset)
+		}
+	}
+
+	offset, jitter, missed := src.Health()
+	if offset != 250*time.Microsecond || jitter != 0 || missed != 0 {
+		t.Fatalf("health is %s/%s/%d, want 250µs/0s/0", offset, jitter, missed)
+	}
+}
+
+func TestPPSSourceJitter(t *testing.T) {
+	sim := newSimulatedPPS(time.Unix(1600000000, 0), 0, 100*time.Microsecond)
+	src := newPPSSource(sim, 3)
+
+	for i := 0; i < 50; i++ {
+		tick, err := src.Next()
+		if err != nil {
+			t.Fatalf("pulse %d failed: %v", i, err)
+		}
+		if tick.Offset > 100*time.Microsecond || tick.Offset < -100*time.Microsecond {
+			t.Fatalf("pulse %d offset %s is outside of the jitter", i, tick.Offset)
+		}
+	}
+
+	_, jitter, _ := src.Health()
+	if jitter == 0 || jitter > 200*time.Microsecond {
+		t.Fatalf("jitter is %s, want something between 0 and 200µs", jitter)
+	}
+}
+
+func TestPPSSourceMissedPulses(t *testing.T) {
+	sim := newSimulatedPPS(time.Unix(1600000000, 0), 0, 0)
+	sim.Drop(3, 4)
+	src := newPPSSource(sim, 3)
+
+	errors := 0
+	for i := 0; i < 6; i++ {
+		if _, err := src.Next(); err != nil {
+			errors++
+		}
+	}
+
+	if errors != 2 {
+		t.Fatalf("got %d failed pulses, want 2", errors)
+	}
+	if _, _, missed := src.Health(); missed != 2 {
+		t.Fatalf("missed is %d, want 2", missed)
+	}
+	if src.FallingBack() {
+		t.Fatalf("fell back to the system clock after only 2 missed pulses")
+	}
+}
+
+func TestPPSSourceFallback(t *testing.T) {
+	sim := newSimulatedPPS(time.Unix(1600000000, 0), 0, 0)
+	sim.Drop(2, 3, 4)
+	src := newPPSSource(sim, 2)
+
+	if _, err := src.Next(); err != nil {
+		t.Fatalf("first pulse failed: %v", err)
+	}
+	if _, err := src.Next(); err == nil {
+		t.Fatalf("dropped pulse did not fail")
+	}
+
+	tick, err := src.Next()
+	if err != nil {
+		t.Fatalf("fallback did not produce a tick: %v", err)
+	}
+	if tick.FromPPS || !src.FallingBack() {
+		t.Fatalf("source did not fall back to the system clock")
+	}
+	if src.Name() != "pps-fallback" {
+		t.Fatalf("name is %s while falling back", src.Name())
+	}
+
+	src.Next()
+	tick, err = src.Next()
+	if err != nil || !tick.FromPPS {
+		t.Fatalf("source did not recover once pulses came back: %v", err)
+	}
+	if src.FallingBack() {
+		t.Fatalf("source is still falling back")
+	}
+	if _, _, missed := src.Health(); missed != 3 {
+		t.Fatalf("missed is %d, want 3", missed)
+	}
+}
+
+func TestPPSTXTime(t *testing.T) {
+	second := time.Unix(1600000000, 0)
+	pulse := secondTick{
+		Time:    second.Add(300 * time.Microsecond), // System clock is 300µs fast
+		Offset:  300 * time.Microsecond,
+		FromPPS: true,
+	}
+
+	// Woke up 2ms after the pulse, sending takes another 50µs
+	now := pulse.Time.Add(2 * time.Millisecond)
+	tx := ppsTXTime(pulse, now, 50*time.Microsecond)
+
+	want := second.Add(2*time.Millisecond + 50*time.Microsecond)
+	if !tx.Equal(want) {
+		t.Fatalf("TX time is %s, want %s", tx.Sub(second), want.Sub(second))
+	}
+}
+
+func TestUpdateSendLag(t *testing.T) {
+	lag := updateSendLag(0, 80*time.Microsecond)
+	if lag != 80*time.Microsecond {
+		t.Fatalf("first sample gave %s, want 80µs", lag)
+	}
+	for i := 0; i < 100; i++ {
+		lag = updateSendLag(lag, 40*time.Microsecond)
+	}
+	if lag > 41*time.Microsecond {
+		t.Fatalf("lag did not converge, got %s", lag)
+	}
+}
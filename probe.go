@@ -0,0 +1,274 @@
+package main
+
+import (
+	"sort"
+	"sync"
+	"time"
+)
+
+// A prober is a measurement target that is not a sping session, like a STAMP
+// reflector. It keeps its own per-direction figures, that are exported with
+// the same metrics as sping sessions.
+type prober interface {
+	Protocol() string
+	Host() string
+	Stats() proberStats
+}
+
+type proberStats struct {
+	RXLatency time.Duration // From the target to us
+	TXLatency time.Duration // From us to the target
+	RXLoss    int
+	TXLoss    int
+	RTTLoss   int  // Lost somewhere, but the protocol can not tell which way
+	Exchanges int  // How many probes the loss figures are out of
+	RXOnly    bool // Only the direction towards us is measured, like on a reflector
+}
+
+var probers []prober
+var probersLock sync.RWMutex
+
+func registerProber(p prober) {
+	probersLock.Lock()
+	probers = append(probers, p)
+	probersLock.Unlock()
+}
+
+func unregisterProber(p prober) {
+	probersLock.Lock()
+	defer probersLock.Unlock()
+	for i, v := range probers {
+		if v == p {
+			probers = append(probers[:i], probers[i+1:]...)
+			return
+		}
+	}
+}
+
+// probeWindow keeps the last 32 probes sent to a target, the same window size
+// that sping sessions use for their acks
+type probeWindow struct {
+	mu      sync.Mutex
+	samples [32]probeSample
+	next    int
+}
+
+type probeSample struct {
+	Seq     uint32
+	Sent    time.Time
+	Replied bool
+	Forward time.Duration
+	Reverse time.Duration
+	NoDelay bool // The reply could not be split into each direction, so only counts for loss
+
+	// The reflectors own count of packets it has seen, if it keeps one. Gaps
+	// between this and Seq tell us about loss on the way there.
+	RefSeq    uint32
+	HasRefSeq bool
+}
+
+// sent records a probe going out
+func (w *probeWindow) sent(seq uint32, at time.Time) {
+	w.mu.Lock()
+	w.samples[w.next] = probeSample{Seq: seq, Sent: at}
+	w.next = (w.next + 1) % len(w.samples)
+	w.mu.Unlock()
+}
+
+// sentAt gives when a probe still in the window was sent
+func (w *probeWindow) sentAt(seq uint32) (time.Time, bool) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	for _, s := range w.samples {
+		if !s.Sent.IsZero() && s.Seq == seq {
+			return s.Sent, true
+		}
+	}
+	return time.Time{}, false
+}
+
+// repliedNoDelay records a reply that says nothing useful about the delay each way
+func (w *probeWindow) repliedNoDelay(seq uint32) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	for i := range w.samples {
+		s := &w.samples[i]
+		if !s.Sent.IsZero() && s.Seq == seq {
+			s.Replied = true
+			s.NoDelay = true
+			return
+		}
+	}
+}
+
+// replied records the reply to a probe, it returns false if the probe is not
+// in the window (too old, or never sent)
+func (w *probeWindow) replied(seq uint32, forward, reverse time.Duration) bool {
+	return w.repliedWithRefSeq(seq, forward, reverse, 0, false)
+}
+
+func (w *probeWindow) repliedWithRefSeq(seq uint32, forward, reverse time.Duration, refSeq uint32, hasRefSeq bool) bool {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	for i := range w.samples {
+		s := &w.samples[i]
+		if s.Sent.IsZero() || s.Seq != seq {
+			continue
+		}
+		s.Replied = true
+		s.Forward = forward
+		s.Reverse = reverse
+		s.RefSeq = refSeq
+		s.HasRefSeq = hasRefSeq
+		return true
+	}
+	return false
+}
+
+// stats works out the figures for the window. Probes younger than timeout are
+// left out of the loss, since their reply could still be on the way
+func (w *probeWindow) stats(now time.Time, timeout time.Duration) proberStats {
+	w.mu.Lock()
+	samples := make([]probeSample, 0, len(w.samples))
+	for _, s := range w.samples {
+		if !s.Sent.IsZero() {
+			samples = append(samples, s)
+		}
+	}
+	w.mu.Unlock()
+
+	st := proberStats{}
+	sort.Slice(samples, func(i, j int) bool { return samples[i].Sent.Before(samples[j].Sent) })
+
+	// Latency is from the latest probe that made it back, like getStats
+	for i := len(samples) - 1; i >= 0; i-- {
+		if samples[i].Replied && !samples[i].NoDelay {
+			st.TXLatency = samples[i].Forward
+			st.RXLatency = samples[i].Reverse
+			break
+		}
+	}
+
+	if len(samples) < len(w.samples) {
+		// Don't send loss stats when we don't have enough info to operate with
+		return st
+	}
+
+	lost := 0
+	for _, s := range samples {
+		if !s.Replied && now.Sub(s.Sent) > timeout {
+			lost++
+		}
+	}
+
+	// Between two replies the reflector counter moves on by one for every
+	// probe that reached it, so anything else was lost on the way there.
+	// Loss outside of the first and last reply can't be told apart.
+	forwardLost, lostBetween := 0, 0
+	first, last := -1, -1
+	for i, s := range samples {
+		if !s.Replied || !s.HasRefSeq {
+			continue
+		}
+		if last != -1 {
+			gap := int(s.Seq-samples[last].Seq) - int(s.RefSeq-samples[last].RefSeq)
+			if gap > 0 {
+				forwardLost += gap
+			}
+		} else {
+			first = i
+		}
+		last = i
+	}
+	if first != last {
+		for _, s := range samples[first:last] {
+			if !s.Replied {
+				lostBetween++
+			}
+		}
+		if forwardLost > lostBetween {
+			forwardLost = lostBetween
+		}
+	}
+
+	st.Exchanges = len(samples)
+	st.TXLoss = forwardLost
+	st.RXLoss = lostBetween - forwardLost
+	st.RTTLoss = lost - lostBetween
+	return st
+}
+
+// oneWayWindow keeps the last 32 packets of a one way stream (like an OWAMP
+// test session), where each packet is known to have arrived or not on its own
+type oneWayWindow struct {
+	mu      sync.Mutex
+	samples [32]oneWaySample
+	next    int
+	filled  int
+	lastSeq uint32
+	started bool
+}
+
+type oneWaySample struct {
+	Seq     uint32
+	Arrived bool
+	Delay   time.Duration
+}
+
+// record notes packet seq as arrived (with its delay) or lost. Sequence
+// numbers skipped over since the last record are counted as lost.
+func (w *oneWayWindow) record(seq uint32, arrived bool, delay time.Duration) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.started {
+		if int32(seq-w.lastSeq) <= 0 {
+			// Late or duplicated, it has already been counted
+			return
+		}
+		gap := seq - w.lastSeq - 1
+		if gap > uint32(len(w.samples)) {
+			gap = uint32(len(w.samples))
+		}
+		for i := uint32(0); i < gap; i++ {
+			w.add(oneWaySample{Seq: seq - gap + i})
+		}
+	}
+	w.started = true
+	w.lastSeq = seq
+	w.add(oneWaySample{Seq: seq, Arrived: arrived, Delay: delay})
+}
+
+func (w *oneWayWindow) add(s oneWaySample) {
+	w.samples[w.next] = s
+	w.next = (w.next + 1) % len(w.samples)
+	if w.filled < len(w.samples) {
+		w.filled++
+	}
+}
+
+// reset forgets the sequence, for when a new stream starts from 0 again
+func (w *oneWayWindow) reset() {
+	w.mu.Lock()
+	w.started = false
+	w.mu.Unlock()
+}
+
+// stats gives the delay of the latest packet to arrive, and the loss over
+// the window. full is false until the window has seen 32 packets.
+func (w *oneWayWindow) stats() (delay time.Duration, lost int, full bool) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	for i := 1; i <= w.filled; i++ {
+		s := w.samples[(w.next-i+len(w.samples))%len(w.samples)]
+		if s.Arrived {
+			delay = s.Delay
+			break
+		}
+	}
+	for i := 0; i < w.filled; i++ {
+		if !w.samples[i].Arrived {
+			lost++
+		}
+	}
+	return delay, lost, w.filled == len(w.samples)
+}
@@ -0,0 +1,52 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestProbeWindowLossAttribution(t *testing.T) {
+	w := probeWindow{}
+	start := time.Unix(1600000000, 0)
+	refSeq := uint32(0)
+
+	for seq := uint32(0); seq < 32; seq++ {
+		w.sent(seq, start.Add(time.Duration(seq)*time.Second))
+		switch seq {
+		case 5, 6:
+			// Lost on the way there, the reflector never counts them
+		case 10:
+			// Lost on the way back, the reflector counted it
+			refSeq++
+		default:
+			w.repliedWithRefSeq(seq, 10*time.Millisecond, 20*time.Millisecond, refSeq, true)
+			refSeq++
+		}
+	}
+
+	st := w.stats(start.Add(40*time.Second), 2*time.Second)
+	if st.TXLoss != 2 || st.RXLoss != 1 || st.RTTLoss != 0 || st.Exchanges != 32 {
+		t.Fatalf("got %+v, want 2 TX loss and 1 RX loss of 32", st)
+	}
+	if st.TXLatency != 10*time.Millisecond || st.RXLatency != 20*time.Millisecond {
+		t.Fatalf("latency is TX %s RX %s, want 10ms/20ms", st.TXLatency, st.RXLatency)
+	}
+}
+
+func TestProbeWindowUnattributedLoss(t *testing.T) {
+	w := probeWindow{}
+	start := time.Unix(1600000000, 0)
+
+	for seq := uint32(0); seq < 40; seq++ {
+		w.sent(seq, start.Add(time.Duration(seq)*time.Second))
+		if seq%4 != 3 {
+			w.replied(seq, 10*time.Millisecond, 20*time.Millisecond)
+		}
+	}
+
+	// The last probe is still in flight, so doesn't count as lost
+	st := w.stats(start.Add(39*time.Second+500*time.Millisecond), 2*time.Second)
+	if st.RTTLoss != 7 || st.TXLoss != 0 || st.RXLoss != 0 {
+		t.Fatalf("got %+v, want 7 round trip loss", st)
+	}
+}
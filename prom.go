@@ -4,6 +4,7 @@ import (
 	"flag"
 	"log"
 	"net/http"
+	"strconv"
 
 	"github.com/prometheus/client_golang/prometheus"
 	"github.com/prometheus/client_golang/prometheus/promhttp"
@@ -20,6 +21,7 @@ func handlePrometheus() {
 		promhttp.HandlerOpts{})
 
 	http.Handle(*metricsPath, handler)
+	http.HandleFunc("/paths", handlePathsAPI)
 
 	http.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
 		if *metricsPath == "/metrics" {
@@ -56,6 +58,24 @@ type Collector struct{}
 func (c Collector) Describe(ch chan<- *prometheus.Desc) {
 	promLatency.Describe(ch)
 	promLoss.Describe(ch)
+	promPPSOffset.Describe(ch)
+	promPPSJitter.Describe(ch)
+	promPPSMissed.Describe(ch)
+	promPPSLocked.Describe(ch)
+	promClockSteps.Describe(ch)
+	promQuarantined.Describe(ch)
+	promLeapSecond.Describe(ch)
+	promHopCount.Describe(ch)
+	promRouteChanges.Describe(ch)
+	promRemarked.Describe(ch)
+	promMaxSize.Describe(ch)
+	promSizeLoss.Describe(ch)
+	promPathMTU.Describe(ch)
+	promCapacity.Describe(ch)
+	promAddressChanges.Describe(ch)
+	promAddressRejected.Describe(ch)
+	promBehindNAT.Describe(ch)
+	promPeerInfo.Describe(ch)
 }
 
 //Collect implements the prometheus.Collector interface.
@@ -65,6 +85,26 @@ func (c Collector) Collect(ch chan<- prometheus.Metric) {
 	if err == nil {
 		promLatency.Collect(ch)
 		promLoss.Collect(ch)
+		if *usePPS {
+			promPPSOffset.Collect(ch)
+			promPPSJitter.Collect(ch)
+			promPPSMissed.Collect(ch)
+			promPPSLocked.Collect(ch)
+		}
+		promClockSteps.Collect(ch)
+		promQuarantined.Collect(ch)
+		promLeapSecond.Collect(ch)
+		promHopCount.Collect(ch)
+		promRouteChanges.Collect(ch)
+		promRemarked.Collect(ch)
+		promMaxSize.Collect(ch)
+		promSizeLoss.Collect(ch)
+		promPathMTU.Collect(ch)
+		promCapacity.Collect(ch)
+		promAddressChanges.Collect(ch)
+		promAddressRejected.Collect(ch)
+		promBehindNAT.Collect(ch)
+		promPeerInfo.Collect(ch)
 	} else {
 		log.Println("ERROR:", err)
 		return
@@ -77,14 +117,135 @@ var (
 			Name: "splitping_latency",
 			Help: "The latency (in s) in each direction",
 		},
-		[]string{"direction", "host"},
+		[]string{"direction", "host", "protocol", "class", "flow", "transport", "listener"},
 	)
 	promLoss = prometheus.NewGaugeVec(
 		prometheus.GaugeOpts{
 			Name: "splitping_loss",
 			Help: "The loss in (in persent) each direction",
 		},
-		[]string{"direction", "host"},
+		[]string{"direction", "host", "protocol", "class", "flow", "transport", "listener"},
+	)
+	promPPSOffset = prometheus.NewGauge(
+		prometheus.GaugeOpts{
+			Name: "splitping_pps_offset",
+			Help: "The offset (in s) of the system clock from the last PPS pulse",
+		},
+	)
+	promPPSJitter = prometheus.NewGauge(
+		prometheus.GaugeOpts{
+			Name: "splitping_pps_jitter",
+			Help: "The jitter (in s) of the PPS pulse to system clock offset",
+		},
+	)
+	promPPSMissed = prometheus.NewGauge(
+		prometheus.GaugeOpts{
+			Name: "splitping_pps_missed_pulses",
+			Help: "How many PPS pulses have not arrived since startup",
+		},
+	)
+	promPPSLocked = prometheus.NewGauge(
+		prometheus.GaugeOpts{
+			Name: "splitping_pps_locked",
+			Help: "1 if PPS pulses are being used, 0 if fallen back to the system clock",
+		},
+	)
+	promClockSteps = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "splitping_clock_steps",
+			Help: "How many clock steps (or leap smears) have been seen, by kind",
+		},
+		[]string{"kind", "host"},
+	)
+	promQuarantined = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "splitping_quarantined_samples",
+			Help: "How many samples have been held back because of a clock step",
+		},
+		[]string{"host"},
+	)
+	promLeapSecond = prometheus.NewGauge(
+		prometheus.GaugeOpts{
+			Name: "splitping_leap_second",
+			Help: "Unix time of the last scheduled leap second the kernel has told us about",
+		},
+	)
+	promHopCount = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "splitping_hop_count",
+			Help: "How many hops the path takes in each direction, worked out from the TTL packets arrive with",
+		},
+		[]string{"direction", "host", "protocol", "class", "flow", "transport", "listener"},
+	)
+	promRouteChanges = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "splitping_route_changes",
+			Help: "How many times the hop count in each direction has changed",
+		},
+		[]string{"direction", "host", "class", "flow", "transport", "listener"},
+	)
+	promRemarked = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "splitping_remarked",
+			Help: "1 if packets sent marked with class are arriving remarked as to, 0 if they arrive as sent",
+		},
+		[]string{"direction", "host", "class", "flow", "transport", "listener", "to"},
+	)
+	promMaxSize = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "splitping_max_size",
+			Help: "The biggest size sweep probe (in bytes, as an IP packet) that got through in the last round",
+		},
+		[]string{"direction", "host", "class", "flow", "transport", "listener"},
+	)
+	promSizeLoss = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "splitping_size_loss",
+			Help: "The loss of size sweep probes at each size, over the last few rounds",
+		},
+		[]string{"direction", "host", "class", "flow", "transport", "listener", "size"},
+	)
+	promPathMTU = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "splitping_path_mtu",
+			Help: "The path MTU in each direction, as the sending end's kernel sees it",
+		},
+		[]string{"direction", "host", "class", "flow", "transport", "listener"},
+	)
+	promCapacity = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "splitping_capacity",
+			Help: "The capacity (in bits/s) of the bottleneck link in each direction, from how trains of packets spread out",
+		},
+		[]string{"direction", "host", "class", "flow", "transport", "listener"},
+	)
+	promAddressChanges = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "splitping_address_changes",
+			Help: "How many times the peer's address (side=peer), or ours as the peer sees it (side=local), has changed",
+		},
+		[]string{"side", "host"},
+	)
+	promAddressRejected = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "splitping_address_rejected",
+			Help: "How many packets for a locked session have been dropped for coming from some other address",
+		},
+		[]string{"host"},
+	)
+	promBehindNAT = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "splitping_behind_nat",
+			Help: "1 if the peer sees our pings come from some other address than they leave from, 0 if not",
+		},
+		[]string{"host", "flow", "listener"},
+	)
+	promPeerInfo = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "splitping_peer_info",
+			Help: "Always 1, the version of sping the peer runs, the wire version used, and the features both ends have",
+		},
+		[]string{"host", "version", "wire_version", "capabilities"},
 	)
 )
 
@@ -93,14 +254,87 @@ func (c Collector) measure() error {
 	for _, v := range sessionMap {
 		RXL, TXL, RXLoss, TXLoss, exchanges := getStats(v.LastRX, v.LastRXPing, v)
 		PeerAddr := v.PeerAddress.String()
-		promLatency.WithLabelValues("rx", PeerAddr).Set(float64(RXL.Seconds()))
-
-		promLatency.WithLabelValues("tx", PeerAddr).Set(float64(TXL.Seconds()))
+		class, flow, transport, local := v.Class.String(), v.flowName(), v.transportName(), v.Listener
+		if v.Class.Marked {
+			for direction, t := range map[string]tosTracker{"rx": v.rxTOS, "tx": v.txTOS} {
+				if !t.Known {
+					continue
+				}
+				remarked := 0.0
+				if t.TOS != v.Class.TOS {
+					remarked = 1
+				}
+				promRemarked.WithLabelValues(direction, PeerAddr, class, flow, transport, local, tosName(t.TOS)).Set(remarked)
+			}
+		}
+		if v.sweep != nil {
+			v.sweep.export(PeerAddr, class, flow, transport, local)
+		}
+		if v.capacity != nil {
+			v.capacity.export(PeerAddr, class, flow, transport, local)
+		}
+		if v.peerKnown {
+			info := [4]string{PeerAddr, v.softwareName(), strconv.Itoa(int(v.WireVersion)), featureString(v.Features)}
+			if info != v.peerInfo {
+				v.forgetPeerInfo()
+			}
+			promPeerInfo.WithLabelValues(info[:]...).Set(1)
+			v.peerInfo = info
+		}
+		if v.natKnown {
+			behind := 0.0
+			if v.BehindNAT {
+				behind = 1
+			}
+			promBehindNAT.WithLabelValues(PeerAddr, flow, local).Set(behind)
+		}
+		if v.rxHops.Known {
+			promHopCount.WithLabelValues("rx", PeerAddr, "sping", class, flow, transport, local).Set(float64(v.rxHops.Hops))
+		}
+		if v.txHops.Known {
+			promHopCount.WithLabelValues("tx", PeerAddr, "sping", class, flow, transport, local).Set(float64(v.txHops.Hops))
+		}
 		if exchanges == 32 {
-			promLoss.WithLabelValues("rx", PeerAddr).Set(float64(RXLoss) / 32)
-			promLoss.WithLabelValues("tx", PeerAddr).Set(float64(TXLoss) / 32)
+			promLoss.WithLabelValues("rx", PeerAddr, "sping", class, flow, transport, local).Set(float64(RXLoss) / 32)
+			promLoss.WithLabelValues("tx", PeerAddr, "sping", class, flow, transport, local).Set(float64(TXLoss) / 32)
+		}
+		if v.clockSteps.quarantined(clock.Now()) {
+			// Don't export delays we know to be wrong, an absent series is better.
+			// Loss doesn't depend on the clocks, so it carries on.
+			promLatency.DeleteLabelValues("rx", PeerAddr, "sping", class, flow, transport, local)
+			promLatency.DeleteLabelValues("tx", PeerAddr, "sping", class, flow, transport, local)
+			continue
 		}
+		promLatency.WithLabelValues("rx", PeerAddr, "sping", class, flow, transport, local).Set(float64(RXL.Seconds()))
+
+		promLatency.WithLabelValues("tx", PeerAddr, "sping", class, flow, transport, local).Set(float64(TXL.Seconds()))
 	}
 	sessionLock.Unlock()
+
+	probersLock.RLock()
+	for _, v := range probers {
+		st := v.Stats()
+		host, proto := v.Host(), v.Protocol()
+		if st.RXOnly {
+			if st.RXLatency != 0 {
+				promLatency.WithLabelValues("rx", host, proto, "", "", "", "").Set(st.RXLatency.Seconds())
+			}
+			if st.Exchanges != 0 {
+				promLoss.WithLabelValues("rx", host, proto, "", "", "", "").Set(float64(st.RXLoss) / float64(st.Exchanges))
+			}
+			continue
+		}
+		if st.RXLatency != 0 || st.TXLatency != 0 {
+			promLatency.WithLabelValues("rx", host, proto, "", "", "", "").Set(st.RXLatency.Seconds())
+			promLatency.WithLabelValues("tx", host, proto, "", "", "", "").Set(st.TXLatency.Seconds())
+		}
+		if st.Exchanges != 0 {
+			exchanges := float64(st.Exchanges)
+			promLoss.WithLabelValues("rx", host, proto, "", "", "", "").Set(float64(st.RXLoss) / exchanges)
+			promLoss.WithLabelValues("tx", host, proto, "", "", "", "").Set(float64(st.TXLoss) / exchanges)
+			promLoss.WithLabelValues("round-trip", host, proto, "", "", "", "").Set(float64(st.RTTLoss) / exchanges)
+		}
+	}
+	probersLock.RUnlock()
 	return nil
 }
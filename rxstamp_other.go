@@ -0,0 +1,12 @@
+// +build !linux
+
+package main
+
+import (
+	"net"
+	"time"
+)
+
+func enableRXStamps(c *net.UDPConn) {}
+
+func stampFromControlMessage(oob []byte) (time.Time, bool) { return time.Time{}, false }
@@ -13,77 +13,103 @@ import (
 	"github.com/vmihailenco/msgpack/v4"
 )
 
-func startSession(ip net.IP) {
+// startSession keeps a session going with peer, run as opts asks, on the
+// listener bind gives, sent from where it pins it to, set up with the
+// handshake ("tcp", "udp" or "auto") asked for
+func startSession(peer *net.UDPAddr, opts inviteOptions, bind localBinding, handshake string) {
+	ip := peer.IP
+	local := bind.on(listeners[bind.Listener])
+
+	// Each flow has its own socket, so its own source port
+	var replyWith net.PacketConn
+	switch {
+	case opts.Transport == "icmp":
+		sock, err := openICMPSocket(ip.To4() == nil)
+		if err != nil {
+			log.Printf("%v: Cannot open an ICMP socket: %v", ip, err)
+			return
+		}
+		replyWith = icmpTransport{sock: sock, id: int(newSessionID() & 0xffff)}
+	case (opts.Flow != 0 || bind.pinned()) && opts.Transport == "":
+		conn, err := listenFlow(local)
+		if err != nil {
+			log.Printf("%v: Cannot make a socket for flow %d: %v", ip, opts.Flow, err)
+			return
+		}
+		replyWith = conn
+	}
+	// UDP invites go from the socket the session will use, so they open the same NAT mapping
+	inviteFrom, _ := replyWith.(*net.UDPConn)
+	if inviteFrom == nil && listeners[bind.Listener] != nil {
+		inviteFrom = listeners[bind.Listener].udp
+	}
+
 	first := true
 	for {
 		if !first {
-			time.Sleep(time.Second)
+			clock.Sleep(time.Second)
 		}
 		first = false
 
-		conn, err := net.Dial("tcp", net.JoinHostPort(ip.String(), "6924"))
-		if err != nil {
-			log.Printf("Cannot (TCP) handshake to %v: %v", ip, err)
-			continue
-		}
-
-		bannerBuf := make([]byte, 10000)
-		n, err := conn.Read(bannerBuf)
-		if n > 9000 {
-			log.Printf("%v: Host banner too big", ip.String())
-			conn.Close()
-			continue
+		var sessionID uint32
+		var conn net.Conn
+		var err error
+		if handshake != "udp" || opts.Transport == "tcp" {
+			sessionID, conn, err = tcpInvite(peer, opts, local, handshake == "auto")
+			if err != nil {
+				log.Printf("%v: %v", ip, err)
+			}
 		}
-
-		if !strings.HasPrefix(string(bannerBuf[:n]), "sping-0.3-") {
-			log.Printf("%v: Host banner not sping", ip.String())
-			conn.Close()
-			continue
+		if handshake == "udp" || (handshake == "auto" && err != nil && opts.Transport != "tcp") {
+			if sessionID, err = udpInvite(inviteFrom, peer, opts); err != nil {
+				log.Printf("%v: %v", ip, err)
+			}
 		}
-
-		// defer conn.Close()
-		// [+] Send Session Starting Request
-		_, err = conn.Write([]byte("INVITE\r\n"))
 		if err != nil {
-			log.Printf("%v: Failed to ask for invite", ip.String())
-			conn.Close()
-			continue
-		}
-		// [+] Read the Invite Banner
-		inviteBuf := make([]byte, 10)
-		n, err = conn.Read(inviteBuf)
-		if n > 31 || n == 0 {
-			log.Printf("%v: Invite banner wrong size %d", ip.String(), n)
-			conn.Close()
 			continue
 		}
 
-		conn.Close()
-		invite, err := strconv.ParseUint(string(inviteBuf[:n]), 10, 32)
-		if err != nil {
-			log.Printf("%v: Invite session bad", ip.String())
-			continue
+		// TCP sessions carry on over the connection the invite came on
+		var tcp *tcpTransport
+		if opts.Transport == "tcp" {
+			tcp = newTCPTransport(conn)
+			replyWith = tcp
+			go routeFrames(tcp)
+		} else if conn != nil {
+			conn.Close()
 		}
 
 		// [+] Make the internal session with the invite banner
 		// [+] Put the session in the session table, Flagged as TCP handshaked
 		sessionLock.Lock()
-		sessionMap[uint32(invite)] = &session{
+		sessionMap[sessionID] = &session{
 			PeerAddress:  ip,
-			SessionID:    uint32(invite),
+			PeerPort:     peer.Port,
+			Listener:     bind.Listener,
+			SessionID:    sessionID,
 			TCPActivated: true,
 			MadeByMe:     true,
-			SessionMade:  time.Now(),
-			UDPHandshake: make(chan bool, 0),
+			SessionMade:  clock.Now(),
+			UDPHandshake: make(chan bool, 1),
+			pulse:        make(chan secondTick, 1),
+			ReplyWith:    replyWith,
+			bind:         local,
+			Class:        opts.Class,
+			Flow:         opts.Flow,
+			Transport:    opts.Transport,
+			PadTo:        opts.Size,
+			sweep:        newSizeSweep(opts.Sweep),
+			capacity:     newCapacityEstimator(opts.Capacity),
+			Locked:       opts.Lock,
 		}
 		sessionLock.Unlock()
 		// [+] Start the UDP Handshaker
-		go sessionMap[uint32(invite)].sendUDPHandshake()
+		go sessionMap[sessionID].sendUDPHandshake()
 		// [+] Monitor the session table for the session disappearing and restart session if gone
 		for {
-			time.Sleep(time.Second * 10)
+			clock.Sleep(time.Second * 10)
 			sessionLock.Lock()
-			SessionExists := sessionMap[uint32(invite)] != nil
+			SessionExists := sessionMap[sessionID] != nil
 			sessionLock.Unlock()
 
 			if SessionExists {
@@ -92,33 +118,78 @@ func startSession(ip net.IP) {
 				break
 			}
 		}
+		if tcp != nil {
+			tcp.Close()
+		}
+	}
+}
+
+// tcpInvite asks the peer for a session over its TCP port, giving back the
+// session and the connection it was asked for on. In a hurry the connect
+// gives up soon, so a firewall dropping it leaves time for a UDP invite.
+func tcpInvite(peer *net.UDPAddr, opts inviteOptions, local localBinding, hurry bool) (uint32, net.Conn, error) {
+	d := local.dialer("tcp")
+	if hurry {
+		d.Timeout = 5 * time.Second
+	}
+	conn, err := d.Dial("tcp", peer.String())
+	if err != nil {
+		return 0, nil, fmt.Errorf("Cannot (TCP) handshake: %v", err)
+	}
+
+	bannerBuf := make([]byte, 10000)
+	n, err := conn.Read(bannerBuf)
+	if n > 9000 {
+		conn.Close()
+		return 0, nil, fmt.Errorf("Host banner too big")
+	}
+
+	if err := checkBanner(string(bannerBuf[:n])); err != nil {
+		conn.Close()
+		return 0, nil, err
+	}
+
+	// [+] Send Session Starting Request
+	_, err = conn.Write([]byte(opts.String()))
+	if err != nil {
+		conn.Close()
+		return 0, nil, fmt.Errorf("Failed to ask for invite")
+	}
+	// [+] Read the Invite Banner
+	inviteBuf := make([]byte, 10)
+	n, err = conn.Read(inviteBuf)
+	if n > 31 || n == 0 {
+		conn.Close()
+		return 0, nil, fmt.Errorf("Invite banner wrong size %d", n)
 	}
+
+	sessionID, err := strconv.ParseUint(string(inviteBuf[:n]), 10, 32)
+	if err != nil {
+		conn.Close()
+		return 0, nil, fmt.Errorf("Invite session bad")
+	}
+	return uint32(sessionID), conn, nil
 }
 
 // sendUDPHandshake is called by session.startSession to send UDP handshakes in the background
 // the actual handshake is RX'd elsewhere, decoded and this function is notified of a sucessful
 // handshake via a channel boop. At that point the function kicks off the actual send loop.
 func (s *session) sendUDPHandshake() {
-	ticker := time.NewTicker(time.Second)
-	defer ticker.Stop()
-	s.ReplyWith = *globalReplyWith
+	if s.ReplyWith == nil {
+		s.ReplyWith = listeners[s.Listener].udp
+	}
 
 	for {
 		select {
-		case <-ticker.C:
+		case <-clock.After(time.Second):
 			// Send a packet, but check if we have not already expired
-			if time.Since(s.SessionMade) > time.Minute && !s.UDPActivated {
+			if clock.Since(s.SessionMade) > time.Minute && !s.UDPActivated {
 				// Clearly what we are doing is not working, time to stop
 				log.Printf("Timed out UDP handshaking with %s", s.PeerAddress)
 				return
 			}
 			// Cool no time out, let's send a handshake
-			hs := handshakeStruct{
-				Type:    'h',
-				Magic:   11181,
-				Session: s.SessionID,
-				Version: 3,
-			}
+			hs := s.handshake(false)
 			b, err := msgpack.Marshal(hs)
 			if err != nil {
 				log.Fatalf("Failed to marshal packet %v / %#v", err, hs)
@@ -126,7 +197,7 @@ func (s *session) sendUDPHandshake() {
 
 			ua := net.UDPAddr{
 				IP:   s.PeerAddress,
-				Port: 6924,
+				Port: s.PeerPort,
 			}
 
 			s.ReplyWith.WriteTo(b, &ua)
@@ -139,33 +210,34 @@ func (s *session) sendUDPHandshake() {
 	}
 }
 
-func listenOnTCP() {
-	tListener, err := net.Listen("tcp", *bindAddr)
-	if err != nil {
-		log.Fatalf("Failed to listen on TCP port %v", err)
-	}
-
+// listenOnTCP takes sessions (and other requests) on a listener's TCP port
+func listenOnTCP(tListener net.Listener, l *listener) {
 	for {
 		conn, err := tListener.Accept()
 		if err != nil {
 			log.Printf("Failed to accept connection, %v", err)
 			continue
 		}
-		go handleTCPconnection(conn)
+		go handleTCPconnection(conn, l)
 	}
 }
 
 type handshakeStruct struct {
 	Type    uint8  `msgpack:"Y"` // MUST be 'h' for a handshake
 	Magic   uint16 `msgpack:"M"`
-	Version uint16 `msgpack:"V"`
+	Version uint16 `msgpack:"V"` // Always 3, an old sping won't take anything else
 	Session uint32 `msgpack:"S"`
+
+	Versions []uint8 `msgpack:"W"` // The wire versions the sender speaks, empty from an old sping
+	Features uint32  `msgpack:"F"` // What the sender can do, featureAcks and so on
+	Software string  `msgpack:"D"` // The sender's version of sping
+	Answer   bool    `msgpack:"U"` // Set on the reply, an old sping sends the handshake back as it came
 }
 
-func handleTCPconnection(conn net.Conn) {
+func handleTCPconnection(conn net.Conn, l *listener) {
 	defer conn.Close()
 
-	_, err := conn.Write([]byte("sping-0.3-https://github.com/benjojo/sping\n"))
+	_, err := conn.Write([]byte(banner))
 	if err != nil {
 		return
 	}
@@ -176,36 +248,197 @@ func handleTCPconnection(conn net.Conn) {
 		return
 	}
 
-	if string(buf[:n]) != "INVITE\r\n" {
+	if string(buf[:n]) == "TRACE\r\n" {
+		handlePathTraceRequest(conn, l)
+		return
+	}
+	if strings.HasPrefix(string(buf[:n]), "LOAD ") {
+		handleLoadRequest(conn, string(buf[:n]), l)
+		return
+	}
+
+	opts, ok := parseInvite(string(buf[:n]))
+	if !ok {
 		conn.Write([]byte("I_DONT_UNDERSTAND"))
 		return
 	}
 
-	nSes := newSessionID()
+	var remote net.IP
+	if a, ok := conn.RemoteAddr().(*net.TCPAddr); ok {
+		remote = a.IP
+	}
+	if err := openInviteTransport(opts, remote); err != nil {
+		log.Printf("Cannot take a session from %s: %v", remote, err)
+		conn.Write([]byte("NO_ICMP"))
+		return
+	}
 
+	nSes := acceptInvite(opts, l, "")
+	conn.Write([]byte(fmt.Sprint(nSes)))
+	if opts.Transport == "tcp" {
+		routeFrames(newTCPTransport(conn))
+	}
+}
+
+// openInviteTransport gets ready to take a session over the transport opts
+// asks for, from remote
+func openInviteTransport(opts inviteOptions, remote net.IP) error {
+	if opts.Transport != "icmp" {
+		return nil
+	}
+	if remote == nil {
+		return fmt.Errorf("ICMP sessions need an IP to ping")
+	}
+	// Handshakes and pings will be coming in over ICMP, so it had better be listened to
+	if _, err := openICMPSocket(remote.To4() == nil); err != nil {
+		return fmt.Errorf("cannot open an ICMP socket for an ICMP session: %v", err)
+	}
+	return nil
+}
+
+// acceptInvite makes the session an invite asks for on l, and waits for its
+// UDP handshake. Invites given a key are only taken once, asking again with
+// the same key gives back the same session.
+func acceptInvite(opts inviteOptions, l *listener, key string) uint32 {
 	sessionLock.Lock()
+	defer sessionLock.Unlock()
+	if key != "" {
+		for id, ses := range sessionMap {
+			if ses.inviteKey == key {
+				return id
+			}
+		}
+	}
+
+	nSes := newSessionID()
 	sessionMap[nSes] = &session{
 		SessionID:    nSes,
 		MadeByMe:     false,
 		TCPActivated: true,
-		SessionMade:  time.Now(),
-		UDPHandshake: make(chan bool, 0),
+		Listener:     l.Name,
+		SessionMade:  clock.Now(),
+		UDPHandshake: make(chan bool, 1), // So a handshake turning up while nothing is waiting on it is not lost
+		pulse:        make(chan secondTick, 1),
+		Class:        opts.Class,
+		Flow:         opts.Flow,
+		Transport:    opts.Transport,
+		PadTo:        opts.Size,
+		sweep:        newSizeSweep(opts.Sweep),
+		capacity:     newCapacityEstimator(opts.Capacity),
+		Locked:       opts.Lock,
+		inviteKey:    key,
 	}
-	sessionLock.Unlock()
 	go sessionMap[nSes].waitForHandshake()
+	return nSes
+}
 
-	conn.Write([]byte(fmt.Sprint(nSes)))
+// inviteOptions is how the session being asked for should be run. They are
+// sent after INVITE as key=value pairs, a plain INVITE being the defaults.
+type inviteOptions struct {
+	Class trafficClass // Marked sessions say how, so the peer marks its pings the same way
+	Flow  int          // Which of the flows to the peer this is, 0 if it is not running several
+	Size  int          // What to pad pings out to, 0 to leave them be
+	Sweep string       // "auto" or a list of sizes to sweep, "" to not
+
+	Transport string // "icmp" or "tcp" to send packets over that, "" for UDP
+
+	Capacity bool // If trains of packets should be sent to estimate capacity
+	Lock     bool // If the session should only take packets from the address it was set up from
+}
+
+func (o inviteOptions) String() string {
+	s := "INVITE"
+	if o.Class.Marked {
+		s += fmt.Sprintf(" tos=%d", o.Class.TOS)
+	}
+	if o.Flow != 0 {
+		s += fmt.Sprintf(" flow=%d", o.Flow)
+	}
+	if o.Size != 0 {
+		s += fmt.Sprintf(" size=%d", o.Size)
+	}
+	if o.Sweep != "" {
+		s += " sweep=" + o.Sweep
+	}
+	if o.Capacity {
+		s += " capacity=1"
+	}
+	if o.Transport != "" {
+		s += " transport=" + o.Transport
+	}
+	if o.Lock {
+		s += " lock=1"
+	}
+	return s + "\r\n"
+}
+
+// parseInvite reads an INVITE line, options it does not know are ignored
+func parseInvite(s string) (o inviteOptions, ok bool) {
+	if !strings.HasSuffix(s, "\r\n") {
+		return o, false
+	}
+	fields := strings.Fields(s)
+	if len(fields) == 0 || fields[0] != "INVITE" {
+		return o, false
+	}
+	for _, f := range fields[1:] {
+		kv := strings.SplitN(f, "=", 2)
+		if len(kv) != 2 {
+			return o, false
+		}
+		switch kv[0] {
+		case "tos", "flow":
+			v, err := strconv.ParseUint(kv[1], 10, 8)
+			if err != nil {
+				return o, false
+			}
+			if kv[0] == "tos" {
+				o.Class = trafficClass{Marked: true, TOS: int(v)}
+			} else {
+				o.Flow = int(v)
+			}
+		case "size":
+			v, err := strconv.Atoi(kv[1])
+			if err != nil || v < 0 || v > maxProbeSize {
+				return o, false
+			}
+			o.Size = v
+		case "sweep":
+			if _, err := parseSweep(kv[1]); err != nil {
+				return o, false
+			}
+			o.Sweep = kv[1]
+		case "capacity", "lock":
+			v, err := strconv.ParseBool(kv[1])
+			if err != nil {
+				return o, false
+			}
+			if kv[0] == "capacity" {
+				o.Capacity = v
+			} else {
+				o.Lock = v
+			}
+		case "transport":
+			switch kv[1] {
+			case "udp":
+				o.Transport = ""
+			case "icmp", "tcp":
+				o.Transport = kv[1]
+			default:
+				return o, false
+			}
+		}
+	}
+	return o, true
 }
 
 func (s *session) waitForHandshake() {
-	ticker := time.NewTicker(time.Second)
-	defer ticker.Stop()
 
 	for {
 		select {
-		case <-ticker.C:
+		case <-clock.After(time.Second):
 			// Send a packet, but check if we have not already expired
-			if time.Since(s.SessionMade) > time.Minute && !s.UDPActivated {
+			if clock.Since(s.SessionMade) > time.Minute && !s.UDPActivated {
 				// Clearly what we are doing is not working, time to stop
 				log.Printf("Timed out UDP handshaking with %s", s.PeerAddress)
 				return
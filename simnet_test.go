@@ -0,0 +1,177 @@
+package main
+
+import (
+	"errors"
+	"math/rand"
+	"net"
+	"sort"
+	"time"
+)
+
+// simNetwork is a deterministic fake network for tests. Packets are not sent
+// anywhere, instead deliveries are queued up as events that run on a
+// fakeClock when the test calls RunUntil.
+type simNetwork struct {
+	clock  *fakeClock
+	rng    *rand.Rand
+	events []simEvent
+	seq    int
+}
+
+type simEvent struct {
+	at  time.Time
+	seq int // Keeps events at the same time in the order they were made
+	fn  func()
+}
+
+// simLink is how one direction of the network behaves. Loss, Reorder and
+// Duplicate are fractions of packets, applied evenly (a Loss of 0.1 drops
+// exactly every 10th packet) so tests can know what to expect.
+type simLink struct {
+	Delay        time.Duration
+	Jitter       time.Duration // Random extra delay of up to this much
+	Loss         float64
+	Reorder      float64       // Fraction of packets held back by ReorderDelay
+	ReorderDelay time.Duration // Defaults to 1.5s, so the next ping overtakes
+	Duplicate    float64
+	TTL          int           // What packets arrive with, 0 for not known
+	Remark       func(int) int // Rewrites the TOS of packets on the way, if set
+	MTU          int           // Bigger packets (with IPv4 and UDP headers) are dropped, 0 for no limit
+	Rate         float64       // The bottleneck in bits/s, packets queue up behind each other, 0 for no limit
+
+	lossCredit, reorderCredit, dupCredit float64
+	busyUntil                            time.Time
+	Sent, Dropped, Duplicated, Reordered int
+}
+
+// take adds rate to credit, and returns true each time it goes over a whole packet
+func take(credit *float64, rate float64) bool {
+	*credit += rate
+	if *credit >= 1 {
+		*credit--
+		return true
+	}
+	return false
+}
+
+func newSimNetwork(c *fakeClock, seed int64) *simNetwork {
+	return &simNetwork{
+		clock: c,
+		rng:   rand.New(rand.NewSource(seed)),
+	}
+}
+
+func (n *simNetwork) schedule(at time.Time, fn func()) {
+	n.seq++
+	n.events = append(n.events, simEvent{at: at, seq: n.seq, fn: fn})
+}
+
+// RunUntil delivers everything due up to t, moving the clock along as it goes
+func (n *simNetwork) RunUntil(t time.Time) {
+	for {
+		sort.Slice(n.events, func(i, j int) bool {
+			if n.events[i].at.Equal(n.events[j].at) {
+				return n.events[i].seq < n.events[j].seq
+			}
+			return n.events[i].at.Before(n.events[j].at)
+		})
+		if len(n.events) == 0 || n.events[0].at.After(t) {
+			break
+		}
+		ev := n.events[0]
+		n.events = n.events[1:]
+		n.clock.Set(ev.at)
+		ev.fn()
+	}
+	n.clock.Set(t)
+}
+
+// simHandler is called for every packet delivered to a simEndpoint
+type simHandler func(buf []byte, from *net.UDPAddr, info rxInfo, conn net.PacketConn)
+
+// pair makes two endpoints that can talk to each other, ab being the link from a to b
+func (n *simNetwork) pair(aAddr, bAddr *net.UDPAddr, ab, ba *simLink) (*simEndpoint, *simEndpoint) {
+	a := &simEndpoint{net: n, addr: aAddr, out: ab}
+	b := &simEndpoint{net: n, addr: bAddr, out: ba}
+	a.peer, b.peer = b, a
+	return a, b
+}
+
+// simEndpoint is a net.PacketConn on a simNetwork
+type simEndpoint struct {
+	net     *simNetwork
+	addr    *net.UDPAddr
+	peer    *simEndpoint
+	out     *simLink
+	Handler simHandler
+}
+
+func (e *simEndpoint) WriteTo(b []byte, addr net.Addr) (int, error) {
+	return e.WriteToWithTOS(b, addr.(*net.UDPAddr), 0)
+}
+
+func (e *simEndpoint) WriteToWithTOS(b []byte, addr *net.UDPAddr, tos int) (int, error) {
+	l := e.out
+	l.Sent++
+	if l.MTU != 0 && len(b)+28 > l.MTU {
+		l.Dropped++
+		return len(b), nil
+	}
+	if take(&l.lossCredit, l.Loss) {
+		l.Dropped++
+		return len(b), nil
+	}
+
+	delay := l.Delay
+	if l.Rate > 0 {
+		now := e.net.clock.Now()
+		start := now
+		if l.busyUntil.After(start) {
+			start = l.busyUntil
+		}
+		l.busyUntil = start.Add(time.Duration(float64((len(b)+28)*8) / l.Rate * float64(time.Second)))
+		delay += l.busyUntil.Sub(now)
+	}
+	if l.Jitter > 0 {
+		delay += time.Duration(e.net.rng.Int63n(int64(l.Jitter)))
+	}
+	if take(&l.reorderCredit, l.Reorder) {
+		l.Reordered++
+		if l.ReorderDelay == 0 {
+			delay += 1500 * time.Millisecond
+		} else {
+			delay += l.ReorderDelay
+		}
+	}
+
+	copies := 1
+	if take(&l.dupCredit, l.Duplicate) {
+		l.Duplicated++
+		copies = 2
+	}
+
+	buf := make([]byte, len(b))
+	copy(buf, b)
+	info := rxInfo{TTL: l.TTL, TOS: tos, TOSKnown: true}
+	if l.Remark != nil {
+		info.TOS = l.Remark(tos)
+	}
+	for i := 0; i < copies; i++ {
+		e.net.schedule(e.net.clock.Now().Add(delay+time.Duration(i)*time.Millisecond), func() {
+			if e.peer.Handler != nil {
+				e.peer.Handler(buf, e.addr, info, e.peer)
+			}
+		})
+	}
+	return len(b), nil
+}
+
+func (e *simEndpoint) ReadFrom(b []byte) (int, net.Addr, error) {
+	return 0, nil, errors.New("simEndpoint delivers packets to its Handler")
+}
+
+func (e *simEndpoint) Close() error                       { return nil }
+func (e *simEndpoint) LocalAddr() net.Addr                { return e.addr }
+func (e *simEndpoint) SetDeadline(t time.Time) error      { return nil }
+func (e *simEndpoint) SetReadDeadline(t time.Time) error  { return nil }
+func (e *simEndpoint) SetWriteDeadline(t time.Time) error { return nil }
@@ -0,0 +1,121 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"strings"
+	"syscall"
+
+	"golang.org/x/net/ipv4"
+	"golang.org/x/net/ipv6"
+)
+
+// On a host with more than one address, letting the kernel pick the source
+// of a reply can send it from a different address to the one the peer sent
+// to, which breaks NAT and firewall state, and measures some other path. So
+// sping notes the address each packet arrived at (IP_PKTINFO, or
+// IPV6_PKTINFO) and replies from it. Peers can also be pinned to a source
+// address, an interface or a VRF with the source=, interface= and vrf=
+// options.
+
+// localBinding pins where a session's packets leave from
+type localBinding struct {
+	Source   net.IP // nil to let the kernel pick
+	Device   string // An interface, or the device of a VRF, "" for any
+	Listener string // The listener to use, "" for the one from -listenAddr
+}
+
+// localBinding gives the source=, interface=, vrf= and listener= options of a sping peer, checked
+func (p peerSpec) localBinding() (b localBinding, err error) {
+	b.Listener = p.Options.Get("listener")
+	if v := p.Options.Get("source"); v != "" {
+		if b.Source = net.ParseIP(v); b.Source == nil {
+			return b, fmt.Errorf("bad source %q, it must be an IP", v)
+		}
+		if (b.Source.To4() == nil) != strings.Contains(p.Host, ":") {
+			return b, fmt.Errorf("source %s is not the same address family as the peer", v)
+		}
+	}
+	iface, vrf := p.Options.Get("interface"), p.Options.Get("vrf")
+	if iface != "" && vrf != "" {
+		return b, fmt.Errorf("only one of interface and vrf can be given")
+	}
+	if b.Device = iface + vrf; b.Device != "" {
+		if _, err := net.InterfaceByName(b.Device); err != nil {
+			return b, fmt.Errorf("no device %q: %v", b.Device, err)
+		}
+	}
+	return b, nil
+}
+
+// pinned is true if the session needs its own sockets, rather than the shared ones
+func (b localBinding) pinned() bool {
+	return b.Source != nil || b.Device != ""
+}
+
+// control binds sockets to the device, for net.Dialer and net.ListenConfig
+func (b localBinding) control(network, address string, c syscall.RawConn) error {
+	if b.Device == "" {
+		return nil
+	}
+	var serr error
+	if err := c.Control(func(fd uintptr) { serr = bindToDevice(fd, b.Device) }); err != nil {
+		return err
+	}
+	return serr
+}
+
+// dialer makes connections from the source address and device, if they are set
+func (b localBinding) dialer(network string) *net.Dialer {
+	d := &net.Dialer{Control: b.control}
+	if b.Source != nil {
+		switch network {
+		case "tcp":
+			d.LocalAddr = &net.TCPAddr{IP: b.Source}
+		case "udp":
+			d.LocalAddr = &net.UDPAddr{IP: b.Source}
+		}
+	}
+	return d
+}
+
+// pktinfoControlMessage is the control message to send a packet to dst from
+// the local address src, nil if src is nil or the wrong family for dst
+func pktinfoControlMessage(dst, src net.IP) []byte {
+	if src == nil {
+		return nil
+	}
+	if dst.To4() != nil {
+		if src.To4() == nil {
+			return nil
+		}
+		return (&ipv4.ControlMessage{Src: src.To4()}).Marshal()
+	}
+	if src.To4() != nil {
+		return nil
+	}
+	return (&ipv6.ControlMessage{Src: src}).Marshal()
+}
+
+// writeToFrom sends b to addr marked with tos, from the local address src
+// (nil to let the kernel pick), as far as c can do those
+func writeToFrom(c net.PacketConn, b []byte, addr *net.UDPAddr, tos int, src net.IP) (int, error) {
+	if w, ok := c.(tosWriter); ok {
+		if tos != 0 {
+			return w.WriteToWithTOS(b, addr, tos)
+		}
+		return c.WriteTo(b, addr)
+	}
+	if u, ok := c.(*net.UDPConn); ok {
+		var oob []byte
+		if tos != 0 {
+			oob = tosControlMessage(addr.IP, tos)
+		}
+		oob = append(oob, pktinfoControlMessage(addr.IP, src)...)
+		if len(oob) != 0 {
+			n, _, err := u.WriteMsgUDP(b, oob, addr)
+			return n, err
+		}
+	}
+	return c.WriteTo(b, addr)
+}
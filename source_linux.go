@@ -0,0 +1,10 @@
+// +build linux
+
+package main
+
+import "golang.org/x/sys/unix"
+
+// bindToDevice has only packets through the device (or VRF) go in and out of the socket
+func bindToDevice(fd uintptr, device string) error {
+	return unix.SetsockoptString(int(fd), unix.SOL_SOCKET, unix.SO_BINDTODEVICE, device)
+}
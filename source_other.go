@@ -0,0 +1,9 @@
+// +build !linux
+
+package main
+
+import "errors"
+
+func bindToDevice(fd uintptr, device string) error {
+	return errors.New("binding to an interface or VRF is not supported on this platform")
+}
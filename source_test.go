@@ -0,0 +1,93 @@
+package main
+
+import (
+	"net"
+	"testing"
+	"time"
+)
+
+func TestLocalBinding(t *testing.T) {
+	for peer, want := range map[string]localBinding{
+		"192.0.2.1":                             {},
+		"sping://192.0.2.1?source=198.51.100.7": {Source: net.ParseIP("198.51.100.7")},
+		"sping://192.0.2.1?interface=lo":        {Device: "lo"},
+		"sping://192.0.2.1?vrf=lo":              {Device: "lo"},
+	} {
+		spec, err := parsePeerSpec(peer)
+		if err != nil {
+			t.Fatal(err)
+		}
+		b, err := spec.localBinding()
+		if err != nil {
+			if want.Device != "" {
+				t.Logf("skipping %s: %v", peer, err)
+				continue
+			}
+			t.Fatalf("%s: %v", peer, err)
+		}
+		if !b.Source.Equal(want.Source) || b.Device != want.Device || b.pinned() != (peer != "192.0.2.1") {
+			t.Fatalf("%s gave %+v, want %+v", peer, b, want)
+		}
+	}
+
+	for _, bad := range []string{
+		"sping://192.0.2.1?source=host.example",
+		"sping://192.0.2.1?source=2001:db8::1",
+		"sping://192.0.2.1?interface=lo&vrf=blue",
+		"sping://192.0.2.1?interface=nosuchdevice0",
+	} {
+		spec, _ := parsePeerSpec(bad)
+		if _, err := spec.localBinding(); err == nil {
+			t.Fatalf("%s was accepted", bad)
+		}
+	}
+}
+
+func TestReplyFromArrivalAddress(t *testing.T) {
+	// All of 127/8 is local, so a reply to something sent to 127.0.0.2 would
+	// come from 127.0.0.1 if the kernel were left to pick
+	for _, addr := range []string{"0.0.0.0:0", "[::]:0"} {
+		la, _ := net.ResolveUDPAddr("udp", addr)
+		c, err := net.ListenUDP("udp", la)
+		if err != nil {
+			t.Logf("skipping %s: %v", addr, err)
+			continue
+		}
+		rc := newRXInfoConn(c)
+
+		peer, err := net.ListenUDP("udp4", &net.UDPAddr{IP: net.ParseIP("127.0.0.1")})
+		if err != nil {
+			t.Fatal(err)
+		}
+		to := &net.UDPAddr{IP: net.ParseIP("127.0.0.2"), Port: c.LocalAddr().(*net.UDPAddr).Port}
+		if _, err := peer.WriteTo([]byte("hello"), to); err != nil {
+			t.Fatal(err)
+		}
+
+		c.SetReadDeadline(time.Now().Add(time.Second))
+		buf := make([]byte, 100)
+		_, from, info, err := rc.ReadFromWithInfo(buf)
+		if err != nil {
+			t.Fatalf("%s: %v", addr, err)
+		}
+		if info.Dst == nil {
+			t.Logf("%s: the destination address can't be read here", addr)
+		} else if !info.Dst.Equal(to.IP) {
+			t.Fatalf("%s: arrived at %s, want %s", addr, info.Dst, to.IP)
+		}
+
+		if _, err := writeToFrom(c, []byte("hi"), from, 0, info.Dst); err != nil {
+			t.Fatalf("%s: %v", addr, err)
+		}
+		peer.SetReadDeadline(time.Now().Add(time.Second))
+		_, replyFrom, err := peer.ReadFromUDP(buf)
+		if err != nil {
+			t.Fatalf("%s: %v", addr, err)
+		}
+		if info.Dst != nil && !replyFrom.IP.Equal(to.IP) {
+			t.Fatalf("%s: reply came from %s, want %s", addr, replyFrom.IP, to.IP)
+		}
+		peer.Close()
+		c.Close()
+	}
+}
@@ -0,0 +1,108 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"os/signal"
+	"time"
+
+	"github.com/benjojo/sping/impair"
+)
+
+type directionFlags struct {
+	delay, jitter, reorderDelay *time.Duration
+	loss, burst, reorder, dup   *float64
+}
+
+func addDirectionFlags(prefix, name string) directionFlags {
+	return directionFlags{
+		delay:        flag.Duration(prefix+".delay", 0, "Delay added to "+name+" packets"),
+		jitter:       flag.Duration(prefix+".jitter", 0, "Random extra delay (up to this much) added to "+name+" packets"),
+		loss:         flag.Float64(prefix+".loss", 0, "Average loss (0-1) of "+name+" packets"),
+		burst:        flag.Float64(prefix+".burst", 1, "Average length of "+name+" loss bursts, above 1 uses a Gilbert-Elliott model"),
+		reorder:      flag.Float64(prefix+".reorder", 0, "Chance (0-1) of "+name+" packets being held back to reorder them"),
+		reorderDelay: flag.Duration(prefix+".reorder-delay", 50*time.Millisecond, "How long reordered "+name+" packets are held back for"),
+		dup:          flag.Float64(prefix+".duplicate", 0, "Chance (0-1) of "+name+" packets being duplicated"),
+	}
+}
+
+func (d directionFlags) direction() impair.Direction {
+	dir := impair.Direction{
+		Delay:        *d.delay,
+		Jitter:       *d.jitter,
+		Reorder:      *d.reorder,
+		ReorderDelay: *d.reorderDelay,
+		Duplicate:    *d.dup,
+	}
+	if *d.burst > 1 {
+		dir.Loss = impair.Burst(*d.loss, *d.burst)
+	} else {
+		dir.Loss = impair.Bernoulli(*d.loss)
+	}
+	return dir
+}
+
+func main() {
+	listen := flag.String("listen", "127.0.0.3:6924", "Address to listen on")
+	target := flag.String("target", "127.0.0.2:6924", "Address to relay to")
+	proto := flag.String("proto", "both", "What to relay: udp, tcp or both")
+	seed := flag.Int64("seed", time.Now().UnixNano(), "Random seed")
+	fwd := addDirectionFlags("fwd", "forward (towards the target)")
+	rev := addDirectionFlags("rev", "reverse (from the target)")
+	flag.Usage = func() {
+		fmt.Fprintf(os.Stderr, `sping-impair [flags]
+
+Relays UDP and/or TCP from -listen to -target, impairing it on the way.
+Put it between two sping instances to test them against a bad network.
+
+`)
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+
+	cfg := impair.Config{
+		Forward: fwd.direction(),
+		Reverse: rev.direction(),
+		Seed:    *seed,
+	}
+
+	var relays []*impair.Relay
+	if *proto == "udp" || *proto == "both" {
+		r, err := impair.NewUDPRelay(*listen, *target, cfg)
+		if err != nil {
+			log.Fatalf("Failed to start UDP relay: %v", err)
+		}
+		relays = append(relays, r)
+	}
+	if *proto == "tcp" || *proto == "both" {
+		r, err := impair.NewTCPRelay(*listen, *target, cfg)
+		if err != nil {
+			log.Fatalf("Failed to start TCP relay: %v", err)
+		}
+		relays = append(relays, r)
+	}
+	if len(relays) == 0 {
+		log.Fatalf("-proto must be udp, tcp or both")
+	}
+	log.Printf("Relaying %s %s -> %s", *proto, *listen, *target)
+
+	sig := make(chan os.Signal, 1)
+	signal.Notify(sig, os.Interrupt)
+	ticker := time.NewTicker(10 * time.Second)
+	for {
+		select {
+		case <-ticker.C:
+			for _, r := range relays {
+				f, b := r.Stats()
+				log.Printf("%s forward %+v reverse %+v", r.Addr(), f, b)
+			}
+		case <-sig:
+			for _, r := range relays {
+				r.Close()
+			}
+			return
+		}
+	}
+}
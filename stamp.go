@@ -0,0 +1,284 @@
+package main
+
+import (
+	"encoding/binary"
+	"errors"
+	"flag"
+	"log"
+	"net"
+	"sync"
+	"time"
+)
+
+// STAMP (RFC 8762) support, in unauthenticated mode. This is also wire
+// compatible with TWAMP-Light, so it works with most routers.
+//
+// As a Session-Sender, sping sends a test packet every second to a
+// reflector, and works out forward delay from the reflectors receive
+// timestamp, and reverse delay from its transmit timestamp.
+//
+// As a Session-Reflector, sping answers test packets from anyone.
+
+var stampListen = flag.String("stamp.listen", "", "Address to run a STAMP/TWAMP-Light reflector on, for example [::]:862 (disabled if empty)")
+var stampStateful = flag.Bool("stamp.stateful", true, "Run the STAMP reflector in stateful mode, counting packets per sender")
+
+const stampPacketLen = 44
+
+var errSTAMPTooShort = errors.New("STAMP packet too short")
+
+// stampTestPacket is a Session-Sender test packet
+type stampTestPacket struct {
+	Seq           uint32
+	Timestamp     time.Time
+	ErrorEstimate uint16
+}
+
+func (p stampTestPacket) Marshal() []byte {
+	b := make([]byte, stampPacketLen)
+	binary.BigEndian.PutUint32(b[0:4], p.Seq)
+	putNTPTime(b[4:12], p.Timestamp)
+	binary.BigEndian.PutUint16(b[12:14], p.ErrorEstimate)
+	return b
+}
+
+func parseSTAMPTestPacket(b []byte) (stampTestPacket, error) {
+	if len(b) < stampPacketLen {
+		return stampTestPacket{}, errSTAMPTooShort
+	}
+	return stampTestPacket{
+		Seq:           binary.BigEndian.Uint32(b[0:4]),
+		Timestamp:     getNTPTime(b[4:12]),
+		ErrorEstimate: binary.BigEndian.Uint16(b[12:14]),
+	}, nil
+}
+
+// stampReflectedPacket is what a Session-Reflector sends back
+type stampReflectedPacket struct {
+	Seq              uint32
+	Timestamp        time.Time // T3, when the reflector sent this
+	ErrorEstimate    uint16
+	SSID             uint16
+	ReceiveTimestamp time.Time // T2, when the reflector got the test packet
+	SenderSeq        uint32
+	SenderTimestamp  time.Time // T1, copied from the test packet
+	SenderError      uint16
+	SenderTTL        uint8
+}
+
+func (p stampReflectedPacket) Marshal() []byte {
+	b := make([]byte, stampPacketLen)
+	binary.BigEndian.PutUint32(b[0:4], p.Seq)
+	putNTPTime(b[4:12], p.Timestamp)
+	binary.BigEndian.PutUint16(b[12:14], p.ErrorEstimate)
+	binary.BigEndian.PutUint16(b[14:16], p.SSID)
+	putNTPTime(b[16:24], p.ReceiveTimestamp)
+	binary.BigEndian.PutUint32(b[24:28], p.SenderSeq)
+	putNTPTime(b[28:36], p.SenderTimestamp)
+	binary.BigEndian.PutUint16(b[36:38], p.SenderError)
+	b[40] = p.SenderTTL
+	return b
+}
+
+func parseSTAMPReflectedPacket(b []byte) (stampReflectedPacket, error) {
+	if len(b) < stampPacketLen {
+		return stampReflectedPacket{}, errSTAMPTooShort
+	}
+	return stampReflectedPacket{
+		Seq:              binary.BigEndian.Uint32(b[0:4]),
+		Timestamp:        getNTPTime(b[4:12]),
+		ErrorEstimate:    binary.BigEndian.Uint16(b[12:14]),
+		SSID:             binary.BigEndian.Uint16(b[14:16]),
+		ReceiveTimestamp: getNTPTime(b[16:24]),
+		SenderSeq:        binary.BigEndian.Uint32(b[24:28]),
+		SenderTimestamp:  getNTPTime(b[28:36]),
+		SenderError:      binary.BigEndian.Uint16(b[36:38]),
+		SenderTTL:        b[40],
+	}, nil
+}
+
+// stampSender is a Session-Sender towards one reflector
+type stampSender struct {
+	spec     peerSpec
+	conn     net.Conn
+	stateful bool // If the reflector counts packets itself, so forward loss can be told apart
+	window   probeWindow
+	seq      uint32
+}
+
+func (s *stampSender) Protocol() string { return "stamp" }
+func (s *stampSender) Host() string     { return s.spec.Host }
+
+func (s *stampSender) Stats() proberStats {
+	return s.window.stats(clock.Now(), 2*time.Second)
+}
+
+// runSTAMPSender probes a STAMP reflector once a second, forever
+func runSTAMPSender(spec peerSpec) {
+	conn, err := net.Dial("udp", spec.Addr())
+	if err != nil {
+		log.Printf("Cannot start STAMP session to %s: %v", spec, err)
+		return
+	}
+
+	s := &stampSender{
+		spec:     spec,
+		conn:     conn,
+		stateful: spec.boolOption("stateful"),
+	}
+	registerProber(s)
+	go s.readReplies()
+
+	for {
+		clock.Sleep(clock.Until(nextSecondBoundary()))
+		s.send()
+	}
+}
+
+func (s *stampSender) send() {
+	pkt := stampTestPacket{
+		Seq:           s.seq,
+		Timestamp:     timeNowDisciplined(),
+		ErrorEstimate: localErrorEstimate(),
+	}
+	s.window.sent(pkt.Seq, pkt.Timestamp)
+	s.seq++
+
+	if _, err := s.conn.Write(pkt.Marshal()); err != nil && *debugShowLiveStats {
+		log.Printf("[%s] Failed to send STAMP packet: %v", s.spec, err)
+	}
+}
+
+func (s *stampSender) readReplies() {
+	buf := make([]byte, 1500)
+	for {
+		n, err := s.conn.Read(buf)
+		if errors.Is(err, net.ErrClosed) {
+			return
+		}
+		if err != nil {
+			// ICMP unreachables show up as read errors on connected sockets,
+			// they just mean the reflector is not there right now
+			clock.Sleep(time.Second)
+			continue
+		}
+		s.handleReply(buf[:n], timeNowDisciplined())
+	}
+}
+
+func (s *stampSender) handleReply(b []byte, t4 time.Time) {
+	r, err := parseSTAMPReflectedPacket(b)
+	if err != nil {
+		log.Printf("[%s] Bad STAMP reply: %v", s.spec, err)
+		return
+	}
+
+	forward := r.ReceiveTimestamp.Sub(r.SenderTimestamp)
+	reverse := t4.Sub(r.Timestamp)
+	s.window.repliedWithRefSeq(r.SenderSeq, forward, reverse, r.Seq, s.stateful)
+
+	if *debugShowLiveStats {
+		log.Printf("[%s] STAMP seq %d Forward: %s Reverse: %s", s.spec, r.SenderSeq, forward, reverse)
+	}
+}
+
+// stampReflector answers STAMP test packets
+type stampReflector struct {
+	conn     net.PacketConn
+	stateful bool
+
+	mu       sync.Mutex
+	counters map[string]*stampCounter
+}
+
+type stampCounter struct {
+	seq      uint32
+	lastSeen time.Time
+}
+
+func listenSTAMPReflector() {
+	conn, err := net.ListenPacket("udp", *stampListen)
+	if err != nil {
+		log.Fatalf("Failed to listen for STAMP on %s: %v", *stampListen, err)
+	}
+	r := &stampReflector{
+		conn:     conn,
+		stateful: *stampStateful,
+		counters: make(map[string]*stampCounter),
+	}
+	go r.expireCounters()
+	r.serve()
+}
+
+func (r *stampReflector) serve() {
+	buf := make([]byte, 1500)
+	conn := newRXInfoConn(r.conn.(*net.UDPConn))
+	for {
+		n, addr, ttl, err := conn.ReadFromWithTTL(buf)
+		if errors.Is(err, net.ErrClosed) {
+			return
+		}
+		if err != nil {
+			log.Printf("Failed to rx STAMP packet, %v", err)
+			clock.Sleep(time.Millisecond * 777)
+			continue
+		}
+		t2 := timeNowDisciplined()
+
+		if !packetLimiter.Allow() {
+			continue
+		}
+
+		reply, err := r.reflect(buf[:n], addr, t2, senderTTL(ttl))
+		if err != nil {
+			continue
+		}
+		r.conn.WriteTo(reply, addr)
+	}
+}
+
+// reflect builds the reply to a test packet from addr, received at t2 with the given TTL
+func (r *stampReflector) reflect(b []byte, addr net.Addr, t2 time.Time, ttl uint8) ([]byte, error) {
+	p, err := parseSTAMPTestPacket(b)
+	if err != nil {
+		return nil, err
+	}
+
+	seq := p.Seq
+	if r.stateful {
+		r.mu.Lock()
+		c := r.counters[addr.String()]
+		if c == nil {
+			c = &stampCounter{}
+			r.counters[addr.String()] = c
+		}
+		seq = c.seq
+		c.seq++
+		c.lastSeen = clock.Now()
+		r.mu.Unlock()
+	}
+
+	reply := stampReflectedPacket{
+		Seq:              seq,
+		ErrorEstimate:    localErrorEstimate(),
+		ReceiveTimestamp: t2,
+		SenderSeq:        p.Seq,
+		SenderTimestamp:  p.Timestamp,
+		SenderError:      p.ErrorEstimate,
+		SenderTTL:        ttl,
+	}
+	reply.Timestamp = timeNowDisciplined()
+	return reply.Marshal(), nil
+}
+
+func (r *stampReflector) expireCounters() {
+	for {
+		clock.Sleep(time.Minute)
+		r.mu.Lock()
+		for k, c := range r.counters {
+			if clock.Since(c.lastSeen) > 5*time.Minute {
+				delete(r.counters, k)
+			}
+		}
+		r.mu.Unlock()
+	}
+}
@@ -0,0 +1,109 @@
+package main
+
+import (
+	"net"
+	"testing"
+	"time"
+)
+
+func TestNTPTimeRoundTrip(t *testing.T) {
+	in := time.Unix(1600000000, 123456789)
+	out := fromNTPTime(toNTPTime(in))
+	if d := out.Sub(in); d > time.Nanosecond || d < -time.Nanosecond {
+		t.Fatalf("round trip moved the time by %s", d)
+	}
+	if toNTPTime(time.Unix(0, 0))>>32 != ntpEpochOffset {
+		t.Fatalf("unix epoch is not at the right NTP second")
+	}
+}
+
+func TestErrorEstimate(t *testing.T) {
+	for _, d := range []time.Duration{time.Microsecond, time.Millisecond, 10 * time.Millisecond, time.Second} {
+		e := errorEstimate(d, true)
+		if e&0x8000 == 0 {
+			t.Fatalf("S bit not set")
+		}
+		scale := (e >> 8) & 0x3f
+		mult := e & 0xff
+		got := time.Duration(float64(mult) * float64(uint64(1)<<scale) / (1 << 32) * 1e9)
+		if got < d || got > d*2+time.Nanosecond {
+			t.Fatalf("estimate for %s decodes as %s", d, got)
+		}
+	}
+}
+
+func TestSTAMPPacketRoundTrip(t *testing.T) {
+	in := stampReflectedPacket{
+		Seq:              7,
+		Timestamp:        time.Unix(1600000000, 5000),
+		ErrorEstimate:    0x8101,
+		ReceiveTimestamp: time.Unix(1600000000, 1000),
+		SenderSeq:        9,
+		SenderTimestamp:  time.Unix(1599999999, 0),
+		SenderError:      0x8001,
+		SenderTTL:        61,
+	}
+	b := in.Marshal()
+	if len(b) != stampPacketLen {
+		t.Fatalf("packet is %d bytes, want %d", len(b), stampPacketLen)
+	}
+	out, err := parseSTAMPReflectedPacket(b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if out.Seq != in.Seq || out.SenderSeq != in.SenderSeq || out.SenderTTL != in.SenderTTL ||
+		!out.Timestamp.Equal(in.Timestamp) || !out.ReceiveTimestamp.Equal(in.ReceiveTimestamp) || !out.SenderTimestamp.Equal(in.SenderTimestamp) {
+		t.Fatalf("got %+v, want %+v", out, in)
+	}
+
+	if _, err := parseSTAMPTestPacket(b[:20]); err != errSTAMPTooShort {
+		t.Fatalf("short packet gave %v", err)
+	}
+}
+
+func TestSTAMPSenderAndReflector(t *testing.T) {
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	r := &stampReflector{conn: conn, stateful: true, counters: make(map[string]*stampCounter)}
+	served := make(chan bool)
+	go func() {
+		r.serve()
+		close(served)
+	}()
+	t.Cleanup(func() {
+		conn.Close()
+		<-served
+	})
+
+	spec, _ := parsePeerSpec("stamp://" + conn.LocalAddr().String() + "?stateful=1")
+	sconn, err := net.Dial("udp", spec.Addr())
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := &stampSender{spec: spec, conn: sconn, stateful: true}
+	read := make(chan bool)
+	go func() {
+		s.readReplies()
+		close(read)
+	}()
+	t.Cleanup(func() {
+		sconn.Close()
+		<-read
+	})
+
+	for i := 0; i < 32; i++ {
+		s.send()
+		time.Sleep(5 * time.Millisecond)
+	}
+	time.Sleep(100 * time.Millisecond)
+
+	st := s.window.stats(clock.Now(), 50*time.Millisecond)
+	if st.Exchanges != 32 || st.RXLoss+st.TXLoss+st.RTTLoss != 0 {
+		t.Fatalf("got loss %+v over loopback", st)
+	}
+	if st.TXLatency <= 0 || st.TXLatency > 50*time.Millisecond || st.RXLatency <= 0 || st.RXLatency > 50*time.Millisecond {
+		t.Fatalf("loopback latency is TX %s RX %s", st.TXLatency, st.RXLatency)
+	}
+}
@@ -0,0 +1,392 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"log"
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/vmihailenco/msgpack/v4"
+)
+
+// Pings are small, so they get through paths that bigger packets don't. A
+// sweep sends a probe at each of a ladder of sizes (as IP packets) with DF
+// set, both ends do it, and tell each other which sizes got through. That
+// finds MTU black holes, like a tunnel that is only there in one direction.
+// Packet Too Big (or Fragmentation Needed) messages are taken in by the
+// kernel, which then fails sends that are too big, and gives the path MTU.
+
+var sweepInterval = flag.Duration("sweep.interval", 10*time.Second, "How often sping peers with sweep set send a round of probes at each size")
+
+// sweepWindow is how many rounds the loss at each size is worked out over
+const sweepWindow = 10
+
+// maxProbeSize is the biggest a padded ping or sweep probe can be, it has to fit in the read buffer
+const maxProbeSize = 9600
+
+// sweepLadder is what sweep=auto tries, up to the MTU of the interface the peer is reached over
+var sweepLadder = []int{576, 1280, 1400, 1420, 1450, 1480, 1492, 1500, 4470, 9000}
+
+// parseSweep checks a sweep= option, "auto" or a comma separated list of sizes
+func parseSweep(s string) ([]int, error) {
+	if s == "auto" {
+		return nil, nil
+	}
+	var sizes []int
+	for _, v := range strings.Split(s, ",") {
+		n, err := strconv.Atoi(strings.TrimSpace(v))
+		if err != nil || n < 100 || n > maxProbeSize {
+			return nil, fmt.Errorf("bad sweep size %q", v)
+		}
+		sizes = append(sizes, n)
+	}
+	sort.Ints(sizes)
+	return sizes, nil
+}
+
+// sizeOptions gives the size= and sweep= options of a sping peer, checked
+func (p peerSpec) sizeOptions() (size int, sweep string, err error) {
+	if v := p.Options.Get("size"); v != "" {
+		size, err = strconv.Atoi(v)
+		if err != nil || size < 0 || size > maxProbeSize {
+			return 0, "", fmt.Errorf("bad size %q", v)
+		}
+	}
+	sweep = p.Options.Get("sweep")
+	if sweep != "" {
+		if _, err := parseSweep(sweep); err != nil {
+			return 0, "", err
+		}
+	}
+	return size, sweep, nil
+}
+
+// interfaceMTU is the MTU of the interface that dst is reached over, 1500 if it can't be found
+func interfaceMTU(dst net.IP) int {
+	c, err := net.DialUDP("udp", nil, &net.UDPAddr{IP: dst, Port: 6924})
+	if err != nil {
+		return 1500
+	}
+	local := c.LocalAddr().(*net.UDPAddr).IP
+	c.Close()
+
+	ifaces, _ := net.Interfaces()
+	for _, iface := range ifaces {
+		addrs, _ := iface.Addrs()
+		for _, a := range addrs {
+			if n, ok := a.(*net.IPNet); ok && n.IP.Equal(local) {
+				return iface.MTU
+			}
+		}
+	}
+	return 1500
+}
+
+// autoSweepSizes is the ladder up to mtu, and mtu itself
+func autoSweepSizes(dst net.IP, mtu int) []int {
+	if mtu > maxProbeSize {
+		mtu = maxProbeSize // Like on loopback
+	}
+	var sizes []int
+	for _, s := range sweepLadder {
+		if s >= mtu {
+			break
+		}
+		if s < 1280 && dst.To4() == nil {
+			continue // IPv6 links can't be smaller than 1280
+		}
+		sizes = append(sizes, s)
+	}
+	return append(sizes, mtu)
+}
+
+// headerLen is how much of an IP packet to dst is IP and UDP header
+func headerLen(dst net.IP) int {
+	if dst.To4() != nil {
+		return 20 + 8
+	}
+	return 40 + 8
+}
+
+// marshalPadded marshals what build gives, padded so it comes out at size bytes (or as near as it can)
+func marshalPadded(build func(pad []byte) interface{}, size int) ([]byte, error) {
+	var pad []byte
+	b, err := msgpack.Marshal(build(pad))
+	// The length of the padding's own header can change with it, so go round a few times
+	for i := 0; i < 3 && err == nil && len(b) != size; i++ {
+		n := len(pad) + size - len(b)
+		if n < 0 {
+			break
+		}
+		pad = make([]byte, n)
+		b, err = msgpack.Marshal(build(pad))
+	}
+	return b, err
+}
+
+// sweepStruct is a size sweep probe. Every packet is read as a pingStruct
+// first, so the tags can't be ones that it uses for something else.
+type sweepStruct struct {
+	Type    uint8    `msgpack:"Y"` // MUST be 's' for a sweep probe
+	Magic   uint16   `msgpack:"M"`
+	Session uint32   `msgpack:"S"`
+	Round   uint16   `msgpack:"R"`
+	Size    uint16   `msgpack:"Z"` // The size of the IP packet this was sent as
+	Sizes   []uint16 `msgpack:"O"` // Every size sent this round
+	Padding []byte   `msgpack:"P"`
+}
+
+// sizeResults is what got through at each size in one direction
+type sizeResults struct {
+	history map[int][]bool // The last sweepWindow rounds at each size, true if it got through
+
+	Known        bool
+	MaxDelivered int // The biggest size that got through in the last round, 0 if none did
+}
+
+// record takes a round, returning the old MaxDelivered if it has changed
+func (r *sizeResults) record(sent, got []int) (from int, changed bool) {
+	if r.history == nil {
+		r.history = make(map[int][]bool)
+	}
+	delivered := map[int]bool{}
+	for _, s := range got {
+		delivered[s] = true
+	}
+	max := 0
+	for _, s := range sent {
+		h := append(r.history[s], delivered[s])
+		if len(h) > sweepWindow {
+			h = h[len(h)-sweepWindow:]
+		}
+		r.history[s] = h
+		if delivered[s] && s > max {
+			max = s
+		}
+	}
+	from, changed = r.MaxDelivered, r.Known && max != r.MaxDelivered
+	r.Known, r.MaxDelivered = true, max
+	return from, changed
+}
+
+// loss gives the share of probes lost at each size over the last few rounds
+func (r *sizeResults) loss() map[int]float64 {
+	out := make(map[int]float64)
+	for s, h := range r.history {
+		lost := 0
+		for _, ok := range h {
+			if !ok {
+				lost++
+			}
+		}
+		out[s] = float64(lost) / float64(len(h))
+	}
+	return out
+}
+
+// sizeSweep is the state of the size sweep for a session
+type sizeSweep struct {
+	mu sync.Mutex
+
+	sizes    []int // nil for the automatic ladder, until it is worked out
+	dfWarned bool  // If we have said DF can't be set on the session's socket
+
+	round    uint16
+	sent     []int    // What went out in this round
+	peerSeen uint16   // The round the peer last told us about
+	peerGot  []uint16 // And the sizes it got in it
+	tx, rx   sizeResults
+	rxRound  uint16
+	rxSent   []int
+	rxGot    []int
+
+	PathMTU     int // Towards the peer, as the kernel sees it
+	PeerPathMTU int // From the peer, as their kernel sees it
+}
+
+func newSizeSweep(spec string) *sizeSweep {
+	if spec == "" {
+		return nil
+	}
+	sizes, _ := parseSweep(spec)
+	return &sizeSweep{sizes: sizes}
+}
+
+// runSweep sends a round of sweep probes every -sweep.interval, for as long as the session lasts
+func (s *session) runSweep() {
+	for {
+		clock.Sleep(*sweepInterval)
+		if clock.Since(s.LastRX) > time.Minute {
+			return
+		}
+		if err := s.sweepRound(); err != nil {
+			log.Printf("[%s] Size sweep failed: %v", s.PeerAddress, err)
+		}
+	}
+}
+
+// sweepRound finishes off the last round of probes, and sends the next
+func (s *session) sweepRound() error {
+	sw := s.sweep
+	sw.mu.Lock()
+	defer sw.mu.Unlock()
+	if s.ReplyTo == nil {
+		return nil
+	}
+	dst := s.ReplyTo.IP
+
+	if sw.sent != nil {
+		var got []int
+		if sw.peerSeen == sw.round {
+			for _, v := range sw.peerGot {
+				got = append(got, int(v))
+			}
+		}
+		if from, changed := sw.tx.record(sw.sent, got); changed {
+			log.Printf("[%s] Biggest packet getting through on tx went from %d to %d", s.PeerAddress, from, sw.tx.MaxDelivered)
+		}
+	}
+
+	if sw.sizes == nil {
+		sw.sizes = autoSweepSizes(dst, interfaceMTU(dst))
+	}
+
+	sw.round++
+	sw.sent = sw.sizes
+	sizes := make([]uint16, len(sw.sizes))
+	for i, v := range sw.sizes {
+		sizes[i] = uint16(v)
+	}
+	probes := make([][]byte, len(sw.sizes))
+	for i, size := range sw.sizes {
+		probe := sweepStruct{Type: 's', Magic: 11181, Session: s.SessionID, Round: sw.round, Size: uint16(size), Sizes: sizes}
+		b, err := marshalPadded(func(pad []byte) interface{} {
+			probe.Padding = pad
+			return probe
+		}, size-headerLen(dst))
+		if err != nil {
+			return err
+		}
+		probes[i] = b
+	}
+
+	// Sent on the session's own socket, so the probes have the same 5-tuple as
+	// the pings and take the same path. Other sessions can share the socket, so
+	// only one sweep can have DF set on it at a time.
+	var err error
+	dontFragmentLock.Lock()
+	dfErr := withDontFragment(s.ReplyWith, dst.To4() == nil, func() {
+		for _, b := range probes {
+			if _, err = writeToFrom(s.ReplyWith, b, s.ReplyTo, s.Class.TOS, s.ReplyFrom); err != nil && !errors.Is(err, syscall.EMSGSIZE) {
+				// EMSGSIZE is the kernel having been told it's too big for the path, that is just a lost probe
+				return
+			}
+			err = nil
+		}
+	})
+	dontFragmentLock.Unlock()
+	if dfErr != nil && !sw.dfWarned {
+		log.Printf("[%s] Can't set DF on the size sweep, probes may be fragmented: %v", s.PeerAddress, dfErr)
+		sw.dfWarned = true
+	}
+	if err != nil {
+		return err
+	}
+	sw.PathMTU = s.kernelPathMTU()
+	return nil
+}
+
+var dontFragmentLock sync.Mutex
+
+// kernelPathMTU is the path MTU the kernel has towards the peer, 0 if not known.
+// A fresh socket is connected each time (nothing is sent on it), so the route
+// lookup picks up what the kernel has learnt since.
+func (s *session) kernelPathMTU() int {
+	bind := s.bind
+	if bind.Source == nil {
+		bind.Source = s.ReplyFrom
+	}
+	c, err := bind.dialer("udp").Dial("udp", s.ReplyTo.String())
+	if err != nil {
+		return 0
+	}
+	defer c.Close()
+	return pathMTU(c.(*net.UDPConn))
+}
+
+// receiveSweepProbe records a sweep probe from the peer
+func (s *session) receiveSweepProbe(buf []byte) {
+	if s.sweep == nil {
+		return
+	}
+	probe := sweepStruct{}
+	if err := msgpack.Unmarshal(buf, &probe); err != nil {
+		return
+	}
+	sw := s.sweep
+	sw.mu.Lock()
+	defer sw.mu.Unlock()
+
+	if probe.Round != sw.rxRound {
+		if sw.rxSent != nil {
+			if from, changed := sw.rx.record(sw.rxSent, sw.rxGot); changed {
+				log.Printf("[%s] Biggest packet getting through on rx went from %d to %d", s.PeerAddress, from, sw.rx.MaxDelivered)
+			}
+		}
+		sw.rxRound, sw.rxSent, sw.rxGot = probe.Round, nil, nil
+		for _, v := range probe.Sizes {
+			sw.rxSent = append(sw.rxSent, int(v))
+		}
+	}
+	sw.rxGot = append(sw.rxGot, int(probe.Size))
+}
+
+// sweepReport fills in what a ping tells the peer about the sweep
+func (s *session) sweepReport(p *pingStruct) {
+	sw := s.sweep
+	sw.mu.Lock()
+	defer sw.mu.Unlock()
+	p.SweepRound = sw.rxRound
+	p.SweepGot = nil
+	for _, v := range sw.rxGot {
+		p.SweepGot = append(p.SweepGot, uint16(v))
+	}
+	p.SweepMTU = uint16(sw.PathMTU)
+}
+
+// observeSweepReport takes in what the peer has said about our probes
+func (s *session) observeSweepReport(p pingStruct) {
+	sw := s.sweep
+	sw.mu.Lock()
+	defer sw.mu.Unlock()
+	sw.peerSeen, sw.peerGot = p.SweepRound, p.SweepGot
+	sw.PeerPathMTU = int(p.SweepMTU)
+}
+
+// export sets the size sweep metrics for a session
+func (sw *sizeSweep) export(host, class, flow, transport, listener string) {
+	sw.mu.Lock()
+	defer sw.mu.Unlock()
+	for direction, r := range map[string]*sizeResults{"tx": &sw.tx, "rx": &sw.rx} {
+		if !r.Known {
+			continue
+		}
+		promMaxSize.WithLabelValues(direction, host, class, flow, transport, listener).Set(float64(r.MaxDelivered))
+		for size, loss := range r.loss() {
+			promSizeLoss.WithLabelValues(direction, host, class, flow, transport, listener, strconv.Itoa(size)).Set(loss)
+		}
+	}
+	if sw.PathMTU != 0 {
+		promPathMTU.WithLabelValues("tx", host, class, flow, transport, listener).Set(float64(sw.PathMTU))
+	}
+	if sw.PeerPathMTU != 0 {
+		promPathMTU.WithLabelValues("rx", host, class, flow, transport, listener).Set(float64(sw.PeerPathMTU))
+	}
+}
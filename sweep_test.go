@@ -0,0 +1,114 @@
+package main
+
+import (
+	"net"
+	"runtime"
+	"testing"
+	"time"
+
+	"github.com/vmihailenco/msgpack/v4"
+)
+
+func TestMarshalPadded(t *testing.T) {
+	for _, size := range []int{100, 300, 1472, 9000} {
+		probe := sweepStruct{Type: 's', Magic: 11181, Session: 1, Size: uint16(size), Sizes: []uint16{576, 1500}}
+		b, err := marshalPadded(func(pad []byte) interface{} {
+			probe.Padding = pad
+			return probe
+		}, size)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(b) != size {
+			t.Fatalf("padded to %d bytes, want %d", len(b), size)
+		}
+		var back sweepStruct
+		if err := msgpack.Unmarshal(b, &back); err != nil || back.Size != uint16(size) {
+			t.Fatalf("padded probe read back as %+v (%v)", back, err)
+		}
+	}
+}
+
+func TestAutoSweepSizes(t *testing.T) {
+	got := autoSweepSizes(net.ParseIP("2001:db8::1"), 1500)
+	want := []int{1280, 1400, 1420, 1450, 1480, 1492, 1500}
+	if len(got) != len(want) {
+		t.Fatalf("got sizes %v, want %v", got, want)
+	}
+	for i := range got {
+		if got[i] != want[i] {
+			t.Fatalf("got sizes %v, want %v", got, want)
+		}
+	}
+}
+
+func TestSimSizeSweep(t *testing.T) {
+	// A tunnel on the way there only, so big packets get lost going one way
+	p, done := newSimPair(&simLink{Delay: 20 * time.Millisecond, MTU: 1400}, &simLink{Delay: 20 * time.Millisecond})
+	defer done()
+	sizes := []int{576, 1280, 1400, 1500}
+	p.local.sweep = &sizeSweep{sizes: sizes}
+	p.remote.sweep = &sizeSweep{sizes: sizes}
+
+	p.run(2)
+	for i := 0; i < 4; i++ {
+		if err := p.local.sweepRound(); err != nil {
+			t.Fatal(err)
+		}
+		if err := p.remote.sweepRound(); err != nil {
+			t.Fatal(err)
+		}
+		p.run(3)
+	}
+
+	sw := p.local.sweep
+	if !sw.tx.Known || sw.tx.MaxDelivered != 1400 {
+		t.Fatalf("tx max size %+v, want 1400", sw.tx)
+	}
+	if !sw.rx.Known || sw.rx.MaxDelivered != 1500 {
+		t.Fatalf("rx max size %+v, want 1500", sw.rx)
+	}
+	if loss := sw.tx.loss(); loss[1500] != 1 || loss[1400] != 0 {
+		t.Fatalf("tx loss by size %v, want all of 1500 and none of 1400", loss)
+	}
+	if loss := sw.rx.loss(); loss[1500] != 0 {
+		t.Fatalf("rx loss by size %v, want none", loss)
+	}
+}
+
+func TestSweepFromSessionSocket(t *testing.T) {
+	// Dual stack, like the default listener, sending to an IPv4 peer
+	c, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv6unspecified})
+	if err != nil {
+		t.Skip("no dual stack socket:", err)
+	}
+	defer c.Close()
+	peer, err := net.ListenUDP("udp4", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer peer.Close()
+
+	ses := &session{PeerAddress: net.IPv4(127, 0, 0, 1), ReplyWith: c, ReplyTo: peer.LocalAddr().(*net.UDPAddr),
+		sweep: &sizeSweep{sizes: []int{576, 1280}}}
+	if err := ses.sweepRound(); err != nil {
+		t.Fatal(err)
+	}
+	if ses.sweep.dfWarned && runtime.GOOS == "linux" {
+		t.Fatalf("couldn't set DF on the session's socket")
+	}
+
+	// Both probes come from the port the pings do
+	port := c.LocalAddr().(*net.UDPAddr).Port
+	buf := make([]byte, 2000)
+	for i := 0; i < 2; i++ {
+		peer.SetReadDeadline(time.Now().Add(time.Second))
+		_, from, err := peer.ReadFromUDP(buf)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if from.Port != port {
+			t.Fatalf("probe came from port %d, pings go from %d", from.Port, port)
+		}
+	}
+}
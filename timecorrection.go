@@ -2,6 +2,7 @@ package main
 
 import (
 	"log"
+	"sync"
 	"time"
 )
 
@@ -9,7 +10,7 @@ var timeOffset time.Duration
 var lastSync time.Time
 
 func getTimeOffset() time.Duration {
-	if lastSync.IsZero() || time.Since(lastSync) > time.Minute*30 {
+	if lastSync.IsZero() || clock.Since(lastSync) > time.Minute*30 {
 		timeOffset = time.Duration(calibrateAgainstApple())
 
 		if timeOffset.Seconds() > 1 {
@@ -21,5 +22,45 @@ func getTimeOffset() time.Duration {
 }
 
 func timeNowCorrected() time.Time {
-	return time.Now().Add(getTimeOffset())
+	return clock.Now().Add(getTimeOffset())
+}
+
+var lastTick secondTick
+var lastTickLock sync.RWMutex
+
+// recordTick remembers the latest tick from the TimeSource, for timeNowDisciplined
+func recordTick(t secondTick) {
+	lastTickLock.Lock()
+	lastTick = t
+	lastTickLock.Unlock()
+}
+
+// timeNowDisciplined returns the current time corrected with the system clock offset
+// seen at the most recent PPS pulse, so RX stamps are on the same GPS second as the
+// peers TX stamps. Without a recent pulse it is the same as timeNowCorrected.
+func timeNowDisciplined() time.Time {
+	lastTickLock.RLock()
+	t := lastTick
+	lastTickLock.RUnlock()
+
+	now := clock.Now()
+	if !t.FromPPS || now.Sub(t.Time) > 2*time.Second {
+		return timeNowCorrected()
+	}
+	return now.Add(-t.Offset)
+}
+
+// ppsTXTime works out the TX time of a probe sent at now, after a PPS pulse. The time is
+// taken from the pulse (with the offset removed) plus how long it has been since it,
+// plus the expected lag between taking the stamp and the packet being sent
+func ppsTXTime(pulse secondTick, now time.Time, sendLag time.Duration) time.Time {
+	return pulse.Time.Add(-pulse.Offset).Add(now.Sub(pulse.Time)).Add(sendLag)
+}
+
+// updateSendLag folds a new send lag measurement into the running average
+func updateSendLag(avg time.Duration, sample time.Duration) time.Duration {
+	if avg == 0 {
+		return sample
+	}
+	return (avg*7 + sample) / 8
 }
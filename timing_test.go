@@ -0,0 +1,214 @@
+package main
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/vmihailenco/msgpack/v4"
+)
+
+// simPair is a local sping session talking over a simNetwork to a remote
+// one. The local end goes through handlePacket like a real packet would,
+// the remote end is a bare session outside of the sessionMap.
+type simPair struct {
+	clock  *fakeClock
+	net    *simNetwork
+	local  *session
+	remote *session
+	ab, ba *simLink
+}
+
+// Chosen so that the ID window is not wrapping at the start of the test
+var simStart = time.Unix(1600000000-(1600000000%255)+100, 0)
+
+func newSimPair(ab, ba *simLink) (*simPair, func()) {
+	oldClock := clock
+	c := newFakeClock(simStart)
+	clock = c
+	lastSync = time.Time{}
+
+	n := newSimNetwork(c, 1)
+	aAddr := &net.UDPAddr{IP: net.ParseIP("192.0.2.1"), Port: 6924}
+	bAddr := &net.UDPAddr{IP: net.ParseIP("192.0.2.2"), Port: 6924}
+	a, b := n.pair(aAddr, bAddr, ab, ba)
+
+	p := &simPair{
+		clock: c,
+		net:   n,
+		ab:    ab,
+		ba:    ba,
+		local: &session{
+			SessionID:    42,
+			TCPActivated: true,
+			UDPActivated: true,
+			PeerAddress:  bAddr.IP,
+			SessionMade:  c.Now(),
+			Features:     ourFeatures,
+			ReplyWith:    a,
+			ReplyTo:      bAddr,
+		},
+		remote: &session{
+			SessionID:    42,
+			TCPActivated: true,
+			UDPActivated: true,
+			PeerAddress:  aAddr.IP,
+			SessionMade:  c.Now(),
+			Features:     ourFeatures,
+			ReplyWith:    b,
+			ReplyTo:      aAddr,
+		},
+	}
+
+	sessionMap = map[uint32]*session{42: p.local}
+	a.Handler = handlePacket
+	b.Handler = func(buf []byte, from *net.UDPAddr, info rxInfo, conn net.PacketConn) {
+		rx := pingStruct{}
+		if err := msgpack.Unmarshal(buf, &rx); err != nil {
+			panic(err)
+		}
+		if rx.Type == 's' {
+			p.remote.receiveSweepProbe(buf)
+			return
+		}
+		if rx.Type == 'p' {
+			p.remote.receiveTrainPacket(buf, timeNowCorrected(), len(buf)+28)
+			return
+		}
+		p.remote.receivePing(rx, timeNowCorrected(), info, from, conn)
+	}
+
+	return p, func() {
+		clock = oldClock
+		lastSync = time.Time{}
+	}
+}
+
+// run has both ends ping each other once a second, for n seconds
+func (p *simPair) run(n int) {
+	for i := 0; i < n; i++ {
+		p.net.RunUntil(p.clock.Now().Truncate(time.Second).Add(time.Second))
+		p.local.sendPing()
+		p.remote.sendPing()
+	}
+	p.net.RunUntil(p.clock.Now().Add(900 * time.Millisecond))
+}
+
+func (p *simPair) stats() (RXLatency time.Duration, TXLatency time.Duration, RXLoss int, TXLoss int, TotalSent int) {
+	return getStats(p.local.LastRX, p.local.LastRXPing, p.local)
+}
+
+func TestSimAsymmetricDelay(t *testing.T) {
+	p, done := newSimPair(&simLink{Delay: 20 * time.Millisecond}, &simLink{Delay: 35 * time.Millisecond})
+	defer done()
+
+	p.run(40)
+	RXL, TXL, RXLoss, TXLoss, exchanges := p.stats()
+
+	if RXL != 35*time.Millisecond || TXL != 20*time.Millisecond {
+		t.Fatalf("RX/TX latency is %s/%s, want 35ms/20ms", RXL, TXL)
+	}
+	if RXLoss != 0 || TXLoss != 0 || exchanges != 32 {
+		t.Fatalf("loss is %d/%d of %d, want none of 32", RXLoss, TXLoss, exchanges)
+	}
+}
+
+func TestSimJitter(t *testing.T) {
+	p, done := newSimPair(&simLink{Delay: 10 * time.Millisecond, Jitter: 5 * time.Millisecond}, &simLink{Delay: 10 * time.Millisecond})
+	defer done()
+
+	for i := 0; i < 20; i++ {
+		p.run(5)
+		_, TXL, _, _, _ := p.stats()
+		if TXL < 10*time.Millisecond || TXL >= 15*time.Millisecond {
+			t.Fatalf("TX latency %s is outside of 10-15ms", TXL)
+		}
+	}
+}
+
+func TestSimLoss(t *testing.T) {
+	p, done := newSimPair(&simLink{Delay: 20 * time.Millisecond, Loss: 0.25}, &simLink{Delay: 20 * time.Millisecond, Loss: 0.125})
+	defer done()
+
+	p.run(60)
+	_, _, RXLoss, TXLoss, exchanges := p.stats()
+
+	// 31 IDs are checked, so the loss is the share of those that were dropped
+	if TXLoss < 7 || TXLoss > 8 {
+		t.Fatalf("TX loss is %d/%d, want 7 or 8 (25%%)", TXLoss, exchanges)
+	}
+	if RXLoss < 3 || RXLoss > 4 {
+		t.Fatalf("RX loss is %d/%d, want 3 or 4 (12.5%%)", RXLoss, exchanges)
+	}
+}
+
+func TestSimIDWraparound(t *testing.T) {
+	p, done := newSimPair(&simLink{Delay: 15 * time.Millisecond}, &simLink{Delay: 25 * time.Millisecond})
+	defer done()
+
+	p.run(33)
+	// Go around the 255 IDs twice, checking every second
+	for i := 0; i < 520; i++ {
+		p.run(1)
+		RXL, TXL, RXLoss, TXLoss, _ := p.stats()
+		if RXLoss != 0 || TXLoss != 0 {
+			t.Fatalf("second %d (ID %d): false loss %d/%d", i, p.local.CurrentID, RXLoss, TXLoss)
+		}
+		if RXL != 25*time.Millisecond || TXL != 15*time.Millisecond {
+			t.Fatalf("second %d (ID %d): RX/TX latency is %s/%s, want 25ms/15ms", i, p.local.CurrentID, RXL, TXL)
+		}
+	}
+}
+
+func TestSimReorderAndDuplicate(t *testing.T) {
+	ab := &simLink{Delay: 20 * time.Millisecond, Duplicate: 0.2}
+	ba := &simLink{Delay: 30 * time.Millisecond, Reorder: 0.1, Duplicate: 0.1}
+	p, done := newSimPair(ab, ba)
+	defer done()
+
+	p.run(100)
+	if ab.Duplicated == 0 || ba.Reordered == 0 || ba.Duplicated == 0 {
+		t.Fatalf("network did not impair anything: %+v %+v", ab, ba)
+	}
+
+	RXL, TXL, RXLoss, TXLoss, _ := p.stats()
+	if RXLoss != 0 || TXLoss != 0 {
+		t.Fatalf("reordering or duplication was counted as loss %d/%d", RXLoss, TXLoss)
+	}
+	if RXL != 30*time.Millisecond || TXL != 20*time.Millisecond {
+		t.Fatalf("RX/TX latency is %s/%s, want 30ms/20ms", RXL, TXL)
+	}
+}
+
+func TestSessionGC(t *testing.T) {
+	oldClock := clock
+	c := newFakeClock(simStart)
+	clock = c
+	defer func() { clock = oldClock }()
+
+	sessionMap = map[uint32]*session{
+		1: {SessionID: 1, SessionMade: c.Now()},                                           // Never handshakes
+		2: {SessionID: 2, SessionMade: c.Now(), UDPActivated: true, LastRX: c.Now()},      // Goes quiet
+		3: {SessionID: 3, SessionMade: c.Now(), UDPActivated: true, LastRX: c.Now()},      // Stays alive
+		4: {SessionID: 4, SessionMade: c.Now().Add(50 * time.Second), UDPActivated: true}, // Made just before the GC
+	}
+
+	c.Advance(21 * time.Second)
+	gcSessions()
+	if sessionMap[1] != nil {
+		t.Fatalf("session that never handshaked was not removed")
+	}
+
+	c.Advance(40 * time.Second)
+	sessionMap[3].LastRX = c.Now()
+	gcSessions()
+	if sessionMap[2] != nil {
+		t.Fatalf("quiet session was not removed")
+	}
+	if sessionMap[3] == nil {
+		t.Fatalf("live session was removed")
+	}
+	if sessionMap[4] == nil {
+		t.Fatalf("new session without any packets yet was removed")
+	}
+}
@@ -0,0 +1,55 @@
+// +build linux
+
+package main
+
+import (
+	"net"
+	"unsafe"
+
+	"golang.org/x/sys/unix"
+)
+
+// enableRecvTOS asks for the TOS (or IPv6 traffic class) of received packets to be given with them
+func enableRecvTOS(c *net.UDPConn) {
+	rc, err := c.SyscallConn()
+	if err != nil {
+		return
+	}
+	rc.Control(func(fd uintptr) {
+		unix.SetsockoptInt(int(fd), unix.IPPROTO_IP, unix.IP_RECVTOS, 1)
+		unix.SetsockoptInt(int(fd), unix.IPPROTO_IPV6, unix.IPV6_RECVTCLASS, 1)
+	})
+}
+
+// tosFromControlMessage finds the TOS or traffic class a packet arrived with
+func tosFromControlMessage(oob []byte) (int, bool) {
+	msgs, err := unix.ParseSocketControlMessage(oob)
+	if err != nil {
+		return 0, false
+	}
+	for _, m := range msgs {
+		switch {
+		case m.Header.Level == unix.IPPROTO_IP && m.Header.Type == unix.IP_TOS && len(m.Data) >= 1:
+			return int(m.Data[0]), true
+		case m.Header.Level == unix.IPPROTO_IPV6 && m.Header.Type == unix.IPV6_TCLASS && len(m.Data) >= 4:
+			// An int, in whatever order this machine keeps them
+			return int(*(*int32)(unsafe.Pointer(&m.Data[0])) & 0xff), true
+		}
+	}
+	return 0, false
+}
+
+// tosControlMessage is the control message to send a packet to dst with a TOS (or traffic class)
+func tosControlMessage(dst net.IP, tos int) []byte {
+	level, typ := unix.IPPROTO_IP, unix.IP_TOS
+	if dst.To4() == nil {
+		level, typ = unix.IPPROTO_IPV6, unix.IPV6_TCLASS
+	}
+	b := make([]byte, unix.CmsgSpace(4))
+	h := (*unix.Cmsghdr)(unsafe.Pointer(&b[0]))
+	h.Level = int32(level)
+	h.Type = int32(typ)
+	h.SetLen(unix.CmsgLen(4))
+	*(*int32)(unsafe.Pointer(&b[unix.CmsgLen(0)])) = int32(tos)
+	return b
+}
@@ -0,0 +1,11 @@
+// +build !linux
+
+package main
+
+import "net"
+
+func enableRecvTOS(c *net.UDPConn) {}
+
+func tosFromControlMessage(oob []byte) (int, bool) { return 0, false }
+
+func tosControlMessage(dst net.IP, tos int) []byte { return nil }
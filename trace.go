@@ -0,0 +1,395 @@
+package main
+
+import (
+	"encoding/binary"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/benjojo/sping/icmp"
+	"golang.org/x/net/ipv4"
+	"golang.org/x/net/ipv6"
+)
+
+// sping trace <host> is a split mtr. It finds the path with TTL limited ICMP
+// Timestamp requests (reading the hops from the Time Exceeded replies), then
+// sends Timestamp requests to each hop on its own, to show which hop the
+// delay in each direction turns up at.
+
+var traceMaxHops = flag.Int("trace.max-hops", 30, "How many hops sping trace (and path tracing between peers) looks for the host within")
+var traceCount = flag.Int("trace.count", 0, "How many rounds of probes sping trace sends before exiting (0 is forever)")
+
+// Discovery probes use the TTL as the sequence number, probes to hops use ones above this
+const traceProbeSeqBase = 256
+
+// tracer is a running sping trace
+type tracer struct {
+	conn *icmp.PacketConn
+	dst  *net.IPAddr
+	id   int
+
+	mu      sync.Mutex
+	hops    []*traceHop // By TTL-1, nil if nothing answered
+	reached int         // TTL the host answered at, 0 if not yet
+	pending map[uint16]tracePending
+	seq     uint16
+}
+
+type tracePending struct {
+	hop *traceHop
+	t1  time.Time
+}
+
+// traceHop is one hop along the path, and the figures for it so far
+type traceHop struct {
+	TTL        int
+	Addr       net.IP
+	Extensions []string // MPLS labels and interface info from the Time Exceeded
+
+	Sent, Received int
+	Forward        traceStat
+	Reverse        traceStat
+	RTT            traceStat
+	NonStandard    bool // Answers with timestamps that are not ms since midnight UT
+	Unsynced       int  // Replies that can't be right, the hops clock is off
+}
+
+type traceStat struct {
+	Last, Best, Worst, Sum time.Duration
+	N                      int
+}
+
+func (s *traceStat) add(d time.Duration) {
+	s.Last = d
+	if s.N == 0 || d < s.Best {
+		s.Best = d
+	}
+	if s.N == 0 || d > s.Worst {
+		s.Worst = d
+	}
+	s.Sum += d
+	s.N++
+}
+
+func (s traceStat) avg() time.Duration {
+	if s.N == 0 {
+		return 0
+	}
+	return s.Sum / time.Duration(s.N)
+}
+
+func runTrace(host string) {
+	dst, err := net.ResolveIPAddr("ip4", host)
+	if err != nil {
+		log.Fatalf("Cannot trace %s: %v", host, err)
+	}
+	conn, err := icmp.ListenPacket("ip4:icmp", "0.0.0.0")
+	if err != nil {
+		log.Fatalf("Cannot open a raw socket for tracing (this needs root or CAP_NET_RAW): %v", err)
+	}
+	defer conn.Close()
+
+	tr := &tracer{
+		conn:    conn,
+		dst:     dst,
+		id:      os.Getpid() & 0xffff,
+		hops:    make([]*traceHop, *traceMaxHops),
+		pending: make(map[uint16]tracePending),
+		seq:     traceProbeSeqBase,
+	}
+	go tr.readReplies()
+
+	tr.discover()
+
+	live := isTerminal(os.Stdout)
+	for round := 0; *traceCount == 0 || round < *traceCount; round++ {
+		tr.probeHops()
+		clock.Sleep(time.Second)
+		if live {
+			fmt.Print("\033[H\033[2J")
+		}
+		tr.render(os.Stdout)
+		if !live {
+			fmt.Println()
+		}
+	}
+}
+
+func isTerminal(f *os.File) bool {
+	fi, err := f.Stat()
+	return err == nil && fi.Mode()&os.ModeCharDevice != 0
+}
+
+// discover finds the path, a few passes are made to fill in hops that didn't answer the first time
+func (tr *tracer) discover() {
+	for pass := 0; pass < 3; pass++ {
+		for ttl := 1; ttl <= len(tr.hops); ttl++ {
+			tr.mu.Lock()
+			done := tr.hops[ttl-1] != nil || (tr.reached != 0 && ttl >= tr.reached)
+			tr.mu.Unlock()
+			if done {
+				continue
+			}
+			tr.send(tr.dst, ttl, uint16(ttl))
+			clock.Sleep(10 * time.Millisecond)
+		}
+		clock.Sleep(2 * time.Second)
+
+		tr.mu.Lock()
+		complete := tr.reached != 0
+		for i := 0; i < tr.reached-1; i++ {
+			if tr.hops[i] == nil {
+				complete = false
+			}
+		}
+		tr.mu.Unlock()
+		if complete {
+			return
+		}
+	}
+}
+
+// probeHops sends a Timestamp request to every hop found
+func (tr *tracer) probeHops() {
+	tr.mu.Lock()
+	hops := make([]*traceHop, 0, len(tr.hops))
+	for _, h := range tr.visibleHops() {
+		if h != nil {
+			hops = append(hops, h)
+		}
+	}
+	tr.mu.Unlock()
+
+	for _, h := range hops {
+		tr.mu.Lock()
+		seq := tr.seq
+		tr.seq++
+		if tr.seq < traceProbeSeqBase {
+			tr.seq = traceProbeSeqBase
+		}
+		t1 := tr.send(&net.IPAddr{IP: h.Addr}, 64, seq)
+		tr.pending[seq] = tracePending{hop: h, t1: t1}
+		h.Sent++
+		tr.mu.Unlock()
+	}
+
+	// Forget probes that never came back
+	tr.mu.Lock()
+	for seq, p := range tr.pending {
+		if clock.Since(p.t1) > 10*time.Second {
+			delete(tr.pending, seq)
+		}
+	}
+	tr.mu.Unlock()
+}
+
+// visibleHops is the hops up to the host (or all of them if it has not answered), mu must be held
+func (tr *tracer) visibleHops() []*traceHop {
+	if tr.reached != 0 {
+		return tr.hops[:tr.reached]
+	}
+	last := 0
+	for i, h := range tr.hops {
+		if h != nil {
+			last = i + 1
+		}
+	}
+	return tr.hops[:last]
+}
+
+// send sends a Timestamp request and returns the time it was stamped with
+func (tr *tracer) send(dst *net.IPAddr, ttl int, seq uint16) time.Time {
+	if p := tr.conn.IPv4PacketConn(); p != nil {
+		p.SetTTL(ttl)
+	}
+	t1 := timeNowDisciplined()
+	b, err := newICMPTimestampRequest(tr.id, int(seq), t1)
+	if err != nil {
+		log.Printf("Failed to build ICMP Timestamp request: %v", err)
+		return t1
+	}
+	if _, err := tr.conn.WriteTo(b, dst); err != nil && *debugShowLiveStats {
+		log.Printf("Failed to send ICMP Timestamp request to %s: %v", dst, err)
+	}
+	return t1
+}
+
+func (tr *tracer) readReplies() {
+	buf := make([]byte, 1500)
+	for {
+		n, peer, err := tr.conn.ReadFrom(buf)
+		if err != nil {
+			return
+		}
+		t4 := timeNowDisciplined()
+		m, err := icmp.ParseMessage(1, buf[:n])
+		if err != nil {
+			continue
+		}
+		ip := peer.(*net.IPAddr).IP
+		tr.handleMessage(m, ip, t4)
+	}
+}
+
+func (tr *tracer) handleMessage(m *icmp.Message, from net.IP, t4 time.Time) {
+	tr.mu.Lock()
+	defer tr.mu.Unlock()
+
+	switch body := m.Body.(type) {
+	case *icmp.TimeExceeded:
+		typ, id, seq, ok := quotedICMPRequest(1, body.Data)
+		if !ok || typ != int(ipv4.ICMPTypeTimestamp) || id != tr.id || seq < 1 || int(seq) > len(tr.hops) {
+			return
+		}
+		if tr.hops[seq-1] == nil {
+			tr.hops[seq-1] = &traceHop{TTL: int(seq), Addr: from, Extensions: describeExtensions(body.Extensions)}
+		}
+
+	case *icmp.Timestamp:
+		if m.Type != ipv4.ICMPTypeTimestampReply || body.ID != tr.id {
+			return
+		}
+		seq := uint16(body.Seq)
+		if seq < traceProbeSeqBase {
+			// The host itself answered a discovery probe
+			if from.Equal(tr.dst.IP) && seq >= 1 && int(seq) <= len(tr.hops) && (tr.reached == 0 || int(seq) < tr.reached) {
+				tr.reached = int(seq)
+				if tr.hops[seq-1] == nil {
+					tr.hops[seq-1] = &traceHop{TTL: int(seq), Addr: from}
+				}
+			}
+			return
+		}
+
+		p, ok := tr.pending[seq]
+		if !ok || !from.Equal(p.hop.Addr) {
+			return
+		}
+		delete(tr.pending, seq)
+		p.hop.record(p.t1, body, t4)
+	}
+}
+
+// record takes a Timestamp reply to a probe sent at t1
+func (h *traceHop) record(t1 time.Time, ts *icmp.Timestamp, t4 time.Time) {
+	h.Received++
+	h.RTT.add(t4.Sub(t1))
+
+	forward, reverse, ok := icmpTimestampSplit(t1, ts, t4)
+	if !ok {
+		h.NonStandard = true
+		return
+	}
+	if !icmpTimestampSynced(forward, reverse) {
+		h.Unsynced++
+	}
+	h.Forward.add(forward)
+	h.Reverse.add(reverse)
+}
+
+// quotedICMPRequest finds the type, ID and sequence number of the request
+// quoted in an ICMP error (the original IP header then 8 bytes of ICMP)
+func quotedICMPRequest(proto int, b []byte) (typ int, id int, seq uint16, ok bool) {
+	hlen := ipv6.HeaderLen
+	if proto == 1 {
+		h, err := icmp.ParseIPv4Header(b)
+		if err != nil {
+			return 0, 0, 0, false
+		}
+		hlen = h.Len
+	}
+	if len(b) < hlen+8 {
+		return 0, 0, 0, false
+	}
+	inner := b[hlen:]
+	return int(inner[0]), int(binary.BigEndian.Uint16(inner[4:6])), binary.BigEndian.Uint16(inner[6:8]), true
+}
+
+// describeExtensions turns the extensions on a Time Exceeded into mtr style strings
+func describeExtensions(exts []icmp.Extension) []string {
+	out := make([]string, 0)
+	for _, e := range exts {
+		switch e := e.(type) {
+		case *icmp.MPLSLabelStack:
+			for _, l := range e.Labels {
+				out = append(out, fmt.Sprintf("[MPLS: Lbl %d TC %d S %d TTL %d]", l.Label, l.TC, boolByte(l.S), l.TTL))
+			}
+		case *icmp.InterfaceInfo:
+			parts := make([]string, 0)
+			if e.Interface != nil {
+				if e.Interface.Name != "" {
+					parts = append(parts, e.Interface.Name)
+				}
+				if e.Interface.Index != 0 {
+					parts = append(parts, fmt.Sprintf("ifindex %d", e.Interface.Index))
+				}
+				if e.Interface.MTU != 0 {
+					parts = append(parts, fmt.Sprintf("mtu %d", e.Interface.MTU))
+				}
+			}
+			if e.Addr != nil {
+				parts = append(parts, e.Addr.IP.String())
+			}
+			out = append(out, fmt.Sprintf("[Interface: %s]", strings.Join(parts, " ")))
+		}
+	}
+	return out
+}
+
+// render writes the mtr style table
+func (tr *tracer) render(w io.Writer) {
+	tr.mu.Lock()
+	defer tr.mu.Unlock()
+
+	fmt.Fprintf(w, "sping trace to %s, %s\n", tr.dst, timeNowCorrected().Format(time.RFC3339))
+	fmt.Fprintf(w, "%3s  %-39s %6s %5s  %9s %9s  %9s %9s  %9s  %s\n",
+		"", "Host", "Loss%", "Snt", "Fwd Last", "Fwd Avg", "Rev Last", "Rev Avg", "RTT Avg", "Flags")
+
+	hops := tr.visibleHops()
+	for i, h := range hops {
+		if h == nil {
+			fmt.Fprintf(w, "%3d. %-39s\n", i+1, "???")
+			continue
+		}
+		loss := 0.0
+		if h.Sent > 0 {
+			loss = 100 * float64(h.Sent-h.Received) / float64(h.Sent)
+		}
+		fwdLast, fwdAvg, revLast, revAvg := "-", "-", "-", "-"
+		if h.Forward.N > 0 {
+			fwdLast, fwdAvg = fmtTraceDuration(h.Forward.Last), fmtTraceDuration(h.Forward.avg())
+			revLast, revAvg = fmtTraceDuration(h.Reverse.Last), fmtTraceDuration(h.Reverse.avg())
+		}
+		rttAvg := "-"
+		if h.RTT.N > 0 {
+			rttAvg = fmtTraceDuration(h.RTT.avg())
+		}
+		fmt.Fprintf(w, "%3d. %-39s %5.1f%% %5d  %9s %9s  %9s %9s  %9s  %s\n",
+			h.TTL, h.Addr, loss, h.Sent, fwdLast, fwdAvg, revLast, revAvg, rttAvg, h.flags())
+		for _, e := range h.Extensions {
+			fmt.Fprintf(w, "     %s\n", e)
+		}
+	}
+	fmt.Fprintf(w, "Flags: N non-standard timestamps (no split), U timestamps look unsynchronised\n")
+}
+
+func (h *traceHop) flags() string {
+	flags := make([]string, 0)
+	if h.NonStandard {
+		flags = append(flags, "N")
+	}
+	if h.Unsynced > 0 {
+		flags = append(flags, "U")
+	}
+	return strings.Join(flags, "")
+}
+
+func fmtTraceDuration(d time.Duration) string {
+	return fmt.Sprintf("%.1fms", float64(d)/float64(time.Millisecond))
+}
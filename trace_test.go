@@ -0,0 +1,110 @@
+package main
+
+import (
+	"bytes"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/benjojo/sping/icmp"
+	"golang.org/x/net/ipv4"
+)
+
+func TestTraceTimeExceeded(t *testing.T) {
+	tr := &tracer{
+		dst:     &net.IPAddr{IP: net.IPv4(192, 0, 2, 1)},
+		id:      4242,
+		hops:    make([]*traceHop, 30),
+		pending: make(map[uint16]tracePending),
+		seq:     traceProbeSeqBase,
+	}
+
+	// What a router quotes back: our IP header, then the start of the request
+	req, err := newICMPTimestampRequest(tr.id, 3, time.Now())
+	if err != nil {
+		t.Fatal(err)
+	}
+	quoted := make([]byte, ipv4.HeaderLen, ipv4.HeaderLen+8)
+	quoted[0] = 0x45
+	quoted = append(quoted, req[:8]...)
+
+	typ, id, seq, ok := quotedICMPRequest(1, quoted)
+	if !ok || typ != int(ipv4.ICMPTypeTimestamp) || id != tr.id || seq != 3 {
+		t.Fatalf("quoted request read as type %d id %d seq %d (%t)", typ, id, seq, ok)
+	}
+
+	hop := net.IPv4(198, 51, 100, 1)
+	tr.handleMessage(&icmp.Message{
+		Type: ipv4.ICMPTypeTimeExceeded,
+		Body: &icmp.TimeExceeded{
+			Data: quoted,
+			Extensions: []icmp.Extension{&icmp.MPLSLabelStack{
+				Class: 1, Type: 1,
+				Labels: []icmp.MPLSLabel{{Label: 24001, S: true, TTL: 1}},
+			}},
+		},
+	}, hop, time.Now())
+
+	if h := tr.hops[2]; h == nil || !h.Addr.Equal(hop) || h.TTL != 3 {
+		t.Fatalf("hop 3 is %+v", tr.hops[2])
+	}
+	if got := tr.hops[2].Extensions; len(got) != 1 || got[0] != "[MPLS: Lbl 24001 TC 0 S 1 TTL 1]" {
+		t.Fatalf("extensions came out as %q", got)
+	}
+
+	// Someone else's traceroute going through the same router
+	other, _ := newICMPTimestampRequest(tr.id+1, 4, time.Now())
+	quoted = append(quoted[:ipv4.HeaderLen], other[:8]...)
+	tr.handleMessage(&icmp.Message{Type: ipv4.ICMPTypeTimeExceeded, Body: &icmp.TimeExceeded{Data: quoted}}, hop, time.Now())
+	if tr.hops[3] != nil {
+		t.Fatalf("picked up a hop from another ID")
+	}
+
+	// The host answering at TTL 5 ends the path there
+	tr.handleMessage(&icmp.Message{
+		Type: ipv4.ICMPTypeTimestampReply,
+		Body: &icmp.Timestamp{ID: tr.id, Seq: 5},
+	}, tr.dst.IP, time.Now())
+	if tr.reached != 5 || len(tr.visibleHops()) != 5 {
+		t.Fatalf("reached %d, %d hops visible", tr.reached, len(tr.visibleHops()))
+	}
+}
+
+func TestTraceHopRecord(t *testing.T) {
+	h := &traceHop{TTL: 1, Addr: net.IPv4(10, 0, 0, 1), Sent: 4}
+
+	t1 := time.Date(2020, 9, 13, 12, 0, 0, 100000, time.UTC)
+	t2 := t1.Add(20 * time.Millisecond)
+	t4 := t2.Add(5 * time.Millisecond)
+	ts := &icmp.Timestamp{Receive: msSinceMidnight(t2), Transmit: msSinceMidnight(t2)}
+	h.record(t1, ts, t4)
+
+	// A hop whose clock is behind, so the forward way looks negative
+	t2 = t1.Add(-50 * time.Millisecond)
+	ts = &icmp.Timestamp{Receive: msSinceMidnight(t2), Transmit: msSinceMidnight(t2)}
+	h.record(t1, ts, t1.Add(10*time.Millisecond))
+
+	if h.Received != 2 || h.Forward.N != 2 || h.Unsynced != 1 || h.NonStandard {
+		t.Fatalf("hop after two replies %+v", h)
+	}
+	if d := h.Forward.Best + 50*time.Millisecond; d > time.Millisecond || d < -time.Millisecond {
+		t.Fatalf("best forward %s", h.Forward.Best)
+	}
+
+	ts = &icmp.Timestamp{Receive: 5 | icmpNonStandard, Transmit: 5 | icmpNonStandard}
+	h.record(t1, ts, t4)
+	if !h.NonStandard || h.Forward.N != 2 || h.RTT.N != 3 {
+		t.Fatalf("non-standard reply taken as %+v", h)
+	}
+	if f := h.flags(); f != "NU" {
+		t.Fatalf("flags %q", f)
+	}
+
+	tr := &tracer{dst: &net.IPAddr{IP: net.IPv4(192, 0, 2, 1)}, hops: []*traceHop{h, nil}, reached: 2}
+	var out bytes.Buffer
+	tr.render(&out)
+	if !strings.Contains(out.String(), "25.0%") || !strings.Contains(out.String(), "  2. ???") {
+		t.Fatalf("table:\n%s", out.String())
+	}
+}
@@ -0,0 +1,267 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/benjojo/sping/icmp"
+	"golang.org/x/net/ipv4"
+	"golang.org/x/net/ipv6"
+)
+
+// Some networks treat UDP, ICMP and TCP differently, policing UDP or rate
+// limiting ICMP, and often only in one direction. Giving a sping peer
+// transports=udp,icmp,tcp runs a session over each, carrying the same
+// packets, so the results can be compared side by side. ICMP sessions send
+// their packets in echo requests (both ways, so the peer's kernel answering
+// them is ignored), TCP sessions keep the connection the INVITE was sent on
+// open and send them over that, each with its length in front.
+
+// icmpMarker starts the data of every echo request carrying a sping packet, so other pings can be told apart
+var icmpMarker = []byte("sping")
+
+// transports gives the transports a sping peer should be probed over, from
+// its transports= option, "" being UDP. Just UDP if it is not given.
+func (p peerSpec) transports() ([]string, error) {
+	v := p.Options.Get("transports")
+	if v == "" {
+		return []string{""}, nil
+	}
+	var out []string
+	for _, t := range strings.Split(v, ",") {
+		switch t = strings.ToLower(strings.TrimSpace(t)); t {
+		case "udp":
+			out = append(out, "")
+		case "icmp", "tcp":
+			out = append(out, t)
+		default:
+			return nil, fmt.Errorf("unknown transport %q", t)
+		}
+	}
+	return out, nil
+}
+
+// transportName is the transport label for the session's metrics
+func (s *session) transportName() string {
+	if s.Transport == "" {
+		return "udp"
+	}
+	return s.Transport
+}
+
+// tcpTransport carries sping packets over a TCP connection, each one with its length in front
+type tcpTransport struct {
+	net.Conn
+	r   *bufio.Reader
+	mu  sync.Mutex
+	tos int
+}
+
+func newTCPTransport(c net.Conn) *tcpTransport {
+	return &tcpTransport{Conn: c, r: bufio.NewReader(c)}
+}
+
+// ReadFrom reads the next packet from the connection
+func (t *tcpTransport) ReadFrom(b []byte) (int, net.Addr, error) {
+	var l [2]byte
+	if _, err := io.ReadFull(t.r, l[:]); err != nil {
+		return 0, nil, err
+	}
+	n := int(binary.BigEndian.Uint16(l[:]))
+	if n > len(b) {
+		return 0, nil, fmt.Errorf("%d byte packet is too big", n)
+	}
+	if _, err := io.ReadFull(t.r, b[:n]); err != nil {
+		return 0, nil, err
+	}
+	return n, t.RemoteAddr(), nil
+}
+
+// WriteTo sends b down the connection, addr is ignored as it can only go to the peer
+func (t *tcpTransport) WriteTo(b []byte, addr net.Addr) (int, error) {
+	return t.WriteToWithTOS(b, nil, 0)
+}
+
+func (t *tcpTransport) WriteToWithTOS(b []byte, addr *net.UDPAddr, tos int) (int, error) {
+	if len(b) > 0xffff {
+		return 0, fmt.Errorf("%d byte packet is too big", len(b))
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if tos != t.tos {
+		if a, ok := t.RemoteAddr().(*net.TCPAddr); ok && a.IP.To4() == nil {
+			ipv6.NewConn(t.Conn).SetTrafficClass(tos)
+		} else {
+			ipv4.NewConn(t.Conn).SetTOS(tos)
+		}
+		t.tos = tos
+	}
+	frame := make([]byte, 2+len(b))
+	binary.BigEndian.PutUint16(frame, uint16(len(b)))
+	copy(frame[2:], b)
+	if _, err := t.Write(frame); err != nil {
+		return 0, err
+	}
+	return len(b), nil
+}
+
+// routeFrames hands the packets that come in on t to handlePacket, until the connection goes
+func routeFrames(t *tcpTransport) {
+	from := &net.UDPAddr{}
+	if a, ok := t.RemoteAddr().(*net.TCPAddr); ok {
+		from = &net.UDPAddr{IP: a.IP, Port: a.Port}
+	}
+	for {
+		buf := make([]byte, 10000)
+		n, _, err := t.ReadFrom(buf)
+		if err != nil {
+			return
+		}
+		if !packetLimiter.Allow() {
+			continue
+		}
+		// Not in the background, so they are handled in the order TCP gives them
+		handlePacket(buf[:n], from, rxInfo{}, t)
+	}
+}
+
+// icmpSocket is the raw ICMP socket shared by every ICMP session of an address family
+type icmpSocket struct {
+	conn  *icmp.PacketConn
+	proto int
+	echo  icmp.Type
+
+	mu  sync.Mutex
+	tos int
+	seq int
+}
+
+var icmpSockets = map[bool]*icmpSocket{}
+var icmpSocketsLock sync.Mutex
+
+// openICMPSocket gives the ICMP socket for IPv4 or IPv6 peers, opening it
+// (and routing what comes in on it) the first time. This needs root or CAP_NET_RAW.
+func openICMPSocket(v6 bool) (*icmpSocket, error) {
+	icmpSocketsLock.Lock()
+	defer icmpSocketsLock.Unlock()
+	if s := icmpSockets[v6]; s != nil {
+		return s, nil
+	}
+
+	s := &icmpSocket{proto: 1, echo: ipv4.ICMPTypeEcho}
+	network, listen := "ip4:icmp", "0.0.0.0"
+	if v6 {
+		s.proto, s.echo = 58, ipv6.ICMPTypeEchoRequest
+		network, listen = "ip6:ipv6-icmp", "::"
+	}
+	c, err := icmp.ListenPacket(network, listen)
+	if err != nil {
+		return nil, err
+	}
+	s.conn = c
+	icmpSockets[v6] = s
+	go s.route()
+	return s, nil
+}
+
+// route hands the sping packets that come in on the socket to handlePacket
+func (s *icmpSocket) route() {
+	for {
+		buf := make([]byte, 10000)
+		n, from, err := s.conn.ReadFrom(buf)
+		if err != nil {
+			log.Printf("Failed to rx from ICMP, %v", err)
+			time.Sleep(time.Millisecond * 777)
+			continue
+		}
+		payload, id, ok := icmpUnwrap(s.proto, buf[:n])
+		if !ok || !packetLimiter.Allow() {
+			continue
+		}
+		ip, _ := from.(*net.IPAddr)
+		if ip == nil {
+			continue
+		}
+		go handlePacket(payload, &net.UDPAddr{IP: ip.IP}, rxInfo{}, icmpTransport{sock: s, id: id})
+	}
+}
+
+// icmpWrap puts a sping packet in an echo request
+func icmpWrap(echo icmp.Type, id, seq int, b []byte) ([]byte, error) {
+	m := icmp.Message{Type: echo, Body: &icmp.Echo{ID: id, Seq: seq, Data: append(append([]byte{}, icmpMarker...), b...)}}
+	return m.Marshal(nil)
+}
+
+// icmpUnwrap gives the sping packet in an echo request, and its ID. Anything else, like the
+// echo replies the peer's kernel sends back for them, or other pings, is not ok.
+func icmpUnwrap(proto int, b []byte) (payload []byte, id int, ok bool) {
+	m, err := icmp.ParseMessage(proto, b)
+	if err != nil || (m.Type != ipv4.ICMPTypeEcho && m.Type != ipv6.ICMPTypeEchoRequest) {
+		return nil, 0, false
+	}
+	echo, isEcho := m.Body.(*icmp.Echo)
+	if !isEcho || !bytes.HasPrefix(echo.Data, icmpMarker) {
+		return nil, 0, false
+	}
+	return echo.Data[len(icmpMarker):], echo.ID, true
+}
+
+// icmpTransport is a net.PacketConn for one session over ICMP. Each session
+// has its own echo ID, which the peer replies with, so on networks that hash
+// ICMP by it sessions (like flows) can take different paths.
+type icmpTransport struct {
+	sock *icmpSocket
+	id   int
+}
+
+func (t icmpTransport) WriteTo(b []byte, addr net.Addr) (int, error) {
+	switch a := addr.(type) {
+	case *net.UDPAddr:
+		return t.WriteToWithTOS(b, a, 0)
+	case *net.IPAddr:
+		return t.WriteToWithTOS(b, &net.UDPAddr{IP: a.IP}, 0)
+	}
+	return 0, fmt.Errorf("can't send ICMP to %v", addr)
+}
+
+func (t icmpTransport) WriteToWithTOS(b []byte, addr *net.UDPAddr, tos int) (int, error) {
+	s := t.sock
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if tos != s.tos {
+		if p := s.conn.IPv4PacketConn(); p != nil {
+			p.SetTOS(tos)
+		} else if p := s.conn.IPv6PacketConn(); p != nil {
+			p.SetTrafficClass(tos)
+		}
+		s.tos = tos
+	}
+	s.seq = (s.seq + 1) & 0xffff
+	m, err := icmpWrap(s.echo, t.id, s.seq, b)
+	if err != nil {
+		return 0, err
+	}
+	if _, err := s.conn.WriteTo(m, &net.IPAddr{IP: addr.IP}); err != nil {
+		return 0, err
+	}
+	return len(b), nil
+}
+
+func (t icmpTransport) ReadFrom(b []byte) (int, net.Addr, error) {
+	return 0, nil, errors.New("icmpTransport packets are handed to handlePacket")
+}
+
+func (t icmpTransport) Close() error                       { return nil } // The socket is shared
+func (t icmpTransport) LocalAddr() net.Addr                { return t.sock.conn.LocalAddr() }
+func (t icmpTransport) SetDeadline(d time.Time) error      { return nil }
+func (t icmpTransport) SetReadDeadline(d time.Time) error  { return nil }
+func (t icmpTransport) SetWriteDeadline(d time.Time) error { return nil }
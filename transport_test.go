@@ -0,0 +1,130 @@
+package main
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/benjojo/sping/icmp"
+	"github.com/vmihailenco/msgpack/v4"
+	"golang.org/x/net/ipv4"
+	"golang.org/x/net/ipv6"
+)
+
+func TestTransports(t *testing.T) {
+	for peer, want := range map[string][]string{
+		"192.0.2.1":                                 {""},
+		"sping://192.0.2.1?transports=tcp":          {"tcp"},
+		"sping://192.0.2.1?transports=udp,ICMP,tcp": {"", "icmp", "tcp"},
+	} {
+		spec, err := parsePeerSpec(peer)
+		if err != nil {
+			t.Fatal(err)
+		}
+		got, err := spec.transports()
+		if err != nil || len(got) != len(want) {
+			t.Fatalf("%s gave transports %q (%v), want %q", peer, got, err, want)
+		}
+		for i := range got {
+			if got[i] != want[i] {
+				t.Fatalf("%s gave transports %q, want %q", peer, got, want)
+			}
+		}
+	}
+	spec, _ := parsePeerSpec("sping://192.0.2.1?transports=sctp")
+	if _, err := spec.transports(); err == nil {
+		t.Fatalf("sctp was accepted")
+	}
+
+	o := inviteOptions{Transport: "icmp", Flow: 2}
+	if got, ok := parseInvite(o.String()); !ok || got != o {
+		t.Fatalf("%q read as %+v (%t)", o, got, ok)
+	}
+	if _, ok := parseInvite("INVITE transport=sctp\r\n"); ok {
+		t.Fatalf("invite for sctp was read")
+	}
+}
+
+func TestTCPTransport(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	peer, err := net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer peer.Close()
+	c, err := l.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	tr := newTCPTransport(c)
+	defer tr.Close()
+
+	ses := &session{
+		SessionID:    7,
+		TCPActivated: true,
+		MadeByMe:     true,
+		SessionMade:  clock.Now(),
+		UDPHandshake: make(chan bool, 1),
+		Transport:    "tcp",
+	}
+	sessionMap = map[uint32]*session{7: ses}
+	go routeFrames(tr)
+
+	// Two packets in one write, they have to come apart again
+	hs, _ := msgpack.Marshal(handshakeStruct{Type: 'h', Magic: 11181, Version: 3, Session: 7})
+	peerSide := newTCPTransport(peer)
+	frame := append([]byte{0, byte(len(hs))}, hs...)
+	peer.Write(append(append([]byte{0, 3}, "bad"...), frame...))
+
+	select {
+	case <-ses.UDPHandshake:
+	case <-time.After(2 * time.Second):
+		t.Fatalf("handshake never got to the session")
+	}
+	if ses.ReplyWith != tr {
+		t.Fatalf("session replies with %v, not the TCP connection", ses.ReplyWith)
+	}
+
+	peer.SetReadDeadline(time.Now().Add(2 * time.Second))
+	buf := make([]byte, 100)
+	n, _, err := peerSide.ReadFrom(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var answer handshakeStruct
+	if err := msgpack.Unmarshal(buf[:n], &answer); err != nil || !answer.Answer || answer.Session != 7 {
+		t.Fatalf("handshake answered with %+v (%v)", answer, err)
+	}
+}
+
+func TestICMPWrap(t *testing.T) {
+	for _, tt := range []struct {
+		proto       int
+		echo, reply icmp.Type
+	}{
+		{1, ipv4.ICMPTypeEcho, ipv4.ICMPTypeEchoReply},
+		{58, ipv6.ICMPTypeEchoRequest, ipv6.ICMPTypeEchoReply},
+	} {
+		b, err := icmpWrap(tt.echo, 1234, 1, []byte("hello"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		payload, id, ok := icmpUnwrap(tt.proto, b)
+		if !ok || id != 1234 || string(payload) != "hello" {
+			t.Fatalf("proto %d: unwrapped as %q, id %d (%t)", tt.proto, payload, id, ok)
+		}
+
+		// The peer's kernel answering it, and somebody else's ping
+		reply, _ := icmpWrap(tt.reply, 1234, 1, []byte("hello"))
+		other, _ := (&icmp.Message{Type: tt.echo, Body: &icmp.Echo{ID: 1, Seq: 1, Data: []byte("abcdefgh")}}).Marshal(nil)
+		for _, b := range [][]byte{reply, other} {
+			if _, _, ok := icmpUnwrap(tt.proto, b); ok {
+				t.Fatalf("proto %d: %x was taken as a sping packet", tt.proto, b)
+			}
+		}
+	}
+}
@@ -0,0 +1,631 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha1"
+	"encoding/binary"
+	"errors"
+	"flag"
+	"fmt"
+	"log"
+	"net"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// Full TWAMP (RFC 5357) support, with the TCP control connection, for
+// carriers that only offer that and not TWAMP-Light. The control connection
+// starts the same as OWAMPs (see owampctl.go), then the client asks for a
+// session with Request-TW-Session and sends test packets that the server
+// reflects, much like STAMP.
+//
+// Every TWAMP session, ones we send and ones we reflect, is kept in
+// twampSessions like sping sessions are in sessionMap, and is exported with
+// the same metrics. Sessions we reflect only know about the direction towards
+// us, so they show up as protocol="twamp-reflector".
+
+var twampListen = flag.String("twamp.listen", "", "Address to run a TWAMP server on, for example [::]:862 (disabled if empty)")
+
+const (
+	twampRequestTWSession = 5
+
+	twampReflectedLen     = 41  // Unauthenticated reflected packet, before padding
+	twampAuthTestLen      = 48  // Test packet in authenticated and encrypted mode
+	twampAuthReflectedLen = 112 // Reflected packet in authenticated and encrypted mode
+
+	twampRefWait = 900 * time.Second // How long a reflector waits for a test packet before giving up (REFWAIT)
+)
+
+var (
+	errTWAMPRejected       = errors.New("TWAMP request rejected")
+	errTWAMPSessionEnded   = errors.New("TWAMP session ended")
+	errTWAMPBadPacket      = errors.New("bad TWAMP test packet")
+	errTWAMPPrivilegedPort = errors.New("TWAMP receiver port is privileged")
+)
+
+// twampSession is one TWAMP test session, either one we send or one we reflect
+type twampSession struct {
+	SID         [16]byte
+	PeerHost    string
+	Reflector   bool
+	SessionMade time.Time
+
+	client   string // Who asked for a session we reflect, for the limit on sessions
+	started  bool   // If a session we reflect has been started
+	mode     uint32
+	aesKey   []byte
+	hmacKey  []byte
+	padding  uint32
+	interval time.Duration // How often to send, 0 is once a second on the second
+	conn     *net.UDPConn
+	peer     *net.UDPAddr
+	done     chan struct{}
+	stopOnce sync.Once
+
+	mu     sync.Mutex
+	seq    uint32
+	LastRX time.Time
+
+	window probeWindow  // Sessions we send
+	rx     oneWayWindow // Sessions we reflect, the packets from the sender
+}
+
+// twampKey picks out a session, both ends have the same SID so it takes the role too
+type twampKey struct {
+	SID       [16]byte
+	Reflector bool
+}
+
+var twampSessions = make(map[twampKey]*twampSession)
+var twampLock sync.Mutex
+
+func addTWAMPSession(t *twampSession) {
+	twampLock.Lock()
+	twampSessions[twampKey{t.SID, t.Reflector}] = t
+	twampLock.Unlock()
+	registerProber(t)
+}
+
+// stop ends the session and forgets about it, it is fine to call more than once
+func (t *twampSession) stop() {
+	t.stopOnce.Do(func() {
+		close(t.done)
+		t.conn.Close()
+		twampLock.Lock()
+		delete(twampSessions, twampKey{t.SID, t.Reflector})
+		twampLock.Unlock()
+		unregisterProber(t)
+		if t.client != "" {
+			releaseTestSession(t.client)
+		}
+	})
+}
+
+func (t *twampSession) Protocol() string {
+	if t.Reflector {
+		return "twamp-reflector"
+	}
+	return "twamp"
+}
+
+func (t *twampSession) Host() string { return t.PeerHost }
+
+func (t *twampSession) Stats() proberStats {
+	if !t.Reflector {
+		return t.window.stats(clock.Now(), 2*time.Second)
+	}
+	delay, lost, full := t.rx.stats()
+	st := proberStats{RXLatency: delay, RXOnly: true}
+	if full {
+		st.RXLoss = lost
+		st.Exchanges = len(t.rx.samples)
+	}
+	return st
+}
+
+func (t *twampSession) secure() bool {
+	return t.mode == modeAuthenticated || t.mode == modeEncrypted
+}
+
+func twampMAC(key, b []byte) []byte {
+	h := hmac.New(sha1.New, key)
+	h.Write(b)
+	return h.Sum(nil)[:hmacLen]
+}
+
+// In unauthenticated mode TWAMP test packets are laid out the same as STAMP
+// ones (STAMP was made that way on purpose). In the other modes every field
+// gets its own AES block, with a HMAC on the end.
+
+func (t *twampSession) marshalTest(p stampTestPacket) []byte {
+	if !t.secure() {
+		b := make([]byte, 14+int(t.padding))
+		if len(b) < stampPacketLen {
+			b = make([]byte, stampPacketLen)
+		}
+		copy(b, p.Marshal())
+		return b
+	}
+
+	b := make([]byte, twampAuthTestLen+int(t.padding))
+	binary.BigEndian.PutUint32(b[0:4], p.Seq)
+	putNTPTime(b[16:24], p.Timestamp)
+	binary.BigEndian.PutUint16(b[24:26], p.ErrorEstimate)
+	copy(b[32:48], twampMAC(t.hmacKey, b[0:32]))
+	encryptTestHeader(b, t.mode, t.aesKey, 32)
+	return b
+}
+
+func (t *twampSession) parseTest(b []byte) (stampTestPacket, error) {
+	if !t.secure() {
+		if len(b) < 14 {
+			return stampTestPacket{}, errTWAMPBadPacket
+		}
+		return stampTestPacket{
+			Seq:           binary.BigEndian.Uint32(b[0:4]),
+			Timestamp:     getNTPTime(b[4:12]),
+			ErrorEstimate: binary.BigEndian.Uint16(b[12:14]),
+		}, nil
+	}
+
+	if len(b) < twampAuthTestLen {
+		return stampTestPacket{}, errTWAMPBadPacket
+	}
+	decryptTestHeader(b, t.mode, t.aesKey, 32)
+	if !hmac.Equal(b[32:48], twampMAC(t.hmacKey, b[0:32])) {
+		return stampTestPacket{}, errTWAMPBadPacket
+	}
+	return stampTestPacket{
+		Seq:           binary.BigEndian.Uint32(b[0:4]),
+		Timestamp:     getNTPTime(b[16:24]),
+		ErrorEstimate: binary.BigEndian.Uint16(b[24:26]),
+	}, nil
+}
+
+func (t *twampSession) marshalReflected(p stampReflectedPacket, size int) []byte {
+	if !t.secure() {
+		if size < stampPacketLen {
+			size = stampPacketLen
+		}
+		b := make([]byte, size)
+		copy(b, p.Marshal())
+		return b
+	}
+
+	b := make([]byte, twampAuthReflectedLen+int(t.padding))
+	binary.BigEndian.PutUint32(b[0:4], p.Seq)
+	putNTPTime(b[16:24], p.Timestamp)
+	binary.BigEndian.PutUint16(b[24:26], p.ErrorEstimate)
+	putNTPTime(b[32:40], p.ReceiveTimestamp)
+	binary.BigEndian.PutUint32(b[48:52], p.SenderSeq)
+	putNTPTime(b[64:72], p.SenderTimestamp)
+	binary.BigEndian.PutUint16(b[72:74], p.SenderError)
+	b[80] = p.SenderTTL
+	copy(b[96:112], twampMAC(t.hmacKey, b[0:96]))
+	encryptTestHeader(b, t.mode, t.aesKey, 96)
+	return b
+}
+
+func (t *twampSession) parseReflected(b []byte) (stampReflectedPacket, error) {
+	if !t.secure() {
+		if len(b) < twampReflectedLen {
+			return stampReflectedPacket{}, errTWAMPBadPacket
+		}
+		if len(b) < stampPacketLen {
+			b = append(b[:len(b):len(b)], make([]byte, stampPacketLen-len(b))...)
+		}
+		return parseSTAMPReflectedPacket(b)
+	}
+
+	if len(b) < twampAuthReflectedLen {
+		return stampReflectedPacket{}, errTWAMPBadPacket
+	}
+	decryptTestHeader(b, t.mode, t.aesKey, 96)
+	if !hmac.Equal(b[96:112], twampMAC(t.hmacKey, b[0:96])) {
+		return stampReflectedPacket{}, errTWAMPBadPacket
+	}
+	return stampReflectedPacket{
+		Seq:              binary.BigEndian.Uint32(b[0:4]),
+		Timestamp:        getNTPTime(b[16:24]),
+		ErrorEstimate:    binary.BigEndian.Uint16(b[24:26]),
+		ReceiveTimestamp: getNTPTime(b[32:40]),
+		SenderSeq:        binary.BigEndian.Uint32(b[48:52]),
+		SenderTimestamp:  getNTPTime(b[64:72]),
+		SenderError:      binary.BigEndian.Uint16(b[72:74]),
+		SenderTTL:        b[80],
+	}, nil
+}
+
+// reflect answers test packets from the sender until the session is stopped
+func (t *twampSession) reflect() {
+	buf := make([]byte, 65536)
+	conn := newRXInfoConn(t.conn)
+	for {
+		t.conn.SetReadDeadline(clock.Now().Add(twampRefWait))
+		n, addr, ttl, err := conn.ReadFromWithTTL(buf)
+		if err != nil {
+			t.stop()
+			return
+		}
+		t2 := timeNowDisciplined()
+		if !addr.IP.Equal(t.peer.IP) {
+			continue
+		}
+
+		p, err := t.parseTest(buf[:n])
+		if err != nil {
+			continue
+		}
+		t.rx.record(p.Seq, true, t2.Sub(p.Timestamp))
+
+		t.mu.Lock()
+		seq := t.seq
+		t.seq++
+		t.LastRX = clock.Now()
+		t.mu.Unlock()
+
+		reply := stampReflectedPacket{
+			Seq:              seq,
+			ErrorEstimate:    localErrorEstimate(),
+			ReceiveTimestamp: t2,
+			SenderSeq:        p.Seq,
+			SenderTimestamp:  p.Timestamp,
+			SenderError:      p.ErrorEstimate,
+			SenderTTL:        senderTTL(ttl),
+		}
+		reply.Timestamp = timeNowDisciplined()
+		t.conn.WriteToUDP(t.marshalReflected(reply, n+twampReflectedLen-14), addr)
+	}
+}
+
+func (t *twampSession) send() {
+	t.mu.Lock()
+	seq := t.seq
+	t.seq++
+	t.mu.Unlock()
+
+	p := stampTestPacket{
+		Seq:           seq,
+		Timestamp:     timeNowDisciplined(),
+		ErrorEstimate: localErrorEstimate(),
+	}
+	t.window.sent(seq, p.Timestamp)
+	if _, err := t.conn.WriteToUDP(t.marshalTest(p), t.peer); err != nil && *debugShowLiveStats {
+		log.Printf("[%s] Failed to send TWAMP packet: %v", t.PeerHost, err)
+	}
+}
+
+func (t *twampSession) readReplies() {
+	buf := make([]byte, 65536)
+	for {
+		n, _, err := t.conn.ReadFromUDP(buf)
+		if err != nil {
+			return
+		}
+		t4 := timeNowDisciplined()
+
+		r, err := t.parseReflected(buf[:n])
+		if err != nil {
+			if *debugShowLiveStats {
+				log.Printf("[%s] Bad TWAMP reply: %v", t.PeerHost, err)
+			}
+			continue
+		}
+		forward := r.ReceiveTimestamp.Sub(r.SenderTimestamp)
+		reverse := t4.Sub(r.Timestamp)
+		t.window.repliedWithRefSeq(r.SenderSeq, forward, reverse, r.Seq, true)
+
+		t.mu.Lock()
+		t.LastRX = clock.Now()
+		t.mu.Unlock()
+
+		if *debugShowLiveStats {
+			log.Printf("[%s] TWAMP seq %d Forward: %s Reverse: %s", t.PeerHost, r.SenderSeq, forward, reverse)
+		}
+	}
+}
+
+func (t *twampSession) untilNextSend() time.Duration {
+	if t.interval == 0 {
+		return clock.Until(nextSecondBoundary())
+	}
+	return t.interval
+}
+
+// runTWAMPClient keeps a TWAMP session going to a server, forever
+func runTWAMPClient(spec peerSpec) {
+	mode, err := parseModeOption(spec.Options.Get("mode"))
+	if err != nil {
+		log.Printf("Cannot start TWAMP session to %s: %v", spec, err)
+		return
+	}
+	keys, err := loadKeyring(*owampKeyFile)
+	if err != nil {
+		log.Printf("Cannot start TWAMP session to %s: %v", spec, err)
+		return
+	}
+
+	for {
+		err := runTWAMPSession(spec, mode, keys, 0)
+		log.Printf("[%s] TWAMP session failed: %v", spec, err)
+		clock.Sleep(10 * time.Second)
+	}
+}
+
+// runTWAMPSession sets up one test session, and sends to it until it ends
+func runTWAMPSession(spec peerSpec, mode uint32, keys keyring, interval time.Duration) error {
+	conn, err := net.DialTimeout("tcp", spec.Addr(), 10*time.Second)
+	if err != nil {
+		return err
+	}
+	c, err := clientHandshake(conn, mode, spec.Options.Get("keyid"), keys)
+	if err != nil {
+		conn.Close()
+		return err
+	}
+	defer c.Close()
+
+	udp, err := net.ListenUDP("udp", testUDPAddr(conn.LocalAddr()))
+	if err != nil {
+		return err
+	}
+	local := udp.LocalAddr().(*net.UDPAddr)
+	remote := conn.RemoteAddr().(*net.TCPAddr)
+
+	padding := uint32(0)
+	if c.Mode == modeUnauthenticated {
+		// We send STAMP sized packets
+		padding = stampPacketLen - 14
+	}
+
+	// The server can suggest another port if the one we ask for is taken
+	port, _ := strconv.Atoi(spec.Options.Get("testport"))
+	var sid [16]byte
+	for try := 0; ; try++ {
+		req := requestSession{
+			Type:         twampRequestTWSession,
+			SenderPort:   uint16(local.Port),
+			ReceiverPort: uint16(port),
+			SenderAddr:   local.IP,
+			ReceiverAddr: remote.IP,
+			Padding:      padding,
+			StartTime:    timeNowCorrected(),
+			Timeout:      2 * time.Second,
+		}
+		head, _ := req.Marshal()
+		if err := c.writeMsg(head); err != nil {
+			udp.Close()
+			return err
+		}
+		b, err := c.readMsg(48)
+		if err != nil {
+			udp.Close()
+			return err
+		}
+		suggested := int(binary.BigEndian.Uint16(b[2:4]))
+		if b[0] == acceptOK {
+			port = suggested
+			copy(sid[:], b[4:20])
+			break
+		}
+		if suggested == 0 || try > 0 {
+			udp.Close()
+			return fmt.Errorf("%w: Request-TW-Session (accept code %d)", errTWAMPRejected, b[0])
+		}
+		port = suggested
+	}
+
+	startMsg := make([]byte, 32)
+	startMsg[0] = owampStartSessions
+	if err := c.writeMsg(startMsg); err != nil {
+		udp.Close()
+		return err
+	}
+	ack, err := c.readMsg(32)
+	if err != nil {
+		udp.Close()
+		return err
+	}
+	if ack[0] != acceptOK {
+		udp.Close()
+		return fmt.Errorf("%w: Start-Sessions (accept code %d)", errTWAMPRejected, ack[0])
+	}
+
+	t := &twampSession{
+		SID:         sid,
+		PeerHost:    spec.Host,
+		SessionMade: clock.Now(),
+		mode:        c.Mode,
+		aesKey:      c.testKey(sid),
+		hmacKey:     c.testHMACKey(sid),
+		padding:     padding,
+		interval:    interval,
+		conn:        udp,
+		peer:        &net.UDPAddr{IP: remote.IP, Port: port, Zone: remote.Zone},
+		done:        make(chan struct{}),
+	}
+	addTWAMPSession(t)
+	defer t.stop()
+	go t.readReplies()
+
+	// The server only says anything else on the control connection to end things
+	go func() {
+		c.readBlocks(16)
+		t.stop()
+	}()
+
+	for {
+		select {
+		case <-t.done:
+			stop := make([]byte, 32)
+			stop[0] = owampStopSessions
+			binary.BigEndian.PutUint32(stop[4:8], 1)
+			c.writeMsg(stop)
+			return errTWAMPSessionEnded
+		case <-clock.After(t.untilNextSend()):
+		}
+		t.send()
+	}
+}
+
+func listenTWAMP() {
+	ln, err := net.Listen("tcp", *twampListen)
+	if err != nil {
+		log.Fatalf("Failed to listen for TWAMP on %s: %v", *twampListen, err)
+	}
+	keys, err := loadKeyring(*owampKeyFile)
+	if err != nil {
+		log.Fatalf("Failed to load TWAMP keys: %v", err)
+	}
+	serveTWAMP(ln, keys)
+}
+
+func serveTWAMP(ln net.Listener, keys keyring) {
+	for {
+		conn, err := ln.Accept()
+		if errors.Is(err, net.ErrClosed) {
+			return
+		}
+		if err != nil {
+			log.Printf("Failed to accept TWAMP connection: %v", err)
+			clock.Sleep(time.Second)
+			continue
+		}
+		go func() {
+			defer conn.Close()
+			c, err := serverHandshake(conn, controlModes(keys), keys)
+			if err != nil {
+				log.Printf("TWAMP control connection from %s failed: %v", conn.RemoteAddr(), err)
+				return
+			}
+			s := &twampServer{c: c}
+			defer s.stopAll()
+			if err := s.serve(); err != nil && *debugShowLiveStats {
+				log.Printf("TWAMP control connection from %s ended: %v", conn.RemoteAddr(), err)
+			}
+		}()
+	}
+}
+
+// twampServer handles one TWAMP control connection
+type twampServer struct {
+	c        *controlConn
+	sessions []*twampSession
+}
+
+func (s *twampServer) serve() error {
+	for {
+		first, err := s.c.readBlocks(16)
+		if err != nil {
+			return err
+		}
+		switch first[0] {
+		case twampRequestTWSession:
+			req, err := readRequestSession(s.c, first)
+			if err != nil {
+				return err
+			}
+			if err := s.c.writeMsg(s.requestTWSession(req)); err != nil {
+				return err
+			}
+		case owampStartSessions:
+			if err := readRestOfMsg(s.c, first, 32); err != nil {
+				return err
+			}
+			s.startAll()
+			if err := s.c.writeMsg(make([]byte, 32)); err != nil {
+				return err
+			}
+		case owampStopSessions:
+			if err := readRestOfMsg(s.c, first, 32); err != nil {
+				return err
+			}
+			s.stopAll()
+		default:
+			return fmt.Errorf("unknown TWAMP control message %d", first[0])
+		}
+	}
+}
+
+// requestTWSession sets up a reflector and gives the Accept-Session reply
+func (s *twampServer) requestTWSession(req requestSession) []byte {
+	var zero [16]byte
+	if req.Padding > owampMaxPadding {
+		return acceptSessionMsg(acceptUnsupported, 0, zero)
+	}
+	remote := testUDPAddr(s.c.conn.RemoteAddr()).IP
+	sender, ok := checkTestAddr(req.SenderAddr, remote)
+	if !ok || req.SenderPort == 0 {
+		return acceptSessionMsg(acceptPermanent, 0, zero)
+	}
+	client := remote.String()
+	if !takeTestSession(client) {
+		log.Printf("TWAMP client %s has too many test sessions", client)
+		return acceptSessionMsg(acceptTemporary, 0, zero)
+	}
+
+	local := testUDPAddr(s.c.conn.LocalAddr())
+	local.Port = int(req.ReceiverPort)
+	var conn *net.UDPConn
+	var err error
+	if local.Port != 0 && local.Port < 1024 {
+		// Those belong to other things on this box, even if we could bind them
+		err = errTWAMPPrivilegedPort
+	} else {
+		conn, err = net.ListenUDP("udp", local)
+	}
+	if err != nil {
+		releaseTestSession(client)
+		if req.ReceiverPort == 0 {
+			log.Printf("Failed to open TWAMP test socket: %v", err)
+			return acceptSessionMsg(acceptTemporary, 0, zero)
+		}
+		// Find a port that is free to suggest instead
+		local.Port = 0
+		other, err := net.ListenUDP("udp", local)
+		if err != nil {
+			return acceptSessionMsg(acceptTemporary, 0, zero)
+		}
+		port := other.LocalAddr().(*net.UDPAddr).Port
+		other.Close()
+		return acceptSessionMsg(acceptTemporary, uint16(port), zero)
+	}
+
+	t := &twampSession{
+		SID:         newSID(local.IP),
+		PeerHost:    client,
+		Reflector:   true,
+		SessionMade: clock.Now(),
+		client:      client,
+		mode:        s.c.Mode,
+		padding:     req.Padding,
+		conn:        conn,
+		peer:        &net.UDPAddr{IP: sender, Port: int(req.SenderPort)},
+		done:        make(chan struct{}),
+	}
+	t.aesKey = s.c.testKey(t.SID)
+	t.hmacKey = s.c.testHMACKey(t.SID)
+	s.sessions = append(s.sessions, t)
+
+	return acceptSessionMsg(acceptOK, uint16(conn.LocalAddr().(*net.UDPAddr).Port), t.SID)
+}
+
+// startAll starts the reflectors asked for since the last Start-Sessions
+func (s *twampServer) startAll() {
+	for _, t := range s.sessions {
+		if t.started {
+			continue
+		}
+		t.started = true
+		addTWAMPSession(t)
+		go t.reflect()
+	}
+}
+
+func (s *twampServer) stopAll() {
+	for _, t := range s.sessions {
+		t.stop()
+	}
+	s.sessions = nil
+}
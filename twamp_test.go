@@ -0,0 +1,206 @@
+package main
+
+import (
+	"encoding/binary"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestTWAMPPacketRoundTrip(t *testing.T) {
+	key := make([]byte, 16)
+	hkey := make([]byte, 32)
+	key[0], hkey[0] = 1, 2
+	test := stampTestPacket{Seq: 9, Timestamp: time.Unix(1600000000, 1000), ErrorEstimate: 0x8101}
+	refl := stampReflectedPacket{
+		Seq:              4,
+		Timestamp:        time.Unix(1600000000, 5000),
+		ErrorEstimate:    0x8101,
+		ReceiveTimestamp: time.Unix(1600000000, 3000),
+		SenderSeq:        9,
+		SenderTimestamp:  time.Unix(1600000000, 1000),
+		SenderError:      0x8102,
+		SenderTTL:        255,
+	}
+
+	for _, mode := range []uint32{modeUnauthenticated, modeAuthenticated, modeEncrypted} {
+		s := &twampSession{mode: mode, aesKey: key, hmacKey: hkey}
+		got, err := s.parseTest(s.marshalTest(test))
+		if err != nil || got != test {
+			t.Fatalf("mode %d: test packet came back as %+v (%v)", mode, got, err)
+		}
+		gotRefl, err := s.parseReflected(s.marshalReflected(refl, 0))
+		if err != nil || gotRefl != refl {
+			t.Fatalf("mode %d: reflected packet came back as %+v (%v)", mode, gotRefl, err)
+		}
+
+		if mode != modeUnauthenticated {
+			b := s.marshalTest(test)
+			b[20] ^= 1
+			if _, err := s.parseTest(b); err == nil {
+				t.Fatalf("mode %d: tampered packet passed the HMAC check", mode)
+			}
+		}
+	}
+
+	// A reflector that does not pad its replies out to the STAMP size
+	s := &twampSession{mode: modeUnauthenticated}
+	if _, err := s.parseReflected(refl.Marshal()[:twampReflectedLen]); err != nil {
+		t.Fatalf("short reflected packet: %v", err)
+	}
+}
+
+func TestTWAMPSessions(t *testing.T) {
+	if testing.Short() {
+		t.Skip("runs real TWAMP sessions on loopback")
+	}
+
+	keys := keyring{"test": []byte("hunter2")}
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	go serveTWAMP(ln, keys)
+
+	for _, mode := range []uint32{modeUnauthenticated, modeAuthenticated, modeEncrypted} {
+		spec, err := parsePeerSpec("twamp://" + ln.Addr().String() + "?keyid=test")
+		if err != nil {
+			t.Fatal(err)
+		}
+		done := make(chan error)
+		go func() { done <- runTWAMPSession(spec, mode, keys, 5*time.Millisecond) }()
+
+		// Wait for the sender windows to fill
+		var sender, reflector *twampSession
+		deadline := time.Now().Add(5 * time.Second)
+		for time.Now().Before(deadline) {
+			time.Sleep(50 * time.Millisecond)
+			sender, reflector = nil, nil
+			twampLock.Lock()
+			for _, s := range twampSessions {
+				if s.Reflector {
+					reflector = s
+				} else {
+					sender = s
+				}
+			}
+			twampLock.Unlock()
+			if sender != nil && sender.Stats().Exchanges != 0 {
+				break
+			}
+		}
+		if sender == nil || reflector == nil {
+			t.Fatalf("mode %d: sessions missing, sender %t reflector %t", mode, sender != nil, reflector != nil)
+		}
+
+		st := sender.Stats()
+		if st.Exchanges == 0 || st.TXLoss != 0 || st.RXLoss != 0 || st.RTTLoss != 0 {
+			t.Fatalf("mode %d: sender stats %+v", mode, st)
+		}
+		if st.TXLatency <= 0 || st.RXLatency <= 0 {
+			t.Fatalf("mode %d: odd latency %+v", mode, st)
+		}
+		if rst := reflector.Stats(); !rst.RXOnly || rst.RXLatency <= 0 {
+			t.Fatalf("mode %d: reflector stats %+v", mode, rst)
+		}
+
+		sender.stop()
+		if err := <-done; err != errTWAMPSessionEnded {
+			t.Fatalf("mode %d: session ended with %v", mode, err)
+		}
+
+		// Stop-Sessions should clear up the reflector too
+		deadline = time.Now().Add(2 * time.Second)
+		for time.Now().Before(deadline) {
+			twampLock.Lock()
+			n := len(twampSessions)
+			twampLock.Unlock()
+			if n == 0 {
+				break
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+		twampLock.Lock()
+		n := len(twampSessions)
+		twampLock.Unlock()
+		if n != 0 {
+			t.Fatalf("mode %d: %d sessions left over", mode, n)
+		}
+	}
+}
+
+func TestTWAMPRequestLimits(t *testing.T) {
+	s := &twampServer{c: loopbackControl(t)}
+	defer s.stopAll()
+
+	lo := net.IPv4(127, 0, 0, 1)
+	ok := requestSession{Type: twampRequestTWSession, SenderAddr: lo, SenderPort: 9000, ReceiverAddr: lo}
+	for _, c := range []struct {
+		name   string
+		change func(r *requestSession)
+		accept byte
+	}{
+		{"fine", func(r *requestSession) {}, acceptOK},
+		{"unspecified sender", func(r *requestSession) { r.SenderAddr = net.IPv4zero }, acceptOK},
+		{"huge padding", func(r *requestSession) { r.Padding = 1 << 20 }, acceptUnsupported},
+		{"someone else", func(r *requestSession) { r.SenderAddr = net.IPv4(192, 0, 2, 1) }, acceptPermanent},
+		{"no sender port", func(r *requestSession) { r.SenderPort = 0 }, acceptPermanent},
+		{"privileged port", func(r *requestSession) { r.ReceiverPort = 53 }, acceptTemporary},
+	} {
+		r := ok
+		c.change(&r)
+		if got := s.requestTWSession(r)[0]; got != c.accept {
+			t.Errorf("%s: accept %d, wanted %d", c.name, got, c.accept)
+		}
+	}
+	if p := binary.BigEndian.Uint16(s.requestTWSession(requestSession{SenderAddr: lo, SenderPort: 9000, ReceiverPort: 53})[2:4]); p < 1024 {
+		t.Errorf("suggested port %d in place of a privileged one", p)
+	}
+
+	for i := 2; i < owampMaxSessions; i++ {
+		if got := s.requestTWSession(ok)[0]; got != acceptOK {
+			t.Fatalf("session %d: accept %d", i, got)
+		}
+	}
+	if got := s.requestTWSession(ok)[0]; got != acceptTemporary {
+		t.Fatalf("one too many: accept %d", got)
+	}
+	s.stopAll()
+	if got := s.requestTWSession(ok)[0]; got != acceptOK {
+		t.Fatalf("after stopping: accept %d", got)
+	}
+}
+
+func TestTWAMPStartTwice(t *testing.T) {
+	s := &twampServer{c: loopbackControl(t)}
+	req := requestSession{Type: twampRequestTWSession, SenderAddr: net.IPv4(127, 0, 0, 1), SenderPort: 9000}
+	if got := s.requestTWSession(req)[0]; got != acceptOK {
+		t.Fatalf("accept %d", got)
+	}
+	refl := s.sessions[0]
+
+	s.startAll()
+	s.startAll()
+	n := 0
+	probersLock.Lock()
+	for _, p := range probers {
+		if p == prober(refl) {
+			n++
+		}
+	}
+	probersLock.Unlock()
+	if n != 1 {
+		t.Fatalf("reflector registered %d times", n)
+	}
+
+	// And stopping it has to leave nothing behind
+	s.stopAll()
+	probersLock.Lock()
+	for _, p := range probers {
+		if p == prober(refl) {
+			t.Fatalf("reflector still registered after stopping")
+		}
+	}
+	probersLock.Unlock()
+}
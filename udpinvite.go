@@ -0,0 +1,200 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"fmt"
+	"log"
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/vmihailenco/msgpack/v4"
+)
+
+// Lots of firewalls only let the UDP port through, so sessions can be set up
+// without the TCP port too. The end asking sends the INVITE line in a UDP
+// packet, and is sent a cookie back, made from its address. Sending the
+// invite again with the cookie shows the address is real (until then nothing
+// is kept), and gets the session. Each step is resent with backoff until the
+// peer answers. Peers say how with handshake=tcp (the default), udp, or auto
+// to try TCP first and fall back to UDP.
+
+// udpInviteStruct asks for a session over UDP, and answers that
+type udpInviteStruct struct {
+	Type     uint8   `msgpack:"Y"` // 'i' to ask, 'c' for a cookie back, 'a' for the answer
+	Magic    uint16  `msgpack:"M"`
+	Session  uint32  `msgpack:"S"` // The session handed out, in an 'a'
+	Nonce    uint64  `msgpack:"X"` // Picked by the end asking, to match answers to what was asked
+	Versions []uint8 `msgpack:"W"` // The wire versions the end asking speaks (or, when refused, the answering end)
+	Version  uint8   `msgpack:"V"` // The version picked, in an 'a'
+	Cookie   []byte  `msgpack:"C"` // Handed out in a 'c', to be sent back with the invite
+	Invite   string  `msgpack:"O"` // The INVITE line, as it would be sent over TCP
+	Refused  string  `msgpack:"R"` // Why the session was not handed out, in an 'a'
+}
+
+// handshakeMode is how sessions to the peer are set up, from its handshake= option
+func (p peerSpec) handshakeMode() (string, error) {
+	switch v := strings.ToLower(p.Options.Get("handshake")); v {
+	case "", "tcp":
+		return "tcp", nil
+	case "udp", "auto":
+		return v, nil
+	default:
+		return "", fmt.Errorf("unknown handshake %q, it can be tcp, udp or auto", v)
+	}
+}
+
+// inviteSecret keys the cookies handed out
+var inviteSecret = func() []byte {
+	b := make([]byte, 32)
+	rand.Read(b)
+	return b
+}()
+
+// inviteCookie is what addr has to send back with the invite it gave nonce
+// to. It changes every minute, the one from the minute before is taken too.
+func inviteCookie(addr *net.UDPAddr, nonce uint64, at time.Time) []byte {
+	m := hmac.New(sha256.New, inviteSecret)
+	fmt.Fprintf(m, "%s/%d/%d", addr, nonce, at.Unix()/60)
+	return m.Sum(nil)[:16]
+}
+
+// handleUDPInvite answers an invite that came in on lSocket
+func handleUDPInvite(buf []byte, rxAddr *net.UDPAddr, lSocket net.PacketConn) {
+	rx := udpInviteStruct{}
+	if err := msgpack.Unmarshal(buf, &rx); err != nil {
+		log.Printf("Failed to parse packet from %v", rxAddr.String())
+		return
+	}
+	l := listenerOn(lSocket)
+	if l == nil {
+		return
+	}
+
+	reply := udpInviteStruct{Type: 'a', Magic: 11181, Nonce: rx.Nonce}
+	now := clock.Now()
+	if !hmac.Equal(rx.Cookie, inviteCookie(rxAddr, rx.Nonce, now)) &&
+		!hmac.Equal(rx.Cookie, inviteCookie(rxAddr, rx.Nonce, now.Add(-time.Minute))) {
+		reply.Type, reply.Cookie = 'c', inviteCookie(rxAddr, rx.Nonce, now)
+	} else if v, ok := pickVersion(rx.Versions); !ok {
+		log.Printf("UDP invite from %s speaks none of our wire versions (%v)", rxAddr, rx.Versions)
+		reply.Refused, reply.Versions = "VERSION", handshakeVersions
+	} else if opts, ok := parseInvite(rx.Invite); !ok || opts.Transport == "tcp" {
+		reply.Refused = "I_DONT_UNDERSTAND"
+	} else if err := openInviteTransport(opts, rxAddr.IP); err != nil {
+		log.Printf("Cannot take a session from %s: %v", rxAddr.IP, err)
+		reply.Refused = "NO_ICMP"
+	} else {
+		reply.Version = v
+		reply.Session = acceptInvite(opts, l, fmt.Sprintf("%s/%d", rxAddr, rx.Nonce))
+	}
+
+	b, err := msgpack.Marshal(reply)
+	if err != nil {
+		log.Fatalf("Failed to marshal packet %v / %#v", err, reply)
+	}
+	lSocket.WriteTo(b, rxAddr)
+}
+
+// listenerOn is the listener c is the socket of, nil if it is not one
+func listenerOn(c net.PacketConn) *listener {
+	for _, l := range listeners {
+		if l.udp == c {
+			return l
+		}
+	}
+	return nil
+}
+
+// inviteAnswer is a 'c' or 'a' packet, and who sent it
+type inviteAnswer struct {
+	udpInviteStruct
+	From *net.UDPAddr
+}
+
+// pendingInvites are the invites waiting on answers, by nonce
+var pendingInvites = map[uint64]chan inviteAnswer{}
+var pendingInvitesLock sync.Mutex
+
+// handleUDPInviteAnswer passes an answer on to the invite waiting on it
+func handleUDPInviteAnswer(buf []byte, rxAddr *net.UDPAddr) {
+	rx := udpInviteStruct{}
+	if err := msgpack.Unmarshal(buf, &rx); err != nil {
+		log.Printf("Failed to parse packet from %v", rxAddr.String())
+		return
+	}
+	pendingInvitesLock.Lock()
+	c := pendingInvites[rx.Nonce]
+	pendingInvitesLock.Unlock()
+	if c == nil {
+		return
+	}
+	select {
+	case c <- inviteAnswer{rx, rxAddr}:
+	default:
+	}
+}
+
+// udpInviteTries is how many times an invite is sent before giving up
+const udpInviteTries = 5
+
+// udpInvite asks the peer for a session in UDP packets sent from c
+func udpInvite(c net.PacketConn, peer *net.UDPAddr, opts inviteOptions) (uint32, error) {
+	if c == nil {
+		return 0, fmt.Errorf("No UDP socket to send invites from")
+	}
+	var nonce uint64
+	binary.Read(rand.Reader, binary.BigEndian, &nonce)
+	answers := make(chan inviteAnswer, 1)
+	pendingInvitesLock.Lock()
+	pendingInvites[nonce] = answers
+	pendingInvitesLock.Unlock()
+	defer func() {
+		pendingInvitesLock.Lock()
+		delete(pendingInvites, nonce)
+		pendingInvitesLock.Unlock()
+	}()
+
+	ask := udpInviteStruct{Type: 'i', Magic: 11181, Nonce: nonce, Versions: handshakeVersions, Invite: opts.String()}
+	wait, cookies := time.Second, 0
+	for tries := 0; tries < udpInviteTries; {
+		b, err := msgpack.Marshal(ask)
+		if err != nil {
+			log.Fatalf("Failed to marshal packet %v / %#v", err, ask)
+		}
+		c.WriteTo(b, peer)
+
+		select {
+		case a := <-answers:
+			if !a.From.IP.Equal(peer.IP) || a.From.Port != peer.Port {
+				continue
+			}
+			if a.Type == 'c' {
+				// Not a lost packet, so it doesn't count as a try, but a peer
+				// that never takes its own cookies has to be given up on
+				if cookies++; cookies > udpInviteTries {
+					return 0, fmt.Errorf("UDP invite never got past the cookie")
+				}
+				ask.Cookie = a.Cookie
+				continue
+			}
+			if a.Refused == "VERSION" {
+				return 0, fmt.Errorf("UDP invite refused, the peer speaks wire versions %v, we speak %v", a.Versions, handshakeVersions)
+			}
+			if a.Refused != "" {
+				return 0, fmt.Errorf("UDP invite refused: %s", a.Refused)
+			}
+			return a.Session, nil
+		case <-clock.After(wait):
+			tries++
+			if wait < 8*time.Second {
+				wait *= 2
+			}
+		}
+	}
+	return 0, fmt.Errorf("No answer to UDP invites")
+}
@@ -0,0 +1,86 @@
+package main
+
+import (
+	"net"
+	"testing"
+
+	"github.com/vmihailenco/msgpack/v4"
+)
+
+func TestHandshakeMode(t *testing.T) {
+	for peer, want := range map[string]string{
+		"192.0.2.1":                         "tcp",
+		"sping://192.0.2.1?handshake=udp":   "udp",
+		"sping://192.0.2.1?handshake=AUTO":  "auto",
+		"sping://192.0.2.1?handshake=smoke": "",
+	} {
+		spec, err := parsePeerSpec(peer)
+		if err != nil {
+			t.Fatal(err)
+		}
+		got, err := spec.handshakeMode()
+		if got != want || (err != nil) != (want == "") {
+			t.Fatalf("%s gave %q (%v), want %q", peer, got, err, want)
+		}
+	}
+
+	if v, ok := pickVersion([]uint8{1, 3, 9}); !ok || v != 3 {
+		t.Fatalf("picked version %d (%t), want 3", v, ok)
+	}
+	if _, ok := pickVersion([]uint8{9}); ok {
+		t.Fatalf("picked a version we don't speak")
+	}
+}
+
+func TestUDPInvite(t *testing.T) {
+	server, err := net.ListenUDP("udp4", &net.UDPAddr{IP: net.ParseIP("127.0.0.1")})
+	if err != nil {
+		t.Fatal(err)
+	}
+	client, err := net.ListenUDP("udp4", &net.UDPAddr{IP: net.ParseIP("127.0.0.1")})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Not closed, routePackets gives up on everything if its socket goes away
+	listeners = map[string]*listener{"up1": {Name: "up1", udp: server}}
+	sessionMap = map[uint32]*session{}
+	go routePackets(server)
+	go routePackets(client)
+
+	opts := inviteOptions{Flow: 3, Lock: true}
+	id, err := udpInvite(client, server.LocalAddr().(*net.UDPAddr), opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sessionLock.Lock()
+	ses := sessionMap[id]
+	sessionLock.Unlock()
+	if ses == nil || ses.Flow != 3 || !ses.Locked || ses.Listener != "up1" || ses.MadeByMe {
+		t.Fatalf("invite made %+v", ses)
+	}
+
+	// An invite without the cookie, or from somewhere else, gets a cookie and no session
+	ask := udpInviteStruct{Type: 'i', Magic: 11181, Nonce: 1, Versions: handshakeVersions, Invite: opts.String(), Cookie: []byte("made up")}
+	b, _ := msgpack.Marshal(ask)
+	handleUDPInvite(b, &net.UDPAddr{IP: net.ParseIP("127.0.0.1"), Port: 1}, server)
+	if len(sessionMap) != 1 {
+		t.Fatalf("%d sessions after an invite with a bad cookie, want 1", len(sessionMap))
+	}
+
+	// Resending the invite, as when the answer is lost, gets the same session
+	ask.Cookie = inviteCookie(client.LocalAddr().(*net.UDPAddr), 1, clock.Now())
+	b, _ = msgpack.Marshal(ask)
+	handleUDPInvite(b, client.LocalAddr().(*net.UDPAddr), server)
+	handleUDPInvite(b, client.LocalAddr().(*net.UDPAddr), server)
+	if len(sessionMap) != 2 {
+		t.Fatalf("%d sessions after the same invite twice, want 2", len(sessionMap))
+	}
+
+	ask.Nonce, ask.Versions = 2, []uint8{9}
+	ask.Cookie = inviteCookie(client.LocalAddr().(*net.UDPAddr), 2, clock.Now())
+	b, _ = msgpack.Marshal(ask)
+	handleUDPInvite(b, client.LocalAddr().(*net.UDPAddr), server)
+	if len(sessionMap) != 2 {
+		t.Fatalf("an invite in a version we don't speak made a session")
+	}
+}
@@ -0,0 +1,66 @@
+package main
+
+import (
+	"encoding/binary"
+	"time"
+)
+
+// Timestamps on the wire for the IETF measurement protocols (STAMP, OWAMP,
+// TWAMP) are 64 bit NTP format: seconds since 1900 then a 32 bit fraction.
+
+const ntpEpochOffset = 2208988800 // Seconds between 1900 and 1970
+
+func toNTPTime(t time.Time) uint64 {
+	secs := uint64(t.Unix() + ntpEpochOffset)
+	frac := (uint64(t.Nanosecond())<<32 + 5e8) / 1e9
+	return secs<<32 | frac
+}
+
+func fromNTPTime(v uint64) time.Time {
+	secs := int64(v>>32) - ntpEpochOffset
+	nsec := ((v&0xffffffff)*1e9 + 1<<31) >> 32
+	return time.Unix(secs, int64(nsec))
+}
+
+func putNTPTime(b []byte, t time.Time) {
+	binary.BigEndian.PutUint64(b, toNTPTime(t))
+}
+
+func getNTPTime(b []byte) time.Time {
+	return fromNTPTime(binary.BigEndian.Uint64(b))
+}
+
+// errorEstimate encodes the RFC 4656 error estimate field, the S bit is set
+// if the clock is synced to UTC. The estimate is Multiplier * 2^(Scale-32)
+// seconds, so find the smallest scale that fits.
+func errorEstimate(estimate time.Duration, synced bool) uint16 {
+	var v uint16
+	if synced {
+		v |= 0x8000
+	}
+
+	secs := estimate.Seconds()
+	scale := uint16(0)
+	for scale < 63 {
+		if m := secs / (float64(uint64(1)<<scale) / (1 << 32)); m < 256 {
+			mult := uint16(m + 1)
+			if mult > 255 {
+				mult = 255
+			}
+			return v | scale<<8 | mult
+		}
+		scale++
+	}
+	return v | 63<<8 | 255
+}
+
+// localErrorEstimate is the error estimate we put on our own timestamps
+func localErrorEstimate() uint16 {
+	if *usePPS {
+		return errorEstimate(10*time.Microsecond, true)
+	}
+	if *flagClockIsPerfect {
+		return errorEstimate(time.Millisecond, true)
+	}
+	return errorEstimate(10*time.Millisecond, false)
+}